@@ -0,0 +1,200 @@
+package dbolt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// BackupManifest describes an incremental backup written by
+// Tx.WriteIncrementalTo. It is stored as JSON on the first line of the
+// backup, which is followed by both meta pages and the page spans listed in
+// Pages.
+type BackupManifest struct {
+	PageSize  int      `json:"pageSize"`
+	SinceTxid int      `json:"sinceTxid"` // transaction the backup applies on top of
+	Txid      int      `json:"txid"`      // transaction the backup restores to
+	PageN     int      `json:"pageN"`     // high water mark at Txid
+	Pages     []uint64 `json:"pages"`     // ids of the page spans, in order
+}
+
+// WriteIncrementalTo writes an incremental backup of the pages written after
+// transaction sinceTxid, usually the Tx.ID of an earlier backup. Applying it
+// with ApplyIncremental to a copy of the database at sinceTxid brings the
+// copy to this transaction. Only pages reachable from this transaction are
+// written, as they are on disk.
+//
+// The database must have been created with Options.PageTxid; otherwise
+// ErrNoPageTxid is returned.
+func (tx *Tx) WriteIncrementalTo(w io.Writer, sinceTxid int) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if tx.db.flags&metaFlagPageTxid == 0 {
+		return 0, ErrNoPageTxid
+	}
+
+	// Find the reachable pages written after sinceTxid.
+	reachable, err := tx.reachablePages()
+	if err != nil {
+		return 0, err
+	}
+	m := BackupManifest{
+		PageSize:  tx.db.pageSize,
+		SinceTxid: sinceTxid,
+		Txid:      int(tx.meta.txid),
+		PageN:     int(tx.meta.pgid),
+		Pages:     []uint64{},
+	}
+	for id, head := range reachable {
+		if head != id {
+			continue
+		}
+		p, err := tx.db.readPage(id)
+		if err != nil {
+			return 0, err
+		}
+		if int(p.txid(tx.db.pageSize, tx.db.trailer)) > sinceTxid {
+			m.Pages = append(m.Pages, uint64(id))
+		}
+		tx.db.releasePage(p)
+	}
+	sort.Slice(m.Pages, func(i, j int) bool { return m.Pages[i] < m.Pages[j] })
+
+	// Write the manifest and both meta pages.
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	nn, err := w.Write(append(buf, '\n'))
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+	wn, err := tx.writeMetaPagesTo(w, tx.meta)
+	n += wn
+	if err != nil {
+		return n, err
+	}
+
+	// Copy the changed pages as they are stored.
+	for _, id := range m.Pages {
+		nn, err := w.Write(tx.db.page(pgid(id)).span(tx.db.pageSize))
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ApplyIncremental applies an incremental backup written by
+// Tx.WriteIncrementalTo to the database file at path, which must not be open.
+// The database must be at the transaction the backup was taken since, such
+// as a full backup written by Tx.WriteTo or a database that the previous
+// backup of a chain was applied to; otherwise ErrBackupMismatch is returned.
+//
+// Pages are written before the meta pages, but the database should still be
+// a copy since pages it references may be overwritten.
+func ApplyIncremental(path string, r io.Reader) (*BackupManifest, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %s", err)
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(line, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	} else if m.PageSize < int(pageHeaderSize) {
+		return nil, fmt.Errorf("invalid manifest page size: %d", m.PageSize)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	// Make sure the database is where the backup starts from.
+	if txid, err := backupBaseTxid(f, m.PageSize); err != nil {
+		return nil, err
+	} else if txid != m.SinceTxid {
+		return nil, ErrBackupMismatch
+	}
+
+	metas := make([]byte, m.PageSize*2)
+	if _, err := io.ReadFull(br, metas); err != nil {
+		return nil, fmt.Errorf("read meta pages: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := pageAt(metas, i, m.PageSize).meta().validate(); err != nil {
+			return nil, fmt.Errorf("meta %d: %s", i, err)
+		}
+	}
+
+	// Write the pages, then the meta pages that reference them.
+	for _, id := range m.Pages {
+		buf := make([]byte, m.PageSize)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, fmt.Errorf("read page %d: %s", id, err)
+		}
+		p := pageAt(buf, 0, m.PageSize)
+		if uint64(p.id) != id {
+			return nil, fmt.Errorf("page %d: unexpected page id %d", id, p.id)
+		}
+		if p.overflow > 0 {
+			buf = append(buf, make([]byte, int(p.overflow)*m.PageSize)...)
+			if _, err := io.ReadFull(br, buf[m.PageSize:]); err != nil {
+				return nil, fmt.Errorf("read page %d: %s", id, err)
+			}
+		}
+		if _, err := f.WriteAt(buf, int64(id)*int64(m.PageSize)); err != nil {
+			return nil, err
+		}
+	}
+	if info, err := f.Stat(); err != nil {
+		return nil, err
+	} else if sz := int64(m.PageN) * int64(m.PageSize); info.Size() < sz {
+		if err := f.Truncate(sz); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(metas, 0); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// backupBaseTxid returns the transaction id of the latest valid meta page of
+// the database file f.
+func backupBaseTxid(f *os.File, pageSize int) (int, error) {
+	buf := make([]byte, pageSize*2)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return 0, err
+	}
+	txid := -1
+	for i := 0; i < 2; i++ {
+		m := pageAt(buf, i, pageSize).meta()
+		if m.validate() == nil && int(m.pageSize) == pageSize && int(m.txid) > txid {
+			txid = int(m.txid)
+		}
+	}
+	if txid < 0 {
+		return 0, ErrBackupMismatch
+	}
+	return txid, nil
+}
+
+// pageAt returns the i-th page of a buffer of pages of the given size.
+func pageAt(buf []byte, i, pageSize int) *page {
+	return (*page)(unsafe.Pointer(&buf[i*pageSize]))
+}
@@ -34,6 +34,9 @@ type Bucket struct {
 	rootNode *node              // materialized node for the root page.
 	nodes    map[pgid]*node     // node cache
 
+	compression Compression // compression of values, from the bucket options
+	inlinePgid  pgid        // page of the parent holding an inline bucket
+
 	// Sets the threshold for filling nodes when they split. By default,
 	// the bucket will fill to 50% but it can be useful to increase this
 	// amount if you know that your write workloads are mostly append-only.
@@ -79,6 +82,7 @@ func (b *Bucket) Writable() bool {
 // Cursor creates a cursor associated with the bucket.
 // The cursor is only valid as long as the transaction is open.
 // Do not use a cursor after the transaction is closed.
+// Moving the cursor onto a damaged page panics with a *PageError, see Tx.Do.
 func (b *Bucket) Cursor() *Cursor {
 	// Update transaction statistics.
 	b.tx.stats.CursorCount++
@@ -110,7 +114,10 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 	}
 
 	// Otherwise create a bucket and cache it.
-	child := b.openBucket(v)
+	child := b.openBucket(v, flags)
+	if child.root == 0 {
+		child.inlinePgid = c.pgid()
+	}
 	if b.buckets != nil {
 		b.buckets[string(name)] = child
 	}
@@ -118,10 +125,11 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 	return child
 }
 
-// Helper method that re-interprets a sub-bucket value
+// Helper method that re-interprets a sub-bucket value and its element flags
 // from a parent into a Bucket
-func (b *Bucket) openBucket(value []byte) *Bucket {
+func (b *Bucket) openBucket(value []byte, flags uint32) *Bucket {
 	child := newBucket(b.tx)
+	child.compression = bucketCompression(flags)
 
 	// Unaligned access requires a copy to be made.
 	const unalignedMask = unsafe.Alignof(struct {
@@ -154,6 +162,10 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
+	return b.createBucket(key, BucketOptions{})
+}
+
+func (b *Bucket) createBucket(key []byte, opts BucketOptions) (*Bucket, error) {
 	if b.tx.db == nil {
 		return nil, ErrTxClosed
 	} else if !b.tx.writable {
@@ -184,7 +196,7 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 
 	// Insert into node.
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, bucketLeafFlag)
+	c.node().put(key, key, value, 0, opts.flags())
 
 	// Since subbuckets are not allowed on inline buckets, we need to
 	// dereference the inline page, if it exists. This will cause the bucket
@@ -258,8 +270,10 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 // Get retrieves the value for a key in the bucket.
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
 // The returned value is only valid for the life of the transaction.
+// Reading a damaged page panics with a *PageError, see Tx.Do.
 func (b *Bucket) Get(key []byte) []byte {
-	k, v, flags := b.Cursor().seek(key)
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
 
 	// Return nil if this is a bucket.
 	if (flags & bucketLeafFlag) != 0 {
@@ -270,7 +284,7 @@ func (b *Bucket) Get(key []byte) []byte {
 	if !bytes.Equal(key, k) {
 		return nil
 	}
-	return v
+	return c.value(v, flags)
 }
 
 // Put sets the value for a key in the bucket.
@@ -299,9 +313,15 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 		return ErrIncompatibleValue
 	}
 
+	// Compress the value if the bucket asks for it and it helps.
+	var valueFlags uint32
+	if compressed, ok := compressValue(b.compression, value); ok {
+		value, valueFlags = compressed, compressedValueFlag
+	}
+
 	// Insert into node.
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	c.node().put(key, key, value, 0, valueFlags)
 
 	return nil
 }
@@ -381,10 +401,13 @@ func (b *Bucket) NextSequence() (uint64, error) {
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller. The provided function must not modify
 // the bucket; this will result in undefined behavior.
-func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+//
+// Reaching a damaged page stops the iteration and returns its *PageError.
+func (b *Bucket) ForEach(fn func(k, v []byte) error) (err error) {
 	if b.tx.db == nil {
 		return ErrTxClosed
 	}
+	defer recoverPageError(&err, b.tx)
 	c := b.Cursor()
 	for k, v := c.First(); k != nil; k, v = c.Next() {
 		if err := fn(k, v); err != nil {
@@ -422,6 +445,16 @@ func (b *Bucket) Stats() BucketStats {
 				used += uintptr(lastElement.pos + lastElement.ksize + lastElement.vsize)
 			}
 
+			// Add up the stored and logical sizes of compressed values.
+			for i := uint16(0); i < p.count; i++ {
+				e := p.leafPageElement(i)
+				if (e.flags & compressedValueFlag) != 0 {
+					s.CompressedValueN++
+					s.CompressedValueBytes += int(e.vsize)
+					s.LogicalValueBytes += compressedValueSize(e.value())
+				}
+			}
+
 			if b.root == 0 {
 				// For inlined bucket just update the inline stats
 				s.InlineBucketInuse += int(used)
@@ -439,7 +472,7 @@ func (b *Bucket) Stats() BucketStats {
 					if (e.flags & bucketLeafFlag) != 0 {
 						// For any bucket element, open the element value
 						// and recursively call Stats on the contained bucket.
-						subStats.Add(b.openBucket(e.value()).Stats())
+						subStats.Add(b.openBucket(e.value(), e.flags).Stats())
 					}
 				}
 			}
@@ -558,7 +591,7 @@ func (b *Bucket) spill() error {
 		if flags&bucketLeafFlag == 0 {
 			panic(fmt.Sprintf("unexpected bucket header flag: %x", flags))
 		}
-		c.node().put([]byte(name), []byte(name), value, 0, bucketLeafFlag)
+		c.node().put([]byte(name), []byte(name), value, 0, flags)
 	}
 
 	// Ignore if there's not a materialized root node.
@@ -748,6 +781,11 @@ type BucketStats struct {
 	BucketN           int // total number of buckets including the top bucket
 	InlineBucketN     int // total number on inlined buckets
 	InlineBucketInuse int // bytes used for inlined buckets (also accounted for in LeafInuse)
+
+	// Compression statistics
+	CompressedValueN     int // number of values stored compressed
+	CompressedValueBytes int // bytes used by compressed values as stored
+	LogicalValueBytes    int // bytes of compressed values once decompressed
 }
 
 func (s *BucketStats) Add(other BucketStats) {
@@ -767,6 +805,10 @@ func (s *BucketStats) Add(other BucketStats) {
 	s.BucketN += other.BucketN
 	s.InlineBucketN += other.InlineBucketN
 	s.InlineBucketInuse += other.InlineBucketInuse
+
+	s.CompressedValueN += other.CompressedValueN
+	s.CompressedValueBytes += other.CompressedValueBytes
+	s.LogicalValueBytes += other.LogicalValueBytes
 }
 
 // cloneBytes returns a copy of a given slice.
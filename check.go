@@ -0,0 +1,518 @@
+package dbolt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// CheckLevel is how thoroughly strict mode checks a transaction on commit.
+type CheckLevel int
+
+const (
+	// CheckOff skips the check.
+	CheckOff CheckLevel = iota
+
+	// CheckIncremental checks only the pages the transaction wrote: that
+	// they are in bounds and not free, that their keys are in order and
+	// that the pages they point to are in bounds and not free. It runs
+	// before anything is written.
+	CheckIncremental
+
+	// CheckFull runs Tx.Check once the pages are written, before the meta
+	// page that makes them visible.
+	CheckFull
+)
+
+// String returns the name of the check level.
+func (l CheckLevel) String() string {
+	switch l {
+	case CheckOff:
+		return "off"
+	case CheckIncremental:
+		return "incremental"
+	case CheckFull:
+		return "full"
+	}
+	return fmt.Sprintf("CheckLevel(%d)", int(l))
+}
+
+// CheckKind is the kind of an inconsistency found by Tx.Check.
+type CheckKind int
+
+const (
+	// CheckDoubleFree is a page that is on the freelist more than once.
+	CheckDoubleFree CheckKind = iota + 1
+
+	// CheckUnreachable is a page that is neither reachable nor free.
+	CheckUnreachable
+
+	// CheckMultipleReferences is a page that is referenced more than once.
+	CheckMultipleReferences
+
+	// CheckReachableFreed is a page that is reachable but free.
+	CheckReachableFreed
+
+	// CheckInvalidType is a page, or a bucket header, that is not of the
+	// type its reference expects.
+	CheckInvalidType
+
+	// CheckOutOfBounds is a reference to a page beyond the high water mark.
+	CheckOutOfBounds
+
+	// CheckKeyOrder is a key out of order within its page, or outside the
+	// range given by the branch element pointing to the page.
+	CheckKeyOrder
+
+	// CheckUnreadable is a page that failed verification when read, for
+	// example because its checksum does not match. Err is the *PageError.
+	CheckUnreadable
+)
+
+// String returns the name of the kind of inconsistency.
+func (k CheckKind) String() string {
+	switch k {
+	case CheckDoubleFree:
+		return "double free"
+	case CheckUnreachable:
+		return "unreachable"
+	case CheckMultipleReferences:
+		return "multiple references"
+	case CheckReachableFreed:
+		return "reachable freed"
+	case CheckInvalidType:
+		return "invalid type"
+	case CheckOutOfBounds:
+		return "out of bounds"
+	case CheckKeyOrder:
+		return "key order"
+	case CheckUnreadable:
+		return "unreadable"
+	}
+	return fmt.Sprintf("CheckKind(%d)", int(k))
+}
+
+// CheckError describes an inconsistency found by Tx.Check. Tx.Commit also
+// returns one in strict mode when the transaction fails its check, after
+// rolling it back; it then describes the first inconsistency found and sets
+// Level and Errors.
+type CheckError struct {
+	Kind   CheckKind // kind of inconsistency
+	Page   int       // id of the page
+	Bucket [][]byte  // path of the bucket the page belongs to, nil for the root bucket and the freelist
+	Err    error     // details, if any
+
+	Level  CheckLevel    // level of the failed check, in strict mode
+	Errors []*CheckError // every inconsistency found, in strict mode
+}
+
+func (e *CheckError) Error() string {
+	if e.Level != CheckOff {
+		msgs := make([]string, len(e.Errors))
+		for i, err := range e.Errors {
+			msgs[i] = err.message()
+		}
+		return fmt.Sprintf("%s check failed: %s", e.Level, strings.Join(msgs, "; "))
+	}
+	return e.message()
+}
+
+// message returns the description of the inconsistency alone.
+func (e *CheckError) message() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "page %d", e.Page)
+	if e.Bucket != nil {
+		buf.WriteString(" in bucket ")
+		for i, name := range e.Bucket {
+			if i > 0 {
+				buf.WriteByte('/')
+			}
+			fmt.Fprintf(&buf, "%q", name)
+		}
+	}
+	fmt.Fprintf(&buf, ": %s", e.Kind)
+	if pe, ok := e.Err.(*PageError); ok {
+		fmt.Fprintf(&buf, ": %s", pe.Err)
+	} else if e.Err != nil {
+		fmt.Fprintf(&buf, ": %s", e.Err)
+	}
+	return buf.String()
+}
+
+// Unwrap returns the details of the inconsistency.
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// checkFailed returns the error Tx.Commit returns in strict mode for errs.
+func checkFailed(level CheckLevel, errs []*CheckError) *CheckError {
+	err := *errs[0]
+	err.Level, err.Errors = level, errs
+	return &err
+}
+
+// strictLevel returns the level of the check strict mode runs on commit.
+func (db *DB) strictLevel() CheckLevel {
+	if db.StrictModeLevel != CheckOff {
+		return db.StrictModeLevel
+	}
+	if db.StrictMode {
+		return CheckFull
+	}
+	return CheckOff
+}
+
+// checkDirty checks the dirty pages of tx for CheckIncremental and returns
+// the inconsistencies found.
+func (tx *Tx) checkDirty() []*CheckError {
+	var errs []*CheckError
+	report := func(kind CheckKind, id pgid, format string, a ...interface{}) {
+		errs = append(errs, &CheckError{Kind: kind, Page: int(id), Err: fmt.Errorf(format, a...)})
+	}
+	ref := func(from pgid, id pgid) {
+		if id < 2 || id >= tx.meta.pgid {
+			report(CheckOutOfBounds, from, "reference to page %d: %d", int(id), int(tx.meta.pgid))
+		} else if tx.db.freelist.freed(id) {
+			report(CheckReachableFreed, id, "referenced by page %d", int(from))
+		}
+	}
+
+	if root := tx.meta.root.root; root != 0 {
+		ref(0, root)
+	}
+	for _, p := range tx.pages {
+		if p.id < 2 || p.id+pgid(p.overflow) >= tx.meta.pgid {
+			report(CheckOutOfBounds, p.id, "%d", int(tx.meta.pgid))
+		}
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			if tx.db.freelist.freed(p.id + i) {
+				report(CheckReachableFreed, p.id+i, "written")
+			}
+		}
+
+		switch {
+		case (p.flags & branchPageFlag) != 0:
+			if p.count == 0 {
+				report(CheckInvalidType, p.id, "empty branch")
+			}
+			var prev []byte
+			for i := uint16(0); i < p.count; i++ {
+				e := p.branchPageElement(i)
+				if i > 0 && bytes.Compare(prev, e.key()) >= 0 {
+					report(CheckKeyOrder, p.id, "at %d", i)
+				}
+				prev = e.key()
+				ref(p.id, e.pgid)
+			}
+		case (p.flags & leafPageFlag) != 0:
+			var prev []byte
+			for i := uint16(0); i < p.count; i++ {
+				e := p.leafPageElement(i)
+				if i > 0 && bytes.Compare(prev, e.key()) >= 0 {
+					report(CheckKeyOrder, p.id, "at %d", i)
+				}
+				prev = e.key()
+				if (e.flags & bucketLeafFlag) == 0 {
+					continue
+				}
+				if v := e.value(); len(v) < bucketHeaderSize {
+					report(CheckInvalidType, p.id, "short bucket header at %d", i)
+				} else if root := (*bucket)(unsafe.Pointer(&v[0])).root; root != 0 {
+					ref(p.id, root)
+				}
+			}
+		case (p.flags & freelistPageFlag) != 0:
+		default:
+			report(CheckInvalidType, p.id, "%s", p.typ())
+		}
+	}
+	return errs
+}
+
+// CheckOptions configures Tx.CheckWithOptions.
+type CheckOptions struct {
+	// Workers is the number of goroutines walking the buckets, one if zero.
+	// The sub-trees of a bucket are handed to idle workers as they are
+	// found, so inconsistencies are reported in no particular order.
+	Workers int
+
+	// Buckets limits the check to the top-level buckets with these names.
+	// Since the other buckets are not walked, pages are not checked for
+	// being reachable.
+	Buckets [][]byte
+
+	// SkipFreelist skips loading and validating the freelist: pages are not
+	// checked for being freed twice, reachable and freed, or unreachable.
+	SkipFreelist bool
+}
+
+// Check performs several consistency checks on the database for this
+// transaction. Every inconsistency found is sent on the returned channel as
+// a *CheckError, which is closed once the check completes.
+//
+// It can be safely run concurrently on a writable transaction. However, this
+// incurs a high cost for large databases and databases with a lot of subbuckets
+// because of caching. This overhead can be removed if running on a read-only
+// transaction, however, it is not safe to execute other writer transactions at
+// the same time.
+func (tx *Tx) Check() <-chan error {
+	return tx.CheckWithOptions(CheckOptions{})
+}
+
+// CheckWithOptions performs the checks of Check as configured by opts.
+func (tx *Tx) CheckWithOptions(opts CheckOptions) <-chan error {
+	ch := make(chan error)
+	go func() {
+		tx.check(opts, func(err *CheckError) { ch <- err })
+		close(ch)
+	}()
+	return ch
+}
+
+// checker walks the pages of a transaction for Tx.Check.
+type checker struct {
+	tx     *Tx
+	opts   CheckOptions
+	freed  map[pgid]bool // free pages, or nil to skip the freelist checks
+	report func(err *CheckError)
+	sem    chan struct{} // tokens of the idle workers
+	wg     sync.WaitGroup
+
+	reportMu sync.Mutex // serializes the calls to report
+
+	mu         sync.Mutex
+	reachable  map[pgid]pgid // id of the page each reachable page belongs to
+	incomplete bool          // set if some pages could not be walked
+}
+
+// newChecker returns a checker of tx that reports the inconsistencies found
+// to report, one at a time.
+func (tx *Tx) newChecker(opts CheckOptions, report func(err *CheckError)) *checker {
+	c := &checker{
+		tx:        tx,
+		opts:      opts,
+		reachable: make(map[pgid]pgid),
+	}
+	c.report = func(err *CheckError) {
+		c.reportMu.Lock()
+		defer c.reportMu.Unlock()
+		report(err)
+	}
+	if opts.Workers > 1 {
+		c.sem = make(chan struct{}, opts.Workers-1)
+	}
+	return c
+}
+
+// check runs the checks of opts on tx and reports the inconsistencies found
+// to report, one at a time.
+func (tx *Tx) check(opts CheckOptions, report func(err *CheckError)) {
+	c := tx.newChecker(opts, report)
+
+	// Check if any pages are double freed.
+	if !opts.SkipFreelist {
+		// Force loading free list if opened in ReadOnly mode.
+		tx.db.loadFreelist()
+
+		c.freed = make(map[pgid]bool)
+		all := make([]pgid, tx.db.freelist.count())
+		tx.db.freelist.copyall(all)
+		for _, id := range all {
+			if c.freed[id] {
+				c.report(&CheckError{Kind: CheckDoubleFree, Page: int(id)})
+			}
+			c.freed[id] = true
+		}
+	}
+
+	// Track every reachable page.
+	c.reachable[0] = 0 // meta0
+	c.reachable[1] = 1 // meta1
+	if tx.meta.freelist != pgidNoFreelist {
+		if p, err := tx.db.readPage(tx.meta.freelist); err != nil {
+			c.report(&CheckError{Kind: CheckUnreadable, Page: int(tx.meta.freelist), Err: err})
+			c.incomplete = true
+		} else {
+			for i := uint32(0); i <= p.overflow; i++ {
+				c.reachable[tx.meta.freelist+pgid(i)] = tx.meta.freelist
+			}
+			tx.db.releasePage(p)
+		}
+	}
+	tx.snapshotDirectory(c.reachable)
+
+	// Recursively check buckets.
+	c.walkBuckets()
+
+	// Ensure all pages below high water mark are either reachable or freed.
+	// This is skipped if some pages could not be walked, since every page
+	// below them would otherwise be reported as unreachable.
+	if c.freed != nil && opts.Buckets == nil && !c.incomplete {
+		for i := pgid(0); i < tx.meta.pgid; i++ {
+			if _, ok := c.reachable[i]; !ok && !c.freed[i] {
+				c.report(&CheckError{Kind: CheckUnreachable, Page: int(i)})
+			}
+		}
+	}
+}
+
+// walkBuckets checks the pages of the root bucket and of the buckets below
+// it, and adds them to the reachable pages.
+func (c *checker) walkBuckets() {
+	if root := c.tx.root.root; root != 0 {
+		c.walk(root, nil, nil, nil)
+	}
+	c.wg.Wait()
+}
+
+// walk checks the page id of the bucket at path and the pages below it. The
+// keys of the page must be at least min and, unless max is nil, less than
+// max. Sub-trees are handed to an idle worker if there is one.
+func (c *checker) walk(id pgid, path [][]byte, min, max []byte) {
+	tx := c.tx
+	if id < 2 || id >= tx.meta.pgid {
+		c.report(&CheckError{Kind: CheckOutOfBounds, Page: int(id), Bucket: path, Err: fmt.Errorf("%d", int(tx.meta.pgid))})
+		c.fail()
+		return
+	}
+
+	// Dirty pages have not been sealed yet so only pages read from the mmap
+	// are verified.
+	p, dirty := tx.pages[id]
+	if !dirty {
+		var err error
+		if p, err = tx.db.readPage(id); err != nil {
+			c.report(&CheckError{Kind: CheckUnreadable, Page: int(id), Bucket: path, Err: err})
+			c.fail()
+			return
+		}
+		defer tx.db.releasePage(p)
+	}
+	if end := id + pgid(p.overflow); end >= tx.meta.pgid {
+		c.report(&CheckError{Kind: CheckOutOfBounds, Page: int(end), Bucket: path, Err: fmt.Errorf("%d", int(tx.meta.pgid))})
+	}
+
+	// Ensure each page is only referenced once. A page referenced again is
+	// not walked again, which also stops at cycles.
+	var multiple []pgid
+	c.mu.Lock()
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		if _, ok := c.reachable[id+i]; ok {
+			multiple = append(multiple, id+i)
+		}
+		c.reachable[id+i] = id
+	}
+	c.mu.Unlock()
+	for _, m := range multiple {
+		c.report(&CheckError{Kind: CheckMultipleReferences, Page: int(m), Bucket: path})
+	}
+	if len(multiple) > 0 && multiple[0] == id {
+		return
+	}
+
+	// We should only encounter un-freed leaf and branch pages.
+	if c.freed[id] {
+		c.report(&CheckError{Kind: CheckReachableFreed, Page: int(id), Bucket: path})
+	}
+	if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
+		c.report(&CheckError{Kind: CheckInvalidType, Page: int(id), Bucket: path, Err: errors.New(p.typ())})
+		c.fail()
+		return
+	}
+
+	// Ensure the keys are in order and within the range of the page. Only
+	// the first key out of order is reported.
+	key := func(i uint16) []byte {
+		if (p.flags & branchPageFlag) != 0 {
+			return p.branchPageElement(i).key()
+		}
+		return p.leafPageElement(i).key()
+	}
+	for i := uint16(0); i < p.count; i++ {
+		var err error
+		if k := key(i); i > 0 && bytes.Compare(key(i-1), k) >= 0 {
+			err = fmt.Errorf("key %d not after key %d", i, i-1)
+		} else if bytes.Compare(k, min) < 0 {
+			err = fmt.Errorf("key %d before its branch element", i)
+		} else if max != nil && bytes.Compare(k, max) >= 0 {
+			err = fmt.Errorf("key %d not before the next branch element", i)
+		}
+		if err != nil {
+			c.report(&CheckError{Kind: CheckKeyOrder, Page: int(id), Bucket: path, Err: err})
+			break
+		}
+	}
+
+	// Walk the children of branch pages and the sub-buckets of leaf pages.
+	// The keys they are given are copied, since the page is released when
+	// this returns while workers may still be walking them.
+	if (p.flags & branchPageFlag) != 0 {
+		for i := uint16(0); i < p.count; i++ {
+			e := p.branchPageElement(i)
+			next := max
+			if i+1 < p.count {
+				next = cloneBytes(p.branchPageElement(i + 1).key())
+			}
+			c.spawn(e.pgid, path, cloneBytes(e.key()), next)
+		}
+		return
+	}
+	for i := uint16(0); i < p.count; i++ {
+		e := p.leafPageElement(i)
+		if (e.flags & bucketLeafFlag) == 0 {
+			continue
+		}
+		if path == nil && c.opts.Buckets != nil && !containsKey(c.opts.Buckets, e.key()) {
+			continue
+		}
+		v := e.value()
+		if len(v) < bucketHeaderSize {
+			c.report(&CheckError{Kind: CheckInvalidType, Page: int(id), Bucket: path, Err: fmt.Errorf("short bucket header at %d", i)})
+			continue
+		}
+
+		// Ignore inline buckets.
+		if root := (*bucket)(unsafe.Pointer(&v[0])).root; root != 0 {
+			child := make([][]byte, len(path)+1)
+			copy(child, path)
+			child[len(path)] = cloneBytes(e.key())
+			c.spawn(root, child, nil, nil)
+		}
+	}
+}
+
+// spawn walks the page id on an idle worker if there is one, or else right
+// away.
+func (c *checker) spawn(id pgid, path [][]byte, min, max []byte) {
+	select {
+	case c.sem <- struct{}{}:
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.walk(id, path, min, max)
+			<-c.sem
+		}()
+	default:
+		c.walk(id, path, min, max)
+	}
+}
+
+// fail records that some pages could not be walked.
+func (c *checker) fail() {
+	c.mu.Lock()
+	c.incomplete = true
+	c.mu.Unlock()
+}
+
+// containsKey returns whether keys contains key.
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
@@ -43,6 +48,9 @@ var (
 	// ErrCorrupt is returned when a checking a data file finds errors.
 	ErrCorrupt = errors.New("invalid value")
 
+	// ErrDiffer is returned when comparing databases finds differences.
+	ErrDiffer = errors.New("databases differ")
+
 	// ErrNonDivisibleBatchSize is returned when the batch size can't be evenly
 	// divided by the iteration count.
 	ErrNonDivisibleBatchSize = errors.New("number of iterations must be divisible by the batch size")
@@ -113,12 +121,18 @@ func (m *Main) Run(args ...string) error {
 		return newCheckCommand(m).Run(args[1:]...)
 	case "compact":
 		return newCompactCommand(m).Run(args[1:]...)
+	case "diff":
+		return newDiffCommand(m).Run(args[1:]...)
 	case "dump":
 		return newDumpCommand(m).Run(args[1:]...)
+	case "export":
+		return newExportCommand(m).Run(args[1:]...)
 	case "page-item":
 		return newPageItemCommand(m).Run(args[1:]...)
 	case "get":
 		return newGetCommand(m).Run(args[1:]...)
+	case "import":
+		return newImportCommand(m).Run(args[1:]...)
 	case "info":
 		return newInfoCommand(m).Run(args[1:]...)
 	case "keys":
@@ -127,8 +141,16 @@ func (m *Main) Run(args ...string) error {
 		return newPageCommand(m).Run(args[1:]...)
 	case "pages":
 		return newPagesCommand(m).Run(args[1:]...)
+	case "rekey":
+		return newRekeyCommand(m).Run(args[1:]...)
+	case "repair":
+		return newRepairCommand(m).Run(args[1:]...)
+	case "restore":
+		return newRestoreCommand(m).Run(args[1:]...)
 	case "stats":
 		return newStatsCommand(m).Run(args[1:]...)
+	case "surgery":
+		return newSurgeryCommand(m).Run(args[1:]...)
 	default:
 		return ErrUnknownCommand
 	}
@@ -149,15 +171,25 @@ The commands are:
     buckets     print a list of buckets
     check       verifies integrity of dbolt database
     compact     copies a dbolt database, compacting it in the process
+    diff        print the buckets and keys that differ between two databases
     dump        print a hexadecimal dump of a single page
+    export      writes the buckets and keys of a database as JSON or CSV
     get         print the value of a key in a bucket
+    import      reads the buckets and keys written by export
     info        print basic info
     keys        print a list of keys in a bucket
     help        print this screen
     page        print one or more pages in human readable format
     pages       print list of pages with their types
     page-item   print the key and value of a page item.
+    rekey       copies an encrypted database under a new key
+    repair      salvages the keys of a damaged database
+    restore     restores a database from a full and incremental backups
     stats       iterate over all pages and generate usage stats
+    surgery     edits the meta and data pages of a copy of a database
+
+The diff, export, import, rekey, repair, restore and surgery commands take
+their options before or after their paths.
 
 Use "dbolt [command] -h" for more information about a command.
 `, "\n")
@@ -182,8 +214,16 @@ func newCheckCommand(m *Main) *CheckCommand {
 // Run executes the command.
 func (cmd *CheckCommand) Run(args ...string) error {
 	// Parse flags.
+	var options bolt.CheckOptions
 	fs := flag.NewFlagSet("", flag.ContinueOnError)
 	help := fs.Bool("h", false, "")
+	asJSON := fs.Bool("json", false, "")
+	fs.IntVar(&options.Workers, "workers", runtime.GOMAXPROCS(0), "")
+	fs.BoolVar(&options.SkipFreelist, "skip-freelist", false, "")
+	fs.Func("bucket", "", func(name string) error {
+		options.Buckets = append(options.Buckets, []byte(name))
+		return nil
+	})
 	if err := fs.Parse(args); err != nil {
 		return err
 	} else if *help {
@@ -208,15 +248,36 @@ func (cmd *CheckCommand) Run(args ...string) error {
 
 	// Perform consistency check.
 	return db.View(func(tx *bolt.Tx) error {
-		var count int
-		for err := range tx.Check() {
-			fmt.Fprintln(cmd.Stdout, err)
-			count++
+		var errs []checkResult
+		for err := range tx.CheckWithOptions(options) {
+			if !*asJSON {
+				fmt.Fprintln(cmd.Stdout, err)
+			}
+			errs = append(errs, newCheckResult(err))
+		}
+
+		// Print the errors as a single JSON document.
+		if *asJSON {
+			enc := json.NewEncoder(cmd.Stdout)
+			enc.SetIndent("", "  ")
+			if errs == nil {
+				errs = []checkResult{}
+			}
+			if err := enc.Encode(struct {
+				OK     bool          `json:"ok"`
+				Errors []checkResult `json:"errors"`
+			}{len(errs) == 0, errs}); err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				return ErrCorrupt
+			}
+			return nil
 		}
 
 		// Print summary of errors.
-		if count > 0 {
-			fmt.Fprintf(cmd.Stdout, "%d errors found\n", count)
+		if len(errs) > 0 {
+			fmt.Fprintf(cmd.Stdout, "%d errors found\n", len(errs))
 			return ErrCorrupt
 		}
 
@@ -226,17 +287,52 @@ func (cmd *CheckCommand) Run(args ...string) error {
 	})
 }
 
+// checkResult is an inconsistency as printed by "check -json".
+type checkResult struct {
+	Kind    string   `json:"kind"`
+	Page    int      `json:"page"`
+	Bucket  []string `json:"bucket,omitempty"`
+	Message string   `json:"message"`
+}
+
+// newCheckResult returns the result printed for an error from Tx.Check.
+func newCheckResult(err error) checkResult {
+	var cerr *bolt.CheckError
+	if !errors.As(err, &cerr) {
+		return checkResult{Message: err.Error()}
+	}
+	r := checkResult{Kind: cerr.Kind.String(), Page: cerr.Page, Message: cerr.Error()}
+	for _, name := range cerr.Bucket {
+		r.Bucket = append(r.Bucket, string(name))
+	}
+	return r
+}
+
 // Usage returns the help message.
 func (cmd *CheckCommand) Usage() string {
 	return strings.TrimLeft(`
-usage: bolt check PATH
+usage: bolt check [options] PATH
 
 Check opens a database at PATH and runs an exhaustive check to verify that
 all pages are accessible or are marked as freed. It also verifies that no
-pages are double referenced.
+pages are double referenced and that keys are in order.
 
 Verification errors will stream out as they are found and the process will
 return after all pages have been checked.
+
+Additional options include:
+
+	-json
+		Prints the errors found as a JSON document once the check
+		completes. Each error has a kind, a page id, the path of its
+		bucket and a message.
+	-workers N
+		Walks the buckets on N goroutines. Defaults to GOMAXPROCS.
+	-bucket NAME
+		Checks only the top-level bucket NAME. Can be repeated. Pages
+		are then not checked for being reachable.
+	-skip-freelist
+		Skips the freelist checks.
 `, "\n")
 }
 
@@ -287,15 +383,49 @@ func (cmd *InfoCommand) Run(args ...string) error {
 	info := db.Info()
 	fmt.Fprintf(cmd.Stdout, "Page Size: %d\n", info.PageSize)
 
+	// Print the file size next to the disk space it takes up, which is less
+	// once free pages are punched out.
+	apparent, allocated, err := fileSizes(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "Apparent Size: %d\n", apparent)
+	fmt.Fprintf(cmd.Stdout, "Allocated Size: %d\n", allocated)
+
 	return nil
 }
 
+// fileSizes returns the size of the data file at path and the size of the
+// disk blocks allocated to it, summed over the segment files if path is the
+// directory of a segmented database.
+func fileSizes(path string) (apparent, allocated int64, err error) {
+	paths := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return 0, 0, err
+	} else if info.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(path, "data.[0-9]*")); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		apparent += info.Size()
+		allocated += allocatedSize(info)
+	}
+	return apparent, allocated, nil
+}
+
 // Usage returns the help message.
 func (cmd *InfoCommand) Usage() string {
 	return strings.TrimLeft(`
 usage: bolt info PATH
 
-Info prints basic information about the Bolt database at PATH.
+Info prints basic information about the Bolt database at PATH, including the
+apparent size of the data file and the disk space allocated to it. The latter
+is smaller when the file is sparse, as after Options.PunchFreePages.
 `, "\n")
 }
 
@@ -686,6 +816,12 @@ func (cmd *PageCommand) PrintMeta(w io.Writer, buf []byte) error {
 	fmt.Fprintf(w, "Flags:      %08x\n", m.flags)
 	fmt.Fprintf(w, "Root:       <pgid=%d>\n", m.root.root)
 	fmt.Fprintf(w, "Freelist:   <pgid=%d>\n", m.freelist)
+	if m.flags&metaFlagSnapshots != 0 {
+		fmt.Fprintf(w, "Snapshots:  <pgid=%d>\n", m.snapshots)
+	}
+	if m.flags&metaFlagEncrypted != 0 {
+		fmt.Fprintf(w, "Key pages:  %d <key=%d>\n", m.seals, m.sealKey)
+	}
 	fmt.Fprintf(w, "HWM:        <pgid=%d>\n", m.pgid)
 	fmt.Fprintf(w, "Txn ID:     %d\n", m.txid)
 	fmt.Fprintf(w, "Checksum:   %016x\n", m.checksum)
@@ -775,10 +911,31 @@ func (cmd *PageCommand) PrintFreelist(w io.Writer, buf []byte) error {
 
 	// Print each page in the freelist.
 	ids := (*[consts.MaxAllocSize]pgid)(unsafe.Pointer(&p.ptr))
-	for i := idx; i < count; i++ {
-		fmt.Fprintf(w, "%d\n", ids[i])
+	if (p.flags & freelistExtentPageFlag) != 0 {
+		// Extents of free pages are stored as their start and size.
+		for i := 0; i < count; i++ {
+			start, size := ids[idx+2*i], ids[idx+2*i+1]
+			fmt.Fprintf(w, "%d-%d\n", start, start+size-1)
+		}
+		idx += 2 * count
+	} else {
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "%d\n", ids[idx+i])
+		}
+		idx += count
 	}
 	fmt.Fprintf(w, "\n")
+
+	// Pages still used by snapshots are listed after the free pages.
+	if (p.flags & freelistHeldPageFlag) != 0 {
+		held := int(ids[idx])
+		fmt.Fprintf(w, "Held by snapshots: %d\n", held)
+		fmt.Fprintf(w, "\n")
+		for i := 1; i <= held; i++ {
+			fmt.Fprintf(w, "%d\n", ids[idx+i])
+		}
+		fmt.Fprintf(w, "\n")
+	}
 	return nil
 }
 
@@ -1025,6 +1182,18 @@ func (cmd *StatsCommand) Run(args ...string) error {
 		}
 		fmt.Fprintf(cmd.Stdout, "\tBytes used for inlined buckets: %d (%d%%)\n", s.InlineBucketInuse, percentage)
 
+		// Only report compression for databases that use it.
+		if s.CompressedValueN != 0 {
+			fmt.Fprintln(cmd.Stdout, "Compression statistics")
+			fmt.Fprintf(cmd.Stdout, "\tNumber of compressed values: %d\n", s.CompressedValueN)
+			percentage = 0
+			if s.LogicalValueBytes != 0 {
+				percentage = int(float32(s.CompressedValueBytes) * 100.0 / float32(s.LogicalValueBytes))
+			}
+			fmt.Fprintf(cmd.Stdout, "\tBytes stored for compressed values: %d (%d%%)\n", s.CompressedValueBytes, percentage)
+			fmt.Fprintf(cmd.Stdout, "\tBytes of compressed values once decompressed: %d\n", s.LogicalValueBytes)
+		}
+
 		return nil
 	})
 }
@@ -1810,6 +1979,37 @@ func ReadPageSize(path string) (int, error) {
 	return int(m.pageSize), nil
 }
 
+// parseFlags parses args with fs and returns the path they name. Flags may
+// come before and after the path.
+func parseFlags(fs *flag.FlagSet, args []string) (string, error) {
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return "", err
+	} else if len(paths) > 1 {
+		return "", fmt.Errorf("unexpected argument: %s", paths[1])
+	} else if len(paths) == 0 {
+		return "", nil
+	}
+	return paths[0], nil
+}
+
+// parseArgs parses args with fs and returns the arguments that are not
+// flags. Flags may come before, between and after them, up to a "--".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var paths []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		} else if fs.NArg() == 0 {
+			return paths, nil
+		} else if i := len(args) - fs.NArg(); i > 0 && args[i-1] == "--" {
+			return append(paths, fs.Args()...), nil
+		}
+		paths = append(paths, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
 // atois parses a slice of strings into integers.
 func atois(strs []string) ([]int, error) {
 	var a []int
@@ -1829,11 +2029,33 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+
+	freelistExtentPageFlag = 0x20
+	freelistHeldPageFlag   = 0x40
 )
 
 // DO NOT EDIT. Copied from the "bolt" package.
 const bucketLeafFlag = 0x01
 
+// DO NOT EDIT. Copied from the "bolt" package.
+const (
+	metaFlagPageChecksum = 0x01
+	metaFlagEncrypted    = 0x02
+	metaFlagPageTxid     = 0x04
+	metaFlagSnapshots    = 0x08
+
+	metaFlagFreelistExtents = 0x10
+)
+
+// DO NOT EDIT. Copied from the "bolt" package.
+const (
+	pageChecksumSize = 4
+	pageTxidSize     = 8
+)
+
+// DO NOT EDIT. Copied from the "bolt" package.
+const pgidNoFreelist pgid = 0xffffffffffffffff
+
 // DO NOT EDIT. Copied from the "bolt" package.
 type pgid uint64
 
@@ -1851,6 +2073,24 @@ type meta struct {
 	pgid     pgid
 	txid     txid
 	checksum uint64
+
+	snapshots pgid
+	sealKey   uint32
+	seals     uint64
+}
+
+// DO NOT EDIT. Copied from the "bolt" package.
+func (m *meta) sum64() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	if m.flags&metaFlagSnapshots != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(m.snapshots)]byte)(unsafe.Pointer(&m.snapshots))[:])
+	}
+	if m.flags&metaFlagEncrypted != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(m.sealKey)]byte)(unsafe.Pointer(&m.sealKey))[:])
+		_, _ = h.Write((*[unsafe.Sizeof(m.seals)]byte)(unsafe.Pointer(&m.seals))[:])
+	}
+	return h.Sum64()
 }
 
 // DO NOT EDIT. Copied from the "bolt" package.
@@ -2025,3 +2265,1223 @@ Additional options include:
 		Defaults to 64KB.
 `, "\n")
 }
+
+// DiffCommand represents the "diff" command execution.
+type DiffCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newDiffCommand returns a DiffCommand.
+func newDiffCommand(m *Main) *DiffCommand {
+	return &DiffCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *DiffCommand) Run(args ...string) error {
+	// Parse flags.
+	var options bolt.DiffOptions
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	help := fs.Bool("h", false, "")
+	asJSON := fs.Bool("json", false, "")
+	summary := fs.Bool("summary", false, "")
+	fs.Func("bucket", "", func(name string) error {
+		options.Bucket = append(options.Bucket, []byte(name))
+		return nil
+	})
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require both database paths.
+	if len(paths) < 2 {
+		return ErrPathRequired
+	} else if len(paths) > 2 {
+		return fmt.Errorf("unexpected argument: %s", paths[2])
+	}
+	pathA, pathB := paths[0], paths[1]
+	for _, path := range []string{pathA, pathB} {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+	}
+
+	// Open databases.
+	a, err := bolt.Open(pathA, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := bolt.Open(pathB, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	// Compare them, printing the differences as they are found.
+	var counts diffSummary
+	enc := json.NewEncoder(cmd.Stdout)
+	if err := a.View(func(txA *bolt.Tx) error {
+		return b.View(func(txB *bolt.Tx) error {
+			return bolt.DiffTxWithOptions(txA, txB, options, func(d bolt.Diff) error {
+				counts.add(d)
+				if *summary {
+					return nil
+				} else if *asJSON {
+					return enc.Encode(newDiffResult(d))
+				}
+				fmt.Fprintln(cmd.Stdout, formatDiff(d))
+				return nil
+			})
+		})
+	}); err != nil {
+		return err
+	}
+
+	// Print the counts of differences.
+	if *summary {
+		if *asJSON {
+			if err := enc.Encode(counts); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(cmd.Stdout, "buckets: %d added, %d removed\n", counts.BucketsAdded, counts.BucketsRemoved)
+			fmt.Fprintf(cmd.Stdout, "keys: %d added, %d removed, %d changed\n", counts.KeysAdded, counts.KeysRemoved, counts.KeysChanged)
+			fmt.Fprintf(cmd.Stdout, "sequences: %d changed\n", counts.SequencesChanged)
+		}
+	}
+	if counts != (diffSummary{}) {
+		return ErrDiffer
+	}
+	return nil
+}
+
+// diffResult is a difference as printed by "diff -json".
+type diffResult struct {
+	Kind        string   `json:"kind"`
+	Type        string   `json:"type"`
+	Bucket      []string `json:"bucket,omitempty"`
+	Key         string   `json:"key"`
+	Old         []byte   `json:"old,omitempty"`
+	New         []byte   `json:"new,omitempty"`
+	OldSequence *uint64  `json:"oldSequence,omitempty"`
+	NewSequence *uint64  `json:"newSequence,omitempty"`
+}
+
+// newDiffResult returns the result printed for a difference from DiffTx.
+func newDiffResult(d bolt.Diff) diffResult {
+	r := diffResult{Kind: d.Kind.String(), Type: diffType(d), Key: string(d.Key), Old: d.Old, New: d.New}
+	for _, name := range d.Bucket {
+		r.Bucket = append(r.Bucket, string(name))
+	}
+	if d.IsBucket && d.Kind != bolt.DiffAdded {
+		r.OldSequence = &d.OldSequence
+	}
+	if d.IsBucket && d.Kind != bolt.DiffRemoved {
+		r.NewSequence = &d.NewSequence
+	}
+	return r
+}
+
+// diffType returns what differs: a bucket, a key or the sequence of a bucket.
+func diffType(d bolt.Diff) string {
+	switch {
+	case d.IsBucket && d.Kind == bolt.DiffChanged:
+		return "sequence"
+	case d.IsBucket:
+		return "bucket"
+	}
+	return "key"
+}
+
+// formatDiff returns a difference as printed by "diff".
+func formatDiff(d bolt.Diff) string {
+	var path []string
+	for _, name := range d.Bucket {
+		path = append(path, fmt.Sprintf("%q", name))
+	}
+	switch diffType(d) {
+	case "sequence":
+		path = append(path, fmt.Sprintf("%q", d.Key))
+		return fmt.Sprintf("changed sequence of %s: %d -> %d", strings.Join(path, "/"), d.OldSequence, d.NewSequence)
+	case "bucket":
+		path = append(path, fmt.Sprintf("%q", d.Key))
+		return fmt.Sprintf("%s bucket %s", d.Kind, strings.Join(path, "/"))
+	}
+	return fmt.Sprintf("%s key %q in %s", d.Kind, d.Key, strings.Join(path, "/"))
+}
+
+// diffSummary counts the differences printed by "diff -summary".
+type diffSummary struct {
+	BucketsAdded     int `json:"bucketsAdded"`
+	BucketsRemoved   int `json:"bucketsRemoved"`
+	KeysAdded        int `json:"keysAdded"`
+	KeysRemoved      int `json:"keysRemoved"`
+	KeysChanged      int `json:"keysChanged"`
+	SequencesChanged int `json:"sequencesChanged"`
+}
+
+// add counts the difference d.
+func (s *diffSummary) add(d bolt.Diff) {
+	switch {
+	case d.IsBucket && d.Kind == bolt.DiffAdded:
+		s.BucketsAdded++
+	case d.IsBucket && d.Kind == bolt.DiffRemoved:
+		s.BucketsRemoved++
+	case d.IsBucket:
+		s.SequencesChanged++
+	case d.Kind == bolt.DiffAdded:
+		s.KeysAdded++
+	case d.Kind == bolt.DiffRemoved:
+		s.KeysRemoved++
+	default:
+		s.KeysChanged++
+	}
+}
+
+// Usage returns the help message.
+func (cmd *DiffCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt diff [options] A B
+
+Diff compares the databases at paths A and B, walking both side by side in
+bucket and key order. It prints every bucket and key added to B or removed
+from A, every value that changed and every bucket whose sequence changed.
+Buckets added or removed are printed with all their keys.
+
+The process returns an error if the databases differ.
+
+Additional options include:
+
+	-json
+		Prints a JSON object per line for every difference, with its
+		kind, its type, the path of its bucket, its key and the old
+		and new values or sequences.
+	-bucket NAME
+		Compares only the bucket NAME. Repeat it to name a nested
+		bucket, outermost first.
+	-summary
+		Prints only the counts of differences.
+`, "\n")
+}
+
+// ExportCommand represents the "export" command execution.
+type ExportCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newExportCommand returns an ExportCommand.
+func newExportCommand(m *Main) *ExportCommand {
+	return &ExportCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *ExportCommand) Run(args ...string) (err error) {
+	// Parse flags.
+	var options bolt.ExportOptions
+	var format, output string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&format, "format", "jsonl", "")
+	fs.StringVar(&output, "o", "", "")
+	fs.BoolVar(&options.Base64, "base64", false, "")
+	fs.Func("bucket", "", func(name string) error {
+		options.Bucket = append(options.Bucket, []byte(name))
+		return nil
+	})
+	path, err := parseFlags(fs, args)
+	if err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if options.Format, err = parseFormat(format); err != nil {
+		return err
+	}
+
+	// Require database path.
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	// Open database.
+	db, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Write to the output file, or to stdout.
+	w := cmd.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		return bolt.ExportWithOptions(tx, w, options)
+	})
+}
+
+// Usage returns the help message.
+func (cmd *ExportCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt export [options] PATH
+
+Export writes the buckets, keys and values of the database at PATH to
+stdout, in bucket and key order. It can be read back with "bolt import".
+
+Keys and values are written as strings, or in base64 when they are not
+valid UTF-8.
+
+Additional options include:
+
+	-format FORMAT
+		Either "jsonl", a JSON object per line for every bucket and
+		key, or "csv", rows of key, value and encoding for a single
+		bucket. Defaults to "jsonl".
+	-bucket NAME
+		Exports only the bucket NAME. Repeat it to name a nested
+		bucket, outermost first. Required by "csv".
+	-base64
+		Writes every key and value in base64.
+	-o FILE
+		Writes to FILE instead of stdout.
+`, "\n")
+}
+
+// ImportCommand represents the "import" command execution.
+type ImportCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// newImportCommand returns an ImportCommand.
+func newImportCommand(m *Main) *ImportCommand {
+	return &ImportCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *ImportCommand) Run(args ...string) (err error) {
+	// Parse flags.
+	var options bolt.ImportOptions
+	var format, input string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&format, "format", "jsonl", "")
+	fs.StringVar(&input, "i", "", "")
+	fs.Int64Var(&options.TxMaxSize, "tx-max-size", 65536, "")
+	fs.Func("bucket", "", func(name string) error {
+		options.Bucket = append(options.Bucket, []byte(name))
+		return nil
+	})
+	path, err := parseFlags(fs, args)
+	if err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if options.Format, err = parseFormat(format); err != nil {
+		return err
+	} else if path == "" {
+		return ErrPathRequired
+	}
+
+	// Read from the input file, or from stdin.
+	r := cmd.Stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// Open the database, which is created if missing.
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	return bolt.ImportWithOptions(db, r, options)
+}
+
+// Usage returns the help message.
+func (cmd *ImportCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt import [options] PATH
+
+Import reads buckets, keys and values as written by "bolt export" from
+stdin into the database at PATH, which is created if it does not exist.
+Missing buckets are created and existing keys are overwritten.
+
+Additional options include:
+
+	-format FORMAT
+		Either "jsonl" or "csv". Defaults to "jsonl".
+	-bucket NAME
+		Imports into the bucket NAME. Repeat it to name a nested
+		bucket, outermost first. Required by "csv".
+	-i FILE
+		Reads from FILE instead of stdin.
+	-tx-max-size NUM
+		Specifies the maximum size of individual transactions.
+		Defaults to 64KB.
+`, "\n")
+}
+
+// parseFormat returns the export format named s.
+func parseFormat(s string) (bolt.Format, error) {
+	for _, f := range []bolt.Format{bolt.FormatJSONLines, bolt.FormatCSV} {
+		if s == f.String() {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown format: %s", s)
+}
+
+// RepairCommand represents the "repair" command execution.
+type RepairCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	SrcPath   string
+	DstPath   string
+	TxMaxSize int64
+}
+
+// newRepairCommand returns a RepairCommand.
+func newRepairCommand(m *Main) *RepairCommand {
+	return &RepairCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *RepairCommand) Run(args ...string) (err error) {
+	// Parse flags.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&cmd.DstPath, "o", "", "")
+	fs.Int64Var(&cmd.TxMaxSize, "tx-max-size", 65536, "")
+	if cmd.SrcPath, err = parseFlags(fs, args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if cmd.DstPath == "" {
+		return fmt.Errorf("output file required")
+	}
+
+	// Require the source path.
+	if cmd.SrcPath == "" {
+		return ErrPathRequired
+	}
+	fi, err := os.Stat(cmd.SrcPath)
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Salvage the source file into a new database.
+	if _, err := os.Stat(cmd.DstPath); err == nil {
+		return fmt.Errorf("output file exists: %s", cmd.DstPath)
+	}
+	dst, err := bolt.Open(cmd.DstPath, fi.Mode(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	report, err := bolt.Repair(dst, cmd.SrcPath, cmd.TxMaxSize)
+	if err != nil {
+		return err
+	}
+
+	// Report what was recovered and what was lost.
+	if report.Meta < 0 {
+		fmt.Fprintf(cmd.Stdout, "no valid meta page, assumed page size %d\n", report.PageSize)
+	} else {
+		fmt.Fprintf(cmd.Stdout, "walked from meta page %d, page size %d\n", report.Meta, report.PageSize)
+	}
+	fmt.Fprintf(cmd.Stdout, "scanned %d pages\n", report.PageN)
+	fmt.Fprintf(cmd.Stdout, "recovered %d buckets and %d keys\n", report.Buckets, report.Keys)
+	if report.Orphans > 0 {
+		fmt.Fprintf(cmd.Stdout, "recovered %d orphan pages, %d of them into %q\n", report.Orphans, report.LostFound, bolt.RepairLostFound)
+	}
+	if report.SkippedKeys > 0 {
+		fmt.Fprintf(cmd.Stdout, "skipped %d keys\n", report.SkippedKeys)
+	}
+	for _, l := range report.Lost {
+		var path []string
+		for _, name := range l.Bucket {
+			path = append(path, fmt.Sprintf("%q", name))
+		}
+		if path == nil {
+			path = []string{"root bucket"}
+		}
+		fmt.Fprintf(cmd.Stdout, "lost page %d in %s: %s\n", l.Page, strings.Join(path, "/"), l.Err)
+	}
+	if len(report.Lost) == 0 {
+		fmt.Fprintln(cmd.Stdout, "no pages lost")
+	}
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *RepairCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt repair [options] SRC -o DST
+
+Repair salvages the buckets and keys of a damaged data file at SRC into a
+new database at DST. It scans every page of the file, rebuilds the buckets
+from the leaf and branch pages that can be decoded and skips the others.
+
+When pages are lost, the pages they referred to are recovered as orphans:
+into their bucket if it can be told from the keys they hold, or else into
+a bucket per page in the "lost+found" bucket.
+
+A report of what was recovered and of every page lost is printed at the
+end. The original file is left untouched.
+
+Only the data file is read. Segmented databases are refused, and so is a
+database whose write-ahead log (SRC-wal) still holds commits: open it once
+to checkpoint the log, or move the log away to repair the data file as of
+its last checkpoint.
+
+Additional options include:
+
+	-tx-max-size NUM
+		Specifies the maximum size of individual transactions.
+		Defaults to 64KB.
+`, "\n")
+}
+
+// SurgeryCommand represents the "surgery" command execution.
+type SurgeryCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	SrcPath string
+	DstPath string
+}
+
+// newSurgeryCommand returns a SurgeryCommand.
+func newSurgeryCommand(m *Main) *SurgeryCommand {
+	return &SurgeryCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *SurgeryCommand) Run(args ...string) (err error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Parse the flags of the subcommand.
+	var pageID, fromID, toID int
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&cmd.DstPath, "o", "", "")
+	var run func(f *os.File) error
+	switch args[0] {
+	case "revert-meta":
+		run = cmd.revertMeta
+	case "clear-page":
+		fs.IntVar(&pageID, "page", 0, "")
+		run = func(f *os.File) error { return cmd.clearPage(f, pageID) }
+	case "rebuild-freelist":
+		run = cmd.abandonFreelist
+	case "copy-page":
+		fs.IntVar(&fromID, "from", 0, "")
+		fs.IntVar(&toID, "to", 0, "")
+		run = func(f *os.File) error { return cmd.copyPage(f, fromID, toID) }
+	case "set-root":
+		fs.IntVar(&pageID, "page", 0, "")
+		run = func(f *os.File) error { return cmd.setRoot(f, pageID) }
+	default:
+		return ErrUnknownCommand
+	}
+	if cmd.SrcPath, err = parseFlags(fs, args[1:]); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if cmd.DstPath == "" {
+		return fmt.Errorf("output file required")
+	} else if cmd.SrcPath == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(cmd.SrcPath); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	// Operate on a copy of the data file, never on the original.
+	if err := copyNewFile(cmd.DstPath, cmd.SrcPath); err != nil {
+		return err
+	}
+
+	// Do not leave a half-edited copy behind.
+	defer func() {
+		if err != nil {
+			_ = os.Remove(cmd.DstPath)
+		}
+	}()
+	f, err := os.OpenFile(cmd.DstPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := run(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+
+	// The freelist is rebuilt by opening the database without one.
+	if args[0] == "rebuild-freelist" {
+		return cmd.rebuildFreelist()
+	}
+	return nil
+}
+
+// revertMeta overwrites the current meta page with the previous one.
+func (cmd *SurgeryCommand) revertMeta(f *os.File) error {
+	metas, pageSize, err := readMetaPages(f)
+	if err != nil {
+		return err
+	}
+	cur := metas.current()
+	prev := 1 - cur
+	if metas[prev] == nil || metas[prev].txid >= metas[cur].txid {
+		return fmt.Errorf("no previous meta page to revert to")
+	}
+
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(prev*pageSize)); err != nil {
+		return err
+	} else if _, err := f.WriteAt(buf, int64(cur*pageSize)); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "reverted meta page %d from txid %d to txid %d\n", cur, metas[cur].txid, metas[prev].txid)
+	return nil
+}
+
+// clearPage turns page id into an empty leaf page.
+func (cmd *SurgeryCommand) clearPage(f *os.File, id int) error {
+	metas, pageSize, err := readMetaPages(f)
+	if err != nil {
+		return err
+	}
+	m := metas[metas.current()]
+	if err := checkPageID(m, id); err != nil {
+		return err
+	}
+	old, err := readPageAt(f, id, pageSize)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, pageSize)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.id, p.flags = pgid(id), leafPageFlag
+	if err := sealPage(buf, old, m); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf, int64(id*pageSize)); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "cleared page %d\n", id)
+	if n := (*page)(unsafe.Pointer(&old[0])).overflow; n > 0 {
+		fmt.Fprintf(cmd.Stdout, "its %d overflow pages are no longer used, rebuild the freelist to reclaim them\n", n)
+	}
+	return nil
+}
+
+// abandonFreelist drops the freelist from both meta pages, so that it is
+// rebuilt the next time the database is opened.
+func (cmd *SurgeryCommand) abandonFreelist(f *os.File) error {
+	metas, pageSize, err := readMetaPages(f)
+	if err != nil {
+		return err
+	}
+	for i, m := range metas {
+		if m == nil {
+			continue
+		}
+		m.freelist = pgidNoFreelist
+		m.flags &^= metaFlagFreelistExtents
+		m.checksum = m.sum64()
+		buf := (*[unsafe.Sizeof(meta{})]byte)(unsafe.Pointer(m))[:]
+		if _, err := f.WriteAt(buf, int64(i*pageSize+PageHeaderSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildFreelist opens the database, which has no freelist, so that the
+// freelist is rebuilt, and commits to write it.
+func (cmd *SurgeryCommand) rebuildFreelist() (err error) {
+	// Rebuilding panics on pages it cannot walk.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rebuild freelist: %v", r)
+		}
+	}()
+	db, err := bolt.Open(cmd.DstPath, 0666, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Update(func(*bolt.Tx) error { return nil }); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "rebuilt freelist: %d free pages\n", db.Stats().FreePageN)
+	return nil
+}
+
+// copyPage copies page from, with its overflow pages, over page to.
+func (cmd *SurgeryCommand) copyPage(f *os.File, from, to int) error {
+	metas, pageSize, err := readMetaPages(f)
+	if err != nil {
+		return err
+	}
+	m := metas[metas.current()]
+	if err := checkPageID(m, from); err != nil {
+		return err
+	} else if err := checkPageID(m, to); err != nil {
+		return err
+	} else if from == to {
+		return fmt.Errorf("cannot copy page %d onto itself", from)
+	}
+	buf, err := readPageAt(f, from, pageSize)
+	if err != nil {
+		return err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if end := to + int(p.overflow); end >= int(m.pgid) {
+		return fmt.Errorf("page %d: overflow out of bounds: %d", to, end)
+	}
+
+	p.id = pgid(to)
+	if err := sealPage(buf, buf, m); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf, int64(to*pageSize)); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "copied page %d to page %d\n", from, to)
+	return nil
+}
+
+// setRoot points the root bucket of the current meta page at page id.
+func (cmd *SurgeryCommand) setRoot(f *os.File, id int) error {
+	metas, pageSize, err := readMetaPages(f)
+	if err != nil {
+		return err
+	}
+	i := metas.current()
+	m := metas[i]
+	if err := checkPageID(m, id); err != nil {
+		return err
+	}
+	buf, err := readPageAt(f, id, pageSize)
+	if err != nil {
+		return err
+	}
+	if p := (*page)(unsafe.Pointer(&buf[0])); p.flags != branchPageFlag && p.flags != leafPageFlag {
+		return fmt.Errorf("page %d: not a branch or leaf page: %s", id, p.Type())
+	}
+
+	prev := m.root.root
+	m.root.root = pgid(id)
+	m.checksum = m.sum64()
+	mbuf := (*[unsafe.Sizeof(meta{})]byte)(unsafe.Pointer(m))[:]
+	if _, err := f.WriteAt(mbuf, int64(i*pageSize+PageHeaderSize)); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "set the root of meta page %d from page %d to page %d\n", i, prev, id)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *SurgeryCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt surgery COMMAND [options] SRC -o DST
+
+Surgery copies the data file at SRC to DST, which must not exist, and edits
+the copy at a low level. SRC is never modified. The database should have
+been closed cleanly: a write-ahead log next to SRC is not copied.
+
+The commands are:
+
+	revert-meta
+		Overwrites the current meta page, the valid one with the
+		highest transaction id, with the previous one, rolling the
+		database back by one transaction.
+	clear-page -page ID
+		Turns page ID into an empty leaf page. Its overflow pages are
+		left unused.
+	rebuild-freelist
+		Drops the freelist from both meta pages and rebuilds it by
+		scanning the database.
+	copy-page -from ID -to ID
+		Copies a page, with its overflow pages, over another one.
+	set-root -page ID
+		Points the root bucket of the current meta page at page ID.
+
+Pages of encrypted databases cannot be edited.
+`, "\n")
+}
+
+// metaPages holds both meta pages of a data file, nil if invalid.
+type metaPages [2]*meta
+
+// current returns the index of the valid meta page with the highest
+// transaction id.
+func (m metaPages) current() int {
+	if m[0] == nil || (m[1] != nil && m[1].txid > m[0].txid) {
+		return 1
+	}
+	return 0
+}
+
+// readMetaPages reads both meta pages of f and the page size. It fails if
+// neither is valid.
+func readMetaPages(f *os.File) (metaPages, int, error) {
+	var metas metaPages
+	read := func(off int64) *meta {
+		buf := make([]byte, PageHeaderSize+int(unsafe.Sizeof(meta{})))
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return nil
+		}
+		m := (*meta)(unsafe.Pointer(&buf[PageHeaderSize]))
+		if m.magic != bolt.Magic || m.version != bolt.Version || m.checksum != m.sum64() {
+			return nil
+		}
+		return m
+	}
+
+	// The page size is read from the first meta page if it is valid, or
+	// else found by probing for the second one.
+	pageSize, err := bolt.ProbePageSize(f)
+	if err != nil {
+		return metas, 0, fmt.Errorf("no valid meta page")
+	}
+	if m := read(0); m != nil && int(m.pageSize) == pageSize {
+		metas[0] = m
+	}
+	if m := read(int64(pageSize)); m != nil && int(m.pageSize) == pageSize {
+		metas[1] = m
+	}
+	return metas, pageSize, nil
+}
+
+// checkPageID returns an error if id is not a data page below the high water
+// mark of m.
+func checkPageID(m *meta, id int) error {
+	if id < 2 || id >= int(m.pgid) {
+		return fmt.Errorf("page %d: out of bounds: %d", id, m.pgid)
+	}
+	return nil
+}
+
+// readPageAt reads page id of f and its overflow pages.
+func readPageAt(f *os.File, id, pageSize int) ([]byte, error) {
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+		return nil, err
+	}
+	if n := (*page)(unsafe.Pointer(&buf[0])).overflow; n > 0 {
+		buf = make([]byte, (int(n)+1)*pageSize)
+		if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// sealPage fills in the page trailer of buf, as recorded in m: the
+// transaction id is taken from the trailer of old and the checksum is
+// computed anew.
+func sealPage(buf, old []byte, m *meta) error {
+	if m.flags&metaFlagEncrypted != 0 {
+		return fmt.Errorf("pages of encrypted databases cannot be edited")
+	}
+	if m.flags&metaFlagPageTxid != 0 {
+		sz := pageTxidSize
+		if m.flags&metaFlagPageChecksum != 0 {
+			sz += pageChecksumSize
+		}
+		copy(buf[len(buf)-sz:], old[len(old)-sz:len(old)-sz+pageTxidSize])
+	}
+	if m.flags&metaFlagPageChecksum != 0 {
+		end := len(buf) - pageChecksumSize
+		binary.LittleEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], crc32.MakeTable(crc32.Castagnoli)))
+	}
+	return nil
+}
+
+// RekeyCommand represents the "rekey" command execution.
+type RekeyCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	SrcPath    string
+	DstPath    string
+	KeyPath    string
+	NewKeyPath string
+	NewKeyID   uint
+}
+
+// newRekeyCommand returns a RekeyCommand.
+func newRekeyCommand(m *Main) *RekeyCommand {
+	return &RekeyCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *RekeyCommand) Run(args ...string) (err error) {
+	// Parse flags.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&cmd.DstPath, "o", "", "")
+	fs.StringVar(&cmd.KeyPath, "key", "", "")
+	fs.StringVar(&cmd.NewKeyPath, "new-key", "", "")
+	fs.UintVar(&cmd.NewKeyID, "new-key-id", 0, "")
+	if cmd.SrcPath, err = parseFlags(fs, args); err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if cmd.DstPath == "" {
+		return fmt.Errorf("output file required")
+	} else if cmd.KeyPath == "" || cmd.NewKeyPath == "" {
+		return fmt.Errorf("key and new key required")
+	}
+
+	// Require database path.
+	if cmd.SrcPath == "" {
+		return ErrPathRequired
+	}
+
+	// Ensure source file exists.
+	fi, err := os.Stat(cmd.SrcPath)
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Read both key files.
+	keys, err := readKeyFile(cmd.KeyPath)
+	if err != nil {
+		return err
+	}
+	newKeys, err := readKeyFile(cmd.NewKeyPath)
+	if err != nil {
+		return err
+	}
+	newKeyID := uint32(cmd.NewKeyID)
+	if _, ok := newKeys[newKeyID]; !ok {
+		return fmt.Errorf("key %d not found in %s", newKeyID, cmd.NewKeyPath)
+	}
+
+	// Open source database with the old keys.
+	src, err := bolt.Open(cmd.SrcPath, 0444, &bolt.Options{
+		ReadOnly:   true,
+		Encryption: &bolt.Encryption{Key: keyProvider(keys)},
+	})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Write the re-encrypted copy.
+	f, err := os.OpenFile(cmd.DstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if err := src.View(func(tx *bolt.Tx) error {
+		_, err := tx.Rekey(f, &bolt.Encryption{KeyID: newKeyID, Key: keyProvider(newKeys)})
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "rekeyed %s to key %d in %s\n", cmd.SrcPath, newKeyID, cmd.DstPath)
+	return nil
+}
+
+// RestoreCommand represents the "restore" command execution.
+type RestoreCommand struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	DstPath string
+	KeyPath string
+}
+
+// newRestoreCommand returns a RestoreCommand.
+func newRestoreCommand(m *Main) *RestoreCommand {
+	return &RestoreCommand{
+		Stdin:  m.Stdin,
+		Stdout: m.Stdout,
+		Stderr: m.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *RestoreCommand) Run(args ...string) (err error) {
+	// Parse flags.
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&cmd.DstPath, "o", "", "")
+	fs.StringVar(&cmd.KeyPath, "key", "", "")
+	paths, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if err != nil {
+		return err
+	} else if cmd.DstPath == "" {
+		return fmt.Errorf("output file required")
+	}
+
+	// Require the full backup path.
+	if len(paths) == 0 {
+		return ErrPathRequired
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return ErrFileNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Copy the full backup to a new destination file.
+	if err := copyNewFile(cmd.DstPath, paths[0]); err != nil {
+		return err
+	}
+
+	// Apply the incremental backups in order.
+	for _, path := range paths[1:] {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		m, err := bolt.ApplyIncremental(cmd.DstPath, f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		fmt.Fprintf(cmd.Stdout, "applied %s: tx %d to %d, %d pages\n", path, m.SinceTxid, m.Txid, len(m.Pages))
+	}
+
+	// Check the restored database.
+	options := &bolt.Options{}
+	if cmd.KeyPath != "" {
+		keys, err := readKeyFile(cmd.KeyPath)
+		if err != nil {
+			return err
+		}
+		options.Encryption = &bolt.Encryption{Key: keyProvider(keys)}
+	}
+	db, err := bolt.Open(cmd.DstPath, 0666, options)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		var count int
+		for err := range tx.Check() {
+			fmt.Fprintln(cmd.Stdout, err)
+			count++
+		}
+		if count > 0 {
+			fmt.Fprintf(cmd.Stdout, "%d errors found\n", count)
+			return ErrCorrupt
+		}
+		fmt.Fprintf(cmd.Stdout, "restored %s to tx %d\n", cmd.DstPath, tx.ID())
+		return nil
+	})
+}
+
+// copyNewFile copies the file at src to dst, which must not exist.
+func copyNewFile(dst, src string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Usage returns the help message.
+func (cmd *RestoreCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt restore [options] -o DST FULL [INCREMENTAL...]
+
+Restore copies the full backup at FULL path, as written by Tx.WriteTo, to a
+new database at DST path and applies the incremental backups written by
+Tx.WriteIncrementalTo in the order given. Each incremental backup must start
+at the transaction the database was restored to so far.
+
+The restored database is checked for consistency before the command returns.
+Backups are left untouched.
+
+Additional options include:
+
+	-key KEYFILE
+		Key file of an encrypted database, in the format used by rekey.
+`, "\n")
+}
+
+// readKeyFile reads encryption keys from a file. Each non-empty line holds
+// a key id and a hex encoded key separated by whitespace; a line with only a
+// key is key id 0.
+func readKeyFile(path string) (map[uint32][]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[uint32][]byte)
+	for i, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		var id uint64
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+		case 2:
+			if id, err = strconv.ParseUint(fields[0], 10, 32); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid key id: %s", path, i+1, err)
+			}
+			fields = fields[1:]
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid key line", path, i+1)
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %s", path, i+1, err)
+		}
+		keys[uint32(id)] = key
+	}
+	return keys, nil
+}
+
+// keyProvider returns a bolt.Encryption key function serving keys from a map.
+func keyProvider(keys map[uint32][]byte) func(id uint32) ([]byte, error) {
+	return func(id uint32) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id")
+	}
+}
+
+// Usage returns the help message.
+func (cmd *RekeyCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: bolt rekey -key KEYFILE -new-key KEYFILE [options] -o DST SRC
+
+Rekey opens the encrypted database at SRC path and writes a copy to DST path
+with every page encrypted under a new key. Pages that are no longer in use
+are zeroed in the copy so no data encrypted under the old keys survives.
+
+Key files hold one key per line as a decimal key id followed by the key in
+hex. A line with only a key is key id 0. Keys must be 16, 24 or 32 bytes.
+
+The original database is left untouched.
+
+Additional options include:
+
+	-new-key-id NUM
+		Key id in the new key file used to encrypt the copy.
+		Defaults to 0.
+`, "\n")
+}
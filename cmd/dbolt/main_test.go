@@ -4,12 +4,14 @@ import (
 	"bytes"
 	crypto "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 
 	bolt "github.com/c0mm4nd/dbolt"
@@ -27,6 +29,85 @@ func TestInfoCommand_Run(t *testing.T) {
 	if err := m.Run("info", db.Path); err != nil {
 		t.Fatal(err)
 	}
+
+	info, err := os.Stat(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := m.Stdout.String(); !strings.Contains(out, fmt.Sprintf("Apparent Size: %d\n", info.Size())) ||
+		!strings.Contains(out, "Allocated Size: ") {
+		t.Fatalf("unexpected stdout:\n\n%s", out)
+	}
+}
+
+// Ensure the "check" command can print the errors found as JSON.
+func TestCheckCommand_Run_JSON(t *testing.T) {
+	db := MustOpen(0666, nil)
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var root int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	db.DB.Close()
+
+	type result struct {
+		OK     bool `json:"ok"`
+		Errors []struct {
+			Kind   string   `json:"kind"`
+			Page   int      `json:"page"`
+			Bucket []string `json:"bucket"`
+		} `json:"errors"`
+	}
+	m := NewMain()
+	var r result
+	if err := m.Run("check", "-json", db.Path); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(m.Stdout.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	} else if !r.OK || r.Errors == nil || len(r.Errors) != 0 {
+		t.Fatalf("unexpected stdout:\n\n%s", m.Stdout.String())
+	}
+
+	// Turn the root page of the bucket into a freelist page.
+	f, err := os.OpenFile(db.Path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0x10, 0}, int64(root*pageSize+8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = NewMain()
+	r = result{}
+	if err := m.Run("check", "-json", "-workers", "4", db.Path); err != main.ErrCorrupt {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := json.Unmarshal(m.Stdout.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	} else if r.OK || len(r.Errors) != 1 || r.Errors[0].Kind != "invalid type" || r.Errors[0].Page != root ||
+		fmt.Sprint(r.Errors[0].Bucket) != "[widgets]" {
+		t.Fatalf("unexpected stdout:\n\n%s", m.Stdout.String())
+	}
 }
 
 // Ensure the "stats" command executes correctly with an empty database.
@@ -388,6 +469,490 @@ func TestCompactCommand_Run(t *testing.T) {
 	}
 }
 
+// Ensure the "diff" command prints the differences between two databases.
+func TestDiffCommand_Run(t *testing.T) {
+	a := MustOpen(0666, nil)
+	defer a.Close()
+	b := MustOpen(0666, nil)
+	defer b.Close()
+	for _, db := range []*DB{a, b} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			} else if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+				return err
+			}
+			sub, err := b.CreateBucket([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			return sub.Put([]byte("baz"), []byte("bat"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Update(func(tx *bolt.Tx) error {
+		widgets := tx.Bucket([]byte("widgets"))
+		if err := widgets.SetSequence(9); err != nil {
+			return err
+		}
+		return widgets.Put([]byte("new"), []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.DB.Close()
+	b.DB.Close()
+
+	// Identical databases do not differ.
+	m := NewMain()
+	if err := m.Run("diff", a.Path, a.Path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); out != "" {
+		t.Fatalf("unexpected stdout:\n\n%s", out)
+	}
+
+	m = NewMain()
+	if err := m.Run("diff", a.Path, b.Path); err != main.ErrDiffer {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := "changed sequence of \"widgets\": 0 -> 9\nadded key \"new\" in \"widgets\"\n"; m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout:\n\n%s", m.Stdout.String())
+	}
+
+	m = NewMain()
+	if err := m.Run("diff", "-json", "-bucket", "widgets", a.Path, b.Path); err != main.ErrDiffer {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := `{"kind":"changed","type":"sequence","key":"widgets","oldSequence":0,"newSequence":9}` + "\n" +
+		`{"kind":"added","type":"key","bucket":["widgets"],"key":"new","new":"dmFsdWU="}` + "\n"; m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout:\n\n%s", m.Stdout.String())
+	}
+
+	// Options may follow the paths.
+	m = NewMain()
+	if err := m.Run("diff", a.Path, b.Path, "-bucket", "widgets", "-bucket", "sub"); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); out != "" {
+		t.Fatalf("unexpected stdout:\n\n%s", out)
+	}
+
+	m = NewMain()
+	if err := m.Run("diff", "-summary", "-json", a.Path, b.Path); err != main.ErrDiffer {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := `{"bucketsAdded":0,"bucketsRemoved":0,"keysAdded":1,"keysRemoved":0,"keysChanged":0,"sequencesChanged":1}` + "\n"; m.Stdout.String() != exp {
+		t.Fatalf("unexpected stdout:\n\n%s", m.Stdout.String())
+	}
+}
+
+// Ensure the "export" command writes what the "import" command reads back.
+func TestExportCommand_Run(t *testing.T) {
+	db := MustOpen(0666, nil)
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		} else if err := sub.SetSequence(7); err != nil {
+			return err
+		}
+		return sub.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Close()
+
+	// Round trip the whole database as JSON Lines through stdout and stdin.
+	m := NewMain()
+	if err := m.Run("export", db.Path); err != nil {
+		t.Fatal(err)
+	}
+	dstPath := db.Path + ".imported"
+	defer os.Remove(dstPath)
+	m2 := NewMain()
+	m2.Stdin = m.Stdout
+	if err := m2.Run("import", "-tx-max-size", "1024", dstPath); err != nil {
+		t.Fatal(err)
+	}
+	want, err := chkdb(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := chkdb(dstPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatal("imported database differs")
+	}
+
+	// A bucket with nested buckets cannot be exported as CSV.
+	m = NewMain()
+	if err := m.Run("export", "-format", "csv", "-bucket", "widgets", db.Path); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := NewMain().Run("export", "-format", "xml", db.Path); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the "repair" command salvages a data file whose meta pages are lost.
+func TestRepairCommand_Run(t *testing.T) {
+	db := MustOpen(0666, nil)
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return fillBucket(b, []byte("widgets."))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	db.DB.Close()
+
+	// Repair the intact file, with the output flag after the source path.
+	dstPath := db.Path + ".repaired"
+	defer os.Remove(dstPath)
+	m := NewMain()
+	if err := m.Run("repair", db.Path, "-o", dstPath); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "no pages lost") {
+		t.Fatalf("unexpected stdout:\n\n%s", out)
+	}
+	want, err := chkdb(db.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := chkdb(dstPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatal("repaired database differs")
+	}
+
+	// Zero both meta pages: the file cannot be opened anymore.
+	f, err := os.OpenFile(db.Path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 2*pageSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(dstPath); err != nil {
+		t.Fatal(err)
+	}
+	m = NewMain()
+	if err := m.Run("repair", "-o", dstPath, db.Path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "no valid meta page") || !strings.Contains(out, `into "lost+found"`) {
+		t.Fatalf("unexpected stdout:\n\n%s", out)
+	}
+
+	// The output file must not exist.
+	m = NewMain()
+	if err := m.Run("repair", "-o", dstPath, db.Path); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure the "surgery" commands edit a copy of the data file.
+func TestSurgeryCommand_Run(t *testing.T) {
+	db := MustOpen(0666, &bolt.Options{PageChecksum: true})
+	defer db.Close()
+	for _, v := range []string{"old", "new"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(v)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var leaves []int
+	if err := db.View(func(tx *bolt.Tx) error {
+		for id := 2; ; id++ {
+			info, err := tx.Page(id)
+			if err != nil {
+				return err
+			} else if info == nil {
+				return nil
+			} else if info.Type == "leaf" && info.Count > 10 {
+				leaves = append(leaves, id)
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Close()
+
+	// surgery runs a surgery command and returns the path of the copy.
+	n := 0
+	surgery := func(args ...string) string {
+		n++
+		dst := fmt.Sprintf("%s.%d", db.Path, n)
+		t.Cleanup(func() { os.Remove(dst) })
+		m := NewMain()
+		if err := m.Run(append(append([]string{"surgery"}, args...), db.Path, "-o", dst)...); err != nil {
+			t.Fatal(err)
+		}
+		return dst
+	}
+	open := func(path string) *bolt.DB {
+		d, err := bolt.Open(path, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	get := func(d *bolt.DB) (n int, v string) {
+		if err := d.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			v = string(b.Get([]byte("0000")))
+			n = b.Stats().KeyN
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n, v
+	}
+	checkErrors := func(d *bolt.DB) (n int) {
+		if err := d.View(func(tx *bolt.Tx) error {
+			for range tx.Check() {
+				n++
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Reverting the meta page rolls back the last transaction.
+	if _, v := get(open(surgery("revert-meta"))); v != "old" {
+		t.Fatalf("unexpected value after revert-meta: %q", v)
+	}
+
+	// The freelist is rebuilt from scratch.
+	if d := open(surgery("rebuild-freelist")); checkErrors(d) != 0 {
+		t.Fatal("unexpected check errors after rebuild-freelist")
+	}
+
+	// Clearing a leaf drops its keys.
+	if n, _ := get(open(surgery("clear-page", "-page", strconv.Itoa(leaves[0])))); n >= 1000 {
+		t.Fatalf("unexpected key count after clear-page: %d", n)
+	}
+
+	// Copying a leaf over another one leaves its keys out of order.
+	if d := open(surgery("copy-page", "-from", strconv.Itoa(leaves[0]), "-to", strconv.Itoa(leaves[1]))); checkErrors(d) == 0 {
+		t.Fatal("expected check errors after copy-page")
+	}
+
+	// Pointing the root bucket at a leaf of the bucket hides the bucket.
+	d := open(surgery("set-root", "-page", strconv.Itoa(leaves[0])))
+	if err := d.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected bucket to be gone after set-root")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed edit leaves no copy behind.
+	dst := db.Path + ".failed"
+	if err := NewMain().Run("surgery", "clear-page", "-page", "1000000", db.Path, "-o", dst); err == nil {
+		t.Fatal("expected error clearing a page beyond the high water mark")
+	} else if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("expected copy to be removed: %v", err)
+	}
+
+	// The source file is left untouched and is never written in place.
+	if n, v := get(open(db.Path)); n != 1000 || v != "new" {
+		t.Fatalf("source changed: %d keys, %q", n, v)
+	}
+	m := NewMain()
+	if err := m.Run("surgery", "revert-meta", db.Path, "-o", db.Path); err == nil {
+		t.Fatal("expected error writing in place")
+	}
+}
+
+// Ensure the "rekey" command writes a copy readable only with the new key.
+func TestRekeyCommand_Run(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	keyFile := func(line string) string {
+		f, err := ioutil.TempFile("", "bolt-key-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	oldKeyPath := keyFile(fmt.Sprintf("%x", oldKey))
+	defer os.Remove(oldKeyPath)
+	newKeyPath := keyFile(fmt.Sprintf("5 %x", newKey))
+	defer os.Remove(newKeyPath)
+
+	db := MustOpen(0666, &bolt.Options{Encryption: &bolt.Encryption{
+		Key: func(uint32) ([]byte, error) { return oldKey, nil },
+	}})
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Close()
+
+	dstPath := db.Path + ".rekeyed"
+	defer os.Remove(dstPath)
+	m := NewMain()
+	if err := m.Run("rekey", "-key", oldKeyPath, "-new-key", newKeyPath, "-new-key-id", "5", "-o", dstPath, db.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := bolt.Open(dstPath, 0666, &bolt.Options{Encryption: &bolt.Encryption{
+		KeyID: 5,
+		Key: func(id uint32) ([]byte, error) {
+			if id != 5 {
+				return nil, fmt.Errorf("unexpected key id %d", id)
+			}
+			return newKey, nil
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the "restore" command applies incremental backups to a full backup
+// of an encrypted database.
+func TestRestoreCommand_Run(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	f, err := ioutil.TempFile("", "bolt-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := f.Name()
+	defer os.Remove(keyPath)
+	if _, err := fmt.Fprintf(f, "%x\n", key); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db := MustOpen(0666, &bolt.Options{PageTxid: true, Encryption: &bolt.Encryption{
+		Key: func(uint32) ([]byte, error) { return key, nil },
+	}})
+	defer db.Close()
+
+	put := func(k, v string) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k), []byte(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := func(path string, since int) int {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var txid int
+		if err := db.View(func(tx *bolt.Tx) error {
+			txid = tx.ID()
+			if since < 0 {
+				_, err := tx.WriteTo(f)
+				return err
+			}
+			_, err := tx.WriteIncrementalTo(f, since)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return txid
+	}
+
+	full, inc1, inc2 := db.Path+".full", db.Path+".inc1", db.Path+".inc2"
+	for _, path := range []string{full, inc1, inc2} {
+		defer os.Remove(path)
+	}
+	put("foo", "1")
+	txid := backup(full, -1)
+	put("bar", "2")
+	txid = backup(inc1, txid)
+	put("foo", "3")
+	backup(inc2, txid)
+
+	dstPath := db.Path + ".restored"
+	defer os.Remove(dstPath)
+	m := NewMain()
+	if err := m.Run("restore", "-key", keyPath, "-o", dstPath, full, inc1, inc2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination is never overwritten.
+	if err := m.Run("restore", full, "-o", dstPath); !os.IsExist(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db.DB.Close()
+	dst, err := bolt.Open(dstPath, 0666, &bolt.Options{Encryption: &bolt.Encryption{
+		Key: func(uint32) ([]byte, error) { return key, nil },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); string(v) != "3" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("bar")); string(v) != "2" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func fillBucket(b *bolt.Bucket, prefix []byte) error {
 	n := 10 + rand.Intn(50)
 	for i := 0; i < n; i++ {
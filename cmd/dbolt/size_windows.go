@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// allocatedSize returns the size of a file, since sparse files are not
+// punched on Windows.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -3,9 +3,14 @@ package dbolt
 // Compact will create a copy of the source DB and in the destination DB. This may
 // reclaim space that the source database no longer has use for. txMaxSize can be
 // used to limit the transactions size of this process and may trigger intermittent
-// commits. A value of zero will ignore transaction sizes.
+// commits. A value of zero will ignore transaction sizes. Returns
+// ErrCompactSnapshots if src has snapshots; drop them first.
 // TODO: merge with: https://github.com/etcd-io/etcd/blob/b7f0f52a16dbf83f18ca1d803f7892d750366a94/mvcc/backend/backend.go#L349
 func Compact(dst, src *DB, txMaxSize int64) error {
+	if len(src.Snapshots()) > 0 {
+		return ErrCompactSnapshots
+	}
+
 	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
 	var size int64
 	tx, err := dst.Begin(true)
@@ -14,7 +19,7 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 	}
 	defer tx.Rollback()
 
-	if err := walk(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+	if err := walk(src, func(keys [][]byte, k, v []byte, seq uint64, opts BucketOptions) error {
 		// On each key/value, check if we have exceeded tx size.
 		sz := int64(len(k) + len(v))
 		if size+sz > txMaxSize && txMaxSize != 0 {
@@ -35,7 +40,7 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 		// Create bucket on the root transaction if this is the first level.
 		nk := len(keys)
 		if nk == 0 {
-			bkt, err := tx.CreateBucket(k)
+			bkt, err := tx.CreateBucketWithOptions(k, opts)
 			if err != nil {
 				return err
 			}
@@ -58,7 +63,7 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 
 		// If there is no value then this is a bucket call.
 		if v == nil {
-			bkt, err := b.CreateBucket(k)
+			bkt, err := b.CreateBucketWithOptions(k, opts)
 			if err != nil {
 				return err
 			}
@@ -79,21 +84,27 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 
 // walkFunc is the type of the function called for keys (buckets and "normal"
 // values) discovered by Walk. keys is the list of keys to descend to the bucket
-// owning the discovered key/value pair k/v.
-type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+// owning the discovered key/value pair k/v. seq and opts are the sequence and
+// options of the bucket k, or of the bucket owning the value v.
+type walkFunc func(keys [][]byte, k, v []byte, seq uint64, opts BucketOptions) error
 
 // walk walks recursively the bolt database db, calling walkFn for each key it finds.
 func walk(db *DB, walkFn walkFunc) error {
 	return db.View(func(tx *Tx) error {
-		return tx.ForEach(func(name []byte, b *Bucket) error {
-			return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
-		})
+		return walkTx(tx, walkFn)
+	})
+}
+
+// walkTx walks recursively the buckets of tx, calling walkFn for each key it finds.
+func walkTx(tx *Tx, walkFn walkFunc) error {
+	return tx.ForEach(func(name []byte, b *Bucket) error {
+		return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
 	})
 }
 
 func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
 	// Execute callback.
-	if err := fn(keypath, k, v, seq); err != nil {
+	if err := fn(keypath, k, v, seq, BucketOptions{Compression: b.Compression()}); err != nil {
 		return err
 	}
 
@@ -102,8 +113,12 @@ func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFun
 		return nil
 	}
 
+	return walkChildren(b, append(keypath, k), fn)
+}
+
+// walkChildren walks recursively the keys of the bucket b found at keypath.
+func walkChildren(b *Bucket, keypath [][]byte, fn walkFunc) error {
 	// Iterate over each child key/value.
-	keypath = append(keypath, k)
 	return b.ForEach(func(k, v []byte) error {
 		if v == nil {
 			bkt := b.Bucket(k)
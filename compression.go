@@ -0,0 +1,156 @@
+package dbolt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm used to compress the values of a bucket.
+type Compression uint8
+
+const (
+	// NoCompression stores values as they are given. This is the default.
+	NoCompression Compression = iota
+
+	// Flate compresses values with DEFLATE from compress/flate.
+	Flate
+)
+
+// String returns the name of the compression algorithm.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Flate:
+		return "flate"
+	}
+	return fmt.Sprintf("unknown<%d>", uint8(c))
+}
+
+// The compression of a bucket is kept in the flags of its element in the
+// parent bucket, above the bucketLeafFlag.
+const bucketCompressionShift = 8
+
+// BucketOptions are the options a bucket is created with. They are persisted
+// with the bucket.
+type BucketOptions struct {
+	// Compression compresses values transparently: Put stores them
+	// compressed and Get and Cursor return them decompressed. Values that do
+	// not shrink are stored as they are. Keys are never compressed.
+	Compression Compression
+}
+
+// flags returns the element flags of a bucket created with these options.
+func (o BucketOptions) flags() uint32 {
+	return bucketLeafFlag | uint32(o.Compression)<<bucketCompressionShift
+}
+
+// bucketCompression returns the compression recorded in the element flags of
+// a bucket.
+func bucketCompression(flags uint32) Compression {
+	return Compression(flags >> bucketCompressionShift)
+}
+
+// CreateBucketWithOptions creates a new bucket at the given key with the
+// given options and returns the new bucket. It returns the same errors as
+// CreateBucket, and ErrInvalidCompression for an unknown compression.
+func (b *Bucket) CreateBucketWithOptions(key []byte, opts BucketOptions) (*Bucket, error) {
+	if opts.Compression > Flate {
+		return nil, ErrInvalidCompression
+	}
+	return b.createBucket(key, opts)
+}
+
+// Compression returns the compression of the bucket's values.
+func (b *Bucket) Compression() Compression {
+	return b.compression
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// maxFlateRatio bounds how many times larger than its stream a DEFLATE
+// value can be.
+const maxFlateRatio = 1032
+
+// compressValue compresses a value for storage in a bucket. The value is
+// prefixed with its uncompressed length. It returns false if compression
+// does not make the value smaller.
+func compressValue(c Compression, v []byte) ([]byte, bool) {
+	if c == NoCompression || len(v) == 0 {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	var hdr [binary.MaxVarintLen64]byte
+	buf.Write(hdr[:binary.PutUvarint(hdr[:], uint64(len(v)))])
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(v); err != nil {
+		return nil, false
+	} else if err := w.Close(); err != nil {
+		return nil, false
+	}
+
+	if buf.Len() >= len(v) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressValue decompresses a value stored by compressValue. A value whose
+// stream is shorter or longer than its recorded length, or is followed by
+// more data, is corrupt.
+func decompressValue(c Compression, v []byte) ([]byte, error) {
+	// The length is checked against what the stream can expand to before
+	// anything is allocated for it.
+	n, sz := binary.Uvarint(v)
+	if sz <= 0 || n > MaxValueSize || n > uint64(len(v)-sz)*maxFlateRatio {
+		return nil, ErrCorruptValue
+	}
+
+	switch c {
+	case Flate:
+		r := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(r)
+		br := bytes.NewReader(v[sz:])
+		if err := r.(flate.Resetter).Reset(br, nil); err != nil {
+			return nil, err
+		}
+		out := make([]byte, n)
+		if _, err := io.ReadFull(r, out); err != nil {
+			return nil, ErrCorruptValue
+		}
+		// The stream must end with the value, and the value with the stream,
+		// as compressValue wrote them.
+		var extra [1]byte
+		if m, err := r.Read(extra[:]); m != 0 || err != io.EOF || br.Len() != 0 {
+			return nil, ErrCorruptValue
+		}
+		return out, nil
+	}
+	return nil, ErrInvalidCompression
+}
+
+// compressedValueSize returns the uncompressed length of a value stored by
+// compressValue.
+func compressedValueSize(v []byte) int {
+	n, _ := binary.Uvarint(v)
+	return int(n)
+}
@@ -0,0 +1,141 @@
+package dbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Ensure that a compressed value decompresses only with the length it was
+// stored with and nothing after its stream.
+func TestDecompressValue_Corrupt(t *testing.T) {
+	want := bytes.Repeat([]byte("value"), 100)
+	v, ok := compressValue(Flate, want)
+	if !ok {
+		t.Fatal("expected compression")
+	}
+	if got, err := decompressValue(Flate, v); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected value: %q", got)
+	}
+
+	_, sz := binary.Uvarint(v)
+	lengths := func(n int) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return append(buf[:binary.PutUvarint(buf, uint64(n))], v[sz:]...)
+	}
+	for _, tt := range []struct {
+		name string
+		v    []byte
+	}{
+		{"Shorter", lengths(len(want) - 1)},
+		{"Longer", lengths(len(want) + 1)},
+		{"Trailing", append(append([]byte(nil), v...), 0, 1, 2)},
+	} {
+		if _, err := decompressValue(Flate, tt.v); err != ErrCorruptValue {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+// Ensure that a value claiming a huge length is rejected before its length
+// is allocated.
+func TestDecompressValue_HugeLength(t *testing.T) {
+	v, ok := compressValue(Flate, bytes.Repeat([]byte("value"), 100))
+	if !ok {
+		t.Fatal("expected compression")
+	}
+	_, sz := binary.Uvarint(v)
+	buf := make([]byte, binary.MaxVarintLen64)
+	v = append(buf[:binary.PutUvarint(buf, MaxValueSize)], v[sz:]...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := decompressValue(Flate, v); err != ErrCorruptValue {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("unexpected allocation: %d bytes", n)
+	}
+}
+
+// Ensure that a value that cannot be decompressed is reported for the leaf
+// page holding it, including the parent page of an inline bucket.
+func TestBucket_Get_CorruptValue(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("value"), 100)
+	corrupt := []byte{10, 1, 2, 3}
+	if err := db.Update(func(tx *Tx) error {
+		for name, n := range map[string]int{"widgets": 1000, "inline": 1} {
+			b, err := tx.CreateBucketWithOptions([]byte(name), BucketOptions{Compression: Flate})
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), value); err != nil {
+					return err
+				}
+			}
+			c := b.Cursor()
+			c.seek([]byte("0500"))
+			c.node().put([]byte("0500"), []byte("0500"), corrupt, 0, compressedValueFlag)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// leaf returns the id of the leaf page in b holding key.
+	leaf := func(b *Bucket, key []byte) (id pgid) {
+		b.forEachPage(func(p *page, _ int) {
+			if (p.flags & leafPageFlag) == 0 {
+				return
+			}
+			elems := p.leafPageElements()
+			for i := range elems {
+				if bytes.Equal(elems[i].key(), key) {
+					id = p.id
+				}
+			}
+		})
+		return id
+	}
+	want := make(map[string]pgid)
+	if err := db.View(func(tx *Tx) error {
+		want["widgets"] = leaf(tx.Bucket([]byte("widgets")), []byte("0500"))
+		want["inline"] = leaf(&tx.root, []byte("inline"))
+		if tx.Bucket([]byte("inline")).root != 0 {
+			t.Fatal("expected inline bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, id := range want {
+		if id < 2 {
+			t.Fatalf("%s: unexpected leaf page: %d", name, id)
+		}
+		err := db.View(func(tx *Tx) error {
+			tx.Bucket([]byte(name)).Get([]byte("0500"))
+			return nil
+		})
+		var perr *PageError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		} else if perr.ID != int(id) || perr.Err != ErrCorruptValue {
+			t.Fatalf("%s: unexpected page error: %v", name, perr)
+		}
+	}
+}
@@ -15,6 +15,11 @@ import (
 // Changing data while traversing with a cursor may cause it to be invalidated
 // and return unexpected keys and/or values. You must reposition your cursor
 // after mutating data.
+//
+// Moving a cursor onto a damaged page panics with a *PageError, and moving the
+// cursor of a read-only transaction invalidated by the MaxReadTxAge watchdog
+// panics with ErrTxInvalidated, like any read through the transaction; see
+// Tx.Do.
 type Cursor struct {
 	bucket *Bucket
 	stack  []elemRef
@@ -30,6 +35,7 @@ func (c *Cursor) Bucket() *Bucket {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) First() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.checkInvalidated()
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
 	c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
@@ -45,7 +51,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 	if (flags & uint32(bucketLeafFlag)) != 0 {
 		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 
 }
 
@@ -54,6 +60,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Last() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.checkInvalidated()
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
 	ref := elemRef{page: p, node: n}
@@ -64,7 +71,7 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 	if (flags & uint32(bucketLeafFlag)) != 0 {
 		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 // Next moves the cursor to the next item in the bucket and returns its key and value.
@@ -72,11 +79,12 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Next() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.checkInvalidated()
 	k, v, flags := c.next()
 	if (flags & uint32(bucketLeafFlag)) != 0 {
 		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 // Prev moves the cursor to the previous item in the bucket and returns its key and value.
@@ -84,6 +92,7 @@ func (c *Cursor) Next() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Prev() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.checkInvalidated()
 
 	// Attempt to move back one element until we're successful.
 	// Move up the stack as we hit the beginning of each page in our stack.
@@ -107,7 +116,7 @@ func (c *Cursor) Prev() (key []byte, value []byte) {
 	if (flags & uint32(bucketLeafFlag)) != 0 {
 		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 // Seek moves the cursor to a given key and returns it.
@@ -127,7 +136,7 @@ func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
 	} else if (flags & uint32(bucketLeafFlag)) != 0 {
 		return k, nil
 	}
-	return k, v
+	return k, c.value(v, flags)
 }
 
 // Delete removes the current key/value under the cursor from the bucket.
@@ -153,6 +162,7 @@ func (c *Cursor) Delete() error {
 // If the key does not exist then the next key is used.
 func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.bucket.tx.checkInvalidated()
 
 	// Start from root page/node and traverse to correct page.
 	c.stack = c.stack[:0]
@@ -350,6 +360,33 @@ func (c *Cursor) keyValue() ([]byte, []byte, uint32) {
 	return elem.key(), elem.value(), elem.flags
 }
 
+// value returns a value as stored in the bucket, decompressing it if needed.
+// A value that cannot be decompressed causes a panic with a *PageError for
+// the page the cursor is positioned on.
+func (c *Cursor) value(v []byte, flags uint32) []byte {
+	if (flags & compressedValueFlag) == 0 {
+		return v
+	}
+	v, err := decompressValue(c.bucket.compression, v)
+	if err != nil {
+		c.bucket.tx.raise(&PageError{ID: int(c.pgid()), Err: err})
+	}
+	return v
+}
+
+// pgid returns the id of the page the cursor is positioned on. For an inline
+// bucket this is the page of the parent bucket that holds it.
+func (c *Cursor) pgid() pgid {
+	if c.bucket.root == 0 {
+		return c.bucket.inlinePgid
+	}
+	ref := &c.stack[len(c.stack)-1]
+	if ref.node != nil {
+		return ref.node.pgid
+	}
+	return ref.page.id
+}
+
 // node returns the node that the cursor is currently positioned on.
 func (c *Cursor) node() *node {
 	_assert(len(c.stack) > 0, "accessing a node with a zero-length cursor stack")
@@ -1,13 +1,13 @@
 package dbolt
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -28,6 +28,9 @@ const (
 	FreelistArrayType = FreelistType("array")
 	// FreelistMapType indicates backend freelist type is hashmap
 	FreelistMapType = FreelistType("hashmap")
+	// FreelistExtentType indicates backend freelist type is a tree of
+	// extents of free pages
+	FreelistExtentType = FreelistType("extent")
 )
 
 // The largest step that can be taken when remapping the mmap.
@@ -47,7 +50,7 @@ type DB struct {
 
 	path     string
 	openFile func(string, int, os.FileMode) (*os.File, error)
-	file     *os.File
+	storage  Storage
 	dataref  []byte // mmap'ed readonly, write throws SEGV
 	data     *[consts.MaxMapSize]byte
 	datasz   int
@@ -55,6 +58,9 @@ type DB struct {
 	meta0    *meta
 	meta1    *meta
 	pageSize int
+	recovery RecoveryInfo
+	flags    uint32 // meta flags of the data file
+	trailer  int    // bytes reserved at the end of every data page span
 	opened   bool
 	rwtx     *Tx
 	txs      []*Tx
@@ -63,23 +69,33 @@ type DB struct {
 	freelist     *freelist
 	freelistLoad sync.Once
 
+	encryptor *encryptor
+	wal       *wal
+	snapshots map[string]snapshot // protected by metalock
+
 	pagePool sync.Pool
 
 	batchMu sync.Mutex
 	batch   *batch
 
-	rwlock   sync.Mutex   // Allows only one writer at a time.
+	rwlock   writerLock   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
 	statlock sync.RWMutex // Protects stats access.
 
 	ops struct {
 		writeAt func(b []byte, off int64) (n int, err error)
+		writev  func(bufs [][]byte, off int64) (n int, calls int, err error)
 	}
 
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
+
+	// noPunch is set once punching holes for free pages failed.
+	noPunch bool
+
+	watchdog *watchdog // checks the age of read-only transactions, or nil
 }
 
 // Path returns the path to currently open database file.
@@ -101,6 +117,10 @@ func (db *DB) String() string {
 // If the file does not exist then it will be created automatically.
 // Passing in nil options will cause Bolt to open the database with the default options.
 func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
+	if options != nil && options.InMemory {
+		return OpenMemory(options)
+	}
+
 	db := &DB{
 		opened:  true,
 		Options: options,
@@ -111,7 +131,7 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		db.Options = DefaultOptions
 	}
 
-	flag := os.O_RDWR // TODO: support multi-file storage
+	flag := os.O_RDWR
 	if db.Options.ReadOnly {
 		flag = os.O_RDONLY
 		db.readOnly = true
@@ -122,14 +142,33 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		db.openFile = os.OpenFile
 	}
 
-	// Open data file and separate sync handler for metadata writes.
-	var err error
-	if db.file, err = db.openFile(path, flag|os.O_CREATE, mode); err != nil {
+	// Open the data file, or the directory of segment files of a segmented
+	// database, unless a storage is provided.
+	if db.Options.Storage != nil {
+		db.storage = db.Options.Storage
+		db.path = path
+	} else if info, serr := os.Stat(path); db.Options.SegmentSize > 0 || (serr == nil && info.IsDir()) {
+		s, err := openSegments(path, db.Options.SegmentSize, flag|os.O_CREATE, mode, db.MmapFlags, db.openFile)
+		if err != nil {
+			_ = db.close()
+			return nil, err
+		}
+		db.storage = s
+		db.path = path
+	} else if f, err := db.openFile(path, flag|os.O_CREATE, mode); err != nil {
 		_ = db.close()
 		return nil, err
+	} else {
+		db.storage = &fileStorage{file: f, readOnly: db.readOnly, mmapFlags: db.MmapFlags}
+		db.path = f.Name()
 	}
-	db.path = db.file.Name()
+	_, logs := db.Options.Storage.(LogStorage)
+	return db.open(db.Options.Storage == nil || logs)
+}
 
+// open opens the database in db.storage, creating it if it is empty. The
+// write-ahead log is only used if wal is set.
+func (db *DB) open(wal bool) (*DB, error) {
 	// Lock file so that other processes using Bolt in read-write mode cannot
 	// use the database  at the same time. This would cause corruption since
 	// the two processes would write meta pages and free pages separately.
@@ -137,24 +176,35 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	// if !options.ReadOnly.
 	// The database file is locked using the shared lock (more than one process may
 	// hold a lock at the same time) otherwise (options.ReadOnly is set).
-	if err := flock(db, !db.readOnly, db.Options.Timeout); err != nil {
+	if err := db.storage.Lock(!db.readOnly, db.Options.Timeout); err != nil {
+		// Close without unlocking what is locked by someone else.
+		_ = db.storage.Close()
+		db.storage = nil
 		_ = db.close()
 		return nil, err
 	}
 
 	// Default values for test hooks
-	db.ops.writeAt = db.file.WriteAt
+	db.ops.writeAt = db.storage.WriteAt
+	db.ops.writev = func(bufs [][]byte, off int64) (int, int, error) {
+		return writev(db.storage, bufs, off)
+	}
 
 	if db.pageSize = db.Options.PageSize; db.pageSize == 0 {
 		// Set the default page size to the OS page size.
 		db.pageSize = defaultPageSize
 	}
 
+	if db.Options.Encryption != nil {
+		db.encryptor = newEncryptor(db.Options.Encryption)
+	}
+
 	// Initialize the database if it doesn't exist.
-	if info, err := db.file.Stat(); err != nil {
+	var probed bool
+	if size, err := db.storage.Size(); err != nil {
 		_ = db.close()
 		return nil, err
-	} else if info.Size() == 0 {
+	} else if size == 0 {
 		// Initialize new files with meta pages.
 		if err := db.init(); err != nil {
 			// clean up file descriptor on initialization fail
@@ -162,24 +212,23 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 			return nil, err
 		}
 	} else {
-		// Read the first meta page to determine the page size.
-		var buf [0x1000]byte
-		// If we can't read the page size, but can read a page, assume
-		// it's the same as the OS or one given -- since that's how the
-		// page size was chosen in the first place.
-		//
-		// If the first page is invalid and this OS uses a different
-		// page size than what the database was created with then we
-		// are out of luck and cannot access the database.
-		//
-		// TODO: scan for next page
-		if bw, err := db.file.ReadAt(buf[:], 0); err == nil && bw == len(buf) {
-			if m := db.pageInBuffer(buf[:], 0).meta(); m.validate() == nil {
-				db.pageSize = int(m.pageSize)
-			}
-		} else {
+		// Read the meta pages to determine the page size. If neither can be
+		// found, assume it's the same as the OS or one given -- since that's
+		// how the page size was chosen in the first place.
+		size, p, err := db.readPageSize()
+		if err != nil {
+			_ = db.close()
+			return nil, err
+		} else if size != 0 {
+			db.pageSize = size
+		}
+		probed = p
+	}
+
+	if s, ok := db.storage.(*segments); ok {
+		if err := s.check(db.pageSize); err != nil {
 			_ = db.close()
-			return nil, ErrInvalid
+			return nil, err
 		}
 	}
 
@@ -190,16 +239,62 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		},
 	}
 
+	// Read the write-ahead log, if any, so that its pages are seen by the
+	// mmap below.
+	if wal {
+		if err := db.openWAL(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
 	// Memory map the data file.
-	if err := db.mmap(db.Options.InitialMmapSize); err != nil {
+	minsz := db.Options.InitialMmapSize
+	if db.wal != nil {
+		if sz := db.wal.highWater(db.pageSize); sz > minsz {
+			minsz = sz
+		}
+	}
+	if err := db.mmap(minsz); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+	db.recordRecovery(probed)
+
+	// Make sure the encryption settings match the data file.
+	if err := db.checkEncryption(); err != nil {
 		_ = db.close()
 		return nil, err
 	}
 
+	if err := db.loadSnapshots(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	if db.MaxReadTxAge > 0 {
+		db.startWatchdog()
+	}
+
 	if db.readOnly {
 		return db, nil
 	}
 
+	// Fold a log left behind by a crash into the data file, and keep the
+	// log open only in WAL mode.
+	if db.wal != nil {
+		if err := db.checkpoint(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+		if db.WAL {
+			db.startCheckpointer()
+		} else {
+			_ = db.wal.close(db)
+			db.wal = nil
+		}
+	}
+
 	db.loadFreelist()
 
 	// Flush freelist when transitioning from no sync to sync so
@@ -225,13 +320,25 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 func (db *DB) loadFreelist() {
 	db.freelistLoad.Do(func() {
 		db.freelist = newFreelist(db.FreelistType)
+		db.freelist.snapshots = snapshotTxids(db.snapshots)
+		var held []pgid
 		if !db.hasSyncedFreelist() {
 			// Reconstruct free list by scanning the DB.
 			db.freelist.readIDs(db.freepages())
+			held = db.heldPages()
+		} else if p, err := db.readPage(db.meta().freelist); err != nil {
+			// The freelist page is damaged so rebuild it by scanning the DB.
+			db.freelist.readIDs(db.freepages())
+			held = db.heldPages()
 		} else {
 			// Read free list from freelist page.
-			db.freelist.read(db.page(db.meta().freelist))
+			db.freelist.read(p)
+			held = readHeld(p)
+			db.releasePage(p)
 		}
+
+		// Hold the pages only used by snapshots until they are dropped.
+		db.freelist.hold(db.meta().txid, held)
 		db.stats.FreePageN = db.freelist.free_count()
 	})
 }
@@ -245,16 +352,38 @@ func (db *DB) hasSyncedFreelist() bool {
 func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
+	return db.remap(minsz)
+}
 
-	info, err := db.file.Stat()
+// remap maps the data file like mmap. The caller must hold the mmap lock.
+func (db *DB) remap(minsz int) (err error) {
+	start := time.Now()
+	defer func() {
+		db.statlock.Lock()
+		db.stats.RemapN++
+		db.stats.RemapTime += time.Since(start)
+		db.stats.MmapSize = db.datasz
+		db.statlock.Unlock()
+
+		if db.Tracer != nil {
+			s := span(db.rwtxid(), start)
+			s.Bytes, s.Err = int64(db.datasz), err
+			db.Tracer.Remap(s)
+		}
+	}()
+
+	fileSize, err := db.fileSize()
 	if err != nil {
 		return fmt.Errorf("mmap stat error: %s", err)
-	} else if int(info.Size()) < db.pageSize*2 {
+	} else if fileSize < db.pageSize*2 {
 		return fmt.Errorf("file size too small")
 	}
 
+	db.statlock.Lock()
+	db.stats.FileSize = fileSize
+	db.statlock.Unlock()
+
 	// Ensure the size is at least the minimum size.
-	fileSize := int(info.Size())
 	size := fileSize
 	if size < minsz {
 		size = minsz
@@ -282,9 +411,13 @@ func (db *DB) mmap(minsz int) error {
 	}
 
 	// Memory-map the data file as a byte slice.
-	if err := mmap(db, size); err != nil {
+	b, err := db.storage.Mmap(size)
+	if err != nil {
 		return err
 	}
+	db.dataref = b
+	db.data = (*[consts.MaxMapSize]byte)(unsafe.Pointer(&b[0]))
+	db.datasz = size
 
 	if db.Mlock {
 		// Don't allow swapping of data file
@@ -306,12 +439,39 @@ func (db *DB) mmap(minsz int) error {
 		return err0
 	}
 
+	// A meta page written with a feature this binary does not know must not
+	// be passed over for the other one, which would lose the transactions
+	// committed since.
+	if err0 == ErrUnsupportedFeature {
+		return err0
+	} else if err1 == ErrUnsupportedFeature {
+		return err1
+	}
+	db.flags = db.meta().flags
+	db.trailer = db.meta().trailerSize()
+
 	return nil
 }
 
+// fileSize returns the size of the data file on disk, over all segments of a
+// segmented database.
+func (db *DB) fileSize() (int, error) {
+	sz, err := db.storage.Size()
+	return int(sz), err
+}
+
 // munmap unmaps the data file from memory.
 func (db *DB) munmap() error {
-	if err := munmap(db); err != nil {
+	// Ignore the unmap if we have no mapped data.
+	if db.dataref == nil {
+		return nil
+	}
+
+	err := db.storage.Munmap(db.dataref)
+	db.dataref = nil
+	db.data = nil
+	db.datasz = 0
+	if err != nil {
 		return fmt.Errorf("unmap error: " + err.Error())
 	}
 	return nil
@@ -396,8 +556,18 @@ func (db *DB) init() error {
 		m.root = bucket{root: 3}
 		m.pgid = 4
 		m.txid = txid(i)
+		if db.PageChecksum {
+			m.flags |= metaFlagPageChecksum
+		}
+		if db.PageTxid {
+			m.flags |= metaFlagPageTxid
+		}
+		if db.encryptor != nil {
+			m.flags |= metaFlagEncrypted
+		}
 		m.checksum = m.sum64()
 	}
+	trailer := db.pageInBuffer(buf, 0).meta().trailerSize()
 
 	// Write an empty freelist at page 3.
 	p := db.pageInBuffer(buf, pgid(2))
@@ -411,11 +581,27 @@ func (db *DB) init() error {
 	p.flags = leafPageFlag
 	p.count = 0
 
+	// Seal the freelist and leaf pages if they carry a trailer.
+	db.flags = db.pageInBuffer(buf, 0).meta().flags
+	db.trailer = trailer
+	for i := pgid(2); i < 4; i++ {
+		if err := db.sealPage(db.pageInBuffer(buf, i), 0); err != nil {
+			return err
+		}
+	}
+	if db.encryptor != nil {
+		for i := pgid(0); i < 2; i++ {
+			m := db.pageInBuffer(buf, i).meta()
+			db.encryptor.record(m)
+			m.checksum = m.sum64()
+		}
+	}
+
 	// Write the buffer to our data file.
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
 	}
-	if err := fdatasync(db); err != nil {
+	if err := db.storage.Sync(); err != nil {
 		return err
 	}
 	db.filesz = len(buf)
@@ -427,16 +613,28 @@ func (db *DB) init() error {
 // It will block waiting for any open transactions to finish
 // before closing the database and returning.
 func (db *DB) Close() error {
+	db.wal.stopCheckpointer()
+	db.watchdog.stopWatchdog()
+
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
+	// Leave a data file that is complete without the write-ahead log.
+	var err error
+	if db.opened && !db.readOnly {
+		err = db.checkpoint()
+	}
+
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
 
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
-	return db.close()
+	if cerr := db.close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (db *DB) close() error {
@@ -450,27 +648,35 @@ func (db *DB) close() error {
 
 	// Clear ops.
 	db.ops.writeAt = nil
+	db.ops.writev = nil
 
 	// Close the mmap.
 	if err := db.munmap(); err != nil {
 		return err
 	}
 
-	// Close file handles.
-	if db.file != nil {
+	// Close the write-ahead log.
+	if db.wal != nil {
+		if err := db.wal.close(db); err != nil {
+			return fmt.Errorf("wal close: %s", err)
+		}
+		db.wal = nil
+	}
+
+	// Close the storage.
+	if db.storage != nil {
 		// No need to unlock read-only file.
 		if !db.readOnly {
 			// Unlock the file.
-			if err := funlock(db); err != nil {
-				log.Printf("bolt.Close(): funlock error: %s", err)
+			if err := db.storage.Unlock(); err != nil {
+				db.logger().Printf("bolt.Close(): funlock error: %s", err)
 			}
 		}
 
-		// Close the file descriptor.
-		if err := db.file.Close(); err != nil {
+		if err := db.storage.Close(); err != nil {
 			return fmt.Errorf("db file close: %s", err)
 		}
-		db.file = nil
+		db.storage = nil
 	}
 
 	db.path = ""
@@ -494,14 +700,47 @@ func (db *DB) close() error {
 //
 // IMPORTANT: You must close read-only transactions after you are finished or
 // else the database will not reclaim old pages.
+//
+// Reads that find a damaged page, such as one failing its checksum or lying
+// past the end of the file, panic with a *PageError, and reads through a
+// read-only transaction invalidated under Options.InvalidateLongReadTx panic
+// with ErrTxInvalidated. View, Update, Bucket.ForEach and the functions that
+// take a Tx, such as Export and DiffTx, return them as errors; other reads
+// through a transaction begun here do not, unless they are made within Tx.Do.
 func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.BeginContext(context.Background(), writable)
+}
+
+// BeginContext starts a new transaction like Begin, but stops waiting for the
+// writer lock and returns ctx.Err() once ctx is done. The transaction keeps ctx
+// for functions to check with Tx.Context; it is not rolled back when ctx is
+// done.
+func (db *DB) BeginContext(ctx context.Context, writable bool) (*Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var t *Tx
+	var err error
 	if writable {
-		return db.beginRWTx()
+		t, err = db.beginRWTx(ctx)
+	} else {
+		t, err = db.beginTx()
 	}
-	return db.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	t.ctx = ctx
+	return t, nil
 }
 
 func (db *DB) beginTx() (*Tx, error) {
+	return db.beginReadTx("")
+}
+
+// beginReadTx starts a read-only transaction on the latest version of the
+// database, or on the version saved by the named snapshot.
+func (db *DB) beginReadTx(snapshot string) (*Tx, error) {
 	// Lock the meta pages while we initialize the transaction. We obtain
 	// the meta lock before the mmap lock because that's the order that the
 	// write transaction will obtain them.
@@ -522,6 +761,22 @@ func (db *DB) beginTx() (*Tx, error) {
 	// Create a transaction associated with the database.
 	t := &Tx{}
 	t.init(db)
+	if snapshot != "" {
+		s, ok := db.snapshots[snapshot]
+		if !ok {
+			db.mmaplock.RUnlock()
+			db.metalock.Unlock()
+			return nil, ErrSnapshotNotFound
+		}
+
+		// The snapshot has no freelist or snapshots of its own.
+		t.meta.root = bucket{root: s.root}
+		t.meta.pgid = s.pgid
+		t.meta.txid = s.txid
+		t.meta.freelist = pgidNoFreelist
+		t.meta.setSnapshotDirectory(0)
+		*t.root.bucket = t.meta.root
+	}
 
 	// Keep track of transaction until it closes.
 	db.txs = append(db.txs, t)
@@ -536,26 +791,43 @@ func (db *DB) beginTx() (*Tx, error) {
 	db.stats.OpenTxN = n
 	db.statlock.Unlock()
 
+	if db.Tracer != nil {
+		db.Tracer.TxBegin(t.info())
+	}
 	return t, nil
 }
 
-func (db *DB) beginRWTx() (*Tx, error) {
+func (db *DB) beginRWTx(ctx context.Context) (*Tx, error) {
 	// If the database was opened with Options.ReadOnly, return an error.
 	if db.readOnly {
 		return nil, ErrDatabaseReadOnly
 	}
 
+	// A DB that was never opened has no options, the tracer among them.
+	if db.Options == nil {
+		return nil, ErrDatabaseNotOpen
+	}
+
 	// Obtain writer lock. This is released by the transaction when it closes.
 	// This enforces only one writer transaction at a time.
-	db.rwlock.Lock()
+	start := time.Now()
+	err := db.rwlock.LockContext(ctx)
+	if db.Tracer != nil {
+		s := span(0, start)
+		s.Err = err
+		db.Tracer.WriterLockWait(s)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	// Once we have the writer lock then we can lock the meta pages so that
 	// we can set up the transaction.
 	db.metalock.Lock()
-	defer db.metalock.Unlock()
 
 	// Exit if the database is not open yet.
 	if !db.opened {
+		db.metalock.Unlock()
 		db.rwlock.Unlock()
 		return nil, ErrDatabaseNotOpen
 	}
@@ -564,35 +836,132 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	t := &Tx{writable: true}
 	t.init(db)
 	db.rwtx = t
-	db.freePages()
+	released := db.freePages()
+	db.metalock.Unlock()
+
+	// Punch the released pages before the transaction can reuse them.
+	if db.PunchFreePages && !db.readOnly {
+		db.punchFreePages(released)
+	}
+	if db.Tracer != nil {
+		db.Tracer.TxBegin(t.info())
+	}
 	return t, nil
 }
 
 // freePages releases any pages associated with closed read-only transactions.
-func (db *DB) freePages() {
+// Snapshots hold on to their pages like open read-only transactions. It
+// returns the ids released.
+func (db *DB) freePages() pgids {
+	open := make(txids, 0, len(db.txs)+len(db.snapshots))
+	for _, t := range db.txs {
+		open = append(open, t.meta.txid)
+	}
+	for _, s := range db.snapshots {
+		open = append(open, s.txid)
+	}
+
 	// Free all pending pages prior to earliest open transaction.
-	sort.Sort(txsById(db.txs))
+	sort.Sort(open)
 	minid := txid(0xFFFFFFFFFFFFFFFF)
-	if len(db.txs) > 0 {
-		minid = db.txs[0].meta.txid
+	if len(open) > 0 {
+		minid = open[0]
 	}
+	var released pgids
 	if minid > 0 {
-		db.freelist.release(minid - 1)
+		released = append(released, db.freelist.release(minid-1)...)
 	}
 	// Release unused txid extents.
-	for _, t := range db.txs {
-		db.freelist.releaseRange(minid, t.meta.txid-1)
-		minid = t.meta.txid + 1
+	for _, id := range open {
+		released = append(released, db.freelist.releaseRange(minid, id-1)...)
+		minid = id + 1
 	}
-	db.freelist.releaseRange(minid, txid(0xFFFFFFFFFFFFFFFF))
+	released = append(released, db.freelist.releaseRange(minid, txid(0xFFFFFFFFFFFFFFFF))...)
 	// Any page both allocated and freed in an extent is safe to release.
+	return released
+}
+
+// punchMinPages is the shortest run of released pages that PunchFreePages
+// deallocates.
+const punchMinPages = 16
+
+// punchFreePages deallocates the disk blocks of the runs of at least
+// punchMinPages contiguous ids in released, if the storage supports it.
+// Punching is best effort: the pages are free either way, so it stops for good
+// at the first error, as on filesystems without hole support.
+func (db *DB) punchFreePages(released pgids) {
+	p, ok := db.storage.(holePuncher)
+	if !ok || db.noPunch || len(released) < punchMinPages {
+		return
+	}
+	sort.Sort(released)
+
+	var punched int
+	for i := 0; i < len(released); {
+		j := i + 1
+		for j < len(released) && released[j] == released[j-1]+1 {
+			j++
+		}
+		if j-i >= punchMinPages {
+			off, size := int64(released[i])*int64(db.pageSize), int64(j-i)*int64(db.pageSize)
+			if err := p.punchHole(off, size); err != nil {
+				db.noPunch = true
+				break
+			}
+			punched += int(size)
+		}
+		i = j
+	}
+
+	db.statlock.Lock()
+	db.stats.PunchedBytes += punched
+	db.statlock.Unlock()
+}
+
+// writerLock is a mutex whose Lock can be given up when a context is done.
+// The zero value is unlocked.
+type writerLock struct {
+	once sync.Once
+	ch   chan struct{} // holds a value while locked
+}
+
+func (l *writerLock) init() {
+	l.once.Do(func() { l.ch = make(chan struct{}, 1) })
+}
+
+// Lock locks l, waiting until it is unlocked.
+func (l *writerLock) Lock() {
+	l.init()
+	l.ch <- struct{}{}
 }
 
-type txsById []*Tx
+// LockContext locks l like Lock, but returns ctx.Err() without locking l once
+// ctx is done.
+func (l *writerLock) LockContext(ctx context.Context) error {
+	l.init()
+	select {
+	case l.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks l. It panics if l is not locked.
+func (l *writerLock) Unlock() {
+	l.init()
+	select {
+	case <-l.ch:
+	default:
+		panic("bolt: unlock of unlocked writer lock")
+	}
+}
+
+type txids []txid
 
-func (t txsById) Len() int           { return len(t) }
-func (t txsById) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t txsById) Less(i, j int) bool { return t[i].meta.txid < t[j].meta.txid }
+func (t txids) Len() int           { return len(t) }
+func (t txids) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t txids) Less(i, j int) bool { return t[i] < t[j] }
 
 // removeTx removes a transaction from the database.
 func (db *DB) removeTx(tx *Tx) {
@@ -631,8 +1000,18 @@ func (db *DB) removeTx(tx *Tx) {
 // returned from the Update() method.
 //
 // Attempting to manually commit or rollback within the function will cause a panic.
-func (db *DB) Update(fn func(*Tx) error) error {
-	t, err := db.Begin(true)
+func (db *DB) Update(fn func(*Tx) error) (err error) {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext executes a function within the context of a read-write managed
+// transaction like Update. It stops waiting for the writer lock once ctx is
+// done, and rolls the transaction back instead of committing it if ctx is done
+// by the time the function returns. In both cases it returns ctx.Err().
+//
+// The function can check ctx through Tx.Context during long iterations.
+func (db *DB) UpdateContext(ctx context.Context, fn func(*Tx) error) (err error) {
+	t, err := db.BeginContext(ctx, true)
 	if err != nil {
 		return err
 	}
@@ -643,6 +1022,7 @@ func (db *DB) Update(fn func(*Tx) error) error {
 			t.rollback()
 		}
 	}()
+	defer recoverPageError(&err, t)
 
 	// Mark as a managed tx so that the inner function cannot manually commit.
 	t.managed = true
@@ -650,6 +1030,9 @@ func (db *DB) Update(fn func(*Tx) error) error {
 	// If an error is returned from the function then rollback and return error.
 	err = fn(t)
 	t.managed = false
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		_ = t.Rollback()
 		return err
@@ -662,8 +1045,16 @@ func (db *DB) Update(fn func(*Tx) error) error {
 // Any error that is returned from the function is returned from the View() method.
 //
 // Attempting to manually rollback within the function will cause a panic.
-func (db *DB) View(fn func(*Tx) error) error {
-	t, err := db.Begin(false)
+func (db *DB) View(fn func(*Tx) error) (err error) {
+	return db.ViewContext(context.Background(), fn)
+}
+
+// ViewContext executes a function within the context of a managed read-only
+// transaction like View. It returns ctx.Err() without calling the function if
+// ctx is already done; the function can check ctx through Tx.Context during
+// long iterations.
+func (db *DB) ViewContext(ctx context.Context, fn func(*Tx) error) (err error) {
+	t, err := db.BeginContext(ctx, false)
 	if err != nil {
 		return err
 	}
@@ -674,6 +1065,7 @@ func (db *DB) View(fn func(*Tx) error) error {
 			t.rollback()
 		}
 	}()
+	defer recoverPageError(&err, t)
 
 	// Mark as a managed tx so that the inner function cannot manually rollback.
 	t.managed = true
@@ -689,6 +1081,32 @@ func (db *DB) View(fn func(*Tx) error) error {
 	return t.Rollback()
 }
 
+// recoverPageError converts the *PageError or ErrTxInvalidated panic one of
+// txs raised while reading the data file into an error returned to the
+// caller. Nothing is recovered unless one of txs raised such a panic, so that
+// any other panic propagates from where it happened.
+func recoverPageError(err *error, txs ...*Tx) {
+	raised := false
+	for _, tx := range txs {
+		raised = raised || tx.raised != nil
+	}
+	if !raised {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	for _, tx := range txs {
+		if e := tx.raised; e != nil && r == e {
+			tx.raised = nil
+			*err = e
+			return
+		}
+	}
+	panic(r)
+}
+
 // Batch calls fn as part of a batch. It behaves similar to Update,
 // except:
 //
@@ -707,7 +1125,19 @@ func (db *DB) View(fn func(*Tx) error) error {
 //
 // Batch is only useful when there are multiple goroutines calling it.
 func (db *DB) Batch(fn func(*Tx) error) error {
+	return db.BatchContext(context.Background(), fn)
+}
+
+// BatchContext calls fn as part of a batch like Batch. Once ctx is done before
+// the batch calls fn, fn is left out of the batch and BatchContext returns
+// ctx.Err(). Once the batch has called fn, BatchContext waits for the batch
+// to commit as Batch does.
+func (db *DB) BatchContext(ctx context.Context, fn func(*Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	errCh := make(chan error, 1)
+	state := new(int32)
 
 	db.batchMu.Lock()
 	if (db.batch == nil) || (db.batch != nil && len(db.batch.calls) >= db.MaxBatchSize) {
@@ -717,23 +1147,46 @@ func (db *DB) Batch(fn func(*Tx) error) error {
 		}
 		db.batch.timer = time.AfterFunc(db.MaxBatchDelay, db.batch.trigger)
 	}
-	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh})
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh, state: state})
 	if len(db.batch.calls) >= db.MaxBatchSize {
 		// wake up batch, it's ready to run
 		go db.batch.trigger()
 	}
 	db.batchMu.Unlock()
 
-	err := <-errCh
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		// Leave the batch unless it has already called fn.
+		if atomic.CompareAndSwapInt32(state, callWaiting, callAbandoned) {
+			return ctx.Err()
+		}
+		err = <-errCh
+	}
 	if err == trySolo {
-		err = db.Update(fn)
+		err = db.UpdateContext(ctx, fn)
 	}
 	return err
 }
 
+// The states of a call.
+const (
+	callWaiting   = iota // the batch has not called fn yet
+	callClaimed          // the batch calls fn, and its caller waits for the result
+	callAbandoned        // the caller gave up, and the batch must not call fn
+)
+
 type call struct {
-	fn  func(*Tx) error
-	err chan<- error
+	fn    func(*Tx) error
+	err   chan<- error
+	state *int32
+}
+
+// claim reports whether the batch may call c.fn, keeping the caller waiting
+// for its result.
+func (c call) claim() bool {
+	return atomic.CompareAndSwapInt32(c.state, callWaiting, callClaimed) || atomic.LoadInt32(c.state) == callClaimed
 }
 
 type batch struct {
@@ -764,6 +1217,16 @@ retry:
 	for len(b.calls) > 0 {
 		failIdx := -1
 		err := b.db.Update(func(tx *Tx) error {
+			// Drop the calls whose callers gave up while the batch waited
+			// for the writer lock.
+			calls := b.calls[:0]
+			for _, c := range b.calls {
+				if c.claim() {
+					calls = append(calls, c)
+				}
+			}
+			b.calls = calls
+
 			for i, c := range b.calls {
 				if err := safelyCall(c.fn, tx); err != nil {
 					failIdx = i
@@ -821,10 +1284,45 @@ func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
 //
 // This is not necessary under normal operation, however, if you use NoSync
 // then it allows you to force the database file to sync against the disk.
-func (db *DB) Sync() error { return fdatasync(db) }
+func (db *DB) Sync() error {
+	if db.wal != nil {
+		if err := db.timedSync(0, db.wal.sync); err != nil {
+			return err
+		}
+	}
+	return db.timedSync(0, db.storage.Sync)
+}
+
+// timedSync calls sync, counting it in the stats and reporting it to the
+// tracer, if any, as a sync made by the writable transaction txid.
+func (db *DB) timedSync(txid txid, sync func() error) error {
+	start := time.Now()
+	err := sync()
+	d := time.Since(start)
+
+	db.statlock.Lock()
+	db.stats.SyncN++
+	db.stats.SyncTime += d
+	db.statlock.Unlock()
+
+	if db.Tracer != nil {
+		s := span(txid, start)
+		s.Err = err
+		db.Tracer.Sync(s)
+	}
+	return err
+}
+
+// addWritten counts n bytes written to the data file or the log in the stats.
+func (db *DB) addWritten(n int) {
+	db.statlock.Lock()
+	db.stats.WriteBytes += int64(n)
+	db.statlock.Unlock()
+}
 
 // Stats retrieves ongoing performance stats for the database.
-// This is only updated when a transaction closes.
+// Transaction stats are updated when a transaction closes, and storage stats
+// as they change.
 func (db *DB) Stats() Stats {
 	db.statlock.RLock()
 	defer db.statlock.RUnlock()
@@ -839,10 +1337,82 @@ func (db *DB) Info() *Info {
 
 // page retrieves a page reference from the mmap based on the current page size.
 func (db *DB) page(id pgid) *page {
+	// Pages in the write-ahead log take precedence over the data file.
+	if p := db.wal.page(id); p != nil {
+		return p
+	}
 	pos := id * pgid(db.pageSize)
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
 
+// readPage returns the page at id ready to be read by a transaction. Pages
+// are checked to be within the mmap, before anything is read from them, and
+// to carry the expected id. They are then decrypted into a buffer for
+// encrypted databases and verified against their checksum if page checksums
+// are enabled. Meta pages are protected by their own checksum and are
+// returned directly from the mmap.
+func (db *DB) readPage(id pgid) (*page, error) {
+	// Pages in the write-ahead log are whole, wherever the mmap ends.
+	p := db.wal.page(id)
+	if p == nil {
+		// Compare page counts so that a huge id cannot overflow.
+		n := pgid(db.datasz / db.pageSize)
+		if id >= n {
+			return nil, &PageError{ID: int(id), Err: fmt.Errorf("out of bounds: %d", n)}
+		}
+		p = db.page(id)
+		if id <= 1 {
+			return p, nil
+		}
+		if pgid(p.overflow) >= n-id {
+			return nil, &PageError{ID: int(id), Err: fmt.Errorf("overflow %d out of bounds", p.overflow)}
+		}
+	} else if id <= 1 {
+		return p, nil
+	}
+	if p.id != id {
+		return nil, &PageError{ID: int(id), Err: fmt.Errorf("unexpected page id %d", p.id)}
+	}
+	if db.trailer == 0 {
+		return p, nil
+	}
+	if db.encryptor != nil {
+		var err error
+		if p, err = db.decryptPage(p); err != nil {
+			return nil, &PageError{ID: int(id), Err: err}
+		}
+	}
+	if sz := db.checksumTrailer(); db.flags&metaFlagPageChecksum != 0 && p.checksum(db.pageSize, sz) != p.sum32(db.pageSize, sz) {
+		return nil, &PageError{ID: int(id), Err: ErrChecksum}
+	}
+	return p, nil
+}
+
+// sealPage fills in the trailer of a dirty page written by transaction id
+// right before it is written: the transaction id is recorded, the checksum is
+// computed over the final content and the page is then encrypted in place.
+func (db *DB) sealPage(p *page, id txid) error {
+	if db.flags&metaFlagPageTxid != 0 {
+		p.setTxid(db.pageSize, db.trailer, id)
+	}
+	if db.flags&metaFlagPageChecksum != 0 {
+		p.setChecksum(db.pageSize, db.checksumTrailer())
+	}
+	if db.encryptor != nil {
+		return db.encryptor.seal(p.span(db.pageSize))
+	}
+	return nil
+}
+
+// checksumTrailer returns the size of the page trailer from the checksum on.
+// The transaction id comes before the checksum so that it is covered by it.
+func (db *DB) checksumTrailer() int {
+	if db.flags&metaFlagPageTxid != 0 {
+		return db.trailer - pageTxidSize
+	}
+	return db.trailer
+}
+
 // pageInBuffer retrieves a page reference from a given byte array based on the current page size.
 func (db *DB) pageInBuffer(b []byte, id pgid) *page {
 	return (*page)(unsafe.Pointer(&b[id*pgid(db.pageSize)]))
@@ -884,8 +1454,13 @@ func (db *DB) allocate(txid txid, count int) (*page, error) {
 	p := (*page)(unsafe.Pointer(&buf[0]))
 	p.overflow = uint32(count - 1)
 
-	// Use pages from the freelist if they are available.
-	if p.id = db.freelist.allocate(txid, count); p.id != 0 {
+	// Use pages from the freelist if they are available. Shrink takes the
+	// lowest ones so that pages move towards the start of the file.
+	allocate := db.freelist.allocate
+	if db.rwtx != nil && db.rwtx.shrinking {
+		allocate = db.freelist.allocateLowest
+	}
+	if p.id = allocate(txid, count); p.id != 0 {
 		return p, nil
 	}
 
@@ -898,19 +1473,31 @@ func (db *DB) allocate(txid txid, count int) (*page, error) {
 		}
 	}
 
-	// Move the page id high water mark.
+	// Move the page id high water mark. The allocation is recorded like
+	// those from the freelist so that releaseRange can free the pages while
+	// older transactions or snapshots are open.
 	db.rwtx.meta.pgid += pgid(count)
+	db.freelist.allocs[p.id] = txid
 
 	return p, nil
 }
 
 // grow grows the size of the database to the given sz.
-func (db *DB) grow(sz int) error {
+func (db *DB) grow(sz int) (err error) {
 	// Ignore if the new size is less than available file size.
 	if sz <= db.filesz {
 		return nil
 	}
 
+	if db.Tracer != nil {
+		start := time.Now()
+		defer func() {
+			s := span(db.rwtxid(), start)
+			s.Bytes, s.Err = int64(db.filesz), err
+			db.Tracer.Grow(s)
+		}()
+	}
+
 	// If the data is smaller than the alloc size then only allocate what's needed.
 	// Once it goes over the allocation size then allocate in chunks.
 	if db.datasz < db.AllocSize {
@@ -922,12 +1509,10 @@ func (db *DB) grow(sz int) error {
 	// Truncate and fsync to ensure file size metadata is flushed.
 	// https://github.com/boltdb/bolt/issues/284
 	if !db.NoGrowSync && !db.readOnly {
-		if runtime.GOOS != "windows" {
-			if err := db.file.Truncate(int64(sz)); err != nil {
-				return fmt.Errorf("file resize error: %s", err)
-			}
+		if err := db.storage.Truncate(int64(sz)); err != nil {
+			return fmt.Errorf("file resize error: %s", err)
 		}
-		if err := db.file.Sync(); err != nil {
+		if err := db.timedSync(db.rwtxid(), db.storage.Sync); err != nil {
 			return fmt.Errorf("file sync error: %s", err)
 		}
 		if db.Mlock {
@@ -936,12 +1521,27 @@ func (db *DB) grow(sz int) error {
 				return fmt.Errorf("mlock/munlock error: %s", err)
 			}
 		}
+
+		db.statlock.Lock()
+		db.stats.GrowN++
+		db.stats.GrowBytes += int64(sz - db.filesz)
+		db.stats.FileSize = sz
+		db.statlock.Unlock()
 	}
 
 	db.filesz = sz
 	return nil
 }
 
+// maxWriteBatchSize returns the largest number of bytes written by a single
+// vectored write on commit.
+func (db *DB) maxWriteBatchSize() int {
+	if db.MaxWriteBatchSize > 0 {
+		return db.MaxWriteBatchSize
+	}
+	return DefaultMaxWriteBatchSize
+}
+
 func (db *DB) IsReadOnly() bool {
 	return db.readOnly
 }
@@ -958,20 +1558,21 @@ func (db *DB) freepages() []pgid {
 		panic("freepages: failed to open read only tx")
 	}
 
-	reachable := make(map[pgid]*page)
-	nofreed := make(map[pgid]bool)
-	ech := make(chan error)
-	go func() {
-		for e := range ech {
-			panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", e))
+	// Only the kinds of inconsistency that stop the walk from descending
+	// into a page leave the set of reachable pages incomplete. Keys out of
+	// order or pages referenced twice do not, so the database still opens.
+	c := tx.newChecker(CheckOptions{SkipFreelist: true}, func(err *CheckError) {
+		switch err.Kind {
+		case CheckInvalidType, CheckOutOfBounds, CheckUnreadable:
+			panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", err))
 		}
-	}()
-	tx.checkBucket(&tx.root, reachable, nofreed, ech)
-	close(ech)
+	})
+	c.walkBuckets()
+	tx.snapshotDirectory(c.reachable)
 
 	var fids []pgid
 	for i := pgid(2); i < db.meta().pgid; i++ {
-		if _, ok := reachable[i]; !ok {
+		if _, ok := c.reachable[i]; !ok {
 			fids = append(fids, i)
 		}
 	}
@@ -985,11 +1586,25 @@ type Stats struct {
 	PendingPageN  int // total number of pending pages on the freelist
 	FreeAlloc     int // total bytes allocated in free pages
 	FreelistInuse int // total bytes used by the freelist
+	PunchedBytes  int // total bytes of free pages punched out of the data file
 
 	// Transaction stats
 	TxN     int // total number of started read transactions
 	OpenTxN int // number of currently open read transactions
 
+	// Storage stats
+	SyncN         int           // total number of syncs of the data file and the log
+	SyncTime      time.Duration // total time spent syncing
+	WriteBytes    int64         // total bytes written to the data file and the log
+	RemapN        int           // total number of times the data file was mapped
+	RemapTime     time.Duration // total time spent mapping, with the mmap lock held
+	GrowN         int           // total number of times the data file was grown
+	GrowBytes     int64         // total bytes the data file was grown by
+	TruncateN     int           // total number of times Shrink truncated the data file
+	TruncateBytes int64         // total bytes Shrink truncated off the data file
+	MmapSize      int           // current size of the mmap
+	FileSize      int           // size of the data file as of the last map, grow or truncate
+
 	TxStats TxStats // global, ongoing stats.
 }
 
@@ -1005,7 +1620,19 @@ func (s *Stats) Sub(other *Stats) Stats {
 	diff.PendingPageN = s.PendingPageN
 	diff.FreeAlloc = s.FreeAlloc
 	diff.FreelistInuse = s.FreelistInuse
+	diff.PunchedBytes = s.PunchedBytes - other.PunchedBytes
 	diff.TxN = s.TxN - other.TxN
+	diff.SyncN = s.SyncN - other.SyncN
+	diff.SyncTime = s.SyncTime - other.SyncTime
+	diff.WriteBytes = s.WriteBytes - other.WriteBytes
+	diff.RemapN = s.RemapN - other.RemapN
+	diff.RemapTime = s.RemapTime - other.RemapTime
+	diff.GrowN = s.GrowN - other.GrowN
+	diff.GrowBytes = s.GrowBytes - other.GrowBytes
+	diff.TruncateN = s.TruncateN - other.TruncateN
+	diff.TruncateBytes = s.TruncateBytes - other.TruncateBytes
+	diff.MmapSize = s.MmapSize
+	diff.FileSize = s.FileSize
 	diff.TxStats = s.TxStats.Sub(&other.TxStats)
 	return diff
 }
@@ -0,0 +1,141 @@
+package dbolt
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// memory is the Storage of an in-memory database. The buffer doubles as the
+// mmap, so it is only replaced while the mmap is being remapped.
+type memory struct {
+	mu   sync.Mutex // protects buf and size
+	buf  []byte
+	size int64 // size of the data file; bytes past the buffer are zero
+}
+
+// ReadAt reads from the data file offset off. It implements io.ReaderAt.
+func (m *memory) ReadAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	n = len(b)
+	if int64(n) > m.size-off {
+		n = int(m.size - off)
+	}
+	var copied int
+	if off < int64(len(m.buf)) {
+		copied = copy(b[:n], m.buf[off:])
+	}
+	for i := copied; i < n; i++ {
+		b[i] = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes b at the data file offset off. The buffer only grows here
+// before the database is mapped; afterwards the mmap covers every write.
+func (m *memory) WriteAt(b []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	end := off + int64(len(b))
+	if end > int64(len(m.buf)) {
+		m.resize(int(end))
+	}
+	if end > m.size {
+		m.size = end
+	}
+	return copy(m.buf[off:], b), nil
+}
+
+// writev writes bufs at the data file offset off. It counts as one call.
+func (m *memory) writev(bufs [][]byte, off int64) (n int, calls int, err error) {
+	for _, b := range bufs {
+		nn, err := m.WriteAt(b, off+int64(n))
+		n += nn
+		if err != nil {
+			return n, 1, err
+		}
+	}
+	return n, 1, nil
+}
+
+// Truncate changes the size of the data file to sz bytes. The buffer is left
+// in place since it may be mapped, but the bytes cut off are cleared so that
+// they read as zero once the file grows again.
+func (m *memory) Truncate(sz int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := sz; i < int64(len(m.buf)); i++ {
+		m.buf[i] = 0
+	}
+	m.size = sz
+	return nil
+}
+
+// Size returns the size of the data file.
+func (m *memory) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size, nil
+}
+
+// resize moves the data into a buffer of sz bytes. m.mu must be held.
+func (m *memory) resize(sz int) {
+	buf := make([]byte, sz)
+	copy(buf, m.buf)
+	m.buf = buf
+}
+
+// Mmap returns the buffer, growing it to sz bytes.
+func (m *memory) Mmap(sz int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sz > len(m.buf) {
+		m.resize(sz)
+	}
+	return m.buf[:sz], nil
+}
+
+// The buffer is neither synced, locked, unmapped nor closed.
+func (m *memory) Sync() error                        { return nil }
+func (m *memory) Lock(_ bool, _ time.Duration) error { return nil }
+func (m *memory) Unlock() error                      { return nil }
+func (m *memory) Munmap(_ []byte) error              { return nil }
+func (m *memory) Close() error                       { return nil }
+
+// OpenMemory creates a database that is kept in memory and never touches the
+// filesystem: there is no file lock and nothing is synced. It is gone once
+// closed, but Tx.WriteTo and Tx.CopyFile still write a regular database file.
+// Passing in nil options will cause Bolt to open the database with the
+// default options. The ReadOnly, SegmentSize and WAL options are ignored.
+func OpenMemory(options *Options) (*DB, error) {
+	db := &DB{
+		opened:  true,
+		Options: options,
+	}
+
+	// Set default options if no options are provided.
+	if db.Options == nil {
+		db.Options = DefaultOptions
+	}
+
+	// Files are only opened to copy the database out.
+	db.openFile = db.Options.OpenFile
+	if db.openFile == nil {
+		db.openFile = os.OpenFile
+	}
+
+	db.storage = &memory{}
+	return db.open(false)
+}
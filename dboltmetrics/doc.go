@@ -0,0 +1,6 @@
+// Package dboltmetrics exports the statistics of a dbolt database.
+//
+// Publish makes them available through the expvar package, and Handler
+// serves them in the Prometheus text exposition format. Both read DB.Stats
+// anew on every request.
+package dboltmetrics
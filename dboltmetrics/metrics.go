@@ -0,0 +1,110 @@
+package dboltmetrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "github.com/c0mm4nd/dbolt"
+)
+
+// metric is a value derived from the stats of a database.
+type metric struct {
+	name    string // name without the prefix, in snake case
+	counter bool   // whether the value only grows
+	help    string
+	value   func(s *bolt.Stats) float64
+}
+
+func seconds(d time.Duration) float64 { return d.Seconds() }
+
+// metrics are the exported stats, in the order they are written.
+var metrics = []metric{
+	{"free_pages", false, "Number of free pages on the freelist.", func(s *bolt.Stats) float64 { return float64(s.FreePageN) }},
+	{"pending_pages", false, "Number of pending pages on the freelist.", func(s *bolt.Stats) float64 { return float64(s.PendingPageN) }},
+	{"free_alloc_bytes", false, "Bytes allocated in free pages.", func(s *bolt.Stats) float64 { return float64(s.FreeAlloc) }},
+	{"freelist_inuse_bytes", false, "Bytes used by the freelist.", func(s *bolt.Stats) float64 { return float64(s.FreelistInuse) }},
+	{"punched_bytes_total", true, "Bytes of free pages punched out of the data file.", func(s *bolt.Stats) float64 { return float64(s.PunchedBytes) }},
+	{"read_tx_total", true, "Read transactions started.", func(s *bolt.Stats) float64 { return float64(s.TxN) }},
+	{"open_read_tx", false, "Read transactions currently open.", func(s *bolt.Stats) float64 { return float64(s.OpenTxN) }},
+	{"sync_total", true, "Syncs of the data file and the log.", func(s *bolt.Stats) float64 { return float64(s.SyncN) }},
+	{"sync_seconds_total", true, "Time spent syncing.", func(s *bolt.Stats) float64 { return seconds(s.SyncTime) }},
+	{"written_bytes_total", true, "Bytes written to the data file and the log.", func(s *bolt.Stats) float64 { return float64(s.WriteBytes) }},
+	{"remap_total", true, "Times the data file was mapped.", func(s *bolt.Stats) float64 { return float64(s.RemapN) }},
+	{"remap_seconds_total", true, "Time spent mapping with the mmap lock held.", func(s *bolt.Stats) float64 { return seconds(s.RemapTime) }},
+	{"grow_total", true, "Times the data file was grown.", func(s *bolt.Stats) float64 { return float64(s.GrowN) }},
+	{"grow_bytes_total", true, "Bytes the data file was grown by.", func(s *bolt.Stats) float64 { return float64(s.GrowBytes) }},
+	{"truncate_total", true, "Times the data file was truncated by Shrink.", func(s *bolt.Stats) float64 { return float64(s.TruncateN) }},
+	{"truncate_bytes_total", true, "Bytes truncated off the data file by Shrink.", func(s *bolt.Stats) float64 { return float64(s.TruncateBytes) }},
+	{"mmap_bytes", false, "Current size of the mmap.", func(s *bolt.Stats) float64 { return float64(s.MmapSize) }},
+	{"file_bytes", false, "Size of the data file.", func(s *bolt.Stats) float64 { return float64(s.FileSize) }},
+	{"tx_page_alloc_total", true, "Page allocations by transactions.", func(s *bolt.Stats) float64 { return float64(s.TxStats.PageCount) }},
+	{"tx_page_alloc_bytes_total", true, "Bytes allocated in pages by transactions.", func(s *bolt.Stats) float64 { return float64(s.TxStats.PageAlloc) }},
+	{"tx_cursor_total", true, "Cursors created by transactions.", func(s *bolt.Stats) float64 { return float64(s.TxStats.CursorCount) }},
+	{"tx_node_total", true, "Node allocations by transactions.", func(s *bolt.Stats) float64 { return float64(s.TxStats.NodeCount) }},
+	{"tx_node_deref_total", true, "Node dereferences by transactions.", func(s *bolt.Stats) float64 { return float64(s.TxStats.NodeDeref) }},
+	{"tx_rebalance_total", true, "Node rebalances on commit.", func(s *bolt.Stats) float64 { return float64(s.TxStats.Rebalance) }},
+	{"tx_rebalance_seconds_total", true, "Time spent rebalancing on commit.", func(s *bolt.Stats) float64 { return seconds(s.TxStats.RebalanceTime) }},
+	{"tx_split_total", true, "Nodes split on commit.", func(s *bolt.Stats) float64 { return float64(s.TxStats.Split) }},
+	{"tx_spill_total", true, "Nodes spilled on commit.", func(s *bolt.Stats) float64 { return float64(s.TxStats.Spill) }},
+	{"tx_spill_seconds_total", true, "Time spent spilling on commit.", func(s *bolt.Stats) float64 { return seconds(s.TxStats.SpillTime) }},
+	{"tx_write_total", true, "Write calls made on commit.", func(s *bolt.Stats) float64 { return float64(s.TxStats.Write) }},
+	{"tx_write_bytes_total", true, "Bytes written on commit.", func(s *bolt.Stats) float64 { return float64(s.TxStats.WriteBytes) }},
+	{"tx_write_seconds_total", true, "Time spent writing on commit.", func(s *bolt.Stats) float64 { return seconds(s.TxStats.WriteTime) }},
+}
+
+// Var returns an expvar.Var whose value is a map of the stats of db, keyed
+// by the same names Handler uses without the "dbolt_" prefix.
+func Var(db *bolt.DB) expvar.Var {
+	return expvar.Func(func() interface{} {
+		s := db.Stats()
+		m := make(map[string]float64, len(metrics))
+		for _, mt := range metrics {
+			m[mt.name] = mt.value(&s)
+		}
+		return m
+	})
+}
+
+// Publish publishes the stats of db through the expvar package under name.
+// Like expvar.Publish it panics if name is already in use.
+func Publish(name string, db *bolt.DB) {
+	expvar.Publish(name, Var(db))
+}
+
+// Handler returns an http.Handler serving the stats of db in the Prometheus
+// text exposition format. Every metric is named with a "dbolt_" prefix and
+// labelled with the path of the database.
+func Handler(db *bolt.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WriteText(w, db)
+	})
+}
+
+// WriteText writes the stats of db to w in the Prometheus text exposition
+// format, as Handler serves them.
+func WriteText(w io.Writer, db *bolt.DB) error {
+	s := db.Stats()
+	label := `{path="` + escapeLabel(db.Path()) + `"}`
+	for _, mt := range metrics {
+		typ := "gauge"
+		if mt.counter {
+			typ = "counter"
+		}
+		if _, err := fmt.Fprintf(w, "# HELP dbolt_%s %s\n# TYPE dbolt_%s %s\ndbolt_%s%s %g\n",
+			mt.name, mt.help, mt.name, typ, mt.name, label, mt.value(&s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeLabel escapes the backslashes, double quotes and line feeds in a
+// label value.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,173 @@
+package dbolttest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	bolt "github.com/c0mm4nd/dbolt"
+)
+
+// Config describes a crash-consistency test run by Check.
+type Config struct {
+	// Options are used to open the database. Storage is set by Check, and
+	// NoSync must not be set since unsynced commits are not durable.
+	Options *bolt.Options
+
+	// Updates are run in order, each in its own transaction.
+	Updates []func(*bolt.Tx) error
+
+	// Faults are applied to the writes not yet synced at a crash.
+	Faults Faults
+
+	// Seed seeds the choice of faults.
+	Seed int64
+
+	// Recover, if set, is called on the database reopened after each crash,
+	// once Check has verified it. committed is the number of updates that
+	// committed before the crash; the state is that of either committed or
+	// committed+1 updates.
+	Recover func(db *bolt.DB, committed int) error
+}
+
+// Check runs the updates of cfg against a new database once without faults,
+// recording the state after each of them. It then runs them again for every
+// write and every sync made by the updates, crashing at that write or
+// failing that sync, and reopens the database left behind. It returns an
+// error unless every reopened database opens, passes Tx.Check and holds the
+// state after either the updates that committed before the crash or one more.
+func Check(cfg Config) error {
+	// Record the state after every update.
+	s := NewStorage(nil)
+	db, err := open(cfg.Options, s)
+	if err != nil {
+		return err
+	}
+	firstWrite, firstSync := s.Writes()+1, s.Syncs()+1
+	states := make([]string, 0, len(cfg.Updates)+1)
+	state, err := dumpDB(db)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	states = append(states, state)
+	for i, fn := range cfg.Updates {
+		if err := db.Update(fn); err != nil {
+			_ = db.Close()
+			return fmt.Errorf("update %d: %s", i, err)
+		}
+		if state, err = dumpDB(db); err != nil {
+			_ = db.Close()
+			return err
+		}
+		states = append(states, state)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	writes, syncs := s.Writes(), s.Syncs()
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	for n := firstWrite; n <= writes; n++ {
+		if err := crash(cfg, states, rng, func(s *Storage) { s.CrashAtWrite(n) }); err != nil {
+			return fmt.Errorf("crash at write %d: %s", n, err)
+		}
+	}
+	for n := firstSync; n <= syncs; n++ {
+		if err := crash(cfg, states, rng, func(s *Storage) { s.FailSyncAt(n) }); err != nil {
+			return fmt.Errorf("failed sync %d: %s", n, err)
+		}
+	}
+	return nil
+}
+
+// crash runs the updates of cfg against a new storage set up to crash by
+// inject, and verifies the database left behind. Panics while reading a
+// damaged database are returned as errors.
+func crash(cfg Config, states []string, rng *rand.Rand, inject func(*Storage)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	s := NewStorage(nil)
+	db, err := open(cfg.Options, s)
+	if err != nil {
+		return err
+	}
+	inject(s)
+	committed := 0
+	for _, fn := range cfg.Updates {
+		if err := db.Update(fn); err != nil {
+			break
+		}
+		committed++
+	}
+	_ = db.Close()
+
+	db, err = open(cfg.Options, NewStorageWithLog(s.Image(cfg.Faults, rng), s.LogImage(cfg.Faults, rng)))
+	if err != nil {
+		return fmt.Errorf("reopen: %s", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("check: %s", err)
+	}
+	state, err := dumpDB(db)
+	if err != nil {
+		return err
+	}
+	if state != states[committed] && (committed == len(cfg.Updates) || state != states[committed+1]) {
+		return fmt.Errorf("state after %d committed updates is neither theirs nor the next one's", committed)
+	}
+
+	if cfg.Recover != nil {
+		if err := cfg.Recover(db, committed); err != nil {
+			return fmt.Errorf("recover: %s", err)
+		}
+	}
+	return nil
+}
+
+// open opens a database in s with a copy of options.
+func open(options *bolt.Options, s *Storage) (*bolt.DB, error) {
+	o := *bolt.DefaultOptions
+	if options != nil {
+		o = *options
+	}
+	o.Storage = s
+	return bolt.Open("", 0600, &o)
+}
+
+// dumpDB returns every bucket and key of the database, one per line in
+// order.
+func dumpDB(db *bolt.DB) (string, error) {
+	var lines []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return dumpBucket(&lines, fmt.Sprintf("%q", name), b)
+		})
+	})
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), err
+}
+
+// dumpBucket appends the keys of b and its sub-buckets, prefixed with path.
+func dumpBucket(lines *[]string, path string, b *bolt.Bucket) error {
+	*lines = append(*lines, path)
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return dumpBucket(lines, fmt.Sprintf("%s/%q", path, k), b.Bucket(k))
+		}
+		*lines = append(*lines, fmt.Sprintf("%s/%q=%q", path, k, v))
+		return nil
+	})
+}
@@ -0,0 +1,13 @@
+// Package dbolttest helps test that programs built on dbolt survive crashes.
+//
+// Storage keeps a database in memory the way a disk with a volatile write
+// cache would: writes only become durable on Sync, and a crash can drop,
+// reorder or tear the writes made since. It can crash at a given write or
+// fail a given sync, and Image returns what would be left on disk. It also
+// holds the write-ahead log of a database opened with Options.WAL, which
+// crashes along with it.
+//
+// Check runs a sequence of updates, crashing at every write and sync in turn,
+// reopens the database left behind and verifies that every update either
+// committed completely or not at all.
+package dbolttest
@@ -0,0 +1,335 @@
+package dbolttest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	bolt "github.com/c0mm4nd/dbolt"
+)
+
+// ErrCrashed is returned by writes and syncs once the storage has crashed.
+var ErrCrashed = errors.New("dbolttest: storage crashed")
+
+// ErrSyncFailed is returned by a sync that was made to fail with FailSyncAt.
+var ErrSyncFailed = errors.New("dbolttest: sync failed")
+
+// SectorSize is the unit in which a torn write is applied.
+const SectorSize = 512
+
+// Faults are what may happen to the writes that were not synced when the
+// storage loses power. Without any, every write survives in order, as after
+// a process crash that leaves the OS cache intact.
+type Faults struct {
+	Drop    bool // writes may be lost
+	Reorder bool // writes may be applied in another order
+	Tear    bool // writes may be applied in part, in whole sectors
+}
+
+// write is a write or a truncation that has not been synced yet.
+type write struct {
+	off      int64
+	b        []byte
+	truncate bool // the size is changed to off
+}
+
+// disk is the state a storage shares with the storage of its log: writes and
+// syncs are counted across both, and both crash together.
+type disk struct {
+	mu         sync.Mutex
+	writes     int
+	syncs      int
+	crashAt    int
+	failSyncAt int
+	crashed    bool
+}
+
+// Storage is a bolt.Storage kept in memory that can crash at a chosen write
+// or fail a chosen sync. Writes and syncs are counted from one.
+//
+// Storage is a bolt.LogStorage: it holds the write-ahead log of the database
+// in a Storage of its own, which crashes along with it.
+type Storage struct {
+	*disk
+	data    []byte  // current contents, doubling as the mmap
+	size    int64   // current size; bytes past data are zero
+	durable []byte  // contents as of the last sync
+	pending []write // writes and truncations since the last sync
+	locked  bool
+	log     *Storage
+}
+
+// NewStorage returns a storage holding image, which may be nil for an empty
+// one. The image is copied.
+func NewStorage(image []byte) *Storage {
+	return NewStorageWithLog(image, nil)
+}
+
+// NewStorageWithLog returns a storage holding image, whose write-ahead log
+// holds log. Either may be nil for an empty one. Both are copied.
+func NewStorageWithLog(image, log []byte) *Storage {
+	d := &disk{}
+	s := newStorage(d, image)
+	s.log = newStorage(d, log)
+	return s
+}
+
+// newStorage returns a storage of d holding a copy of image.
+func newStorage(d *disk, image []byte) *Storage {
+	return &Storage{
+		disk:    d,
+		data:    append([]byte(nil), image...),
+		size:    int64(len(image)),
+		durable: append([]byte(nil), image...),
+	}
+}
+
+// Log returns the storage of the write-ahead log.
+func (s *Storage) Log() (bolt.Storage, error) {
+	return s.log, nil
+}
+
+// LogImage returns what is left of the write-ahead log if the storage loses
+// power now, like Image.
+func (s *Storage) LogImage(faults Faults, rng *rand.Rand) []byte {
+	return s.log.Image(faults, rng)
+}
+
+// CrashAtWrite makes the storage crash at its nth write. The write counts as
+// made but not synced, and returns ErrCrashed.
+func (s *Storage) CrashAtWrite(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crashAt = n
+}
+
+// FailSyncAt makes the nth sync fail with ErrSyncFailed and crash the
+// storage, leaving the writes since the previous sync unsynced.
+func (s *Storage) FailSyncAt(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failSyncAt = n
+}
+
+// Crash crashes the storage: every later write and sync returns ErrCrashed.
+// Reads still see every write made.
+func (s *Storage) Crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crashed = true
+}
+
+// Crashed reports whether the storage has crashed.
+func (s *Storage) Crashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.crashed
+}
+
+// Writes returns the number of writes made so far.
+func (s *Storage) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// Syncs returns the number of syncs made so far.
+func (s *Storage) Syncs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+// Image returns what is left on disk if the storage loses power now: the
+// contents as of the last sync with the writes and truncations made since
+// applied subject to faults, using rng for every choice. Truncations may be
+// dropped or reordered like writes, but are never torn.
+func (s *Storage) Image(faults Faults, rng *rand.Rand) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := append([]write(nil), s.pending...)
+	if faults.Reorder {
+		rng.Shuffle(len(pending), func(i, j int) { pending[i], pending[j] = pending[j], pending[i] })
+	}
+
+	image := append([]byte(nil), s.durable...)
+	for _, w := range pending {
+		if faults.Drop && rng.Intn(2) == 0 {
+			continue
+		}
+		if w.truncate {
+			image = resize(image, w.off)
+			continue
+		}
+		b := w.b
+		if faults.Tear && len(b) > SectorSize && rng.Intn(2) == 0 {
+			b = b[:rng.Intn(len(b)/SectorSize)*SectorSize]
+		}
+		if end := w.off + int64(len(b)); end > int64(len(image)) {
+			image = append(image, make([]byte, end-int64(len(image)))...)
+		}
+		copy(image[w.off:], b)
+	}
+	return image
+}
+
+// ReadAt reads the current contents, including writes not yet synced.
+func (s *Storage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if int64(n) > s.size-off {
+		n = int(s.size - off)
+	}
+	var copied int
+	if off < int64(len(s.data)) {
+		copied = copy(b[:n], s.data[off:])
+	}
+	for i := copied; i < n; i++ {
+		b[i] = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt records a write that becomes durable on the next sync.
+func (s *Storage) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return 0, ErrCrashed
+	}
+	s.writes++
+	s.pending = append(s.pending, write{off: off, b: append([]byte(nil), b...)})
+
+	// The buffer only grows here before it is mapped, since the database
+	// maps every page it writes.
+	end := off + int64(len(b))
+	s.grow(int(end))
+	copy(s.data[off:], b)
+	if end > s.size {
+		s.size = end
+	}
+
+	if s.writes == s.crashAt {
+		s.crashed = true
+		return len(b), ErrCrashed
+	}
+	return len(b), nil
+}
+
+// Size returns the current size.
+func (s *Storage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, nil
+}
+
+// Truncate changes the current size, clearing the bytes cut off. Like a
+// write, the new size becomes durable on the next sync.
+func (s *Storage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return ErrCrashed
+	}
+	s.pending = append(s.pending, write{off: size, truncate: true})
+	for i := size; i < int64(len(s.data)); i++ {
+		s.data[i] = 0
+	}
+	s.size = size
+	return nil
+}
+
+// Sync makes the writes made so far durable.
+func (s *Storage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.crashed {
+		return ErrCrashed
+	}
+	s.syncs++
+	if s.syncs == s.failSyncAt {
+		s.crashed = true
+		return ErrSyncFailed
+	}
+
+	for _, w := range s.pending {
+		if w.truncate {
+			s.durable = resize(s.durable, w.off)
+			continue
+		}
+		if end := w.off + int64(len(w.b)); end > int64(len(s.durable)) {
+			s.durable = append(s.durable, make([]byte, end-int64(len(s.durable)))...)
+		}
+		copy(s.durable[w.off:], w.b)
+	}
+	s.pending = nil
+	return nil
+}
+
+// Lock fails with bolt.ErrTimeout while the storage is locked.
+func (s *Storage) Lock(exclusive bool, timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.locked {
+		return bolt.ErrTimeout
+	}
+	s.locked = true
+	return nil
+}
+
+// Unlock releases the lock.
+func (s *Storage) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locked = false
+	return nil
+}
+
+// Mmap returns the current contents, growing the buffer to size bytes.
+func (s *Storage) Mmap(size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grow(size)
+	return s.data[:size], nil
+}
+
+// Munmap does nothing.
+func (s *Storage) Munmap(b []byte) error { return nil }
+
+// Close releases the lock. The contents are kept.
+func (s *Storage) Close() error {
+	return s.Unlock()
+}
+
+// grow moves the contents into a buffer of at least sz bytes. s.mu must be
+// held.
+func (s *Storage) grow(sz int) {
+	if sz > len(s.data) {
+		data := make([]byte, sz)
+		copy(data, s.data)
+		s.data = data
+	}
+}
+
+// resize returns b cut or extended with zeros to size bytes.
+func resize(b []byte, size int64) []byte {
+	if size <= int64(len(b)) {
+		return b[:size]
+	}
+	return append(b, make([]byte, size-int64(len(b)))...)
+}
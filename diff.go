@@ -0,0 +1,197 @@
+package dbolt
+
+import "bytes"
+
+// DiffKind is the kind of a difference found by DiffTx.
+type DiffKind int
+
+const (
+	DiffAdded   DiffKind = iota + 1 // only in the second transaction
+	DiffRemoved                     // only in the first transaction
+	DiffChanged                     // in both, with another value or sequence
+)
+
+// String returns the name of the kind of difference.
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Diff is a difference between two transactions found by DiffTx: a bucket or
+// a key added or removed, a value changed, or the sequence of a bucket
+// changed. The slices it holds are only valid for the life of the
+// transactions.
+type Diff struct {
+	Kind     DiffKind
+	Bucket   [][]byte // path of the bucket holding Key, outermost first
+	Key      []byte   // key, or name of the bucket if IsBucket is set
+	IsBucket bool     // whether Key is a bucket rather than a value
+	Old      []byte   // value in the first transaction, if any
+	New      []byte   // value in the second transaction, if any
+
+	// OldSequence and NewSequence are the sequences of a bucket in the
+	// first and the second transaction.
+	OldSequence uint64
+	NewSequence uint64
+}
+
+// DiffOptions configures DiffTxWithOptions.
+type DiffOptions struct {
+	// Bucket is the path of the bucket to compare, outermost name first.
+	// The whole databases are compared if it is empty.
+	Bucket [][]byte
+}
+
+// DiffTx compares the buckets, keys and values of a and b, which may belong
+// to different databases. It calls fn for every difference, walking both in
+// bucket and key order. A bucket added or removed is reported before its
+// keys and nested buckets, which are all reported as well. A key that turned
+// into a bucket, or the reverse, is reported as removed and added.
+//
+// If fn returns an error then the comparison is stopped and the error is
+// returned to the caller. Reaching a damaged page in either transaction stops
+// it as well and returns its *PageError.
+func DiffTx(a, b *Tx, fn func(d Diff) error) error {
+	return DiffTxWithOptions(a, b, DiffOptions{}, fn)
+}
+
+// DiffTxWithOptions compares a and b as configured by opts. See DiffTx.
+func DiffTxWithOptions(a, b *Tx, opts DiffOptions, fn func(d Diff) error) (err error) {
+	defer recoverPageError(&err, a, b)
+	if len(opts.Bucket) == 0 {
+		return diffBucket(nil, &a.root, &b.root, fn)
+	}
+
+	// Compare the bucket, which is reported as added or removed if it is
+	// missing from either transaction.
+	ba, bb := diffLookup(a, opts.Bucket), diffLookup(b, opts.Bucket)
+	path, name := opts.Bucket[:len(opts.Bucket)-1], opts.Bucket[len(opts.Bucket)-1]
+	switch {
+	case ba == nil && bb == nil:
+		return ErrBucketNotFound
+	case ba == nil:
+		return diffAll(DiffAdded, path, name, bb, fn)
+	case bb == nil:
+		return diffAll(DiffRemoved, path, name, ba, fn)
+	}
+	if ba.Sequence() != bb.Sequence() {
+		if err := fn(Diff{Kind: DiffChanged, Bucket: path, Key: name, IsBucket: true, OldSequence: ba.Sequence(), NewSequence: bb.Sequence()}); err != nil {
+			return err
+		}
+	}
+	return diffBucket(opts.Bucket, ba, bb, fn)
+}
+
+// diffLookup returns the bucket at path in tx, or nil if there is none.
+func diffLookup(tx *Tx, path [][]byte) *Bucket {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// diffBucket compares the keys of the buckets a and b found at path, by
+// walking them side by side.
+func diffBucket(path [][]byte, a, b *Bucket, fn func(d Diff) error) error {
+	ca, cb := a.Cursor(), b.Cursor()
+	ka, va := ca.First()
+	kb, vb := cb.First()
+	for ka != nil || kb != nil {
+		cmp := bytes.Compare(ka, kb)
+		switch {
+		case kb == nil || (ka != nil && cmp < 0):
+			if err := diffOne(DiffRemoved, path, ka, va, a, fn); err != nil {
+				return err
+			}
+			ka, va = ca.Next()
+			continue
+		case ka == nil || cmp > 0:
+			if err := diffOne(DiffAdded, path, kb, vb, b, fn); err != nil {
+				return err
+			}
+			kb, vb = cb.Next()
+			continue
+		}
+
+		// The key is in both buckets.
+		var err error
+		switch {
+		case va == nil && vb == nil:
+			ba, bb := a.Bucket(ka), b.Bucket(kb)
+			if ba.Sequence() != bb.Sequence() {
+				err = fn(Diff{Kind: DiffChanged, Bucket: path, Key: ka, IsBucket: true, OldSequence: ba.Sequence(), NewSequence: bb.Sequence()})
+			}
+			if err == nil {
+				err = diffBucket(append(path[:len(path):len(path)], ka), ba, bb, fn)
+			}
+		case va != nil && vb != nil:
+			if !bytes.Equal(va, vb) {
+				err = fn(Diff{Kind: DiffChanged, Bucket: path, Key: ka, Old: va, New: vb})
+			}
+		default:
+			if err = diffOne(DiffRemoved, path, ka, va, a, fn); err == nil {
+				err = diffOne(DiffAdded, path, kb, vb, b, fn)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		ka, va = ca.Next()
+		kb, vb = cb.Next()
+	}
+	return nil
+}
+
+// diffOne reports the key k of the bucket parent at path as added or removed,
+// along with everything it holds if it is a bucket.
+func diffOne(kind DiffKind, path [][]byte, k, v []byte, parent *Bucket, fn func(d Diff) error) error {
+	if v != nil {
+		return diffValue(kind, path, k, v, fn)
+	}
+	return diffAll(kind, path, k, parent.Bucket(k), fn)
+}
+
+// diffValue reports the key k with the value v at path as added or removed.
+func diffValue(kind DiffKind, path [][]byte, k, v []byte, fn func(d Diff) error) error {
+	d := Diff{Kind: kind, Bucket: path, Key: k}
+	if kind == DiffAdded {
+		d.New = v
+	} else {
+		d.Old = v
+	}
+	return fn(d)
+}
+
+// diffAll reports the bucket b named k at path as added or removed, along with
+// everything it holds.
+func diffAll(kind DiffKind, path [][]byte, k []byte, b *Bucket, fn func(d Diff) error) error {
+	d := Diff{Kind: kind, Bucket: path, Key: k, IsBucket: true}
+	if kind == DiffAdded {
+		d.NewSequence = b.Sequence()
+	} else {
+		d.OldSequence = b.Sequence()
+	}
+	if err := fn(d); err != nil {
+		return err
+	}
+
+	path = append(path[:len(path):len(path)], k)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := diffOne(kind, path, k, v, b, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
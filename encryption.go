@@ -0,0 +1,322 @@
+package dbolt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// Size of the encryption part of the page trailer: a key id, a GCM nonce and
+// a GCM tag.
+const (
+	pageKeyIDSize      = 4
+	pageNonceSize      = 12
+	pageTagSize        = 16
+	pageEncryptionSize = pageKeyIDSize + pageNonceSize + pageTagSize
+)
+
+// DefaultMaxKeyPages is the number of pages one key may encrypt if
+// Encryption.MaxKeyPages is not set. Pages are sealed under random 96-bit GCM
+// nonces, which keep the chance of a repeated nonce negligible for about 2^32
+// encryptions under one key.
+const DefaultMaxKeyPages = 1 << 32
+
+// Encryption configures page-level encryption at rest using AES-GCM.
+//
+// Every leaf, branch and freelist page is encrypted when it is written and
+// decrypted into the page pool when a transaction first reads it. The page
+// header (id, flags, count and overflow) is left in the clear and
+// authenticated together with the encrypted body. The two meta pages hold no
+// user data and are not encrypted.
+type Encryption struct {
+	// KeyID selects the key used to encrypt pages written from now on.
+	// Rotating keys is a matter of changing KeyID: pages written under an
+	// older key id remain readable for as long as Key can return that key.
+	KeyID uint32
+
+	// Key returns the AES key for a key id. It must return a 16, 24 or 32
+	// byte key, selecting AES-128, AES-192 or AES-256. Key is called for
+	// KeyID and for the key id recorded in every page that is read.
+	Key func(id uint32) ([]byte, error)
+
+	// MaxKeyPages is the number of page writes KeyID may encrypt. The count
+	// is kept in the meta page, and once it is reached commits fail with
+	// ErrKeyExhausted until KeyID selects another key. Only the current key
+	// id is counted, so a key id must not be used again once replaced.
+	// Defaults to DefaultMaxKeyPages.
+	MaxKeyPages uint64
+}
+
+// encryptor seals and opens pages for an encrypted database.
+type encryptor struct {
+	*Encryption
+
+	mu      sync.Mutex
+	aeads   map[uint32]cipher.AEAD // ciphers by key id
+	sealKey uint32                 // key id counted by seals
+	seals   uint64                 // pages sealed under sealKey
+}
+
+// newEncryptor returns an encryptor for the given options.
+func newEncryptor(e *Encryption) *encryptor {
+	return &encryptor{Encryption: e, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// checkEncryption returns an error if the data file is encrypted but no
+// encryption options were given, or the other way around. The root page is
+// decrypted so that a wrong key is reported by Open.
+func (db *DB) checkEncryption() error {
+	encrypted := db.flags&metaFlagEncrypted != 0
+	if encrypted && db.encryptor == nil {
+		return ErrEncrypted
+	} else if !encrypted && db.encryptor != nil {
+		return ErrNotEncrypted
+	} else if encrypted {
+		db.encryptor.load(db.meta())
+		p, err := db.readPage(db.meta().root.root)
+		if err != nil {
+			return err
+		}
+		if p.overflow == 0 {
+			db.putPage(unsafeByteSlice(unsafe.Pointer(p), 0, 0, db.pageSize))
+		}
+	}
+	return nil
+}
+
+// aead returns the cipher for a key id, creating it on first use.
+func (e *encryptor) aead(id uint32) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if a, ok := e.aeads[id]; ok {
+		return a, nil
+	}
+	key, err := e.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %s", id, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %s", id, err)
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.aeads[id] = a
+	return a, nil
+}
+
+// load resumes counting the pages sealed under the key recorded in m.
+func (e *encryptor) load(m *meta) {
+	e.mu.Lock()
+	e.sealKey, e.seals = m.sealKey, m.seals
+	e.mu.Unlock()
+}
+
+// record saves the count of pages sealed under the current key in m.
+func (e *encryptor) record(m *meta) {
+	e.mu.Lock()
+	m.sealKey, m.seals = e.sealKey, e.seals
+	e.mu.Unlock()
+}
+
+// reserve counts n pages about to be sealed under KeyID, or returns
+// ErrKeyExhausted if that would exceed MaxKeyPages. Pages sealed by a commit
+// that then fails stay counted, since their nonces were used.
+func (e *encryptor) reserve(n uint64) error {
+	max := e.MaxKeyPages
+	if max == 0 {
+		max = DefaultMaxKeyPages
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sealKey != e.KeyID {
+		e.sealKey, e.seals = e.KeyID, 0
+	}
+	if e.seals+n > max {
+		return ErrKeyExhausted
+	}
+	e.seals += n
+	return nil
+}
+
+// seal counts a page against the limit of the current key and encrypts it.
+func (e *encryptor) seal(buf []byte) error {
+	if err := e.reserve(1); err != nil {
+		return err
+	}
+	return e.encrypt(buf)
+}
+
+// encrypt encrypts the body of a page span in place and fills in the key id,
+// nonce and tag at the end of the span. The page must have been counted with
+// reserve.
+func (e *encryptor) encrypt(buf []byte) error {
+	a, err := e.aead(e.KeyID)
+	if err != nil {
+		return err
+	}
+
+	body, trailer := pageCiphertext(buf)
+	binary.LittleEndian.PutUint32(trailer[:pageKeyIDSize], e.KeyID)
+	nonce := trailer[pageKeyIDSize : pageKeyIDSize+pageNonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// The tag is appended to the ciphertext, so seal into a buffer of its own
+	// rather than over the trailer that holds the nonce.
+	sealed := a.Seal(nil, nonce, body, pageAdditionalData(buf))
+	n := copy(body, sealed)
+	copy(trailer[pageKeyIDSize+pageNonceSize:], sealed[n:])
+	return nil
+}
+
+// open decrypts a page span into dst, which must be the same size.
+func (e *encryptor) open(dst, buf []byte) error {
+	body, trailer := pageCiphertext(buf)
+	a, err := e.aead(binary.LittleEndian.Uint32(trailer[:pageKeyIDSize]))
+	if err != nil {
+		return err
+	}
+	nonce := trailer[pageKeyIDSize : pageKeyIDSize+pageNonceSize]
+
+	// GCM expects the tag to follow the ciphertext, so assemble both in the
+	// destination buffer and decrypt in place.
+	out := dst[pageHeaderSize : len(dst)-pageEncryptionSize+pageTagSize]
+	n := copy(out, body)
+	copy(out[n:], trailer[pageKeyIDSize+pageNonceSize:])
+	if _, err := a.Open(out[:0], nonce, out, pageAdditionalData(buf)); err != nil {
+		return ErrChecksum
+	}
+
+	// Copy the clear header and trailer so the page looks as it was written.
+	copy(dst[:pageHeaderSize], buf[:pageHeaderSize])
+	copy(dst[len(dst)-pageEncryptionSize:], trailer)
+	return nil
+}
+
+// pageCiphertext splits a page span into its encrypted body and the
+// encryption trailer.
+func pageCiphertext(buf []byte) (body, trailer []byte) {
+	end := len(buf) - pageEncryptionSize
+	return buf[pageHeaderSize:end], buf[end:]
+}
+
+// pageAdditionalData returns the data authenticated but not encrypted with a
+// page: its header and the key id.
+func pageAdditionalData(buf []byte) []byte {
+	ad := make([]byte, pageHeaderSize+pageKeyIDSize)
+	copy(ad, buf[:pageHeaderSize])
+	copy(ad[pageHeaderSize:], buf[len(buf)-pageEncryptionSize:])
+	return ad
+}
+
+// Rekey writes the database seen by tx to w with every page encrypted under
+// the key selected by enc.KeyID. Pages that are not reachable from tx are
+// written as zeros so that no data encrypted under an older key survives.
+// The database must be encrypted. If err == nil then exactly tx.Size() bytes
+// will be written into the writer.
+func (tx *Tx) Rekey(w io.Writer, enc *Encryption) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if tx.db.encryptor == nil {
+		return 0, ErrNotEncrypted
+	}
+	// Collect every page reachable from this transaction.
+	reachable, err := tx.reachablePages()
+	if err != nil {
+		return n, err
+	}
+
+	// Count the pages about to be sealed, on top of those already sealed
+	// if the key is the current one.
+	e := newEncryptor(enc)
+	e.load(tx.meta)
+	var sealed uint64
+	for id, head := range reachable {
+		if id == head && id > 1 && id < tx.meta.pgid {
+			sealed++
+		}
+	}
+	if err := e.reserve(sealed); err != nil {
+		return n, err
+	}
+	m := *tx.meta
+	e.record(&m)
+
+	// Write both meta pages the same way WriteTo does.
+	nn, err := tx.writeMetaPagesTo(w, &m)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	// Re-encrypt reachable pages and zero everything else.
+	zero := make([]byte, tx.db.pageSize)
+	for id := pgid(2); id < tx.meta.pgid; {
+		if head, ok := reachable[id]; !ok || head != id {
+			nn, err := w.Write(zero)
+			n += int64(nn)
+			if err != nil {
+				return n, err
+			}
+			id++
+			continue
+		}
+
+		p, err := tx.db.readPage(id)
+		if err != nil {
+			return n, err
+		}
+		buf := make([]byte, (int(p.overflow)+1)*tx.db.pageSize)
+		copy(buf, p.span(tx.db.pageSize))
+		tx.db.releasePage(p)
+		if err := e.encrypt(buf); err != nil {
+			return n, err
+		}
+		nn, err := w.Write(buf)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+		id += pgid(len(buf) / tx.db.pageSize)
+	}
+	return n, nil
+}
+
+// decryptPage returns a decrypted copy of an encrypted page. Single pages are
+// taken from the page pool.
+func (db *DB) decryptPage(p *page) (*page, error) {
+	sz := (int(p.overflow) + 1) * db.pageSize
+	var buf []byte
+	if p.overflow == 0 {
+		buf = db.pagePool.Get().([]byte)
+	} else {
+		buf = make([]byte, sz)
+	}
+	if err := db.encryptor.open(buf, p.span(db.pageSize)); err != nil {
+		if p.overflow == 0 {
+			db.putPage(buf)
+		}
+		return nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// putPage zeroes a single page buffer and returns it to the page pool.
+func (db *DB) putPage(buf []byte) {
+	// See https://go.googlesource.com/go/+/f03c9202c43e0abb130669852082117ca50aa9b1
+	for i := range buf {
+		buf[i] = 0
+	}
+	db.pagePool.Put(buf)
+}
@@ -1,6 +1,9 @@
 package dbolt
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // These errors can be returned when opening or calling methods on a DB.
 var (
@@ -23,9 +26,51 @@ var (
 	// ErrChecksum is returned when either meta page checksum does not match.
 	ErrChecksum = errors.New("checksum error")
 
+	// ErrUnsupportedFeature is returned when the data file uses an on-disk
+	// format feature that this version of Bolt does not know.
+	ErrUnsupportedFeature = errors.New("unsupported database feature")
+
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
+
+	// ErrEncrypted is returned when opening an encrypted database without
+	// Options.Encryption.
+	ErrEncrypted = errors.New("database is encrypted")
+
+	// ErrNotEncrypted is returned when Options.Encryption is set for a
+	// database that was not created encrypted, or when rekeying such a
+	// database.
+	ErrNotEncrypted = errors.New("database is not encrypted")
+
+	// ErrKeyExhausted is returned by a commit once the current encryption key
+	// has encrypted Encryption.MaxKeyPages pages. Encryption.KeyID must then
+	// select a new key.
+	ErrKeyExhausted = errors.New("encryption key exhausted")
+
+	// ErrNoPageTxid is returned when writing an incremental backup of a
+	// database that was not created with Options.PageTxid.
+	ErrNoPageTxid = errors.New("database does not record page transaction ids")
+
+	// ErrBackupMismatch is returned when applying an incremental backup to a
+	// database that is not at the transaction the backup starts from.
+	ErrBackupMismatch = errors.New("incremental backup does not apply to database")
+
+	// ErrSnapshotNameRequired is returned when creating a snapshot with a
+	// blank name.
+	ErrSnapshotNameRequired = errors.New("snapshot name required")
+
+	// ErrSnapshotExists is returned when creating a snapshot with the name of
+	// an existing one.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+
+	// ErrSnapshotNotFound is returned when opening or dropping a snapshot
+	// that does not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrCompactSnapshots is returned when compacting a database that has
+	// snapshots, which a compacted copy cannot keep.
+	ErrCompactSnapshots = errors.New("cannot compact a database with snapshots")
 )
 
 // These errors can occur when beginning or committing a Tx.
@@ -38,6 +83,12 @@ var (
 	// that has already been committed or rolled back.
 	ErrTxClosed = errors.New("tx closed")
 
+	// ErrTxInvalidated is raised as a panic when a read-only transaction
+	// reads a page or moves a cursor after the MaxReadTxAge watchdog
+	// invalidated it. Managed transactions return it from View; transactions
+	// begun with DB.Begin return it from Tx.Do.
+	ErrTxInvalidated = errors.New("tx invalidated for exceeding max read tx age")
+
 	// ErrDatabaseReadOnly is returned when a mutating transaction is started on a
 	// read-only database.
 	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
@@ -68,4 +119,28 @@ var (
 	// on an existing non-bucket key or when trying to create or delete a
 	// non-bucket key on an existing bucket key.
 	ErrIncompatibleValue = errors.New("incompatible value")
+
+	// ErrInvalidCompression is returned when creating a bucket with an
+	// unknown compression.
+	ErrInvalidCompression = errors.New("invalid compression")
+
+	// ErrCorruptValue is returned when a compressed value cannot be
+	// decompressed.
+	ErrCorruptValue = errors.New("corrupt compressed value")
 )
+
+// PageError is returned when a page read from the data file fails
+// validation, for example because its checksum does not match.
+type PageError struct {
+	ID  int   // id of the failing page
+	Err error // underlying cause, such as ErrChecksum
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %s", e.ID, e.Err)
+}
+
+// Unwrap returns the underlying cause of the page error.
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
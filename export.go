@@ -0,0 +1,437 @@
+package dbolt
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Format is the encoding of a logical export of a database.
+type Format int
+
+const (
+	// FormatJSONLines writes a JSON object per line for every bucket, with
+	// its sequence and compression, and for every key and value, in bucket
+	// and key order.
+	// Keys and values are strings, or base64 when they are not valid UTF-8,
+	// as told by the "encoding" field of the line.
+	FormatJSONLines Format = iota
+
+	// FormatCSV writes the keys and values of a single bucket as rows of
+	// key, value and encoding, under a header row. Nested buckets cannot
+	// be exported as CSV.
+	FormatCSV
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatJSONLines:
+		return "jsonl"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// exportBase64 is the encoding of the lines or rows written in base64.
+const exportBase64 = "base64"
+
+// errCSVBucketRequired is returned when exporting or importing CSV without a
+// bucket.
+var errCSVBucketRequired = errors.New("csv requires a bucket")
+
+// ExportOptions configures ExportWithOptions.
+type ExportOptions struct {
+	Format Format
+
+	// Bucket is the path of the bucket to export, outermost name first.
+	// Its keys and nested buckets are written relative to it. The whole
+	// database is exported if it is empty, which FormatCSV does not allow.
+	Bucket [][]byte
+
+	// Base64 writes every key and value in base64, even valid UTF-8.
+	Base64 bool
+}
+
+// ImportOptions configures ImportWithOptions.
+type ImportOptions struct {
+	Format Format
+
+	// Bucket is the path of the bucket to import into, outermost name
+	// first, which is created if missing. The buckets of the stream are
+	// imported at the root if it is empty, which FormatCSV does not allow.
+	Bucket [][]byte
+
+	// TxMaxSize limits the size of the transactions the import commits, as
+	// with Compact. A value of zero imports in a single transaction.
+	TxMaxSize int64
+}
+
+// exportRecord is a line of a FormatJSONLines export: a bucket or a key in the
+// bucket at Path.
+type exportRecord struct {
+	Path        []string `json:"path,omitempty"`
+	Key         string   `json:"key"`
+	Value       *string  `json:"value,omitempty"`
+	Bucket      bool     `json:"bucket,omitempty"`
+	Sequence    uint64   `json:"sequence,omitempty"`
+	Compression string   `json:"compression,omitempty"`
+	Encoding    string   `json:"encoding,omitempty"`
+}
+
+// Export writes the buckets, keys and values of tx to w in the given format.
+func Export(tx *Tx, w io.Writer, format Format) error {
+	return ExportWithOptions(tx, w, ExportOptions{Format: format})
+}
+
+// ExportWithOptions writes the buckets, keys and values of tx to w as
+// configured by opts. The export can be read back with Import. Reaching a
+// damaged page stops the export and returns its *PageError.
+func ExportWithOptions(tx *Tx, w io.Writer, opts ExportOptions) (err error) {
+	defer recoverPageError(&err, tx)
+	bw := bufio.NewWriter(w)
+	switch opts.Format {
+	case FormatJSONLines:
+		err = exportJSONLines(tx, bw, opts)
+	case FormatCSV:
+		err = exportCSV(tx, bw, opts)
+	default:
+		err = fmt.Errorf("unknown export format: %s", opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// exportWalk walks the bucket to export, or the whole database.
+func exportWalk(tx *Tx, path [][]byte, fn walkFunc) error {
+	if len(path) == 0 {
+		return walkTx(tx, fn)
+	}
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			break
+		}
+		b = b.Bucket(name)
+	}
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return walkChildren(b, nil, fn)
+}
+
+func exportJSONLines(tx *Tx, w io.Writer, opts ExportOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return exportWalk(tx, opts.Bucket, func(keys [][]byte, k, v []byte, seq uint64, bopts BucketOptions) error {
+		encode := func(b []byte) string { return string(b) }
+		r := exportRecord{Bucket: v == nil}
+		if opts.Base64 || !validUTF8(keys, k, v) {
+			encode = base64.StdEncoding.EncodeToString
+			r.Encoding = exportBase64
+		}
+		for _, name := range keys {
+			r.Path = append(r.Path, encode(name))
+		}
+		r.Key = encode(k)
+		if v == nil {
+			r.Sequence = seq
+			if bopts.Compression != NoCompression {
+				r.Compression = bopts.Compression.String()
+			}
+		} else {
+			s := encode(v)
+			r.Value = &s
+		}
+		return enc.Encode(r)
+	})
+}
+
+func exportCSV(tx *Tx, w io.Writer, opts ExportOptions) error {
+	if len(opts.Bucket) == 0 {
+		return errCSVBucketRequired
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "value", "encoding"}); err != nil {
+		return err
+	}
+	if err := exportWalk(tx, opts.Bucket, func(keys [][]byte, k, v []byte, seq uint64, _ BucketOptions) error {
+		if v == nil {
+			return fmt.Errorf("cannot export nested bucket %q as csv", k)
+		}
+		if opts.Base64 || !validUTF8(nil, k, v) {
+			enc := base64.StdEncoding
+			return cw.Write([]string{enc.EncodeToString(k), enc.EncodeToString(v), exportBase64})
+		}
+		return cw.Write([]string{string(k), string(v), ""})
+	}); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// validUTF8 returns true if the keys, k and v are all valid UTF-8.
+func validUTF8(keys [][]byte, k, v []byte) bool {
+	for _, name := range keys {
+		if !utf8.Valid(name) {
+			return false
+		}
+	}
+	return utf8.Valid(k) && utf8.Valid(v)
+}
+
+// Import reads buckets, keys and values in the given format from r into db,
+// as written by Export. Existing keys are overwritten.
+func Import(db *DB, r io.Reader, format Format) error {
+	return ImportWithOptions(db, r, ImportOptions{Format: format})
+}
+
+// ImportWithOptions reads buckets, keys and values from r into db as
+// configured by opts. Existing keys are overwritten and missing buckets are
+// created, with the compression the stream records for them; existing buckets
+// keep theirs. On error, the transactions already committed are kept.
+func ImportWithOptions(db *DB, r io.Reader, opts ImportOptions) error {
+	im := &importer{db: db, root: opts.Bucket, txMaxSize: opts.TxMaxSize}
+	if err := im.begin(); err != nil {
+		return err
+	}
+	defer func() { _ = im.tx.Rollback() }()
+
+	var err error
+	switch opts.Format {
+	case FormatJSONLines:
+		err = im.readJSONLines(r)
+	case FormatCSV:
+		err = im.readCSV(r)
+	default:
+		err = fmt.Errorf("unknown import format: %s", opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+	return im.tx.Commit()
+}
+
+// importer writes the records of an import, committing whenever a
+// transaction grows past txMaxSize.
+type importer struct {
+	db        *DB
+	tx        *Tx
+	root      [][]byte
+	size      int64
+	txMaxSize int64
+}
+
+// begin begins the next transaction.
+func (im *importer) begin() error {
+	tx, err := im.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	im.tx, im.size = tx, 0
+	return nil
+}
+
+// grow accounts for sz more bytes, committing the transaction first if they
+// do not fit.
+func (im *importer) grow(sz int64) error {
+	if im.txMaxSize != 0 && im.size+sz > im.txMaxSize {
+		if err := im.tx.Commit(); err != nil {
+			return err
+		}
+		if err := im.begin(); err != nil {
+			return err
+		}
+	}
+	im.size += sz
+	return nil
+}
+
+// bucket returns the bucket at path under the bucket imported into, creating
+// the buckets that are missing. An empty path is the root bucket.
+func (im *importer) bucket(path [][]byte) (*Bucket, error) {
+	b := &im.tx.root
+	for _, name := range append(im.root[:len(im.root):len(im.root)], path...) {
+		var err error
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// put stores k and v in the bucket at path.
+func (im *importer) put(path [][]byte, k, v []byte) error {
+	if err := im.grow(int64(len(k) + len(v))); err != nil {
+		return err
+	}
+	b, err := im.bucket(path)
+	if err != nil {
+		return err
+	} else if b == &im.tx.root {
+		return ErrIncompatibleValue
+	}
+	return b.Put(k, v)
+}
+
+// createBucket creates the bucket k with opts in the bucket at path, unless it
+// exists, and sets its sequence.
+func (im *importer) createBucket(path [][]byte, k []byte, seq uint64, opts BucketOptions) error {
+	if err := im.grow(int64(len(k))); err != nil {
+		return err
+	}
+	parent, err := im.bucket(path)
+	if err != nil {
+		return err
+	}
+	b := parent.Bucket(k)
+	if b == nil {
+		if b, err = parent.CreateBucketWithOptions(k, opts); err != nil {
+			return err
+		}
+	}
+	return b.SetSequence(seq)
+}
+
+func (im *importer) readJSONLines(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if err := im.importRecord(rec); err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+	}
+}
+
+// importRecord imports a line of a FormatJSONLines export.
+func (im *importer) importRecord(rec exportRecord) error {
+	decode, err := importDecoder(rec.Encoding)
+	if err != nil {
+		return err
+	}
+	var path [][]byte
+	for _, name := range rec.Path {
+		b, err := decode(name)
+		if err != nil {
+			return err
+		}
+		path = append(path, b)
+	}
+	k, err := decode(rec.Key)
+	if err != nil {
+		return err
+	}
+	if rec.Bucket {
+		c, err := importCompression(rec.Compression)
+		if err != nil {
+			return err
+		}
+		return im.createBucket(path, k, rec.Sequence, BucketOptions{Compression: c})
+	}
+	v := []byte{}
+	if rec.Value != nil {
+		if v, err = decode(*rec.Value); err != nil {
+			return err
+		}
+	}
+	return im.put(path, k, v)
+}
+
+func (im *importer) readCSV(r io.Reader) error {
+	if len(im.root) == 0 {
+		return errCSVBucketRequired
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Find the columns by name, the encoding being optional.
+	key, value, encoding := -1, -1, -1
+	for i, name := range header {
+		switch name {
+		case "key":
+			key = i
+		case "value":
+			value = i
+		case "encoding":
+			encoding = i
+		}
+	}
+	if key < 0 || value < 0 {
+		return errors.New("csv header requires key and value columns")
+	}
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(row) != len(header) {
+			return fmt.Errorf("line %d: wrong number of fields", line)
+		}
+		var enc string
+		if encoding >= 0 {
+			enc = row[encoding]
+		}
+		decode, err := importDecoder(enc)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		k, err := decode(row[key])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		v, err := decode(row[value])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := im.put(nil, k, v); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// importCompression returns the compression named by a bucket line.
+func importCompression(name string) (Compression, error) {
+	switch name {
+	case "", NoCompression.String():
+		return NoCompression, nil
+	case Flate.String():
+		return Flate, nil
+	}
+	return 0, fmt.Errorf("unknown compression: %q", name)
+}
+
+// importDecoder returns the function decoding the keys and values of a line
+// or row with the given encoding.
+func importDecoder(encoding string) (func(string) ([]byte, error), error) {
+	switch encoding {
+	case "":
+		return func(s string) ([]byte, error) { return []byte(s), nil }, nil
+	case exportBase64:
+		return base64.StdEncoding.DecodeString, nil
+	}
+	return nil, fmt.Errorf("unknown encoding: %q", encoding)
+}
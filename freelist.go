@@ -24,10 +24,15 @@ type freelist struct {
 	ids            []pgid                      // all free and available free page ids.
 	allocs         map[pgid]txid               // mapping of txid that allocated a pgid.
 	pending        map[txid]*txPending         // mapping of soon-to-be free page ids by tx.
-	cache          map[pgid]bool               // fast lookup of all free and pending page ids.
+	cache          map[pgid]bool               // fast lookup of all free and pending page ids, or only pending ones for the extent backend.
 	freemaps       map[uint64]pidSet           // key is the size of continuous pages(span), value is a set which contains the starting pgids of same size
 	forwardMap     map[pgid]uint64             // key is start pgid, value is its span size
 	backwardMap    map[pgid]uint64             // key is end pgid, value is its span size
+	extents        *extentNode                 // treap of free extents, for the extent backend
+	extentFree     int                         // number of free pages in extents
+	extentCount    int                         // number of extents in extents
+	extentSeed     uint32                      // state of the generator of treap priorities
+	snapshots      []txid                      // sorted txids of the snapshots, see pendingIDs
 	allocate       func(txid txid, n int) pgid // the freelist allocate func
 	free_count     func() int                  // the function which gives you free page number
 	mergeSpans     func(ids pgids)             // the mergeSpan func
@@ -45,6 +50,7 @@ func newFreelist(freelistType FreelistType) *freelist {
 		freemaps:     make(map[uint64]pidSet),
 		forwardMap:   make(map[pgid]uint64),
 		backwardMap:  make(map[pgid]uint64),
+		extentSeed:   2463534242,
 	}
 
 	if freelistType == FreelistMapType {
@@ -53,6 +59,12 @@ func newFreelist(freelistType FreelistType) *freelist {
 		f.mergeSpans = f.hashmapMergeSpans
 		f.getFreePageIDs = f.hashmapGetFreePageIDs
 		f.readIDs = f.hashmapReadIDs
+	} else if freelistType == FreelistExtentType {
+		f.allocate = f.extentAllocate
+		f.free_count = f.extentFreeCount
+		f.mergeSpans = f.extentMergeSpans
+		f.getFreePageIDs = f.extentGetFreePageIDs
+		f.readIDs = f.extentReadIDs
 	} else {
 		f.allocate = f.arrayAllocate
 		f.free_count = f.arrayFreeCount
@@ -67,10 +79,20 @@ func newFreelist(freelistType FreelistType) *freelist {
 // size returns the size of the page after serialization.
 func (f *freelist) size() int {
 	n := f.count()
+	if f.freelistType == FreelistExtentType {
+		// Extents take two elements each, and every pending page adds at most
+		// one extent or one held id. See freelist.writeExtents. This may
+		// overestimate the size, but saves merging the pending ids twice.
+		n = 2 * (f.extentCount + f.pending_count())
+	}
 	if n >= 0xFFFF {
 		// The first element will be used to store the count. See freelist.write.
 		n++
 	}
+	if len(f.snapshots) > 0 {
+		// The held pages are preceded by their count. See freelist.writeHeld.
+		n++
+	}
 	return int(pageHeaderSize) + (int(unsafe.Sizeof(pgid(0))) * n)
 }
 
@@ -104,6 +126,31 @@ func (f *freelist) copyall(dst []pgid) {
 	mergepgids(dst, f.getFreePageIDs(), m)
 }
 
+// pendingIDs returns the sorted pending ids, split into those that become
+// free once no transaction is open and those held by snapshots. A page
+// allocated by txid A and freed by txid T is held by a snapshot taken at txid
+// S if A <= S < T. Pages held on load have no allocating txid.
+func (f *freelist) pendingIDs() (free, held pgids) {
+	free = make(pgids, 0, f.pending_count())
+	for tid, txp := range f.pending {
+		if len(f.snapshots) == 0 {
+			free = append(free, txp.ids...)
+			continue
+		}
+		for i, id := range txp.ids {
+			j := sort.Search(len(f.snapshots), func(j int) bool { return f.snapshots[j] >= txp.alloctx[i] })
+			if j < len(f.snapshots) && f.snapshots[j] < tid {
+				held = append(held, id)
+			} else {
+				free = append(free, id)
+			}
+		}
+	}
+	sort.Sort(free)
+	sort.Sort(held)
+	return free, held
+}
+
 // arrayAllocate returns the starting page id of a contiguous list of pages of a given size.
 // If a contiguous block cannot be found then 0 is returned.
 func (f *freelist) arrayAllocate(txid txid, n int) pgid {
@@ -148,6 +195,35 @@ func (f *freelist) arrayAllocate(txid txid, n int) pgid {
 	return 0
 }
 
+// allocateLowest is like allocate but always returns the lowest contiguous
+// block of a given size, as the array and extent backends do anyway.
+func (f *freelist) allocateLowest(txid txid, n int) pgid {
+	if f.freelistType == FreelistMapType {
+		return f.hashmapAllocateLowest(txid, n)
+	}
+	return f.allocate(txid, n)
+}
+
+// trim removes the free page ids from id upwards, so that the high water
+// mark can be lowered to id. Pending ids are kept.
+func (f *freelist) trim(id pgid) {
+	ids := f.getFreePageIDs()
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if i == len(ids) {
+		return
+	}
+	kept := make([]pgid, i)
+	copy(kept, ids)
+
+	// The hashmap is only reset by readIDs when there are ids left.
+	if f.freelistType == FreelistMapType {
+		f.freemaps = make(map[uint64]pidSet)
+		f.forwardMap = make(map[pgid]uint64)
+		f.backwardMap = make(map[pgid]uint64)
+	}
+	f.readIDs(kept)
+}
+
 // free releases a page and its overflow for a given transaction id.
 // If the page is already free then a panic will occur.
 func (f *freelist) free(txid txid, p *page) {
@@ -171,7 +247,7 @@ func (f *freelist) free(txid txid, p *page) {
 
 	for id := p.id; id <= p.id+pgid(p.overflow); id++ {
 		// Verify that page is not already free.
-		if f.cache[id] {
+		if f.freed(id) {
 			panic(fmt.Sprintf("page %d already freed", id))
 		}
 		// Add to the freelist and cache.
@@ -182,7 +258,8 @@ func (f *freelist) free(txid txid, p *page) {
 }
 
 // release moves all page ids for a transaction id (or older) to the freelist.
-func (f *freelist) release(txid txid) {
+// It returns the ids moved.
+func (f *freelist) release(txid txid) pgids {
 	m := make(pgids, 0)
 	for tid, txp := range f.pending {
 		if tid <= txid {
@@ -193,12 +270,14 @@ func (f *freelist) release(txid txid) {
 		}
 	}
 	f.mergeSpans(m)
+	return m
 }
 
 // releaseRange moves pending pages allocated within an extent [begin,end] to the free list.
-func (f *freelist) releaseRange(begin, end txid) {
+// It returns the ids moved.
+func (f *freelist) releaseRange(begin, end txid) pgids {
 	if begin > end {
-		return
+		return nil
 	}
 	var m pgids
 	for tid, txp := range f.pending {
@@ -226,6 +305,7 @@ func (f *freelist) releaseRange(begin, end txid) {
 		}
 	}
 	f.mergeSpans(m)
+	return m
 }
 
 // rollback removes the pages from a given pending tx.
@@ -257,6 +337,9 @@ func (f *freelist) rollback(txid txid) {
 
 // freed returns whether a given page is in the free list.
 func (f *freelist) freed(pgid pgid) bool {
+	if f.freelistType == FreelistExtentType && !f.cache[pgid] {
+		return f.extentContains(pgid)
+	}
 	return f.cache[pgid]
 }
 
@@ -265,20 +348,12 @@ func (f *freelist) read(p *page) {
 	if (p.flags & freelistPageFlag) == 0 {
 		panic(fmt.Sprintf("invalid freelist page: %d, page type is %s", p.id, p.typ()))
 	}
-	// If the page.count is at the max uint16 value (64k) then it's considered
-	// an overflow and the size of the freelist is stored as the first element.
-	var idx, count = 0, int(p.count)
-	if count == 0xFFFF {
-		idx = 1
-		c := *(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
-		count = int(c)
-		if count < 0 {
-			panic(fmt.Sprintf("leading element count %d overflows int", c))
-		}
-	}
+	idx, count := freelistElements(p)
 
-	// Copy the list of page ids from the freelist.
-	if count == 0 {
+	// Copy the list of extents or page ids from the freelist.
+	if (p.flags & freelistExtentPageFlag) != 0 {
+		f.readExtentPage(p, idx, count)
+	} else if count == 0 {
 		f.ids = nil
 	} else {
 		var ids []pgid
@@ -307,8 +382,17 @@ func (f *freelist) arrayGetFreePageIDs() []pgid {
 
 // write writes the page ids onto a freelist page. All free and pending ids are
 // saved to disk since in the event of a program crash, all pending ids will
-// become free.
+// become free. Pending ids held by snapshots are the exception: they are
+// listed apart, since the snapshots outlive a crash.
 func (f *freelist) write(p *page) error {
+	free, held := f.pendingIDs()
+
+	// The extent backend writes extents instead of page ids.
+	if f.freelistType == FreelistExtentType {
+		f.writeExtents(p, f.mergedExtents(free), held)
+		return nil
+	}
+
 	// Combine the old free pgids and pgids waiting on an open transaction.
 
 	// Update the header flag.
@@ -316,7 +400,7 @@ func (f *freelist) write(p *page) error {
 
 	// The page.count can only hold up to 64k elements so if we overflow that
 	// number then we handle it by putting the size in the first element.
-	l := f.count()
+	l := f.free_count() + len(free)
 	if l == 0 {
 		p.count = uint16(l)
 	} else if l < 0xFFFF {
@@ -324,19 +408,78 @@ func (f *freelist) write(p *page) error {
 		var ids []pgid
 		data := unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))
 		unsafeSlice(unsafe.Pointer(&ids), data, l)
-		f.copyall(ids)
+		mergepgids(ids, f.getFreePageIDs(), free)
 	} else {
 		p.count = 0xFFFF
 		var ids []pgid
 		data := unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))
 		unsafeSlice(unsafe.Pointer(&ids), data, l+1)
 		ids[0] = pgid(l)
-		f.copyall(ids[1:])
+		mergepgids(ids[1:], f.getFreePageIDs(), free)
 	}
+	f.writeHeld(p, held)
 
 	return nil
 }
 
+// freelistElements returns the index of the first element of a freelist page and the
+// number of page ids or extents stored from there.
+func freelistElements(p *page) (idx, count int) {
+	// If the page.count is at the max uint16 value (64k) then it's considered
+	// an overflow and the size of the freelist is stored as the first element.
+	idx, count = 0, int(p.count)
+	if count == 0xFFFF {
+		idx = 1
+		c := *(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
+		count = int(c)
+		if count < 0 {
+			panic(fmt.Sprintf("leading element count %d overflows int", c))
+		}
+	}
+	return idx, count
+}
+
+// writeHeld lists the ids held by snapshots on a freelist page, after the
+// free pages, as their count followed by the ids. Pages written while there
+// are snapshots are flagged with freelistHeldPageFlag, even if the snapshots
+// hold no pages.
+func (f *freelist) writeHeld(p *page, held pgids) {
+	if len(f.snapshots) == 0 {
+		return
+	}
+	idx, count := freelistElements(p)
+	if p.flags&freelistExtentPageFlag != 0 {
+		count *= 2
+	}
+	var elems []pgid
+	data := unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(pgid(0)), idx+count)
+	unsafeSlice(unsafe.Pointer(&elems), data, len(held)+1)
+	elems[0] = pgid(len(held))
+	copy(elems[1:], held)
+	p.flags |= freelistHeldPageFlag
+}
+
+// readHeld returns the ids held by snapshots listed on a freelist page.
+func readHeld(p *page) []pgid {
+	if p.flags&freelistHeldPageFlag == 0 {
+		return nil
+	}
+	idx, count := freelistElements(p)
+	if p.flags&freelistExtentPageFlag != 0 {
+		count *= 2
+	}
+	data := unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(pgid(0)), idx+count)
+	n := int(*(*pgid)(data))
+	if n == 0 {
+		return nil
+	}
+	var elems []pgid
+	unsafeSlice(unsafe.Pointer(&elems), unsafeAdd(data, unsafe.Sizeof(pgid(0))), n)
+	held := make([]pgid, n)
+	copy(held, elems)
+	return held
+}
+
 // reload reads the freelist from a page and filters out pending items.
 func (f *freelist) reload(p *page) {
 	f.read(p)
@@ -383,9 +526,36 @@ func (f *freelist) noSyncReload(pgids []pgid) {
 	f.readIDs(a)
 }
 
+// hold moves free pages back to the pending list of txid so that they are not
+// reused. They are released once no transaction before txid is open.
+func (f *freelist) hold(txid txid, ids []pgid) {
+	if len(ids) == 0 {
+		return
+	}
+	held := make(map[pgid]bool, len(ids))
+	txp := f.pending[txid]
+	if txp == nil {
+		txp = &txPending{}
+		f.pending[txid] = txp
+	}
+	for _, id := range ids {
+		if !held[id] {
+			held[id] = true
+			txp.ids = append(txp.ids, id)
+			txp.alloctx = append(txp.alloctx, 0)
+		}
+	}
+	f.noSyncReload(f.getFreePageIDs())
+}
+
 // reindex rebuilds the free cache based on available and pending free lists.
+// The extent backend only caches pending ids, and looks up free ones in the
+// extent treap.
 func (f *freelist) reindex() {
-	ids := f.getFreePageIDs()
+	var ids []pgid
+	if f.freelistType != FreelistExtentType {
+		ids = f.getFreePageIDs()
+	}
 	f.cache = make(map[pgid]bool, len(ids))
 	for _, id := range ids {
 		f.cache[id] = true
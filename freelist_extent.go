@@ -0,0 +1,308 @@
+package dbolt
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// extent is a run of contiguous free pages.
+type extent struct {
+	start pgid
+	size  uint64
+}
+
+// extentNode is a node of a treap of disjoint extents ordered by start. Every
+// node also records the largest extent in its subtree, which leads the search
+// for the lowest extent of a given size down a single path.
+type extentNode struct {
+	extent
+	priority    uint32
+	max         uint64 // size of the largest extent in the subtree
+	left, right *extentNode
+}
+
+// update recomputes the largest extent of the subtree of n.
+func (n *extentNode) update() {
+	n.max = n.size
+	if n.left != nil && n.left.max > n.max {
+		n.max = n.left.max
+	}
+	if n.right != nil && n.right.max > n.max {
+		n.max = n.right.max
+	}
+}
+
+// splitExtents splits the treap t into the extents starting before id and
+// those starting at id or later.
+func splitExtents(t *extentNode, id pgid) (*extentNode, *extentNode) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.start < id {
+		l, r := splitExtents(t.right, id)
+		t.right = l
+		t.update()
+		return t, r
+	}
+	l, r := splitExtents(t.left, id)
+	t.left = r
+	t.update()
+	return l, t
+}
+
+// mergeExtents joins the treaps l and r, where every extent of l starts
+// before those of r.
+func mergeExtents(l, r *extentNode) *extentNode {
+	if l == nil {
+		return r
+	} else if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l.right = mergeExtents(l.right, r)
+		l.update()
+		return l
+	}
+	r.left = mergeExtents(l, r.left)
+	r.update()
+	return r
+}
+
+// extentInsert adds e to the extent treap. It must not overlap or touch an
+// extent already there.
+func (f *freelist) extentInsert(e extent) {
+	// A xorshift generator is enough to keep the treap balanced.
+	f.extentSeed ^= f.extentSeed << 13
+	f.extentSeed ^= f.extentSeed >> 17
+	f.extentSeed ^= f.extentSeed << 5
+
+	n := &extentNode{extent: e, priority: f.extentSeed, max: e.size}
+	l, r := splitExtents(f.extents, e.start)
+	f.extents = mergeExtents(mergeExtents(l, n), r)
+	f.extentFree += int(e.size)
+	f.extentCount++
+}
+
+// extentRemove removes the extent starting at start from the extent treap
+// and returns it.
+func (f *freelist) extentRemove(start pgid) extent {
+	l, r := splitExtents(f.extents, start)
+	n, r := splitExtents(r, start+1)
+	_assert(n != nil && n.left == nil && n.right == nil, "extent %d not found", start)
+	f.extents = mergeExtents(l, r)
+	f.extentFree -= int(n.size)
+	f.extentCount--
+	return n.extent
+}
+
+// extentFloor returns the extent starting at id or the closest one before
+// it, or nil if there is none.
+func (f *freelist) extentFloor(id pgid) *extent {
+	var e *extent
+	for n := f.extents; n != nil; {
+		if n.start <= id {
+			e = &n.extent
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return e
+}
+
+// extentContains returns whether id is in a free extent.
+func (f *freelist) extentContains(id pgid) bool {
+	e := f.extentFloor(id)
+	return e != nil && id < e.start+pgid(e.size)
+}
+
+// extentLowest returns the lowest extent of at least n pages, or nil if there
+// is none.
+func (f *freelist) extentLowest(size uint64) *extent {
+	t := f.extents
+	if t == nil || t.max < size {
+		return nil
+	}
+	for {
+		if t.left != nil && t.left.max >= size {
+			t = t.left
+		} else if t.size >= size {
+			return &t.extent
+		} else {
+			t = t.right
+		}
+	}
+}
+
+// forEachExtent calls fn with every free extent in order.
+func (f *freelist) forEachExtent(fn func(e extent)) {
+	var walk func(n *extentNode)
+	walk = func(n *extentNode) {
+		if n == nil {
+			return
+		}
+		walk(n.left)
+		fn(n.extent)
+		walk(n.right)
+	}
+	walk(f.extents)
+}
+
+// extentAllocate serves the same purpose as arrayAllocate, but finds the
+// lowest contiguous block in O(log n) using the extent treap.
+func (f *freelist) extentAllocate(txid txid, n int) pgid {
+	if n == 0 {
+		return 0
+	}
+	e := f.extentLowest(uint64(n))
+	if e == nil {
+		return 0
+	}
+	if e.start <= 1 {
+		panic(fmt.Sprintf("invalid page allocation: %d", e.start))
+	}
+
+	found := f.extentRemove(e.start)
+	if remain := found.size - uint64(n); remain > 0 {
+		f.extentInsert(extent{start: found.start + pgid(n), size: remain})
+	}
+	f.allocs[found.start] = txid
+	return found.start
+}
+
+// extentFreeCount returns count of free pages(extent version)
+func (f *freelist) extentFreeCount() int {
+	return f.extentFree
+}
+
+// extentMergeSpans adds ids to the extent treap, merging them with the
+// extents next to them. They leave the cache, which only holds pending ids.
+func (f *freelist) extentMergeSpans(ids pgids) {
+	for _, id := range ids {
+		delete(f.cache, id)
+		e := extent{start: id, size: 1}
+		if prev := f.extentFloor(id - 1); prev != nil && prev.start+pgid(prev.size) == id {
+			prev := f.extentRemove(prev.start)
+			e.start, e.size = prev.start, prev.size+1
+		}
+		if next := f.extentFloor(id + 1); next != nil && next.start == id+1 {
+			next := f.extentRemove(next.start)
+			e.size += next.size
+		}
+		f.extentInsert(e)
+	}
+}
+
+// extentGetFreePageIDs returns the sorted free page ids
+func (f *freelist) extentGetFreePageIDs() []pgid {
+	if f.extentFree == 0 {
+		return nil
+	}
+	m := make([]pgid, 0, f.extentFree)
+	f.forEachExtent(func(e extent) {
+		for i := pgid(0); i < pgid(e.size); i++ {
+			m = append(m, e.start+i)
+		}
+	})
+	return m
+}
+
+// extentReadIDs initializes the freelist from a sorted list of ids.
+func (f *freelist) extentReadIDs(ids []pgid) {
+	f.extents, f.extentFree, f.extentCount = nil, 0, 0
+	for i := 0; i < len(ids); {
+		j := i + 1
+		for j < len(ids) && ids[j] == ids[j-1]+1 {
+			j++
+		}
+		f.extentInsert(extent{start: ids[i], size: uint64(j - i)})
+		i = j
+	}
+	f.reindex()
+}
+
+// mergedExtents returns the free extents with the sorted pending ids merged
+// in.
+func (f *freelist) mergedExtents(pending pgids) []extent {
+	var extents []extent
+	add := func(e extent) {
+		if last := len(extents) - 1; last >= 0 && extents[last].start+pgid(extents[last].size) == e.start {
+			extents[last].size += e.size
+		} else {
+			extents = append(extents, e)
+		}
+	}
+	f.forEachExtent(func(e extent) {
+		for len(pending) > 0 && pending[0] < e.start {
+			add(extent{start: pending[0], size: 1})
+			pending = pending[1:]
+		}
+		add(e)
+	})
+	for _, id := range pending {
+		add(extent{start: id, size: 1})
+	}
+	return extents
+}
+
+// writeExtents writes extents onto a freelist page, followed by the ids held
+// by snapshots. Each extent takes two elements, its start and its size.
+func (f *freelist) writeExtents(p *page, extents []extent, held pgids) {
+	p.flags |= freelistPageFlag | freelistExtentPageFlag
+
+	// Like page ids, the number of extents is stored in the first element
+	// if it does not fit in page.count.
+	var elems []pgid
+	data := unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))
+	if len(extents) < 0xFFFF {
+		p.count = uint16(len(extents))
+		unsafeSlice(unsafe.Pointer(&elems), data, 2*len(extents))
+	} else {
+		p.count = 0xFFFF
+		unsafeSlice(unsafe.Pointer(&elems), data, 2*len(extents)+1)
+		elems[0] = pgid(len(extents))
+		elems = elems[1:]
+	}
+	for i, e := range extents {
+		elems[2*i], elems[2*i+1] = e.start, pgid(e.size)
+	}
+	f.writeHeld(p, held)
+}
+
+// readExtents returns the extents stored on a freelist page, sorted.
+func readExtents(p *page, idx, count int) []extent {
+	var elems []pgid
+	data := unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(pgid(0)), idx)
+	unsafeSlice(unsafe.Pointer(&elems), data, 2*count)
+
+	extents := make([]extent, count)
+	for i := range extents {
+		extents[i] = extent{start: elems[2*i], size: uint64(elems[2*i+1])}
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].start < extents[j].start })
+	return extents
+}
+
+// readExtentPage initializes the freelist from a freelist page of extents.
+// The extent backend reads them as they are; the others expand them into
+// page ids.
+func (f *freelist) readExtentPage(p *page, idx, count int) {
+	extents := readExtents(p, idx, count)
+	if f.freelistType != FreelistExtentType {
+		var ids []pgid
+		for _, e := range extents {
+			for i := pgid(0); i < pgid(e.size); i++ {
+				ids = append(ids, e.start+i)
+			}
+		}
+		f.readIDs(ids)
+		return
+	}
+
+	f.extents, f.extentFree, f.extentCount = nil, 0, 0
+	for _, e := range extents {
+		f.extentInsert(e)
+	}
+	f.reindex()
+}
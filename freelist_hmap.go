@@ -60,6 +60,35 @@ func (f *freelist) hashmapAllocate(txid txid, n int) pgid {
 	return 0
 }
 
+// hashmapAllocateLowest is like hashmapAllocate but takes the lowest span
+// that is large enough.
+func (f *freelist) hashmapAllocateLowest(txid txid, n int) pgid {
+	if n == 0 {
+		return 0
+	}
+
+	var pid pgid
+	var size uint64
+	for start, sz := range f.forwardMap {
+		if sz >= uint64(n) && (pid == 0 || start < pid) {
+			pid, size = start, sz
+		}
+	}
+	if pid == 0 {
+		return 0
+	}
+
+	f.delSpan(pid, size)
+	f.allocs[pid] = txid
+	if remain := size - uint64(n); remain > 0 {
+		f.addSpan(pid+pgid(n), remain)
+	}
+	for i := pgid(0); i < pgid(n); i++ {
+		delete(f.cache, pid+i)
+	}
+	return pid
+}
+
 // hashmapReadIDs reads pgids as input an initial the freelist(hashmap version)
 func (f *freelist) hashmapReadIDs(pgids []pgid) {
 	f.init(pgids)
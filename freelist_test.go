@@ -414,6 +414,135 @@ func TestFreelist_map_allocate(t *testing.T) {
 	}
 }
 
+// Ensure that the lowest span that fits is allocated first.
+func TestFreelist_map_allocateLowest(t *testing.T) {
+	f := newTestMapFreelist()
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
+
+	for _, tt := range []struct {
+		n   int
+		exp pgid
+	}{{1, 3}, {2, 4}, {2, 6}, {1, 9}, {2, 12}, {2, 0}, {1, 18}} {
+		if id := f.allocateLowest(1, tt.n); id != tt.exp {
+			t.Fatalf("allocateLowest(%d): exp=%d; got=%d", tt.n, tt.exp, id)
+		}
+	}
+	if x := f.free_count(); x != 0 {
+		t.Fatalf("exp=0; got=%v", x)
+	}
+}
+
+// Ensure that the extent freelist allocates the lowest span that fits.
+func TestFreelist_extent_allocate(t *testing.T) {
+	f := newTestExtentFreelist()
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
+
+	for _, tt := range []struct {
+		n   int
+		exp pgid
+	}{{3, 3}, {0, 0}, {2, 6}, {1, 9}, {2, 12}, {2, 0}, {1, 18}} {
+		if id := f.allocate(1, tt.n); id != tt.exp {
+			t.Fatalf("allocate(%d): exp=%d; got=%d", tt.n, tt.exp, id)
+		}
+	}
+	if x := f.free_count(); x != 0 {
+		t.Fatalf("exp=0; got=%v", x)
+	}
+}
+
+// Ensure that released pages merge with the extents next to them.
+func TestFreelist_extent_release(t *testing.T) {
+	f := newTestExtentFreelist()
+	f.readIDs([]pgid{3, 4, 9})
+	f.free(100, &page{id: 5, overflow: 2})
+	f.free(100, &page{id: 10})
+	f.free(101, &page{id: 8})
+	f.release(100)
+	if exp := []extent{{3, 5}, {9, 2}}; !reflect.DeepEqual(exp, extentsOf(f)) {
+		t.Fatalf("exp=%v; got=%v", exp, extentsOf(f))
+	}
+
+	f.release(101)
+	if exp := []extent{{3, 8}}; !reflect.DeepEqual(exp, extentsOf(f)) {
+		t.Fatalf("exp=%v; got=%v", exp, extentsOf(f))
+	}
+	if x := f.free_count(); x != 8 {
+		t.Fatalf("exp=8; got=%v", x)
+	}
+	if id := f.allocate(1, 8); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+}
+
+// Ensure that the extent freelist allocates the same pages as the array
+// freelist, which also takes the lowest span that fits.
+func TestFreelist_extent_matchesArray(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	a, e := newTestArrayFreelist(), newTestExtentFreelist()
+	var ids []pgid
+	for id := pgid(2); id < 10000; id++ {
+		if rng.Intn(3) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	a.readIDs(ids)
+	e.readIDs(ids)
+
+	var allocated []pgid
+	for i := 0; i < 5000; i++ {
+		txid := txid(i + 1)
+		if rng.Intn(2) == 0 || len(allocated) == 0 {
+			n := rng.Intn(8) + 1
+			id := a.allocate(txid, n)
+			if got := e.allocate(txid, n); got != id {
+				t.Fatalf("allocate(%d) #%d: exp=%d; got=%d", n, i, id, got)
+			}
+			if id != 0 {
+				allocated = append(allocated, id)
+			}
+		} else {
+			j := rng.Intn(len(allocated))
+			id := allocated[j]
+			allocated = append(allocated[:j], allocated[j+1:]...)
+			for _, f := range []*freelist{a, e} {
+				f.free(txid, &page{id: id})
+				f.release(txid)
+			}
+		}
+	}
+	if exp, got := a.getFreePageIDs(), e.getFreePageIDs(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("free ids differ: exp=%d ids; got=%d ids", len(exp), len(got))
+	}
+	if exp, got := a.free_count(), e.free_count(); exp != got {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+}
+
+// Ensure that trimming drops free ids from a given id upwards.
+func TestFreelist_trim(t *testing.T) {
+	for _, f := range []*freelist{newTestArrayFreelist(), newTestMapFreelist(), newTestExtentFreelist()} {
+		f.readIDs([]pgid{3, 4, 5, 9, 12, 13, 18})
+		f.pending[100] = &txPending{ids: []pgid{20}, alloctx: []txid{0}}
+		f.cache[20] = true
+
+		f.trim(12)
+		if exp, got := []pgid{3, 4, 5, 9}, f.getFreePageIDs(); !reflect.DeepEqual(exp, got) {
+			t.Fatalf("%s: exp=%v; got=%v", f.freelistType, exp, got)
+		}
+		if f.freed(13) || !f.freed(9) || !f.freed(20) {
+			t.Fatalf("%s: unexpected cache: %v", f.freelistType, f.cache)
+		}
+
+		f.trim(3)
+		if got := f.getFreePageIDs(); len(got) != 0 {
+			t.Fatalf("%s: exp=[]; got=%v", f.freelistType, got)
+		}
+		if id := f.allocate(1, 1); id != 0 {
+			t.Fatalf("%s: exp=0; got=%d", f.freelistType, id)
+		}
+	}
+}
+
 // Ensure that a freelist can deserialize from a freelist page.
 func TestFreelist_array_read(t *testing.T) {
 	// Create a page.
@@ -509,6 +638,101 @@ func TestFreelist_map_write(t *testing.T) {
 		t.Fatalf("exp=%v; got=%v", exp, f2.getFreePageIDs())
 	}
 }
+
+// Ensure that an extent freelist writes extents that every freelist reads.
+func TestFreelist_extent_write(t *testing.T) {
+	var buf [4096]byte
+	f := newTestExtentFreelist()
+
+	f.readIDs([]pgid{12, 13, 14, 39})
+	f.pending[100] = &txPending{ids: []pgid{28, 11}}
+	f.pending[101] = &txPending{ids: []pgid{3, 15}}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.flags&freelistExtentPageFlag == 0 || p.count != 4 {
+		t.Fatalf("unexpected page: flags=%x; count=%d", p.flags, p.count)
+	}
+	if sz, exp := f.size(), int(pageHeaderSize)+8*2*4; sz < exp {
+		t.Fatalf("size below written size: exp>=%d; got=%d", exp, sz)
+	}
+
+	for _, f2 := range []*freelist{newTestArrayFreelist(), newTestMapFreelist(), newTestExtentFreelist()} {
+		f2.read(p)
+		if exp := []pgid{3, 11, 12, 13, 14, 15, 28, 39}; !reflect.DeepEqual(exp, f2.getFreePageIDs()) {
+			t.Fatalf("%s: exp=%v; got=%v", f2.freelistType, exp, f2.getFreePageIDs())
+		}
+	}
+}
+
+// Ensure that pending pages still used by a snapshot are written apart from
+// the free pages.
+func TestFreelist_write_held(t *testing.T) {
+	for _, f := range []*freelist{newTestArrayFreelist(), newTestMapFreelist(), newTestExtentFreelist()} {
+		var buf [4096]byte
+		f.readIDs([]pgid{12, 13})
+		f.snapshots = []txid{5}
+		f.pending[10] = &txPending{ids: []pgid{14, 20}, alloctx: []txid{3, 7}}
+		f.pending[4] = &txPending{ids: []pgid{30}, alloctx: []txid{2}}
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if err := f.write(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.flags&freelistHeldPageFlag == 0 {
+			t.Fatalf("%s: unexpected flags: %x", f.freelistType, p.flags)
+		}
+
+		f2 := newTestArrayFreelist()
+		f2.read(p)
+		if exp := []pgid{12, 13, 20, 30}; !reflect.DeepEqual(exp, f2.getFreePageIDs()) {
+			t.Fatalf("%s: exp=%v; got=%v", f.freelistType, exp, f2.getFreePageIDs())
+		}
+		if exp, held := []pgid{14}, readHeld(p); !reflect.DeepEqual(exp, held) {
+			t.Fatalf("%s: exp=%v; got=%v", f.freelistType, exp, held)
+		}
+	}
+}
+
+// Ensure that an extent freelist only caches pending pages and finds free
+// pages in its extents.
+func TestFreelist_extent_freed(t *testing.T) {
+	f := newTestExtentFreelist()
+	f.readIDs([]pgid{3, 4, 5, 9})
+	f.free(100, &page{id: 12})
+	if len(f.cache) != 1 || !f.freed(4) || !f.freed(12) || f.freed(6) {
+		t.Fatalf("unexpected cache: %v", f.cache)
+	}
+
+	f.release(100)
+	if len(f.cache) != 0 || !f.freed(12) {
+		t.Fatalf("unexpected cache: %v", f.cache)
+	}
+	if id := f.allocate(1, 3); id != 3 || f.freed(4) || !f.freed(9) {
+		t.Fatalf("unexpected allocation: %d", id)
+	}
+}
+
+// Ensure that an extent freelist reads a freelist page of page ids.
+func TestFreelist_extent_read(t *testing.T) {
+	var buf [4096]byte
+	f := newTestArrayFreelist()
+	f.readIDs([]pgid{3, 4, 5, 9, 23})
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := newTestExtentFreelist()
+	f2.read(p)
+	if exp := []extent{{3, 3}, {9, 1}, {23, 1}}; !reflect.DeepEqual(exp, extentsOf(f2)) {
+		t.Fatalf("exp=%v; got=%v", exp, extentsOf(f2))
+	}
+	if !f2.freed(4) || f2.freed(6) {
+		t.Fatalf("unexpected cache: %v", f2.cache)
+	}
+}
+
 func BenchmarkFreelist_array_Release10K(b *testing.B)   { benchmark_FreelistRelease(b, 10000, true) }
 func BenchmarkFreelist_array_Release100K(b *testing.B)  { benchmark_FreelistRelease(b, 100000, true) }
 func BenchmarkFreelist_array_Release1000K(b *testing.B) { benchmark_FreelistRelease(b, 1000000, true) }
@@ -675,3 +899,15 @@ func newTestMapFreelist() *freelist {
 
 	return newFreelist(freelistType)
 }
+
+// newTestExtentFreelist returns an extent freelist.
+func newTestExtentFreelist() *freelist {
+	return newFreelist(FreelistExtentType)
+}
+
+// extentsOf returns the free extents of f in order.
+func extentsOf(f *freelist) []extent {
+	var extents []extent
+	f.forEachExtent(func(e extent) { extents = append(extents, e) })
+	return extents
+}
@@ -6,6 +6,37 @@ import (
 	"unsafe"
 )
 
+// Meta flags record optional on-disk format features. The trailer flags are
+// fixed when the database file is created; the others are set by the commits
+// that start using the feature. A meta page with a flag this binary does not
+// know is rejected, since its pages cannot be read correctly.
+const (
+	// metaFlagPageChecksum marks every leaf, branch and freelist page as
+	// carrying a CRC32C trailer.
+	metaFlagPageChecksum = 0x01
+
+	// metaFlagEncrypted marks every leaf, branch and freelist page as
+	// encrypted, with the key id, nonce and tag in the page trailer.
+	metaFlagEncrypted = 0x02
+
+	// metaFlagPageTxid marks every leaf, branch and freelist page as
+	// recording the id of the transaction that wrote it in the page trailer.
+	metaFlagPageTxid = 0x04
+
+	// metaFlagSnapshots marks the meta page as holding the page id of the
+	// snapshot directory, and the freelist page as listing the pages held by
+	// snapshots.
+	metaFlagSnapshots = 0x08
+
+	// metaFlagFreelistExtents marks the freelist page as holding extents
+	// rather than page ids. See freelist.writeExtents.
+	metaFlagFreelistExtents = 0x10
+
+	// metaFlagsKnown holds every flag this binary understands.
+	metaFlagsKnown = metaFlagPageChecksum | metaFlagEncrypted | metaFlagPageTxid | metaFlagSnapshots |
+		metaFlagFreelistExtents
+)
+
 type meta struct {
 	magic    uint32
 	version  uint32
@@ -16,6 +47,12 @@ type meta struct {
 	pgid     pgid
 	txid     txid
 	checksum uint64
+
+	// Fields added after the checksum are only covered by it while their
+	// flag is set, so that older meta pages keep their checksum.
+	snapshots pgid   // snapshot directory, with metaFlagSnapshots
+	sealKey   uint32 // key id counted by seals, with metaFlagEncrypted
+	seals     uint64 // pages encrypted under sealKey, with metaFlagEncrypted
 }
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
@@ -26,10 +63,48 @@ func (m *meta) validate() error {
 		return ErrVersionMismatch
 	} else if m.checksum != 0 && m.checksum != m.sum64() {
 		return ErrChecksum
+	} else if m.flags&^metaFlagsKnown != 0 {
+		return ErrUnsupportedFeature
 	}
 	return nil
 }
 
+// snapshotDirectory returns the page id of the snapshot directory, or 0 if
+// there are no snapshots.
+func (m *meta) snapshotDirectory() pgid {
+	if m.flags&metaFlagSnapshots == 0 {
+		return 0
+	}
+	return m.snapshots
+}
+
+// setSnapshotDirectory records id as the page id of the snapshot directory,
+// or records that there are no snapshots if id is 0.
+func (m *meta) setSnapshotDirectory(id pgid) {
+	m.snapshots = id
+	if id == 0 {
+		m.flags &^= metaFlagSnapshots
+	} else {
+		m.flags |= metaFlagSnapshots
+	}
+}
+
+// trailerSize returns the number of bytes reserved at the end of every data
+// page span for the optional page trailer.
+func (m *meta) trailerSize() int {
+	var sz int
+	if m.flags&metaFlagPageTxid != 0 {
+		sz += pageTxidSize
+	}
+	if m.flags&metaFlagPageChecksum != 0 {
+		sz += pageChecksumSize
+	}
+	if m.flags&metaFlagEncrypted != 0 {
+		sz += pageEncryptionSize
+	}
+	return sz
+}
+
 // copy copies one meta object to another.
 func (m *meta) copy(dest *meta) {
 	*dest = *m
@@ -42,6 +117,8 @@ func (m *meta) write(p *page) {
 	} else if m.freelist >= m.pgid && m.freelist != pgidNoFreelist {
 		// TODO: reject pgidNoFreeList if !NoFreelistSync
 		panic(fmt.Sprintf("freelist pgid (%d) above high water mark (%d)", m.freelist, m.pgid))
+	} else if m.snapshotDirectory() >= m.pgid {
+		panic(fmt.Sprintf("snapshot directory pgid (%d) above high water mark (%d)", m.snapshots, m.pgid))
 	}
 
 	// Page id is either going to be 0 or 1 which we can determine by the transaction ID.
@@ -58,5 +135,12 @@ func (m *meta) write(p *page) {
 func (m *meta) sum64() uint64 {
 	h := fnv.New64a()
 	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	if m.flags&metaFlagSnapshots != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(m.snapshots)]byte)(unsafe.Pointer(&m.snapshots))[:])
+	}
+	if m.flags&metaFlagEncrypted != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(m.sealKey)]byte)(unsafe.Pointer(&m.sealKey))[:])
+		_, _ = h.Write((*[unsafe.Sizeof(m.seals)]byte)(unsafe.Pointer(&m.seals))[:])
+	}
 	return h.Sum64()
 }
@@ -0,0 +1,99 @@
+package dbolt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// Ensure that the snapshot directory is marked by a meta flag.
+func TestMeta_SnapshotsFlag(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.CreateSnapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m := db.meta(); m.flags&metaFlagSnapshots == 0 || m.snapshotDirectory() == 0 {
+		t.Fatalf("unexpected meta: flags=%#x, directory=%d", m.flags, m.snapshotDirectory())
+	}
+	if err := db.DropSnapshot("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m := db.meta(); m.flags&metaFlagSnapshots != 0 || m.root.sequence != 0 {
+		t.Fatalf("unexpected meta: flags=%#x, sequence=%d", m.flags, m.root.sequence)
+	}
+}
+
+// Ensure that a freelist written as extents is marked by a meta flag, which is
+// cleared once the freelist is written as page ids again.
+func TestMeta_FreelistExtentsFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	for _, typ := range []FreelistType{FreelistExtentType, FreelistArrayType} {
+		db, err := Open(path, 0666, &Options{FreelistType: typ})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if set := db.meta().flags&metaFlagFreelistExtents != 0; set != (typ == FreelistExtentType) {
+			t.Fatalf("%s: unexpected flags: %#x", typ, db.meta().flags)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a database whose latest meta page uses an unknown flag is
+// refused rather than opened at the previous meta page.
+func TestMeta_UnsupportedFeature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize, id := db.pageSize, int(db.meta().txid%2)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+		t.Fatal(err)
+	}
+	m := (*page)(unsafe.Pointer(&buf[0])).meta()
+	m.flags |= 0x80000000
+	m.checksum = m.sum64()
+	if _, err := f.WriteAt(buf, int64(id*pageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(path, 0666, nil); err != ErrUnsupportedFeature {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -10,6 +10,8 @@ const (
 	DefaultMaxBatchSize  int = 1000
 	DefaultMaxBatchDelay     = 10 * time.Millisecond
 	DefaultAllocSize         = 16 * 1024 * 1024
+
+	DefaultMaxWriteBatchSize = 4 * 1024 * 1024
 )
 
 // Options represents the options that can be set when opening a database.
@@ -26,10 +28,13 @@ type Options struct {
 	// under normal operation, but requires a full database re-sync during recovery.
 	NoFreelistSync bool
 
-	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
+	// FreelistType sets the backend freelist type. There are three options. Array which is simple but endures
 	// dramatic performance degradation if database is large and framentation in freelist is common.
 	// The alternative one is using hashmap, it is faster in almost all circumstances
 	// but it doesn't guarantee that it offers the smallest page id available. In normal case it is safe.
+	// The extent type keeps runs of free pages in a tree, allocates the smallest page id available
+	// in O(log n) and writes the freelist as runs, which keeps it small when millions of pages are
+	// free. Its freelist pages can be read by all types, but not by versions without it.
 	// The default type is array
 	FreelistType FreelistType
 
@@ -53,6 +58,61 @@ type Options struct {
 	// PageSize overrides the default OS page size.
 	PageSize int
 
+	// SegmentSize stores the database as a directory of segment files of
+	// SegmentSize bytes each, named data.000, data.001 and so on, instead of
+	// a single file. It must be a multiple of the page size and of the OS
+	// page size. The segment size of an existing database with more than one
+	// segment takes precedence. A database at a directory path is always
+	// opened as segmented, with DefaultSegmentSize if this is zero. Not
+	// supported on Windows.
+	SegmentSize int
+
+	// PageChecksum stores a CRC32C checksum in a trailer on every leaf,
+	// branch and freelist page. Pages are verified when first read by a
+	// transaction and again by Tx.Check. It only takes effect when a new
+	// database file is created; existing files keep the setting they were
+	// created with.
+	PageChecksum bool
+
+	// PageTxid records in a trailer on every leaf, branch and freelist page
+	// the id of the transaction that last wrote it, which lets
+	// Tx.WriteIncrementalTo copy only the pages changed since an earlier
+	// backup. Like PageChecksum it only takes effect when a new database file
+	// is created.
+	PageTxid bool
+
+	// Encryption enables page-level encryption at rest. Like PageChecksum it
+	// is fixed when the database file is created: opening an encrypted file
+	// without it returns ErrEncrypted and opening a plain file with it
+	// returns ErrNotEncrypted. See Encryption for details.
+	Encryption *Encryption
+
+	// WAL enables write-ahead log mode. Commits append their dirty pages and
+	// meta page to a log, and sync it once instead of writing and syncing the
+	// data file twice. The log is a file next to the data file, named after
+	// it with a "-wal" suffix, or is kept by a LogStorage. It is checkpointed
+	// into the data file in the background once it reaches
+	// WALCheckpointSize, by DB.Checkpoint and on Close.
+	// Open replays a log left behind by a crash whether or not WAL is set.
+	// OpenTemp ignores this option.
+	WAL bool
+
+	// WALCheckpointSize is the size in bytes the write-ahead log may reach
+	// before it is checkpointed. Defaults to DefaultWALCheckpointSize. The
+	// pages of the log are also held in memory, so a commit that leaves the
+	// log at twice this size checkpoints it before returning.
+	WALCheckpointSize int
+
+	// Storage keeps the database in the given Storage instead of the file at
+	// the path passed to Open, which then only names the database. The
+	// storage is closed when the database is, or when Open fails. SegmentSize
+	// is ignored, and so is WAL unless the storage is a LogStorage.
+	Storage Storage
+
+	// InMemory makes Open ignore the path and keep the database in memory
+	// instead, as OpenMemory does.
+	InMemory bool
+
 	// NoSync sets the initial value of DB.NoSync. Normally this can just be
 	// set directly on the DB itself when returned from Open(), but this option
 	// is useful in APIs which expose Options but not the underlying DB.
@@ -62,6 +122,46 @@ type Options struct {
 	// is useful for writing hermetic tests.
 	OpenFile func(string, int, os.FileMode) (*os.File, error)
 
+	// PunchFreePages deallocates the disk blocks of long runs of free pages
+	// once no transaction can read them anymore, so that disk usage follows
+	// the live data while the size of the data file stays the same. It is a
+	// cheaper alternative to compaction, but the file gets fragmented as the
+	// pages are reused. Only supported on Linux, for data files and segments.
+	PunchFreePages bool
+
+	// MaxReadTxAge is the age past which a read-only transaction counts as
+	// forgotten: it blocks remaps and keeps writers from reusing the pages it
+	// may read, so the file grows. When set, a watchdog checks the open
+	// read-only transactions twice per MaxReadTxAge and hands each one found
+	// past that age once to OnLongReadTx and, with InvalidateLongReadTx,
+	// invalidates it.
+	MaxReadTxAge time.Duration
+
+	// OnLongReadTx is called by the MaxReadTxAge watchdog, from its own
+	// goroutine, for each read-only transaction past that age.
+	OnLongReadTx func(TxInfo)
+
+	// InvalidateLongReadTx makes the MaxReadTxAge watchdog invalidate the
+	// read-only transactions past that age: reading a page or moving a
+	// cursor through them afterwards panics with ErrTxInvalidated, which
+	// View and Tx.Do return, so that forgotten readers fail and get rolled
+	// back. A transaction begun with DB.Begin and used outside Tx.Do gets
+	// the panic. The pages it pinned are only reused, and remaps unblocked,
+	// once it is rolled back.
+	InvalidateLongReadTx bool
+
+	// RecordTxStack records the stack that began each transaction, for
+	// DB.OpenTransactions and OnLongReadTx.
+	RecordTxStack bool
+
+	// Tracer receives the steps of every transaction, with their timings
+	// and sizes. See Tracer.
+	Tracer Tracer
+
+	// Logger receives the errors that cannot be returned to a caller.
+	// Defaults to the standard logger of the log package.
+	Logger Logger
+
 	// Mlock locks database file in memory when set to true.
 	// It prevents potential page faults, however
 	// used memory can't be reclaimed. (UNIX only)
@@ -71,7 +171,19 @@ type Options struct {
 	MaxBatchDelay time.Duration
 	AllocSize     int
 
+	// MaxWriteBatchSize is the largest number of bytes of contiguous dirty
+	// pages merged into a single vectored write on commit. Defaults to
+	// DefaultMaxWriteBatchSize.
+	MaxWriteBatchSize int
+
+	// StrictMode checks every write transaction on commit, with
+	// StrictModeLevel or else CheckFull. A transaction that fails the check
+	// is rolled back and Commit returns a *CheckError.
 	StrictMode bool
+
+	// StrictModeLevel sets how thoroughly strict mode checks a transaction.
+	// Setting it turns strict mode on. See CheckLevel.
+	StrictModeLevel CheckLevel
 }
 
 // DefaultOptions represent the options used if nil options are passed into Open().
@@ -1,7 +1,9 @@
 package dbolt
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"sort"
 	"unsafe"
@@ -21,13 +23,34 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+
+	// freelistExtentPageFlag marks a freelist page that stores extents of
+	// free pages instead of their ids.
+	freelistExtentPageFlag = 0x20
+
+	// freelistHeldPageFlag marks a freelist page that lists the pages held
+	// by snapshots after the free pages. See freelist.writeHeld.
+	freelistHeldPageFlag = 0x40
 )
 
 const (
 	bucketLeafFlag = 0x01
+
+	// compressedValueFlag marks a value stored compressed with the
+	// compression of its bucket.
+	compressedValueFlag = 0x02
 )
 const pgidNoFreelist pgid = 0xffffffffffffffff
 
+// pageChecksumSize is the size of the CRC32C stored in the page trailer.
+const pageChecksumSize = 4
+
+// pageTxidSize is the size of the transaction id stored in the page trailer.
+const pageTxidSize = 8
+
+// castagnoli is the CRC32C table used for page checksums.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type pgid uint64
 
 type page struct {
@@ -90,6 +113,43 @@ func (p *page) branchPageElements() []branchPageElement {
 	return elems
 }
 
+// span returns the bytes of the page and all of its overflow pages.
+func (p *page) span(pageSize int) []byte {
+	return unsafeByteSlice(unsafe.Pointer(p), 0, 0, (int(p.overflow)+1)*pageSize)
+}
+
+// sum32 computes the CRC32C of the page span, excluding the trailer.
+func (p *page) sum32(pageSize, trailerSize int) uint32 {
+	buf := p.span(pageSize)
+	return crc32.Checksum(buf[:len(buf)-trailerSize], castagnoli)
+}
+
+// setChecksum stores the page checksum at the start of the trailer.
+func (p *page) setChecksum(pageSize, trailerSize int) {
+	buf := p.span(pageSize)
+	binary.LittleEndian.PutUint32(buf[len(buf)-trailerSize:], p.sum32(pageSize, trailerSize))
+}
+
+// checksum returns the page checksum stored in the trailer.
+func (p *page) checksum(pageSize, trailerSize int) uint32 {
+	buf := p.span(pageSize)
+	return binary.LittleEndian.Uint32(buf[len(buf)-trailerSize:])
+}
+
+// setTxid stores the id of the transaction writing the page at the start of
+// the trailer.
+func (p *page) setTxid(pageSize, trailerSize int, id txid) {
+	buf := p.span(pageSize)
+	binary.LittleEndian.PutUint64(buf[len(buf)-trailerSize:], uint64(id))
+}
+
+// txid returns the id of the transaction that wrote the page, stored at the
+// start of the trailer.
+func (p *page) txid(pageSize, trailerSize int) txid {
+	buf := p.span(pageSize)
+	return txid(binary.LittleEndian.Uint64(buf[len(buf)-trailerSize:]))
+}
+
 // dump writes n bytes of the page to STDERR as hex output.
 func (p *page) hexdump(n int) {
 	buf := unsafeByteSlice(unsafe.Pointer(p), 0, 0, n)
@@ -0,0 +1,63 @@
+package dbolt
+
+import "container/list"
+
+// maxVerifiedPages is the number of verified pages a transaction remembers.
+// Scanning a larger database re-verifies pages that fell out of the cache
+// rather than holding a decrypted copy of every page it has read.
+const maxVerifiedPages = 1024
+
+// pageCache is a least recently used cache of the pages a transaction has
+// verified. Decrypted copies are stored with their page; for plaintext pages
+// only the id is remembered, since pointers into the mmap go stale on remap.
+//
+// Evicted copies are left to the garbage collector instead of returning to
+// the page pool: cursors and keys handed to the caller may still point at
+// them.
+type pageCache struct {
+	items map[pgid]*list.Element
+	lru   list.List
+}
+
+type pageCacheEntry struct {
+	id pgid
+	p  *page
+}
+
+// get returns the cached page for an id and whether the id is cached.
+func (c *pageCache) get(id pgid) (*page, bool) {
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*pageCacheEntry).p, true
+}
+
+// put caches a verified page, evicting the least recently used one if the
+// cache is full.
+func (c *pageCache) put(id pgid, p *page) {
+	if c.items == nil {
+		c.items = make(map[pgid]*list.Element)
+	}
+	c.items[id] = c.lru.PushFront(&pageCacheEntry{id: id, p: p})
+	if c.lru.Len() > maxVerifiedPages {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*pageCacheEntry).id)
+	}
+}
+
+// len returns the number of cached pages.
+func (c *pageCache) len() int {
+	return c.lru.Len()
+}
+
+// forEach calls fn for every cached page copy.
+func (c *pageCache) forEach(fn func(*page)) {
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if p := e.Value.(*pageCacheEntry).p; p != nil {
+			fn(p)
+		}
+	}
+}
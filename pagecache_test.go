@@ -0,0 +1,86 @@
+package dbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+// Ensure that the cache evicts the least recently used page once it is full.
+func TestPageCache_Evict(t *testing.T) {
+	var c pageCache
+	for i := pgid(0); i < maxVerifiedPages; i++ {
+		c.put(i, nil)
+	}
+	if _, ok := c.get(0); !ok {
+		t.Fatal("expected page 0 to be cached")
+	}
+	c.put(maxVerifiedPages, nil)
+	if n := c.len(); n != maxVerifiedPages {
+		t.Fatalf("unexpected len: %d", n)
+	}
+	if _, ok := c.get(0); !ok {
+		t.Fatal("expected recently used page 0 to be kept")
+	}
+	if _, ok := c.get(1); ok {
+		t.Fatal("expected page 1 to be evicted")
+	}
+}
+
+// Ensure that scanning and checking an encrypted database larger than the
+// cache keeps a bounded number of decrypted pages.
+func TestPageCache_EncryptedScan(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{Encryption: &Encryption{
+		Key: func(uint32) ([]byte, error) { return bytes.Repeat([]byte{1}, 32), nil },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const n = 3 * maxVerifiedPages
+	value := make([]byte, db.pageSize/2)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, uint64(i))
+			if err := b.Put(k, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var count int
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if binary.BigEndian.Uint64(k) != uint64(count) || len(v) != len(value) {
+				t.Fatalf("unexpected entry %d: %x (%d bytes)", count, k, len(v))
+			}
+			count++
+		}
+		if count != n {
+			t.Fatalf("unexpected count: %d", count)
+		}
+		if l := tx.verified.len(); l > maxVerifiedPages {
+			t.Fatalf("cache grew to %d pages after scan", l)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		if l := tx.verified.len(); l > maxVerifiedPages {
+			t.Fatalf("cache grew to %d pages after check", l)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
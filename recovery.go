@@ -0,0 +1,104 @@
+package dbolt
+
+import (
+	"io"
+	"unsafe"
+)
+
+// minProbePageSize is the smallest page size probed for meta page 1 when
+// meta page 0 is unreadable.
+const minProbePageSize = 512
+
+// RecoveryInfo describes which meta page Open took the state of the database
+// from, and why the other one was passed over.
+type RecoveryInfo struct {
+	Meta     int   // meta page the database was opened from, 0 or 1
+	Meta0Err error // why meta page 0 failed validation, if it did
+	Meta1Err error // why meta page 1 failed validation, if it did
+
+	// PageSizeProbed is set when meta page 0 could not give the page size
+	// and it was found instead by probing for meta page 1.
+	PageSizeProbed bool
+}
+
+// Fallback reports whether a meta page failed validation, in which case the
+// database was opened from the other one and may have lost its last commit.
+func (r RecoveryInfo) Fallback() bool {
+	return r.Meta0Err != nil || r.Meta1Err != nil
+}
+
+// RecoveryInfo returns how Open recovered the state of the database from its
+// meta pages.
+func (db *DB) RecoveryInfo() RecoveryInfo {
+	return db.recovery
+}
+
+// readPageSize returns the page size of the data file from meta page 0, or
+// from meta page 1 probed at every power-of-two page size if meta page 0 is
+// invalid. size is 0 if neither could be found.
+func (db *DB) readPageSize() (size int, probed bool, err error) {
+	metas, size, err := probeMeta(db.storage)
+	if err != nil {
+		return 0, false, ErrInvalid
+	}
+	return size, metas[0] == nil && size != 0, nil
+}
+
+// ProbePageSize returns the page size of the data file read by r, as recorded
+// by meta page 0 or, if that one is invalid, by meta page 1 found at the page
+// size it records. It returns ErrInvalid if neither meta page is valid.
+func ProbePageSize(r io.ReaderAt) (int, error) {
+	if _, size, _ := probeMeta(r); size != 0 {
+		return size, nil
+	}
+	return 0, ErrInvalid
+}
+
+// probeMeta reads both meta pages of the data file read by r, returning nil
+// for an invalid one, and the page size, or 0 if neither is valid. Meta page
+// 1 sits one page into the file: if meta page 0 does not give the page size,
+// it is probed for at every power-of-two page size from minProbePageSize, and
+// must agree with the page size it was found at. err is only set if meta page
+// 0 cannot be read at all.
+func probeMeta(r io.ReaderAt) (metas [2]*meta, pageSize int, err error) {
+	read := func(off int64) (*meta, error) {
+		buf := make([]byte, int(pageHeaderSize)+int(unsafe.Sizeof(meta{})))
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+		m := (*page)(unsafe.Pointer(&buf[0])).meta()
+		if m.validate() != nil || (off != 0 && int64(m.pageSize) != off) {
+			return nil, nil
+		}
+		return m, nil
+	}
+
+	if metas[0], err = read(0); err != nil {
+		return metas, 0, err
+	} else if metas[0] != nil {
+		metas[1], _ = read(int64(metas[0].pageSize))
+		return metas, int(metas[0].pageSize), nil
+	}
+	for sz := int64(minProbePageSize); sz <= int64(^uint32(0)); sz <<= 1 {
+		m, err := read(sz)
+		if err != nil {
+			break
+		} else if m != nil {
+			metas[1] = m
+			return metas, int(sz), nil
+		}
+	}
+	return metas, 0, nil
+}
+
+// recordRecovery records which meta page the freshly mapped database uses.
+func (db *DB) recordRecovery(probed bool) {
+	db.recovery = RecoveryInfo{
+		Meta0Err:       db.meta0.validate(),
+		Meta1Err:       db.meta1.validate(),
+		PageSizeProbed: probed,
+	}
+	if db.meta() == db.meta1 {
+		db.recovery.Meta = 1
+	}
+}
@@ -0,0 +1,653 @@
+package dbolt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+// RepairLostFound is the name of the top-level bucket Repair puts the keys of
+// orphan pages in when it cannot tell which bucket they belong to. It holds a
+// bucket per orphan page, named after the page id.
+var RepairLostFound = []byte("lost+found")
+
+// repairUnknownCompression is the compression orphan pages put in the
+// RepairLostFound bucket are walked with. Like any compression above Flate, it
+// keeps compressed values as they are stored.
+const repairUnknownCompression Compression = 0xFF
+
+// RepairLoss describes a page Repair could not decode. The keys it held, and
+// those of the pages below it that were not found as orphans, are lost.
+type RepairLoss struct {
+	Page   int      // id of the page
+	Bucket [][]byte // path of the bucket it belongs to, nil for the root bucket
+	Err    error    // why the page could not be decoded
+}
+
+// RepairReport describes what Repair salvaged from a data file.
+type RepairReport struct {
+	PageSize    int          // page size the file was read with
+	PageN       int          // number of pages scanned
+	Meta        int          // meta page the buckets were walked from, or -1 if neither is valid
+	Buckets     int          // number of buckets recovered
+	Keys        int          // number of keys recovered
+	Orphans     int          // pages recovered that no page refers to
+	LostFound   int          // orphan pages put in the RepairLostFound bucket
+	Lost        []RepairLoss // pages that could not be decoded
+	SkippedKeys int          // keys whose value could not be decompressed or stored
+}
+
+// Repair salvages the buckets and keys of the data file at path into dst,
+// which should be empty. The file may be too damaged to be opened: both meta
+// pages may be invalid and any page may fail to decode.
+//
+// Buckets are walked from the latest valid meta page, skipping the pages that
+// cannot be decoded. If pages were lost, the leaf and branch pages that no
+// page refers to and that are not free are recovered too: into the bucket
+// whose lost pages covered their keys if there is exactly one, or else into
+// the RepairLostFound bucket. Keys already recovered are not overwritten by
+// those of orphan pages, which may hold older values. The values of orphan
+// pages put in the RepairLostFound bucket are recovered as they are stored,
+// since the compression of their bucket is unknown, and so are those of
+// buckets with a compression this version does not know.
+//
+// The keys are written in transactions of up to txMaxSize bytes, or in a
+// single one if txMaxSize is zero. Encrypted data files are not supported.
+//
+// Only the data file is read. Segmented databases are not supported, and a
+// database whose write-ahead log still holds commits is refused rather than
+// repaired without them: opening the database once checkpoints the log into
+// the data file. A log that cannot be checkpointed must be moved away for the
+// data file to be repaired as of its last checkpoint.
+func Repair(dst *DB, path string, txMaxSize int64) (*RepairReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errors.New("repairing segmented databases is not supported")
+	}
+	if wi, err := os.Stat(path + walSuffix); err == nil && wi.Size() > 0 {
+		return nil, fmt.Errorf("write-ahead log %s holds commits missing from the data file", path+walSuffix)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	r := &repairer{
+		f:      f,
+		w:      repairWriter{db: dst, maxSize: txMaxSize},
+		report: &RepairReport{Meta: -1},
+	}
+	m := r.readMeta()
+	if m != nil && m.flags&metaFlagEncrypted != 0 {
+		return nil, errors.New("repairing encrypted data files is not supported")
+	}
+	r.pageN = pgid(fi.Size() / int64(r.pageSize))
+	if m != nil && m.pgid < r.pageN {
+		r.pageN = m.pgid
+	}
+	r.report.PageSize, r.report.PageN = r.pageSize, int(r.pageN)
+	r.visited = make([]bool, r.pageN)
+
+	if err := r.w.begin(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r.w.tx != nil {
+			_ = r.w.tx.Rollback()
+		}
+	}()
+
+	// Walk the buckets from the meta page, then fall back to the orphan
+	// pages if some pages were lost.
+	if m != nil {
+		r.readFreelist(m)
+		if err := r.walk(m.root.root, nil, NoCompression, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil || len(r.report.Lost) > 0 {
+		if err := r.recoverOrphans(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.w.tx.Commit()
+	r.w.tx = nil
+	if err != nil {
+		return nil, err
+	}
+	return r.report, nil
+}
+
+// repairer reads the pages of a damaged data file for Repair.
+type repairer struct {
+	f        *os.File
+	pageSize int
+	pageN    pgid   // number of pages to scan
+	flags    uint32 // meta flags, if a meta page is valid
+	trailer  int    // size of the page trailer
+	free     map[pgid]bool
+	visited  []bool
+	holes    []repairHole
+	orphans  bool // set while recovering orphan pages
+	w        repairWriter
+	report   *RepairReport
+}
+
+// repairHole is the key range of a bucket that was held by a lost page.
+type repairHole struct {
+	path        [][]byte
+	compression Compression
+	min, max    []byte
+}
+
+// readMeta returns the valid meta page with the highest transaction id and
+// sets the page size and format it records, or returns nil and guesses the
+// page size if neither meta page is valid.
+func (r *repairer) readMeta() *meta {
+	metas, _, _ := probeMeta(r.f)
+	var found *meta
+	for i, m := range metas {
+		if m != nil && (found == nil || m.txid > found.txid) {
+			found = m
+			r.report.Meta = i
+		}
+	}
+	if found == nil {
+		r.pageSize = os.Getpagesize()
+		return nil
+	}
+	r.pageSize = int(found.pageSize)
+	r.flags = found.flags
+	r.trailer = found.trailerSize()
+	return found
+}
+
+// readFreelist marks the pages on the freelist of m as free. Pages are left
+// unmarked if the freelist cannot be decoded.
+func (r *repairer) readFreelist(m *meta) {
+	if m.freelist == pgidNoFreelist || m.freelist < 2 || m.freelist >= r.pageN {
+		return
+	}
+	p, err := r.readPage(m.freelist)
+	if err != nil || p.id != m.freelist || p.flags&freelistPageFlag == 0 || r.verify(p) != nil {
+		return
+	}
+	idx, count := 0, int(p.count)
+	if count == 0xFFFF {
+		idx, count = 1, int(*(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))))
+	}
+	n := count
+	if p.flags&freelistExtentPageFlag != 0 {
+		n *= 2
+	}
+	if n < 0 || int(pageHeaderSize)+(idx+n)*8 > r.end(p) {
+		return
+	}
+
+	r.free = make(map[pgid]bool)
+	if p.flags&freelistExtentPageFlag != 0 {
+		for _, e := range readExtents(p, idx, count) {
+			for i := uint64(0); i < e.size && i < uint64(r.pageN); i++ {
+				r.free[e.start+pgid(i)] = true
+			}
+		}
+	} else {
+		var ids []pgid
+		unsafeSlice(unsafe.Pointer(&ids), unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(pgid(0)), idx), count)
+		for _, id := range ids {
+			r.free[id] = true
+		}
+	}
+
+	// Pages held by snapshots hold older versions of the data, not orphans.
+	if p.flags&freelistHeldPageFlag == 0 || int(pageHeaderSize)+(idx+n+1)*8 > r.end(p) {
+		return
+	}
+	held := *(*pgid)(unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(pgid(0)), idx+n))
+	if held > r.pageN || int(pageHeaderSize)+(idx+n+1+int(held))*8 > r.end(p) {
+		return
+	}
+	for _, id := range readHeld(p) {
+		r.free[id] = true
+	}
+}
+
+// readPage reads page id and its overflow pages.
+func (r *repairer) readPage(id pgid) (*page, error) {
+	buf := make([]byte, r.pageSize)
+	if _, err := r.f.ReadAt(buf, int64(id)*int64(r.pageSize)); err != nil {
+		return nil, err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.overflow == 0 {
+		return p, nil
+	}
+	if pgid(p.overflow) >= r.pageN-id {
+		return nil, fmt.Errorf("overflow %d out of bounds", p.overflow)
+	}
+	buf = make([]byte, (int(p.overflow)+1)*r.pageSize)
+	if _, err := r.f.ReadAt(buf, int64(id)*int64(r.pageSize)); err != nil {
+		return nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// end returns the offset of the end of the content of p, before its trailer.
+func (r *repairer) end(p *page) int {
+	return (int(p.overflow)+1)*r.pageSize - r.trailer
+}
+
+// verify checks the checksum of p, if pages carry one.
+func (r *repairer) verify(p *page) error {
+	if r.flags&metaFlagPageChecksum == 0 {
+		return nil
+	}
+	sz := r.trailer
+	if r.flags&metaFlagPageTxid != 0 {
+		sz -= pageTxidSize
+	}
+	if p.checksum(r.pageSize, sz) != p.sum32(r.pageSize, sz) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// decode reads page id and checks that it is a leaf or branch page whose
+// elements can be decoded.
+func (r *repairer) decode(id pgid) (*page, error) {
+	if id < 2 || id >= r.pageN {
+		return nil, fmt.Errorf("out of bounds: %d", int(r.pageN))
+	}
+	p, err := r.readPage(id)
+	if err != nil {
+		return nil, err
+	} else if p.id != id {
+		return nil, fmt.Errorf("unexpected page id %d", p.id)
+	} else if err := r.verify(p); err != nil {
+		return nil, err
+	}
+	return p, r.checkElements(p, r.end(p))
+}
+
+// checkElements checks that p is a leaf or branch page whose elements and
+// keys lie within its first end bytes, in order.
+func (r *repairer) checkElements(p *page, end int) error {
+	var size int
+	switch p.flags {
+	case branchPageFlag:
+		size = int(branchPageElementSize)
+	case leafPageFlag:
+		size = int(leafPageElementSize)
+	default:
+		return fmt.Errorf("invalid type: %s", p.typ())
+	}
+	if int(pageHeaderSize)+int(p.count)*size > end {
+		return fmt.Errorf("%d elements overflow the page", p.count)
+	}
+
+	var prev []byte
+	for i := uint16(0); i < p.count; i++ {
+		off := int(pageHeaderSize) + int(i)*size
+		var n int
+		if p.flags == branchPageFlag {
+			e := p.branchPageElement(i)
+			off, n = off+int(e.pos), int(e.ksize)
+			if e.pgid < 2 || e.pgid >= r.pageN {
+				return fmt.Errorf("element %d: child page %d out of bounds", i, e.pgid)
+			}
+		} else {
+			e := p.leafPageElement(i)
+			off, n = off+int(e.pos), int(e.ksize)+int(e.vsize)
+		}
+		if off < int(pageHeaderSize) || off+n > end || n < 0 {
+			return fmt.Errorf("element %d out of bounds", i)
+		}
+
+		k := r.key(p, i)
+		if i > 0 && bytes.Compare(prev, k) >= 0 {
+			return fmt.Errorf("element %d: keys out of order", i)
+		}
+		prev = k
+	}
+	return nil
+}
+
+// key returns the key of element i of p.
+func (r *repairer) key(p *page, i uint16) []byte {
+	if p.flags == branchPageFlag {
+		return p.branchPageElement(i).key()
+	}
+	return p.leafPageElement(i).key()
+}
+
+// walk recovers the keys of page id, and of the pages below it, into the
+// bucket at path. The values of the bucket are stored with compression c,
+// and its keys on the page are expected between min and max. A page that
+// cannot be decoded is reported lost.
+func (r *repairer) walk(id pgid, path [][]byte, c Compression, min, max []byte) error {
+	if id < pgid(len(r.visited)) && r.visited[id] {
+		return nil
+	}
+	p, err := r.decode(id)
+	if err != nil {
+		r.report.Lost = append(r.report.Lost, RepairLoss{Page: int(id), Bucket: path, Err: err})
+		r.holes = append(r.holes, repairHole{path: path, compression: c, min: min, max: max})
+		return nil
+	}
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		r.visited[id+i] = true
+	}
+
+	if p.flags == branchPageFlag {
+		for i := uint16(0); i < p.count; i++ {
+			e := p.branchPageElement(i)
+			next := max
+			if i+1 < p.count {
+				next = p.branchPageElement(i + 1).key()
+			}
+			if err := r.walk(e.pgid, path, c, e.key(), next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return r.leaf(p, path, c)
+}
+
+// leaf recovers the keys of the leaf page p into the bucket at path.
+func (r *repairer) leaf(p *page, path [][]byte, c Compression) error {
+	for i := uint16(0); i < p.count; i++ {
+		e := p.leafPageElement(i)
+		k, v := e.key(), e.value()
+		if (e.flags & bucketLeafFlag) != 0 {
+			if err := r.bucket(p, append(path[:len(path):len(path)], k), e.flags, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The root bucket only holds buckets.
+		if path == nil {
+			r.report.SkippedKeys++
+			continue
+		}
+		if (e.flags&compressedValueFlag) != 0 && c <= Flate {
+			var err error
+			if v, err = decompressValue(c, v); err != nil {
+				r.report.SkippedKeys++
+				continue
+			}
+		}
+		if ok, err := r.w.put(path, k, v, !r.orphans); err != nil {
+			return err
+		} else if ok {
+			r.report.Keys++
+		}
+	}
+	return nil
+}
+
+// bucket recovers the bucket at path, stored as v in an element with flags
+// of the leaf page p.
+func (r *repairer) bucket(p *page, path [][]byte, flags uint32, v []byte) error {
+	if len(v) < bucketHeaderSize {
+		r.report.SkippedKeys++
+		return nil
+	}
+	b := *(*bucket)(unsafe.Pointer(&v[0]))
+	c := bucketCompression(flags)
+	opts := BucketOptions{Compression: c}
+	if c > Flate {
+		opts.Compression = NoCompression
+	}
+	if ok, err := r.w.createBucket(path, opts, b.sequence); err != nil {
+		return err
+	} else if !ok {
+		r.report.SkippedKeys++
+		return nil
+	}
+	r.report.Buckets++
+	if b.root != 0 {
+		return r.walk(b.root, path, c, nil, nil)
+	}
+
+	// Inline buckets hold their leaf page in the value.
+	inline := v[bucketHeaderSize:]
+	if len(inline) < int(pageHeaderSize) {
+		r.report.Lost = append(r.report.Lost, RepairLoss{Page: int(p.id), Bucket: path, Err: errors.New("short inline page")})
+		return nil
+	}
+	buf := make([]byte, len(inline))
+	copy(buf, inline)
+	ip := (*page)(unsafe.Pointer(&buf[0]))
+	if err := r.checkElements(ip, len(buf)); err != nil || ip.flags != leafPageFlag {
+		if err == nil {
+			err = fmt.Errorf("invalid type: %s", ip.typ())
+		}
+		r.report.Lost = append(r.report.Lost, RepairLoss{Page: int(p.id), Bucket: path, Err: fmt.Errorf("inline page: %s", err)})
+		return nil
+	}
+	return r.leaf(ip, path, c)
+}
+
+// recoverOrphans recovers the leaf and branch pages that were not walked, are
+// not free and that no other such page refers to.
+func (r *repairer) recoverOrphans() error {
+	r.orphans = true
+	candidate := make([]bool, r.pageN)
+	referenced := make([]bool, r.pageN)
+	for id := pgid(2); id < r.pageN; id++ {
+		if r.visited[id] || r.free[id] {
+			continue
+		}
+		p, err := r.decode(id)
+		if err != nil {
+			continue
+		}
+		candidate[id] = true
+		for i := uint16(0); i < p.count; i++ {
+			if p.flags == branchPageFlag {
+				referenced[p.branchPageElement(i).pgid] = true
+			} else if e := p.leafPageElement(i); (e.flags&bucketLeafFlag) != 0 && len(e.value()) >= bucketHeaderSize {
+				if root := (*bucket)(unsafe.Pointer(&e.value()[0])).root; root < r.pageN {
+					referenced[root] = true
+				}
+			}
+		}
+	}
+
+	// Pages that only orphans in a cycle refer to are recovered last.
+	for _, roots := range []bool{true, false} {
+		for id := pgid(2); id < r.pageN; id++ {
+			if !candidate[id] || r.visited[id] || (roots && referenced[id]) {
+				continue
+			}
+			if err := r.orphan(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// orphan recovers the orphan page id into the bucket of the only hole that
+// covers its keys, or else into the RepairLostFound bucket.
+func (r *repairer) orphan(id pgid) error {
+	first, last, buckets, err := r.keyRange(id, 0)
+	if err != nil {
+		return nil
+	}
+	r.report.Orphans++
+
+	var match *repairHole
+	for i := range r.holes {
+		h := &r.holes[i]
+		if bytes.Compare(first, h.min) < 0 || (h.max != nil && bytes.Compare(last, h.max) >= 0) {
+			continue
+		} else if h.path == nil && !buckets {
+			continue
+		} else if match != nil {
+			match = nil
+			break
+		}
+		match = h
+	}
+	if match != nil {
+		return r.walk(id, match.path, match.compression, nil, nil)
+	}
+
+	// Keys of unknown buckets are kept in a bucket of their own, with their
+	// values as they are stored.
+	path := [][]byte{RepairLostFound, []byte(strconv.Itoa(int(id)))}
+	if _, err := r.w.createBucket(path[:1], BucketOptions{}, 0); err != nil {
+		return err
+	} else if _, err := r.w.createBucket(path, BucketOptions{}, 0); err != nil {
+		return err
+	}
+	r.report.LostFound++
+	return r.walk(id, path, repairUnknownCompression, nil, nil)
+}
+
+// keyRange returns the first and last keys below page id, and whether the
+// first leaf below it holds only buckets. depth is the number of branch pages
+// above id, which is bounded in case branch pages refer to each other.
+func (r *repairer) keyRange(id pgid, depth int) (first, last []byte, buckets bool, err error) {
+	p, err := r.decode(id)
+	if err != nil {
+		return nil, nil, false, err
+	} else if p.count == 0 {
+		return nil, nil, false, errors.New("empty page")
+	}
+	if p.flags == branchPageFlag {
+		if depth > maxRepairDepth {
+			return nil, nil, false, errors.New("too many branch pages")
+		}
+		first, _, buckets, err = r.keyRange(p.branchPageElement(0).pgid, depth+1)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		_, last, _, err = r.keyRange(p.branchPageElement(p.count-1).pgid, depth+1)
+		return first, last, buckets, err
+	}
+	buckets = true
+	for i := uint16(0); i < p.count; i++ {
+		if (p.leafPageElement(i).flags & bucketLeafFlag) == 0 {
+			buckets = false
+		}
+	}
+	return p.leafPageElement(0).key(), p.leafPageElement(p.count - 1).key(), buckets, nil
+}
+
+// maxRepairDepth bounds the number of branch pages keyRange descends.
+const maxRepairDepth = 64
+
+// repairWriter writes the keys recovered by Repair in transactions of up to
+// maxSize bytes.
+type repairWriter struct {
+	db      *DB
+	tx      *Tx
+	size    int64
+	maxSize int64
+}
+
+// begin begins the next transaction.
+func (w *repairWriter) begin() error {
+	tx, err := w.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	w.tx, w.size = tx, 0
+	return nil
+}
+
+// grow accounts for sz more bytes, committing the transaction first if they
+// do not fit.
+func (w *repairWriter) grow(sz int64) error {
+	if w.maxSize != 0 && w.size+sz > w.maxSize {
+		err := w.tx.Commit()
+		w.tx = nil
+		if err != nil {
+			return err
+		}
+		if err := w.begin(); err != nil {
+			return err
+		}
+	}
+	w.size += sz
+	return nil
+}
+
+// bucket returns the bucket at path, or nil if there is none.
+func (w *repairWriter) bucket(path [][]byte) *Bucket {
+	b := w.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// createBucket creates the bucket at path, whose parent must exist, unless
+// it already exists. It returns false if a key is in the way.
+func (w *repairWriter) createBucket(path [][]byte, opts BucketOptions, seq uint64) (bool, error) {
+	if err := w.grow(int64(len(path[len(path)-1]))); err != nil {
+		return false, err
+	}
+	name := path[len(path)-1]
+	var b *Bucket
+	var err error
+	if len(path) == 1 {
+		if b = w.tx.Bucket(name); b == nil {
+			b, err = w.tx.CreateBucketWithOptions(name, opts)
+		}
+	} else if parent := w.bucket(path[:len(path)-1]); parent == nil {
+		return false, nil
+	} else if b = parent.Bucket(name); b == nil {
+		b, err = parent.CreateBucketWithOptions(name, opts)
+	}
+	if err == ErrIncompatibleValue {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if seq > b.Sequence() {
+		return true, b.SetSequence(seq)
+	}
+	return true, nil
+}
+
+// put stores k and v in the bucket at path. Unless overwrite is set, a key
+// that is already there is left alone. It returns false if the key was not
+// stored.
+func (w *repairWriter) put(path [][]byte, k, v []byte, overwrite bool) (bool, error) {
+	if err := w.grow(int64(len(k) + len(v))); err != nil {
+		return false, err
+	}
+	b := w.bucket(path)
+	if b == nil {
+		return false, nil
+	}
+	if !overwrite {
+		if ek, _ := b.Cursor().Seek(k); bytes.Equal(ek, k) {
+			return false, nil
+		}
+	}
+	if err := b.Put(k, v); err == ErrIncompatibleValue {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
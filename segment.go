@@ -0,0 +1,355 @@
+package dbolt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultSegmentSize is the size of the segment files of a segmented database
+// if Options.SegmentSize is not set.
+const DefaultSegmentSize = 1 << 30
+
+// segmentPath returns the path of the i-th segment file in dir.
+func segmentPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("data.%03d", i))
+}
+
+// segments is the Storage of a segmented database. The data is split over
+// fixed-size segment files in a directory, so the page at id lives in segment
+// id*pageSize/size at offset id*pageSize%size. Every segment but the last one
+// is exactly size bytes long.
+type segments struct {
+	dir       string
+	size      int64
+	flag      int
+	mode      os.FileMode
+	mmapFlags int
+	openFile  func(string, int, os.FileMode) (*os.File, error)
+
+	mu     sync.Mutex // protects the fields below
+	files  []*os.File
+	dirty  []bool
+	added  bool   // segment files were created or removed since the last sync
+	mapped []byte // address range reserved by Mmap, or nil
+}
+
+// openSegments opens the segment files in dir, creating the directory and
+// the first segment if flag has os.O_CREATE. The size of the segments is taken
+// from the first one when there are several; otherwise size is used, falling
+// back to DefaultSegmentSize. Segments are mapped with mmapFlags.
+func openSegments(dir string, size int, flag int, mode os.FileMode, mmapFlags int, openFile func(string, int, os.FileMode) (*os.File, error)) (*segments, error) {
+	if flag&os.O_CREATE != 0 {
+		// Directories are searchable wherever they are readable.
+		if err := os.Mkdir(dir, mode|(mode&0444)>>2); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+
+	s := &segments{dir: dir, flag: flag &^ os.O_CREATE, mode: mode, mmapFlags: mmapFlags, openFile: openFile}
+	for i := 0; ; i++ {
+		f, err := openFile(segmentPath(dir, i), s.flag, mode)
+		if os.IsNotExist(err) && (i > 0 || flag&os.O_CREATE == 0) {
+			break
+		} else if os.IsNotExist(err) {
+			f, err = openFile(segmentPath(dir, i), flag, mode)
+		}
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.dirty = append(s.dirty, false)
+	}
+	if len(s.files) == 0 {
+		return nil, &os.PathError{Op: "open", Path: segmentPath(dir, 0), Err: os.ErrNotExist}
+	}
+
+	if s.size = int64(size); s.size <= 0 {
+		s.size = DefaultSegmentSize
+	}
+	info, err := s.files[0].Stat()
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	if len(s.files) > 1 {
+		s.size = info.Size()
+	} else if info.Size() > s.size {
+		_ = s.Close()
+		return nil, fmt.Errorf("segment %s is larger than the segment size %d", s.files[0].Name(), s.size)
+	}
+	return s, nil
+}
+
+// check verifies that pages never straddle a segment and that segments can
+// be mapped next to each other.
+func (s *segments) check(pageSize int) error {
+	if s.size%int64(pageSize) != 0 || s.size%int64(os.Getpagesize()) != 0 {
+		return fmt.Errorf("segment size %d is not a multiple of the page size", s.size)
+	}
+	return nil
+}
+
+// Size returns the size of the data over all segments.
+func (s *segments) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := len(s.files) - 1
+	info, err := s.files[last].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int64(last)*s.size + info.Size(), nil
+}
+
+// extend adds segments until they can hold sz bytes. Segments are filled up
+// to the segment size before the next one is created, and new segments are
+// mapped into the mmap if it already covers them. s.mu must be held.
+func (s *segments) extend(sz int64) error {
+	for int64(len(s.files))*s.size < sz {
+		last := len(s.files) - 1
+		if err := s.files[last].Truncate(s.size); err != nil {
+			return fmt.Errorf("segment resize error: %s", err)
+		}
+		s.dirty[last] = true
+
+		f, err := s.openFile(segmentPath(s.dir, last+1), s.flag|os.O_CREATE, s.mode)
+		if err != nil {
+			return err
+		}
+		s.files = append(s.files, f)
+		s.dirty = append(s.dirty, true)
+		s.added = true
+
+		if s.mapped != nil {
+			if err := mmapSegment(s, last+1); err != nil {
+				return fmt.Errorf("mmap segment error: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Truncate changes the size of the data to sz bytes. Segments past the new
+// end are removed, except for the first one which holds the lock.
+func (s *segments) Truncate(sz int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.extend(sz); err != nil {
+		return err
+	}
+	for last := len(s.files) - 1; last > 0 && int64(last)*s.size >= sz; last-- {
+		if err := s.files[last].Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(segmentPath(s.dir, last)); err != nil {
+			return err
+		}
+		s.files, s.dirty = s.files[:last], s.dirty[:last]
+		s.added = true
+	}
+
+	last := len(s.files) - 1
+	end := sz - int64(last)*s.size
+	info, err := s.files[last].Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != end {
+		if err := s.files[last].Truncate(end); err != nil {
+			return fmt.Errorf("file resize error: %s", err)
+		}
+		s.dirty[last] = true
+	}
+	return nil
+}
+
+// WriteAt writes b at the data offset off, splitting it over segments.
+func (s *segments) WriteAt(b []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.extend(off + int64(len(b))); err != nil {
+		return 0, err
+	}
+	for len(b) > 0 {
+		i, o := off/s.size, off%s.size
+		sz := int64(len(b))
+		if sz > s.size-o {
+			sz = s.size - o
+		}
+		nn, err := s.files[i].WriteAt(b[:sz], o)
+		n += nn
+		s.dirty[i] = true
+		if err != nil {
+			return n, err
+		}
+		b, off = b[sz:], off+sz
+	}
+	return n, nil
+}
+
+// writev writes bufs at the data file offset off with one vectored write per
+// segment. It returns the number of bytes written and of system calls made.
+func (s *segments) writev(bufs [][]byte, off int64) (n int, calls int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := off
+	for _, b := range bufs {
+		end += int64(len(b))
+	}
+	if err := s.extend(end); err != nil {
+		return 0, 0, err
+	}
+
+	for len(bufs) > 0 {
+		i, o := off/s.size, off%s.size
+
+		// Take the buffers up to the end of the segment, splitting the one
+		// crossing into the next segment.
+		var iov [][]byte
+		for rem := s.size - o; len(bufs) > 0 && rem > 0; {
+			b := bufs[0]
+			if int64(len(b)) > rem {
+				iov = append(iov, b[:rem])
+				bufs[0] = b[rem:]
+				break
+			}
+			iov = append(iov, b)
+			rem -= int64(len(b))
+			bufs = bufs[1:]
+		}
+
+		nn, c, err := pwritev(s.files[i], iov, o)
+		n += nn
+		calls += c
+		s.dirty[i] = true
+		if err != nil {
+			return n, calls, err
+		}
+		off += int64(nn)
+	}
+	return n, calls, nil
+}
+
+// punchHole deallocates size bytes at the data offset off, splitting the
+// range over segments.
+func (s *segments) punchHole(off, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for size > 0 {
+		i, o := off/s.size, off%s.size
+		if i >= int64(len(s.files)) {
+			return nil
+		}
+		sz := size
+		if sz > s.size-o {
+			sz = s.size - o
+		}
+		if err := punchHole(s.files[i], o, sz); err != nil {
+			return err
+		}
+		off, size = off+sz, size-sz
+	}
+	return nil
+}
+
+// ReadAt reads from the data offset off, across segments.
+func (s *segments) ReadAt(b []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	files := s.files
+	s.mu.Unlock()
+
+	for len(b) > 0 {
+		i, o := off/s.size, off%s.size
+		if i >= int64(len(files)) {
+			return n, io.EOF
+		}
+		sz := int64(len(b))
+		if sz > s.size-o {
+			sz = s.size - o
+		}
+		nn, err := files[i].ReadAt(b[:sz], o)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		b, off = b[sz:], off+sz
+	}
+	return n, nil
+}
+
+// Sync flushes the segments written since the last sync, and makes the
+// segment files created or removed since durable in the directory.
+func (s *segments) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.files {
+		if !s.dirty[i] {
+			continue
+		}
+		if err := fdatasync(f); err != nil {
+			return err
+		}
+		s.dirty[i] = false
+	}
+
+	if s.added {
+		d, err := os.Open(s.dir)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = d.Close() }()
+		if err := d.Sync(); err != nil {
+			return err
+		}
+		s.added = false
+	}
+	return nil
+}
+
+// Lock locks the first segment file.
+func (s *segments) Lock(exclusive bool, timeout time.Duration) error {
+	return flock(s.files[0], exclusive, timeout)
+}
+
+// Unlock unlocks the first segment file.
+func (s *segments) Unlock() error {
+	return funlock(s.files[0])
+}
+
+// Mmap maps the segments next to each other in a reserved address range.
+func (s *segments) Mmap(size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mmapSegments(s, size)
+}
+
+// Munmap unmaps the reserved address range along with the segments in it.
+func (s *segments) Munmap(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mapped = nil
+	return munmap(b)
+}
+
+// Close closes every segment file.
+func (s *segments) Close() error {
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.files = nil
+	return err
+}
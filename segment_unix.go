@@ -0,0 +1,60 @@
+//go:build !windows
+
+package dbolt
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapSegments memory maps the segments. An address range of sz bytes is
+// reserved first and every segment is then mapped at its place in it, so
+// pages are contiguous in memory across segments. s.mu must be held.
+func mmapSegments(s *segments, sz int) ([]byte, error) {
+	// Reserve the address range without backing it.
+	b, err := unix.Mmap(-1, 0, sz, syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mapped = b
+	for i := range s.files {
+		if err := mmapSegment(s, i); err != nil {
+			s.mapped = nil
+			_ = unix.Munmap(b)
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// mmapSegment maps the i-th segment over its place in the reserved range, if
+// the range covers it. s.mu must be held.
+func mmapSegment(s *segments, i int) error {
+	start := int64(i) * s.size
+	if start >= int64(len(s.mapped)) {
+		return nil
+	}
+	length := s.size
+	if length > int64(len(s.mapped))-start {
+		length = int64(len(s.mapped)) - start
+	}
+
+	addr := uintptr(unsafe.Pointer(&s.mapped[start]))
+	_, _, errno := syscall.Syscall6(syscall.SYS_MMAP, addr, uintptr(length), syscall.PROT_READ,
+		uintptr(syscall.MAP_SHARED|syscall.MAP_FIXED|s.mmapFlags), s.files[i].Fd(), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	// Advise the kernel that the mmap is accessed randomly.
+	err := unix.Madvise(s.mapped[start:start+length], syscall.MADV_RANDOM)
+	if err != nil && err != syscall.ENOSYS {
+		// Ignore not implemented error in kernel because it still works.
+		return fmt.Errorf("madvise: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package dbolt
+
+import "errors"
+
+// errSegmentsNotSupported is returned when a segmented database is opened on
+// Windows, where segments cannot be mapped next to each other.
+var errSegmentsNotSupported = errors.New("segmented storage is not supported on windows")
+
+// mmapSegments is not supported on Windows.
+func mmapSegments(s *segments, sz int) ([]byte, error) {
+	return nil, errSegmentsNotSupported
+}
+
+// mmapSegment is not supported on Windows.
+func mmapSegment(s *segments, i int) error {
+	return errSegmentsNotSupported
+}
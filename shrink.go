@@ -0,0 +1,258 @@
+package dbolt
+
+import (
+	"bytes"
+	"context"
+	"sort"
+)
+
+// shrinkBatchSize is the number of pages Shrink moves per transaction.
+const shrinkBatchSize = 1024
+
+// shrinkMaxStalls is the number of transactions in a row that may fail to
+// lower the high water mark before Shrink gives up.
+const shrinkMaxStalls = 4
+
+// Shrink returns the free space at the end of the data file to the
+// filesystem. It runs a series of write transactions that move the pages at
+// the top of the file into free pages lower down, then truncates the file and
+// remaps it. Read transactions keep running meanwhile, but pages they or
+// snapshots still use are neither moved nor reclaimed, and the final remap
+// waits for them to finish.
+//
+// Shrink stops waiting for the writer lock and returns ctx.Err() once ctx is
+// done; the transactions committed so far are kept and the file is truncated
+// by a later Shrink.
+func (db *DB) Shrink(ctx context.Context) error {
+	var changed bool
+	var from [][]byte
+	best := pgid(0xFFFFFFFFFFFFFFFF)
+	for stalls := 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tx, err := db.BeginContext(ctx, true)
+		if err != nil {
+			return err
+		}
+		tx.shrinking = true
+		hwm := tx.meta.pgid
+		pass := from == nil
+		moved, next := tx.shrink(from)
+
+		if tx.meta.pgid < best {
+			best, stalls = tx.meta.pgid, 0
+		} else {
+			stalls++
+		}
+
+		// Once a whole pass finds nothing left to do, commit one more time if
+		// anything changed so that both meta pages agree on the high water
+		// mark.
+		done := (pass && moved == 0 && tx.meta.pgid == hwm) || stalls > shrinkMaxStalls
+		if done && !changed {
+			_ = tx.Rollback()
+			break
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		changed, from = true, next
+	}
+	return db.truncate(ctx)
+}
+
+// shrink lowers the high water mark of tx below the free pages at the top of
+// the file, and marks the pages reaching into the rest of the free space for
+// moving into free pages lower down on commit. It walks the buckets from the
+// keys in from, see Bucket.shrink, and returns the number of pages marked, at
+// most about shrinkBatchSize, and the keys to resume at in the next
+// transaction, or nil once the walk reached the end.
+func (tx *Tx) shrink(from [][]byte) (int, [][]byte) {
+	f := tx.db.freelist
+
+	// Drop the free pages at the top of the file.
+	ids := f.getFreePageIDs()
+	hwm := tx.meta.pgid
+	for i := len(ids) - 1; i >= 0 && ids[i] == hwm-1; i-- {
+		hwm--
+	}
+	if hwm < tx.meta.pgid {
+		f.trim(hwm)
+		tx.meta.pgid = hwm
+	}
+
+	// Every page in use at or above limit can take the place of a free page
+	// below it.
+	limit := tx.meta.pgid - pgid(f.free_count())
+	var moved int
+
+	// The freelist is written out anew on every commit, so it moves down by
+	// itself. The snapshot directory is only written out once it changed.
+	if id := tx.meta.snapshotDirectory(); id != 0 {
+		if p := tx.page(id); id+pgid(p.overflow) >= limit {
+			tx.updateSnapshots()
+			moved += int(p.overflow) + 1
+		}
+	}
+
+	next := tx.root.shrink(limit, from, &moved)
+	return moved, next
+}
+
+// shrink materializes the nodes of the pages of b and its sub-buckets that
+// reach limit or above, along with their parents, so that spill writes them
+// to new pages. It adds the number of pages to moved.
+//
+// The walk starts at the key from[0] of b, and at from[1:] within the
+// sub-bucket of that name; pages and sub-buckets before it are skipped. Once
+// moved reaches shrinkBatchSize it stops and returns the keys in the same
+// form to resume at. It returns nil once it walked b to its end.
+func (b *Bucket) shrink(limit pgid, from [][]byte, moved *int) [][]byte {
+	// Inline buckets are part of their parent's page and have no
+	// sub-buckets.
+	if b.root == 0 {
+		return nil
+	}
+
+	var start []byte
+	if len(from) > 0 {
+		start = from[0]
+	}
+
+	// resume returns the keys to resume at key, or from if key does not come
+	// after start.
+	resume := func(key []byte) [][]byte {
+		if len(from) > 0 && bytes.Compare(key, start) <= 0 {
+			return from
+		}
+		return [][]byte{cloneBytes(key)}
+	}
+
+	var path []pgid
+	var walk func(id pgid, key []byte) [][]byte
+	walk = func(id pgid, key []byte) [][]byte {
+		if *moved >= shrinkBatchSize {
+			return resume(key)
+		}
+		p := b.tx.page(id)
+		path = append(path, id)
+		defer func() { path = path[:len(path)-1] }()
+		if id+pgid(p.overflow) >= limit {
+			var n *node
+			for _, id := range path {
+				n = b.node(id, n)
+			}
+			*moved += int(p.overflow) + 1
+		}
+
+		// Skip the children whose keys all come before start.
+		if (p.flags & branchPageFlag) != 0 {
+			i := sort.Search(int(p.count), func(i int) bool {
+				return bytes.Compare(p.branchPageElement(uint16(i)).key(), start) > 0
+			})
+			if i > 0 {
+				i--
+			}
+			for ; i < int(p.count); i++ {
+				e := p.branchPageElement(uint16(i))
+				if next := walk(e.pgid, e.key()); next != nil {
+					return next
+				}
+			}
+			return nil
+		}
+
+		// Find the sub-buckets by their element flags rather than by
+		// reading every value through a cursor.
+		elems := p.leafPageElements()
+		i := sort.Search(len(elems), func(i int) bool {
+			return bytes.Compare(elems[i].key(), start) >= 0
+		})
+		for ; i < len(elems); i++ {
+			e := &elems[i]
+			if (e.flags & bucketLeafFlag) == 0 {
+				continue
+			}
+			if *moved >= shrinkBatchSize {
+				return resume(e.key())
+			}
+			var sub [][]byte
+			if len(from) > 0 && bytes.Equal(e.key(), start) {
+				sub = from[1:]
+			}
+			if next := b.Bucket(e.key()).shrink(limit, sub, moved); next != nil {
+				return append([][]byte{cloneBytes(e.key())}, next...)
+			}
+		}
+		return nil
+	}
+	return walk(b.root, nil)
+}
+
+// truncate cuts the data file after the last page either meta page may
+// reference and remaps it, waiting for read transactions to finish. It gives
+// up waiting for the writer lock once ctx is done.
+func (db *DB) truncate(ctx context.Context) error {
+	if err := db.rwlock.LockContext(ctx); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+
+	// The data file must hold every page before it is cut.
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+
+	hwm := db.meta0.pgid
+	if db.meta1.pgid > hwm {
+		hwm = db.meta1.pgid
+	}
+	sz := int(hwm) * db.pageSize
+	fileSize, err := db.fileSize()
+	if err != nil {
+		return err
+	} else if sz >= fileSize {
+		return nil
+	}
+
+	// Unmap before truncating since Windows cannot resize a mapped file.
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+
+	if db.Mlock {
+		if err := db.munlock(fileSize); err != nil {
+			return err
+		}
+	}
+	if err := db.munmap(); err != nil {
+		return err
+	}
+	err = db.storage.Truncate(int64(sz))
+	if err == nil {
+		err = db.timedSync(0, db.storage.Sync)
+	}
+	if err == nil {
+		db.filesz = sz
+
+		db.statlock.Lock()
+		db.stats.TruncateN++
+		db.stats.TruncateBytes += int64(fileSize - sz)
+		db.stats.FileSize = sz
+		db.statlock.Unlock()
+	}
+
+	// Map the data file again even if it could not be truncated.
+	if merr := db.remap(0); err == nil {
+		err = merr
+	}
+	return err
+}
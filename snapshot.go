@@ -0,0 +1,313 @@
+package dbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Snapshots are kept in a directory page: a leaf page with an element per
+// snapshot, keyed by name. The meta page holds the id of the directory page
+// while the metaFlagSnapshots meta flag is set. Pages that only snapshots
+// still use are listed apart on the freelist page, see freelist.writeHeld.
+
+// snapshotValueSize is the size of a snapshot element in the directory page.
+const snapshotValueSize = 32
+
+// snapshot is a persisted reference to the root of an earlier version of the
+// database.
+type snapshot struct {
+	root    pgid  // root page of the root bucket
+	pgid    pgid  // high water mark
+	txid    txid  // transaction the snapshot was taken at
+	created int64 // creation time in nanoseconds since the epoch
+}
+
+// encode returns the directory element value of the snapshot.
+func (s snapshot) encode() []byte {
+	buf := make([]byte, snapshotValueSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(s.root))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(s.pgid))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(s.txid))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(s.created))
+	return buf
+}
+
+// decodeSnapshot reads a snapshot from a directory element value.
+func decodeSnapshot(buf []byte) snapshot {
+	return snapshot{
+		root:    pgid(binary.LittleEndian.Uint64(buf[0:])),
+		pgid:    pgid(binary.LittleEndian.Uint64(buf[8:])),
+		txid:    txid(binary.LittleEndian.Uint64(buf[16:])),
+		created: int64(binary.LittleEndian.Uint64(buf[24:])),
+	}
+}
+
+// Snapshot describes a named snapshot created with DB.CreateSnapshot.
+type Snapshot struct {
+	Name    string
+	TxID    int       // id of the transaction the snapshot was taken at
+	Created time.Time // time the snapshot was created
+}
+
+// CreateSnapshot persists a snapshot of the latest committed version of the
+// database under name. The pages of that version are not reused until the
+// snapshot is dropped, and OpenSnapshot reads them even after the database
+// has been reopened. Returns ErrSnapshotExists if the name is taken.
+//
+// Snapshots are kept by WriteTo and incremental backups. Compact refuses to
+// compact a database with snapshots.
+func (db *DB) CreateSnapshot(name string) error {
+	if name == "" {
+		return ErrSnapshotNameRequired
+	}
+	return db.Update(func(tx *Tx) error {
+		snapshots := tx.updateSnapshots()
+		if _, ok := snapshots[name]; ok {
+			return ErrSnapshotExists
+		}
+		// Nothing has been written yet, so the meta of the transaction still
+		// describes the last committed version.
+		snapshots[name] = snapshot{
+			root:    tx.meta.root.root,
+			pgid:    tx.meta.pgid,
+			txid:    tx.meta.txid - 1,
+			created: time.Now().UnixNano(),
+		}
+		return nil
+	})
+}
+
+// DropSnapshot removes the snapshot with the given name. Its pages are
+// reused once no other snapshot or open transaction needs them. Returns
+// ErrSnapshotNotFound if there is no such snapshot.
+func (db *DB) DropSnapshot(name string) error {
+	return db.Update(func(tx *Tx) error {
+		snapshots := tx.updateSnapshots()
+		if _, ok := snapshots[name]; !ok {
+			return ErrSnapshotNotFound
+		}
+		delete(snapshots, name)
+		return nil
+	})
+}
+
+// OpenSnapshot starts a read-only transaction on the version of the database
+// saved by the snapshot with the given name. The transaction must be rolled
+// back like any other read-only transaction. Returns ErrSnapshotNotFound if
+// there is no such snapshot.
+func (db *DB) OpenSnapshot(name string) (*Tx, error) {
+	return db.beginReadTx(name)
+}
+
+// Snapshots returns the snapshots of the database ordered by name.
+func (db *DB) Snapshots() []Snapshot {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	infos := make([]Snapshot, 0, len(db.snapshots))
+	for name, s := range db.snapshots {
+		infos = append(infos, Snapshot{Name: name, TxID: int(s.txid), Created: time.Unix(0, s.created)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// updateSnapshots returns the snapshots of a writable transaction for
+// modification. They are written out on commit.
+func (tx *Tx) updateSnapshots() map[string]snapshot {
+	if tx.snapshots == nil {
+		tx.snapshots = make(map[string]snapshot, len(tx.db.snapshots))
+		for name, s := range tx.db.snapshots {
+			tx.snapshots[name] = s
+		}
+	}
+	return tx.snapshots
+}
+
+// snapshotSet returns the snapshots seen by a writable transaction.
+func (tx *Tx) snapshotSet() map[string]snapshot {
+	if tx.snapshots != nil {
+		return tx.snapshots
+	}
+	return tx.db.snapshots
+}
+
+// snapshotTxids returns the sorted txids of snapshots.
+func snapshotTxids(snapshots map[string]snapshot) []txid {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	ids := make(txids, 0, len(snapshots))
+	for _, s := range snapshots {
+		ids = append(ids, s.txid)
+	}
+	sort.Sort(ids)
+	return ids
+}
+
+// commitSnapshots writes the snapshot directory to a new page if the
+// transaction changed it, and frees the old one.
+func (tx *Tx) commitSnapshots() error {
+	if tx.snapshots == nil {
+		return nil
+	}
+	if id := tx.meta.snapshotDirectory(); id != 0 {
+		tx.db.freelist.free(tx.meta.txid, tx.page(id))
+	}
+	tx.meta.setSnapshotDirectory(0)
+	if len(tx.snapshots) == 0 {
+		return nil
+	}
+
+	n := &node{isLeaf: true}
+	for name, s := range tx.snapshots {
+		n.inodes = append(n.inodes, inode{key: []byte(name), value: s.encode()})
+	}
+	sort.Slice(n.inodes, func(i, j int) bool { return string(n.inodes[i].key) < string(n.inodes[j].key) })
+
+	p, err := tx.allocate((n.size() + tx.db.trailer + tx.db.pageSize - 1) / tx.db.pageSize)
+	if err != nil {
+		return err
+	}
+	n.write(p)
+	tx.meta.setSnapshotDirectory(p.id)
+	return nil
+}
+
+// loadSnapshots reads the snapshot directory of the current meta page.
+func (db *DB) loadSnapshots() error {
+	db.snapshots = nil
+	id := db.meta().snapshotDirectory()
+	if id == 0 {
+		return nil
+	}
+	p, err := db.readPage(id)
+	if err != nil {
+		return err
+	}
+	defer db.releasePage(p)
+
+	db.snapshots = make(map[string]snapshot, p.count)
+	for i := uint16(0); i < p.count; i++ {
+		e := p.leafPageElement(i)
+		db.snapshots[string(e.key())] = decodeSnapshot(e.value())
+	}
+	return nil
+}
+
+// snapshotDirectory adds the pages of the snapshot directory seen by tx to
+// reachable.
+func (tx *Tx) snapshotDirectory(reachable map[pgid]pgid) {
+	id := tx.meta.snapshotDirectory()
+	if id == 0 {
+		return
+	}
+	p := tx.db.page(id)
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		reachable[id+i] = id
+	}
+}
+
+// heldPages returns the free pages that snapshots still use, for a freelist
+// rebuilt by scanning the DB. A page that is not free is used by the latest
+// version along with every page below it, so only the parts of the snapshots
+// that have since changed are walked. Pages that cannot be read are held
+// without descending into them.
+func (db *DB) heldPages() []pgid {
+	var ids []pgid
+	skip := func(id pgid) bool { return !db.freelist.freed(id) }
+	db.walkSnapshots(db.snapshots, skip, func(id pgid, p *page) {
+		if p == nil {
+			ids = append(ids, id)
+			return
+		}
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			ids = append(ids, id+i)
+		}
+	})
+	return ids
+}
+
+// snapshotPages adds the pages of the snapshots seen by tx to reachable,
+// along with the snapshot directory. Pages already in reachable are shared
+// with the snapshot, as is every page below them.
+func (tx *Tx) snapshotPages(reachable map[pgid]pgid) error {
+	tx.snapshotDirectory(reachable)
+	id := tx.meta.snapshotDirectory()
+	if id == 0 {
+		return nil
+	}
+	snapshots := make(map[string]snapshot)
+	dir := tx.page(id)
+	for i := uint16(0); i < dir.count; i++ {
+		e := dir.leafPageElement(i)
+		snapshots[string(e.key())] = decodeSnapshot(e.value())
+	}
+
+	var err error
+	skip := func(id pgid) bool { _, ok := reachable[id]; return ok }
+	tx.db.walkSnapshots(snapshots, skip, func(id pgid, p *page) {
+		if p == nil {
+			if err == nil {
+				err = fmt.Errorf("page %d: unreadable snapshot page", id)
+			}
+			return
+		}
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			reachable[id+i] = id
+		}
+	})
+	return err
+}
+
+// walkSnapshots calls fn once for every page of the snapshots, except pages
+// for which skip returns true and the pages below them. Pages that cannot be
+// read are passed as nil and not descended into.
+func (db *DB) walkSnapshots(snapshots map[string]snapshot, skip func(pgid) bool, fn func(id pgid, p *page)) {
+	seen := make(map[pgid]bool)
+	var walk func(id pgid)
+	walk = func(id pgid) {
+		if seen[id] || skip(id) {
+			return
+		}
+		seen[id] = true
+		p, err := db.readPage(id)
+		if err != nil {
+			fn(id, nil)
+			return
+		}
+		defer db.releasePage(p)
+
+		fn(id, p)
+		switch {
+		case p.flags&branchPageFlag != 0:
+			for i := uint16(0); i < p.count; i++ {
+				walk(p.branchPageElement(i).pgid)
+			}
+		case p.flags&leafPageFlag != 0:
+			for i := uint16(0); i < p.count; i++ {
+				e := p.leafPageElement(i)
+				if e.flags&bucketLeafFlag == 0 {
+					continue
+				}
+				if b := (*bucket)(unsafe.Pointer(&e.value()[0])); b.root != 0 {
+					walk(b.root)
+				}
+			}
+		}
+	}
+	for _, s := range snapshots {
+		walk(s.root)
+	}
+}
+
+// releasePage returns a page from readPage to the page pool if it was
+// decrypted into it.
+func (db *DB) releasePage(p *page) {
+	if db.encryptor != nil && p.overflow == 0 {
+		db.putPage(unsafeByteSlice(unsafe.Pointer(p), 0, 0, db.pageSize))
+	}
+}
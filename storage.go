@@ -0,0 +1,153 @@
+package dbolt
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Storage holds the data of a database: a flat range of bytes with the pages
+// at offsets of their id times the page size. Open keeps the data in a file
+// unless Options.Storage provides another implementation, such as one kept in
+// memory, one injecting faults or one backed by the network.
+//
+// The database calls Storage from one goroutine at a time, except that ReadAt
+// may be called concurrently with any method but Close.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the size of the data in bytes.
+	Size() (int64, error)
+
+	// Truncate changes the size of the data. The database only shrinks it
+	// past the pages it uses, and Shrink does so while it is not mapped.
+	Truncate(size int64) error
+
+	// Sync makes the data written so far durable.
+	Sync() error
+
+	// Lock keeps other processes from writing the data until Unlock is
+	// called. The lock is shared when exclusive is false. Lock returns
+	// ErrTimeout once timeout has passed, or waits forever if timeout is
+	// zero.
+	Lock(exclusive bool, timeout time.Duration) error
+
+	// Unlock releases the lock taken by Lock.
+	Unlock() error
+
+	// Mmap returns a view of the first size bytes of the data, which may
+	// extend past its end. Writes must show through the view until Munmap is
+	// called with it. The view is never written to.
+	Mmap(size int) ([]byte, error)
+
+	// Munmap releases a view returned by Mmap.
+	Munmap(b []byte) error
+
+	// Close releases the storage. The database calls it on Close.
+	Close() error
+}
+
+// LogStorage is a Storage that also holds the write-ahead log of the
+// database, so that Options.WAL can be used with it.
+type LogStorage interface {
+	Storage
+
+	// Log returns the storage of the write-ahead log, which is empty until
+	// the log is first written. Only ReadAt, WriteAt, Size, Truncate, Sync
+	// and Close are called on it, and it is closed before the database
+	// storage.
+	Log() (Storage, error)
+}
+
+// vectorWriter is implemented by storage that writes several buffers with
+// fewer calls than one WriteAt each. It returns the number of bytes written
+// and of calls made.
+type vectorWriter interface {
+	writev(bufs [][]byte, off int64) (n int, calls int, err error)
+}
+
+// holePuncher is implemented by storage that can deallocate the disk blocks
+// of a range of the data without changing its size. The range reads as zeros
+// afterwards.
+type holePuncher interface {
+	punchHole(off, size int64) error
+}
+
+// errPunchNotSupported is returned by punchHole on platforms other than Linux.
+var errPunchNotSupported = errors.New("punching holes is not supported on this platform")
+
+// writev writes bufs to s at off, in one WriteAt per buffer unless s is a
+// vectorWriter.
+func writev(s Storage, bufs [][]byte, off int64) (n int, calls int, err error) {
+	if w, ok := s.(vectorWriter); ok {
+		return w.writev(bufs, off)
+	}
+	for _, b := range bufs {
+		nn, err := s.WriteAt(b, off)
+		calls++
+		n += nn
+		off += int64(nn)
+		if err != nil {
+			return n, calls, err
+		}
+	}
+	return n, calls, nil
+}
+
+// fileStorage is the default Storage, a single data file that is locked with
+// flock and memory mapped.
+type fileStorage struct {
+	file      *os.File
+	readOnly  bool
+	mmapFlags int
+	mapped    bool
+}
+
+func (s *fileStorage) ReadAt(b []byte, off int64) (int, error)  { return s.file.ReadAt(b, off) }
+func (s *fileStorage) WriteAt(b []byte, off int64) (int, error) { return s.file.WriteAt(b, off) }
+func (s *fileStorage) Sync() error                              { return fdatasync(s.file) }
+func (s *fileStorage) Unlock() error                            { return funlock(s.file) }
+func (s *fileStorage) Close() error                             { return s.file.Close() }
+
+func (s *fileStorage) Size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Truncate resizes the file. On Windows a mapped file cannot be resized, so
+// it is grown to the size of the mapping by Mmap instead.
+func (s *fileStorage) Truncate(size int64) error {
+	if runtime.GOOS == "windows" && s.mapped {
+		return nil
+	}
+	return s.file.Truncate(size)
+}
+
+func (s *fileStorage) Lock(exclusive bool, timeout time.Duration) error {
+	return flock(s.file, exclusive, timeout)
+}
+
+func (s *fileStorage) Mmap(size int) ([]byte, error) {
+	b, err := mmap(s.file, size, s.mmapFlags, !s.readOnly)
+	s.mapped = err == nil
+	return b, err
+}
+
+func (s *fileStorage) Munmap(b []byte) error {
+	s.mapped = false
+	return munmap(b)
+}
+
+func (s *fileStorage) writev(bufs [][]byte, off int64) (int, int, error) {
+	return pwritev(s.file, bufs, off)
+}
+
+func (s *fileStorage) punchHole(off, size int64) error {
+	return punchHole(s.file, off, size)
+}
@@ -4,21 +4,20 @@ package dbolt
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/c0mm4nd/dbolt/consts"
 	"golang.org/x/sys/unix"
 )
 
 // flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
 	}
-	fd := db.file.Fd()
+	fd := f.Fd()
 	flag := syscall.LOCK_NB
 	if exclusive {
 		flag |= syscall.LOCK_EX
@@ -45,48 +44,55 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 }
 
 // funlock releases an advisory lock on a file descriptor.
-func funlock(db *DB) error {
-	return syscall.Flock(int(db.file.Fd()), syscall.LOCK_UN)
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
 }
 
-// mmap memory maps a DB's data file.
-func mmap(db *DB, sz int) error {
+// mmap memory maps a data file.
+func mmap(f *os.File, sz int, flags int, _ bool) ([]byte, error) {
 	// Map the data file to memory.
-	b, err := unix.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|db.MmapFlags)
+	b, err := unix.Mmap(int(f.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|flags)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Advise the kernel that the mmap is accessed randomly.
 	err = unix.Madvise(b, syscall.MADV_RANDOM)
 	if err != nil && err != syscall.ENOSYS {
 		// Ignore not implemented error in kernel because it still works.
-		return fmt.Errorf("madvise: %s", err)
+		_ = unix.Munmap(b)
+		return nil, fmt.Errorf("madvise: %s", err)
 	}
+	return b, nil
+}
 
-	// Save the original byte slice and convert to a byte array pointer.
-	db.dataref = b
-	db.data = (*[consts.MaxMapSize]byte)(unsafe.Pointer(&b[0]))
-	db.datasz = sz
-	return nil
+// munmap unmaps a data file from memory.
+func munmap(b []byte) error {
+	return unix.Munmap(b)
 }
 
-// munmap unmaps a DB's data file from memory.
-func munmap(db *DB) error {
-	// Ignore the unmap if we have no mapped data.
-	if db.dataref == nil {
-		return nil
-	}
+// fdatasync flushes written data to a file descriptor.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
 
-	// Unmap using the original byte slice.
-	err := unix.Munmap(db.dataref)
-	db.dataref = nil
-	db.data = nil
-	db.datasz = 0
-	return err
+// punchHole is not supported on this platform.
+func punchHole(f *os.File, off, size int64) error {
+	return errPunchNotSupported
 }
 
-// fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return db.file.Sync()
+// pwritev writes bufs to f at off. Vectored writes are not used on this
+// platform so every buffer takes its own system call. It returns the number of
+// bytes written and of system calls made.
+func pwritev(f *os.File, bufs [][]byte, off int64) (n int, calls int, err error) {
+	for _, b := range bufs {
+		nn, err := f.WriteAt(b, off)
+		calls++
+		n += nn
+		off += int64(nn)
+		if err != nil {
+			return n, calls, err
+		}
+	}
+	return n, calls, nil
 }
@@ -4,21 +4,21 @@ package dbolt
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/c0mm4nd/dbolt/consts"
 	"golang.org/x/sys/unix"
 )
 
 // flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
 	}
-	fd := db.file.Fd()
+	fd := f.Fd()
 	flag := syscall.LOCK_NB
 	if exclusive {
 		flag |= syscall.LOCK_EX
@@ -45,48 +45,69 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 }
 
 // funlock releases an advisory lock on a file descriptor.
-func funlock(db *DB) error {
-	return syscall.Flock(int(db.file.Fd()), syscall.LOCK_UN)
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
 }
 
-// mmap memory maps a DB's data file.
-func mmap(db *DB, sz int) error {
+// mmap memory maps a data file.
+func mmap(f *os.File, sz int, flags int, _ bool) ([]byte, error) {
 	// Map the data file to memory.
-	b, err := unix.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|db.MmapFlags)
+	b, err := unix.Mmap(int(f.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|flags)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Advise the kernel that the mmap is accessed randomly.
 	err = unix.Madvise(b, syscall.MADV_RANDOM)
 	if err != nil && err != syscall.ENOSYS {
 		// Ignore not implemented error in kernel because it still works.
-		return fmt.Errorf("madvise: %s", err)
+		_ = unix.Munmap(b)
+		return nil, fmt.Errorf("madvise: %s", err)
 	}
+	return b, nil
+}
 
-	// Save the original byte slice and convert to a byte array pointer.
-	db.dataref = b
-	db.data = (*[consts.MaxMapSize]byte)(unsafe.Pointer(&b[0]))
-	db.datasz = sz
-	return nil
+// munmap unmaps a data file from memory.
+func munmap(b []byte) error {
+	return unix.Munmap(b)
 }
 
-// munmap unmaps a DB's data file from memory.
-func munmap(db *DB) error {
-	// Ignore the unmap if we have no mapped data.
-	if db.dataref == nil {
-		return nil
-	}
+// fdatasync flushes written data to a file descriptor.
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
 
-	// Unmap using the original byte slice.
-	err := unix.Munmap(db.dataref)
-	db.dataref = nil
-	db.data = nil
-	db.datasz = 0
-	return err
+// punchHole deallocates the disk blocks of size bytes of f at off, keeping
+// the size of f.
+func punchHole(f *os.File, off, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
 }
 
-// fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return syscall.Fdatasync(int(db.file.Fd()))
+// pwritev writes bufs to f at off using as few pwritev calls as possible.
+// It returns the number of bytes written and of system calls made.
+func pwritev(f *os.File, bufs [][]byte, off int64) (n int, calls int, err error) {
+	for len(bufs) > 0 {
+		nn, err := unix.Pwritev(int(f.Fd()), bufs, off)
+		calls++
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return n, calls, err
+		} else if nn == 0 {
+			return n, calls, io.ErrShortWrite
+		}
+		n += nn
+		off += int64(nn)
+
+		// Skip past what was written after a short write.
+		for nn > 0 {
+			if nn < len(bufs[0]) {
+				bufs[0] = bufs[0][nn:]
+				break
+			}
+			nn -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+	}
+	return n, calls, nil
 }
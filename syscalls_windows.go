@@ -45,7 +45,7 @@ func unlockFileEx(h syscall.Handle, reserved, locklow, lockhigh uint32, ol *sysc
 }
 
 // flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
@@ -58,7 +58,7 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 		// Fix for https://github.com/etcd-io/bbolt/issues/121. Use byte-range
 		// -1..0 as the lock on the database file.
 		var m1 uint32 = (1 << 32) - 1 // -1 in a uint32
-		err := lockFileEx(syscall.Handle(db.file.Fd()), flag, 0, 1, 0, &syscall.Overlapped{
+		err := lockFileEx(syscall.Handle(f.Fd()), flag, 0, 1, 0, &syscall.Overlapped{
 			Offset:     m1,
 			OffsetHigh: m1,
 		})
@@ -80,61 +80,55 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 }
 
 // funlock releases an advisory lock on a file descriptor.
-func funlock(db *DB) error {
+func funlock(f *os.File) error {
 	var m1 uint32 = (1 << 32) - 1 // -1 in a uint32
-	err := unlockFileEx(syscall.Handle(db.file.Fd()), 0, 1, 0, &syscall.Overlapped{
+	err := unlockFileEx(syscall.Handle(f.Fd()), 0, 1, 0, &syscall.Overlapped{
 		Offset:     m1,
 		OffsetHigh: m1,
 	})
 	return err
 }
 
-// mmap memory maps a DB's data file.
+// mmap memory maps a data file. A writable file is first grown to the size
+// of the mapping.
 // Based on: https://github.com/edsrzf/mmap-go
-func mmap(db *DB, sz int) error {
-	if !db.readOnly {
+func mmap(f *os.File, sz int, _ int, writable bool) ([]byte, error) {
+	if writable {
 		// Truncate the database to the size of the mmap.
-		if err := db.file.Truncate(int64(sz)); err != nil {
-			return fmt.Errorf("truncate: %s", err)
+		if err := f.Truncate(int64(sz)); err != nil {
+			return nil, fmt.Errorf("truncate: %s", err)
 		}
 	}
 
 	// Open a file mapping handle.
 	sizelo := uint32(sz >> 32)
 	sizehi := uint32(sz) & 0xffffffff
-	h, errno := syscall.CreateFileMapping(syscall.Handle(db.file.Fd()), nil, syscall.PAGE_READONLY, sizelo, sizehi, nil)
+	h, errno := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, sizelo, sizehi, nil)
 	if h == 0 {
-		return os.NewSyscallError("CreateFileMapping", errno)
+		return nil, os.NewSyscallError("CreateFileMapping", errno)
 	}
 
 	// Create the memory map.
 	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, uintptr(sz))
 	if addr == 0 {
-		return os.NewSyscallError("MapViewOfFile", errno)
+		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
 
 	// Close mapping handle.
 	if err := syscall.CloseHandle(syscall.Handle(h)); err != nil {
-		return os.NewSyscallError("CloseHandle", err)
+		return nil, os.NewSyscallError("CloseHandle", err)
 	}
 
-	// Convert to a byte array.
+	// Convert to a byte slice.
 	//revive:disable
-	db.data = ((*[consts.MaxMapSize]byte)(unsafe.Pointer(addr)))
+	return (*[consts.MaxMapSize]byte)(unsafe.Pointer(addr))[:sz:sz], nil
 	//revive:enable
-	db.datasz = sz
-
-	return nil
 }
 
-// munmap unmaps a pointer from a file.
+// munmap unmaps a data file from memory.
 // Based on: https://github.com/edsrzf/mmap-go
-func munmap(db *DB) error {
-	if db.data == nil {
-		return nil
-	}
-
-	addr := (uintptr)(unsafe.Pointer(&db.data[0]))
+func munmap(b []byte) error {
+	addr := (uintptr)(unsafe.Pointer(&b[0]))
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return os.NewSyscallError("UnmapViewOfFile", err)
 	}
@@ -142,6 +136,27 @@ func munmap(db *DB) error {
 }
 
 // fdatasync flushes written data to a file descriptor.
-func fdatasync(db *DB) error {
-	return db.file.Sync()
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// punchHole is not supported on this platform.
+func punchHole(f *os.File, off, size int64) error {
+	return errPunchNotSupported
+}
+
+// pwritev writes bufs to f at off. Vectored writes are not used on this
+// platform so every buffer takes its own system call. It returns the number of
+// bytes written and of system calls made.
+func pwritev(f *os.File, bufs [][]byte, off int64) (n int, calls int, err error) {
+	for _, b := range bufs {
+		nn, err := f.WriteAt(b, off)
+		calls++
+		n += nn
+		off += int64(nn)
+		if err != nil {
+			return n, calls, err
+		}
+	}
+	return n, calls, nil
 }
@@ -1183,6 +1183,114 @@ func TestBucket_Put_ValueTooLarge(t *testing.T) {
 	}
 }
 
+// Ensure that values in a compressed bucket are stored compressed and read
+// back transparently across transactions and reopens.
+func TestBucket_CreateBucketWithOptions_Compression(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	value := []byte(strings.Repeat(`{"name":"widget","color":"blue"}`, 100))
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketWithOptions([]byte("bad"), bolt.BucketOptions{Compression: 99}); err != bolt.ErrInvalidCompression {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := tx.CreateBucketWithOptions([]byte("widgets"), bolt.BucketOptions{Compression: bolt.Flate})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), value); err != nil {
+				return err
+			}
+		}
+		// Values that do not shrink are stored as they are.
+		if err := b.Put([]byte("small"), []byte("x")); err != nil {
+			return err
+		}
+		if v := b.Get([]byte("0000")); !bytes.Equal(v, value) {
+			t.Fatalf("unexpected value in tx: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if c := b.Compression(); c != bolt.Flate {
+			t.Fatalf("unexpected compression: %v", c)
+		}
+		if v := b.Get([]byte("0042")); !bytes.Equal(v, value) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("small")); !bytes.Equal(v, []byte("x")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+
+		var n int
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !bytes.Equal(k, []byte("small")) && !bytes.Equal(v, value) {
+				t.Fatalf("unexpected value at %s: %q", k, v)
+			}
+			n++
+		}
+		if n != 101 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+
+		stats := b.Stats()
+		if stats.CompressedValueN != 100 {
+			t.Fatalf("unexpected CompressedValueN: %d", stats.CompressedValueN)
+		} else if stats.LogicalValueBytes != 100*len(value) {
+			t.Fatalf("unexpected LogicalValueBytes: %d", stats.LogicalValueBytes)
+		} else if stats.CompressedValueBytes >= stats.LogicalValueBytes/10 {
+			t.Fatalf("unexpected CompressedValueBytes: %d", stats.CompressedValueBytes)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compression survives the bucket header being rewritten.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).SetSequence(10)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if c := tx.Bucket([]byte("widgets")).Compression(); c != bolt.Flate {
+			t.Fatalf("unexpected compression: %v", c)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction keeps the bucket compressed.
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if err := bolt.Compact(dst.DB, db.DB, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if c := b.Compression(); c != bolt.Flate {
+			t.Fatalf("unexpected compression after compaction: %v", c)
+		} else if n := b.Stats().CompressedValueN; n != 100 {
+			t.Fatalf("unexpected CompressedValueN after compaction: %d", n)
+		} else if v := b.Get([]byte("0042")); !bytes.Equal(v, value) {
+			t.Fatalf("unexpected value after compaction: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure a bucket can calculate stats.
 func TestBucket_Stats(t *testing.T) {
 	if testing.Short() {
@@ -0,0 +1,143 @@
+package dbolt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"testing"
+
+	bolt "github.com/c0mm4nd/dbolt"
+	"github.com/c0mm4nd/dbolt/dbolttest"
+)
+
+// crashUpdates returns updates that create, fill, overwrite and delete
+// buckets, growing the database past its initial mmap.
+func crashUpdates() []func(*bolt.Tx) error {
+	var updates []func(*bolt.Tx) error
+	for i := 0; i < 6; i++ {
+		i := i
+		updates = append(updates, func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("bucket%d", i%3)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 50; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%03d", j)), bytes.Repeat([]byte{byte(i)}, 100*(i+1))); err != nil {
+					return err
+				}
+			}
+			if i == 4 {
+				return tx.DeleteBucket([]byte("bucket0"))
+			}
+			return nil
+		})
+	}
+	return updates
+}
+
+// Ensure that every update survives a crash at any write or sync either
+// completely or not at all.
+func TestCrashConsistency(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options *bolt.Options
+		faults  dbolttest.Faults
+	}{
+		{"ProcessCrash", nil, dbolttest.Faults{}},
+		{"PowerLoss", nil, dbolttest.Faults{Drop: true, Reorder: true, Tear: true}},
+		{"PageChecksum", &bolt.Options{PageChecksum: true}, dbolttest.Faults{Drop: true, Reorder: true, Tear: true}},
+		{"WAL", &bolt.Options{WAL: true}, dbolttest.Faults{Drop: true, Reorder: true, Tear: true}},
+		{"WALCheckpoint", &bolt.Options{WAL: true, WALCheckpointSize: 8192, Logger: log.New(ioutil.Discard, "", 0)}, dbolttest.Faults{Drop: true, Reorder: true, Tear: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			recovered := 0
+			if err := dbolttest.Check(dbolttest.Config{
+				Options: tt.options,
+				Updates: crashUpdates(),
+				Faults:  tt.faults,
+				Seed:    1,
+				Recover: func(db *bolt.DB, committed int) error {
+					recovered++
+					return db.Update(func(tx *bolt.Tx) error {
+						_, err := tx.CreateBucketIfNotExists([]byte("recovered"))
+						return err
+					})
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if recovered == 0 {
+				t.Fatal("expected crashes")
+			}
+		})
+	}
+}
+
+// Ensure that Check reports a database that loses committed updates.
+func TestCrashConsistency_Lost(t *testing.T) {
+	err := dbolttest.Check(dbolttest.Config{
+		Options: &bolt.Options{NoSync: true},
+		Updates: crashUpdates(),
+		Faults:  dbolttest.Faults{Drop: true},
+		Seed:    1,
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// Ensure that the storage only keeps synced writes through a power loss.
+func TestStorage_Image(t *testing.T) {
+	s := dbolttest.NewStorage(nil)
+	if _, err := s.WriteAt([]byte("foo"), 0); err != nil {
+		t.Fatal(err)
+	} else if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	s.CrashAtWrite(3)
+	if _, err := s.WriteAt([]byte("bar"), 3); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.WriteAt([]byte("baz"), 6); !errors.Is(err, dbolttest.ErrCrashed) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := s.Sync(); !errors.Is(err, dbolttest.ErrCrashed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if image := s.Image(dbolttest.Faults{}, nil); string(image) != "foobarbaz" {
+		t.Fatalf("unexpected image: %q", image)
+	}
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		if image := s.Image(dbolttest.Faults{Drop: true, Reorder: true}, rng); !bytes.HasPrefix(image, []byte("foo")) {
+			t.Fatalf("unexpected image: %q", image)
+		}
+	}
+}
+
+// Ensure that truncations only become durable on sync.
+func TestStorage_Image_Truncate(t *testing.T) {
+	s := dbolttest.NewStorage([]byte("foobar"))
+	if err := s.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if image := s.Image(dbolttest.Faults{}, nil); string(image) != "foo" {
+		t.Fatalf("unexpected image: %q", image)
+	}
+	rng := rand.New(rand.NewSource(0))
+	images := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		images[string(s.Image(dbolttest.Faults{Drop: true}, rng))] = true
+	}
+	if !images["foo"] || !images["foobar"] || len(images) != 2 {
+		t.Fatalf("unexpected images: %v", images)
+	}
+
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	} else if image := s.Image(dbolttest.Faults{Drop: true}, rng); string(image) != "foo" {
+		t.Fatalf("unexpected image: %q", image)
+	}
+}
@@ -2,17 +2,24 @@ package dbolt_test
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -532,6 +539,145 @@ func TestOpen_BigPage(t *testing.T) {
 	}
 }
 
+// Ensure that a database whose first meta page is corrupt opens from the
+// second one, even when its page size differs from the OS page size.
+func TestOpen_CorruptMeta0(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{PageSize: 16384})
+	path := db.Path()
+	defer db.MustClose()
+
+	if info := db.RecoveryInfo(); info.Fallback() || info.Meta0Err != nil || info.PageSizeProbed {
+		t.Fatalf("unexpected recovery info: %+v", info)
+	}
+
+	// Commit twice so that the second meta page holds the last commit.
+	for _, k := range []string{"foo", "bar"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k), []byte(k))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the magic of the first meta page.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta0 := (*meta)(unsafe.Pointer(&buf[pageHeaderSize]))
+	meta0.magic = 0
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db0, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db0.Close()
+
+	info := db0.RecoveryInfo()
+	if !info.Fallback() || info.Meta != 1 || info.Meta0Err != bolt.ErrInvalid || info.Meta1Err != nil || !info.PageSizeProbed {
+		t.Fatalf("unexpected recovery info: %+v", info)
+	}
+	if sz := db0.Info().PageSize; sz != 16384 {
+		t.Fatalf("unexpected page size: %d", sz)
+	}
+
+	// Tools reading the file directly find the same page size.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if sz, err := bolt.ProbePageSize(f); err != nil || sz != 16384 {
+		t.Fatalf("unexpected page size: %d (%v)", sz, err)
+	}
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if report, err := bolt.Repair(dst.DB, path, 0); err != nil {
+		t.Fatal(err)
+	} else if report.Meta != 1 || report.PageSize != 16384 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if err := db0.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			return errors.New("bucket not found")
+		}
+		for _, k := range []string{"foo", "bar"} {
+			if v := b.Get([]byte(k)); string(v) != k {
+				t.Fatalf("unexpected value for %q: %q", k, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that rebuilding the freelist on open tolerates keys out of order,
+// which leave every page reachable.
+func TestOpen_RecoverFreeList_KeyOrder(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"mmmm1", "mmmm2"} {
+			if err := b.Put([]byte(k), []byte("v")); err != nil {
+				return err
+			}
+		}
+		// Keep the bucket out of line.
+		return b.Put([]byte("zzzz"), make([]byte, pageSize/2))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the second key before the first.
+	buf, err := os.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = bytes.ReplaceAll(buf, []byte("mmmm2"), []byte("aaaa2"))
+	if err := os.WriteFile(db.f, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	indb, err := bolt.Open(db.f, 0666, db.o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indb.Close()
+	var n int
+	if err := indb.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			if ce := (*bolt.CheckError)(nil); !errors.As(err, &ce) || ce.Kind != bolt.CheckKeyOrder {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected keys out of order")
+	}
+}
+
 // TestOpen_RecoverFreeList tests opening the DB with free-list
 // write-out after no free list sync will recover the free list
 // and write it out.
@@ -600,186 +746,326 @@ func TestOpen_RecoverFreeList(t *testing.T) {
 	}
 }
 
-// Ensure that a database cannot open a transaction when it's not open.
-func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
-	var db bolt.DB
-	if _, err := db.Begin(false); err != bolt.ErrDatabaseNotOpen {
-		t.Fatalf("unexpected error: %s", err)
+// Ensure that commits in WAL mode go to the log, that the log is replayed
+// after a crash and that a torn record at its tail is ignored.
+func TestOpen_WAL(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WAL: true})
+	defer db.MustClose()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%02d", i)), []byte("value"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(db.Path() + "-wal"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() == 0 {
+		t.Fatal("expected a non-empty log")
 	}
-}
 
-// Ensure that a read-write transaction can be retrieved.
-func TestDB_BeginRW(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
+	// Simulate a crash by copying the data file and the log while the
+	// database is open, and append a torn record to the log.
+	path := tempfile()
+	defer os.Remove(path)
+	defer os.Remove(path + "-wal")
+	for _, suffix := range []string{"", "-wal"} {
+		buf, err := ioutil.ReadFile(db.Path() + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suffix != "" {
+			buf = append(buf, bytes.Repeat([]byte{0x21}, 100)...)
+		}
+		if err := ioutil.WriteFile(path+suffix, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	tx, err := db.Begin(true)
+	// Open without WAL mode replays the log into the data file.
+	crashed, err := bolt.Open(path, 0666, nil)
 	if err != nil {
 		t.Fatal(err)
-	} else if tx == nil {
-		t.Fatal("expected tx")
 	}
-
-	if tx.DB() != db.DB {
-		t.Fatal("unexpected tx database")
-	} else if !tx.Writable() {
-		t.Fatal("expected writable tx")
+	if err := crashed.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		}
+		if n := b.Stats().KeyN; n != 10 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("expected the log to be removed: %v", err)
 	}
 
-	if err := tx.Commit(); err != nil {
+	// Checkpoint empties the log of the running database.
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(db.Path() + "-wal"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("unexpected log size: %d", fi.Size())
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("09")); !bytes.Equal(v, []byte("value")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
 }
 
-// TestDB_Concurrent_WriteTo checks that issuing WriteTo operations concurrently
-// with commits does not produce corrupted db files.
-func TestDB_Concurrent_WriteTo(t *testing.T) {
-	o := &bolt.Options{NoFreelistSync: false}
-	db := MustOpenWithOption(o)
+// Ensure that the log is checkpointed in the background once it reaches the
+// checkpoint size and that WriteTo sees pages still in the log.
+func TestOpen_WAL_Checkpoint(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WAL: true, WALCheckpointSize: 64 * 1024})
 	defer db.MustClose()
 
-	var wg sync.WaitGroup
-	wtxs, rtxs := 5, 5
-	wg.Add(wtxs * rtxs)
-	f := func(tx *bolt.Tx) {
-		defer wg.Done()
-		f, err := ioutil.TempFile("", "bolt-")
-		if err != nil {
-			panic(err)
-		}
-		time.Sleep(time.Duration(rand.Intn(20)+1) * time.Millisecond)
-		tx.WriteTo(f)
-		tx.Rollback()
-		f.Close()
-		snap := &DB{nil, f.Name(), o}
-		snap.MustReopen()
-		defer snap.MustClose()
-		snap.MustCheck()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
 	}
 
-	tx1, err := db.Begin(true)
+	// A copy taken while the pages are only in the log is complete.
+	var buf bytes.Buffer
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	path := tempfile()
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := bolt.Open(path, 0666, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := tx1.CreateBucket([]byte("abc")); err != nil {
+	if err := cp.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket in copy")
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
-	if err := tx1.Commit(); err != nil {
+	if err := cp.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	for i := 0; i < wtxs; i++ {
-		tx, err := db.Begin(true)
-		if err != nil {
+	for i := 0; i < 100; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000))
+		}); err != nil {
 			t.Fatal(err)
 		}
-		if err := tx.Bucket([]byte("abc")).Put([]byte{0}, []byte{0}); err != nil {
+
+		// A commit never leaves the log at twice the checkpoint size.
+		if fi, err := os.Stat(db.Path() + "-wal"); err != nil {
 			t.Fatal(err)
+		} else if fi.Size() >= 2*64*1024 {
+			t.Fatalf("log not bounded: %d bytes", fi.Size())
 		}
-		for j := 0; j < rtxs; j++ {
-			rtx, rerr := db.Begin(false)
-			if rerr != nil {
-				t.Fatal(rerr)
-			}
-			go f(rtx)
+	}
+
+	// Wait for the background checkpointer to catch up.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		fi, err := os.Stat(db.Path() + "-wal")
+		if err != nil {
+			t.Fatal(err)
+		} else if fi.Size() < 64*1024 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("log was not checkpointed: %d bytes", fi.Size())
 		}
-		if err := tx.Commit(); err != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 100 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		for err := range tx.Check() {
 			t.Fatal(err)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	wg.Wait()
 }
 
-// Ensure that opening a transaction while the DB is closed returns an error.
-func TestDB_BeginRW_Closed(t *testing.T) {
-	var db bolt.DB
-	if _, err := db.Begin(true); err != bolt.ErrDatabaseNotOpen {
-		t.Fatalf("unexpected error: %s", err)
+// testStorage is a Storage kept in memory that records how it is used.
+type testStorage struct {
+	mu     sync.Mutex
+	buf    []byte
+	size   int64
+	syncs  int
+	locked bool
+	closed bool
+}
+
+func (s *testStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if int64(n) > s.size-off {
+		n = int(s.size - off)
 	}
+	// Bytes past the buffer are zero; it is only grown by Mmap and WriteAt
+	// so that it stays in place while mapped.
+	var copied int
+	if off < int64(len(s.buf)) {
+		copied = copy(b[:n], s.buf[off:])
+	}
+	for i := copied; i < n; i++ {
+		b[i] = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
-func TestDB_Close_PendingTx_RW(t *testing.T) { testDB_Close_PendingTx(t, true) }
-func TestDB_Close_PendingTx_RO(t *testing.T) { testDB_Close_PendingTx(t, false) }
+func (s *testStorage) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end := off + int64(len(b)); end > s.size {
+		s.grow(int(end))
+		s.size = end
+	}
+	return copy(s.buf[off:], b), nil
+}
 
-// Ensure that a database cannot close while transactions are open.
-func testDB_Close_PendingTx(t *testing.T, writable bool) {
-	db := MustOpenDB()
+func (s *testStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, nil
+}
 
-	// Start transaction.
-	tx, err := db.Begin(writable)
-	if err != nil {
-		t.Fatal(err)
+func (s *testStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	return nil
+}
+
+func (s *testStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return nil
+}
+
+func (s *testStorage) Lock(exclusive bool, timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked {
+		return bolt.ErrTimeout
 	}
+	s.locked, s.closed = true, false
+	return nil
+}
 
-	// Open update in separate goroutine.
-	done := make(chan error, 1)
-	go func() {
-		err := db.Close()
-		done <- err
-	}()
+func (s *testStorage) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locked = false
+	return nil
+}
 
-	// Ensure database hasn't closed.
-	time.Sleep(100 * time.Millisecond)
-	select {
-	case err := <-done:
-		if err != nil {
-			t.Errorf("error from inside goroutine: %v", err)
-		}
-		t.Fatal("database closed too early")
-	default:
-	}
+func (s *testStorage) Mmap(size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grow(size)
+	return s.buf[:size], nil
+}
 
-	// Commit/close transaction.
-	if writable {
-		err = tx.Commit()
-	} else {
-		err = tx.Rollback()
+func (s *testStorage) Munmap(b []byte) error { return nil }
+
+func (s *testStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// grow moves the data into a larger buffer if it holds less than sz bytes.
+func (s *testStorage) grow(sz int) {
+	if sz > len(s.buf) {
+		buf := make([]byte, sz)
+		copy(buf, s.buf)
+		s.buf = buf
 	}
+}
+
+// Ensure that a database can be kept in a storage other than a file.
+func TestOpen_Storage(t *testing.T) {
+	path := tempfile()
+	s := &testStorage{}
+	db, err := bolt.Open(path, 0666, &bolt.Options{Storage: s})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Ensure database closed now.
-	time.Sleep(100 * time.Millisecond)
-	select {
-	case err := <-done:
-		if err != nil {
-			t.Fatalf("error from inside goroutine: %v", err)
-		}
-	default:
-		t.Fatal("database did not close")
+	if _, err := bolt.Open(path, 0666, &bolt.Options{Storage: s, Timeout: time.Millisecond}); err != bolt.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
 	}
-}
-
-// Ensure a database can provide a transactional block.
-func TestDB_Update(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
 	if err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Delete([]byte("foo")); err != nil {
-			t.Fatal(err)
+			return err
 		}
-		return nil
+		return b.Put([]byte("foo"), bytes.Repeat([]byte("bar"), 100000))
 	}); err != nil {
 		t.Fatal(err)
 	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.closed || s.locked || s.syncs == 0 {
+		t.Fatalf("unexpected storage state: closed=%v locked=%v syncs=%d", s.closed, s.locked, s.syncs)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+
+	// Reopen from the same storage.
+	db, err = bolt.Open(path, 0666, &bolt.Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
 	if err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("widgets"))
-		if v := b.Get([]byte("foo")); v != nil {
-			t.Fatalf("expected nil value, got: %v", v)
+		for err := range tx.Check() {
+			return err
 		}
-		if v := b.Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
-			t.Fatalf("unexpected value: %v", v)
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, bytes.Repeat([]byte("bar"), 100000)) {
+			return fmt.Errorf("unexpected value of length %d", len(v))
 		}
 		return nil
 	}); err != nil {
@@ -787,158 +1073,1519 @@ func TestDB_Update(t *testing.T) {
 	}
 }
 
-// Ensure a closed database returns an error while running a transaction block
-func TestDB_Update_Closed(t *testing.T) {
-	var db bolt.DB
-	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
-			t.Fatal(err)
-		}
-		return nil
-	}); err != bolt.ErrDatabaseNotOpen {
-		t.Fatalf("unexpected error: %s", err)
+// Ensure that an in-memory database grows, supports batches and can be
+// written out to a regular database file.
+func TestOpenMemory(t *testing.T) {
+	db, err := bolt.Open("", 0666, &bolt.Options{InMemory: true, AllocSize: 64 * 1024, MaxBatchSize: bolt.DefaultMaxBatchSize, MaxBatchDelay: bolt.DefaultMaxBatchDelay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Path() != "" {
+		t.Fatalf("unexpected path: %q", db.Path())
 	}
-}
-
-// Ensure a panic occurs while trying to commit a managed transaction.
-func TestDB_Update_ManualCommit(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
 
-	var panicked bool
-	if err := db.Update(func(tx *bolt.Tx) error {
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					panicked = true
+	// Write enough to remap the buffer several times.
+	for i := 0; i < 20; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 100; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%02d%03d", i, j)), bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+					return err
 				}
-			}()
-
-			if err := tx.Commit(); err != nil {
-				t.Fatal(err)
 			}
-		}()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Batch(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("batch%d", i)), []byte("x"))
+			}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Persist the database and read it back from the file.
+	path := tempfile()
+	defer os.Remove(path)
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fdb, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fdb.Close()
+	if err := fdb.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		n := 0
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			return err
+		}
+		if n != 2010 {
+			return fmt.Errorf("unexpected count: %d", n)
+		}
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("19099")); !bytes.Equal(v, bytes.Repeat([]byte{19}, 1000)) {
+			return fmt.Errorf("unexpected value: %x", v)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
-	} else if !panicked {
-		t.Fatal("expected panic")
 	}
 }
 
-// Ensure a panic occurs while trying to rollback a managed transaction.
-func TestDB_Update_ManualRollback(t *testing.T) {
+// Ensure that a snapshot keeps an old version of the database readable across
+// commits and reopens until it is dropped.
+func TestDB_Snapshot(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
-	var panicked bool
+	// Snapshot a version with a bucket of values.
 	if err := db.Update(func(tx *bolt.Tx) error {
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					panicked = true
-				}
-			}()
-
-			if err := tx.Rollback(); err != nil {
-				t.Fatal(err)
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), bytes.Repeat([]byte("v1"), 50)); err != nil {
+				return err
 			}
-		}()
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
-	} else if !panicked {
-		t.Fatal("expected panic")
 	}
-}
-
-// Ensure a panic occurs while trying to commit a managed transaction.
-func TestDB_View_ManualCommit(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
+	if err := db.CreateSnapshot("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot("v1"); err != bolt.ErrSnapshotExists {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := db.CreateSnapshot(""); err != bolt.ErrSnapshotNameRequired {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := db.OpenSnapshot("v2"); err != bolt.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := db.DropSnapshot("v2"); err != bolt.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-	var panicked bool
-	if err := db.View(func(tx *bolt.Tx) error {
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					panicked = true
+	// Replace the bucket and write enough to reuse any free pages.
+	update := func(gen int) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket([]byte("widgets")); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), bytes.Repeat([]byte{byte(gen)}, 100)); err != nil {
+					return err
 				}
-			}()
-
-			if err := tx.Commit(); err != nil {
-				t.Fatal(err)
 			}
-		}()
-		return nil
-	}); err != nil {
-		t.Fatal(err)
-	} else if !panicked {
-		t.Fatal("expected panic")
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
 	}
-}
+	verify := func() {
+		tx, err := db.OpenSnapshot("v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = tx.Rollback() }()
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		}
+		n := 0
+		if err := b.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(v, bytes.Repeat([]byte("v1"), 50)) {
+				t.Fatalf("unexpected value for %s: %q", k, v)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		update(i)
+	}
+	verify()
 
-// Ensure a panic occurs while trying to rollback a managed transaction.
-func TestDB_View_ManualRollback(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
+	// The snapshot survives a reopen.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	for i := 5; i < 10; i++ {
+		update(i)
+	}
+	verify()
+	db.MustCheck()
 
-	var panicked bool
+	// The pages of the snapshot are not reported as free.
+	stx, err := db.OpenSnapshot("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := stx.Bucket([]byte("widgets")).Root()
+	if err := stx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
 	if err := db.View(func(tx *bolt.Tx) error {
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					panicked = true
-				}
-			}()
-
-			if err := tx.Rollback(); err != nil {
-				t.Fatal(err)
-			}
-		}()
+		if p, err := tx.Page(int(root)); err != nil {
+			return err
+		} else if p.Type != "branch" {
+			t.Fatalf("unexpected snapshot page type: %s", p.Type)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
-	} else if !panicked {
-		t.Fatal("expected panic")
+	}
+
+	// Compacting would lose the snapshot.
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if err := bolt.Compact(dst.DB, db.DB, 0); err != bolt.ErrCompactSnapshots {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if snapshots := db.Snapshots(); len(snapshots) != 1 || snapshots[0].Name != "v1" || snapshots[0].TxID != 2 {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
+	}
+
+	// Dropping the snapshot releases its pages.
+	free := db.Stats().FreePageN
+	if err := db.DropSnapshot("v1"); err != nil {
+		t.Fatal(err)
+	}
+	update(10)
+	if n := db.Stats().FreePageN; n <= free {
+		t.Fatalf("expected more free pages: %d <= %d", n, free)
+	}
+	if _, err := db.OpenSnapshot("v1"); err != bolt.ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	} else if snapshots := db.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
 	}
 }
 
-// Ensure a write transaction that panics does not hold open locks.
-func TestDB_Update_Panic(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
+// Ensure that shrinking moves pages down, truncates the file and keeps the
+// data, snapshots and concurrent readers intact.
+func TestDB_Shrink(t *testing.T) {
+	for _, typ := range []bolt.FreelistType{bolt.FreelistArrayType, bolt.FreelistMapType, bolt.FreelistExtentType} {
+		t.Run(string(typ), func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			o := &bolt.Options{FreelistType: typ}
+			db, err := bolt.Open(path, 0666, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = db.Close() }()
 
-	// Panic during update but recover.
-	func() {
+			put := func(name string, n, size int) {
+				if err := db.Update(func(tx *bolt.Tx) error {
+					b, err := tx.CreateBucketIfNotExists([]byte(name))
+					if err != nil {
+						return err
+					}
+					sub, err := b.CreateBucketIfNotExists([]byte("sub"))
+					if err != nil {
+						return err
+					}
+					for i := 0; i < n; i++ {
+						k := []byte(fmt.Sprintf("%05d", i))
+						if err := b.Put(k, bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+							return err
+						} else if err := sub.Put(k, k); err != nil {
+							return err
+						}
+					}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Fill the bottom of the file with data that is deleted later,
+			// and the top with data that has to move down.
+			put("config", 10, 10)
+			if err := db.CreateSnapshot("config"); err != nil {
+				t.Fatal(err)
+			}
+			put("trash", 20000, 100)
+			put("widgets", 5000, 100)
+			put("large", 5, 20000)
+			if err := db.Update(func(tx *bolt.Tx) error {
+				if err := tx.DeleteBucket([]byte("trash")); err != nil {
+					return err
+				}
+				b := tx.Bucket([]byte("widgets"))
+				for i := 0; i < 5000; i += 2 {
+					if err := b.Delete([]byte(fmt.Sprintf("%05d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			verify := func() {
+				if err := db.View(func(tx *bolt.Tx) error {
+					for err := range tx.Check() {
+						return err
+					}
+					if tx.Bucket([]byte("trash")) != nil {
+						return errors.New("unexpected trash")
+					}
+					for _, c := range []struct {
+						name        string
+						n, size     int
+						step, start int
+					}{{"config", 10, 10, 1, 0}, {"widgets", 5000, 100, 2, 1}, {"large", 5, 20000, 1, 0}} {
+						b := tx.Bucket([]byte(c.name))
+						if b == nil {
+							return fmt.Errorf("missing %s", c.name)
+						}
+						if n := b.Stats().KeyN; n != (c.n-c.start+c.step-1)/c.step+1+c.n {
+							return fmt.Errorf("unexpected key count in %s: %d", c.name, n)
+						}
+						for i := c.start; i < c.n; i += c.step {
+							k := []byte(fmt.Sprintf("%05d", i))
+							if v := b.Get(k); !bytes.Equal(v, bytes.Repeat([]byte{byte(i)}, c.size)) {
+								return fmt.Errorf("unexpected value for %s/%s", c.name, k)
+							} else if v := b.Bucket([]byte("sub")).Get(k); !bytes.Equal(v, k) {
+								return fmt.Errorf("unexpected value for %s/sub/%s", c.name, k)
+							}
+						}
+					}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			size := func() int64 {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return info.Size()
+			}
+
+			// A reader keeps running while the database shrinks.
+			before := size()
+			tx, err := db.Begin(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error)
+			go func() { done <- db.Shrink(context.Background()) }()
+			n := 0
+			if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+				n++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			} else if n != 2501 {
+				t.Fatalf("unexpected count: %d", n)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			verify()
+
+			// Without readers the pages can all move down.
+			if err := db.Shrink(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if after := size(); after > before/2 {
+				t.Fatalf("file did not shrink: %d -> %d", before, after)
+			}
+			verify()
+
+			// The database keeps working once shrunk.
+			put("widgets", 5000, 100)
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				for i := 0; i < 5000; i += 2 {
+					if err := b.Delete([]byte(fmt.Sprintf("%05d", i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if db, err = bolt.Open(path, 0666, o); err != nil {
+				t.Fatal(err)
+			}
+			verify()
+
+			snap, err := db.OpenSnapshot("config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = snap.Rollback() }()
+			if snap.Bucket([]byte("config")) == nil || snap.Bucket([]byte("widgets")) != nil {
+				t.Fatal("unexpected snapshot contents")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := db.Shrink(ctx); err != context.Canceled {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Ensure that shrinking moves more pages than fit in one transaction,
+// resuming its walk over nested buckets from one transaction to the next.
+func TestDB_Shrink_Batches(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// Fill the bottom of the file with data that is deleted later, and the
+	// top with several thousand pages of nested buckets.
+	value := bytes.Repeat([]byte("v"), 400)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("trash"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 40000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 300; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("%03d", i)))
+			if err != nil {
+				return err
+			}
+			sub, err := b.CreateBucket([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 40; j++ {
+				if err := sub.Put([]byte(fmt.Sprintf("%02d", j)), value); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.DeleteBucket([]byte("trash"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := db.Stats().WriteBytes
+	if err := db.Shrink(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := (db.Stats().WriteBytes - written) / int64(db.Info().PageSize); n < 2048 {
+		t.Fatalf("unexpected pages written: %d", n)
+	}
+	if after, err := os.Stat(db.Path()); err != nil {
+		t.Fatal(err)
+	} else if after.Size() > info.Size()/2 {
+		t.Fatalf("file did not shrink: %d -> %d", info.Size(), after.Size())
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		for i := 0; i < 300; i++ {
+			sub := tx.Bucket([]byte(fmt.Sprintf("%03d", i))).Bucket([]byte("sub"))
+			if n := sub.Stats().KeyN; n != 40 {
+				return fmt.Errorf("unexpected key count in %03d: %d", i, n)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that an extent freelist keeps a long run of free pages in a small
+// freelist page, and that every freelist type reads what the others wrote.
+func TestDB_FreelistExtent(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	open := func(typ bolt.FreelistType) *bolt.DB {
+		db, err := bolt.Open(path, 0666, &bolt.Options{FreelistType: typ})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open(bolt.FreelistExtentType)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("config"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Pending pages are written out as free.
+	free := db.Stats().FreePageN + db.Stats().PendingPageN
+	if free < 500 {
+		t.Fatalf("unexpected free page count: %d", free)
+	} else if inuse := db.Stats().FreelistInuse; inuse > 4096 {
+		t.Fatalf("unexpected freelist size: %d", inuse)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []bolt.FreelistType{bolt.FreelistArrayType, bolt.FreelistMapType, bolt.FreelistExtentType} {
+		db := open(typ)
+		if n := db.Stats().FreePageN; n != free {
+			t.Fatalf("%s: unexpected free page count: %d", typ, n)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("config")).Put([]byte(typ), []byte(typ))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				return err
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %s", typ, err)
+		}
+		free = db.Stats().FreePageN + db.Stats().PendingPageN
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a segmented database spreads its pages over segment files and
+// can be reopened from its directory and copied to a single file.
+func TestOpen_Segmented(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("segmented storage is not supported on windows")
+	}
+
+	dir := tempfile()
+	defer os.RemoveAll(dir)
+
+	segmentSize := 16 * os.Getpagesize()
+	db, err := bolt.Open(dir, 0666, &bolt.Options{SegmentSize: segmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 100; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%02d%03d", i, j)), bytes.Repeat([]byte{byte(i)}, 500)); err != nil {
+					return err
+				}
+			}
+			// Overflow pages cross segment boundaries.
+			return b.Put([]byte(fmt.Sprintf("large%02d", i)), bytes.Repeat([]byte{byte(i)}, 3*segmentSize/2))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every segment but the last one is full.
+	segments, err := filepath.Glob(filepath.Join(dir, "data.*"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(segments) < 3 {
+		t.Fatalf("unexpected segments: %v", segments)
+	}
+	for i, path := range segments {
+		if path != filepath.Join(dir, fmt.Sprintf("data.%03d", i)) {
+			t.Fatalf("unexpected segment: %s", path)
+		}
+		if info, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if i < len(segments)-1 && info.Size() != int64(segmentSize) {
+			t.Fatalf("unexpected size of %s: %d", path, info.Size())
+		}
+	}
+
+	// Reopen from the directory without options and copy to a single file.
+	db, err = bolt.Open(dir, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	path := tempfile()
+	defer os.Remove(path)
+	if err := db.View(func(tx *bolt.Tx) error {
+		if err := <-tx.Check(); err != nil {
+			return err
+		}
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	for _, db := range []*bolt.DB{db, copied} {
+		if err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			if v := b.Get([]byte("09099")); !bytes.Equal(v, bytes.Repeat([]byte{9}, 500)) {
+				t.Fatalf("unexpected value: %x", v)
+			}
+			if v := b.Get([]byte("large05")); !bytes.Equal(v, bytes.Repeat([]byte{5}, 3*segmentSize/2)) {
+				t.Fatalf("unexpected large value: %d bytes", len(v))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a database cannot open a transaction when it's not open.
+func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
+	var db bolt.DB
+	if _, err := db.Begin(false); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that a read-write transaction can be retrieved.
+func TestDB_BeginRW(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if tx == nil {
+		t.Fatal("expected tx")
+	}
+
+	if tx.DB() != db.DB {
+		t.Fatal("unexpected tx database")
+	} else if !tx.Writable() {
+		t.Fatal("expected writable tx")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDB_Concurrent_WriteTo checks that issuing WriteTo operations concurrently
+// with commits does not produce corrupted db files.
+func TestDB_Concurrent_WriteTo(t *testing.T) {
+	o := &bolt.Options{NoFreelistSync: false}
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+
+	var wg sync.WaitGroup
+	wtxs, rtxs := 5, 5
+	wg.Add(wtxs * rtxs)
+	f := func(tx *bolt.Tx) {
+		defer wg.Done()
+		f, err := ioutil.TempFile("", "bolt-")
+		if err != nil {
+			panic(err)
+		}
+		time.Sleep(time.Duration(rand.Intn(20)+1) * time.Millisecond)
+		tx.WriteTo(f)
+		tx.Rollback()
+		f.Close()
+		snap := &DB{nil, f.Name(), o}
+		snap.MustReopen()
+		defer snap.MustClose()
+		snap.MustCheck()
+	}
+
+	tx1, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx1.CreateBucket([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < wtxs; i++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Bucket([]byte("abc")).Put([]byte{0}, []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < rtxs; j++ {
+			rtx, rerr := db.Begin(false)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			go f(rtx)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// Ensure that opening a transaction while the DB is closed returns an error.
+func TestDB_BeginRW_Closed(t *testing.T) {
+	var db bolt.DB
+	if _, err := db.Begin(true); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestDB_Close_PendingTx_RW(t *testing.T) { testDB_Close_PendingTx(t, true) }
+func TestDB_Close_PendingTx_RO(t *testing.T) { testDB_Close_PendingTx(t, false) }
+
+// Ensure that a database cannot close while transactions are open.
+func testDB_Close_PendingTx(t *testing.T, writable bool) {
+	db := MustOpenDB()
+
+	// Start transaction.
+	tx, err := db.Begin(writable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open update in separate goroutine.
+	done := make(chan error, 1)
+	go func() {
+		err := db.Close()
+		done <- err
+	}()
+
+	// Ensure database hasn't closed.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("error from inside goroutine: %v", err)
+		}
+		t.Fatal("database closed too early")
+	default:
+	}
+
+	// Commit/close transaction.
+	if writable {
+		err = tx.Commit()
+	} else {
+		err = tx.Rollback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure database closed now.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error from inside goroutine: %v", err)
+		}
+	default:
+		t.Fatal("database did not close")
+	}
+}
+
+// Ensure a database can provide a transactional block.
+func TestDB_Update(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); v != nil {
+			t.Fatalf("expected nil value, got: %v", v)
+		}
+		if v := b.Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a closed database returns an error while running a transaction block
+func TestDB_Update_Closed(t *testing.T) {
+	var db bolt.DB
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that UpdateContext stops waiting for a stuck writer once its
+// context is done, and rolls back once the context is done before commit.
+func TestDB_UpdateContext(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.UpdateContext(ctx, func(tx *bolt.Tx) error {
+		t.Fatal("unexpected call")
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.BeginContext(ctx, true); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The function sees the context, and its changes are rolled back once
+	// the context is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := db.UpdateContext(ctx, func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			return err
+		}
+		cancel()
+		return tx.Context().Err()
+	}); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.ViewContext(context.Background(), func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected rollback")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ViewContext(ctx, func(tx *bolt.Tx) error {
+		t.Fatal("unexpected call")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The writer lock is free again.
+	if err := db.UpdateContext(context.Background(), func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a panic occurs while trying to commit a managed transaction.
+func TestDB_Update_ManualCommit(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var panicked bool
+	if err := db.Update(func(tx *bolt.Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure a panic occurs while trying to rollback a managed transaction.
+func TestDB_Update_ManualRollback(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var panicked bool
+	if err := db.Update(func(tx *bolt.Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure a panic occurs while trying to commit a managed transaction.
+func TestDB_View_ManualCommit(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var panicked bool
+	if err := db.View(func(tx *bolt.Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure a panic occurs while trying to rollback a managed transaction.
+func TestDB_View_ManualRollback(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var panicked bool
+	if err := db.View(func(tx *bolt.Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure a write transaction that panics does not hold open locks.
+func TestDB_Update_Panic(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// Panic during update but recover.
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Log("recover: update", r)
+			}
+		}()
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+				t.Fatal(err)
+			}
+			panic("omg")
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Verify we can update again.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that our change persisted.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a database can return an error through a read-only transactional block.
+func TestDB_View_Error(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return errors.New("xxx")
+	}); err == nil || err.Error() != "xxx" {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that a panic inside View is not recovered and raised again, so that
+// it is still reported at the frame that panicked.
+func TestDB_View_PanicFrame(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var stack string
+	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				t.Log("recover: update", r)
+				stack = string(debug.Stack())
 			}
 		}()
+		_ = db.View(func(tx *bolt.Tx) error {
+			viewPanic()
+			return nil
+		})
+	}()
 
-		if err := db.Update(func(tx *bolt.Tx) error {
-			if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
-				t.Fatal(err)
+	// The first panic on the stack is the most recent one.
+	lines := strings.Split(stack, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "panic(") {
+			if i+2 >= len(lines) || !strings.Contains(lines[i+2], "viewPanic") {
+				t.Fatalf("panic not reported at its frame:\n%s", stack)
+			}
+			return
+		}
+	}
+	t.Fatalf("no panic on the stack:\n%s", stack)
+}
+
+// viewPanic panics from a frame of its own.
+//
+//go:noinline
+func viewPanic() {
+	panic("omg")
+}
+
+// Ensure a read transaction that panics does not hold open locks.
+func TestDB_View_Panic(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Panic during view transaction but recover.
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Log("recover: view", r)
+			}
+		}()
+
+		if err := db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("widgets")) == nil {
+				t.Fatal("expected bucket")
 			}
 			panic("omg")
 		}); err != nil {
 			t.Fatal(err)
 		}
-	}()
+	}()
+
+	// Verify that we can still use read transactions.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that DB stats can be returned.
+func TestDB_Stats(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if stats.TxStats.PageCount != 2 {
+		t.Fatalf("unexpected TxStats.PageCount: %d", stats.TxStats.PageCount)
+	} else if stats.FreePageN != 0 {
+		t.Fatalf("unexpected FreePageN != 0: %d", stats.FreePageN)
+	} else if stats.PendingPageN != 2 {
+		t.Fatalf("unexpected PendingPageN != 2: %d", stats.PendingPageN)
+	}
+}
+
+// Ensure that the storage stats count syncs, writes, remaps and growth.
+func TestDB_Stats_Storage(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	before := db.Stats()
+	if before.RemapN == 0 || before.MmapSize == 0 || before.FileSize == 0 {
+		t.Fatalf("unexpected stats after open: %+v", before)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	diff := stats.Sub(&before)
+	if diff.SyncN < 2 || diff.SyncTime <= 0 {
+		t.Fatalf("unexpected syncs: %d in %v", diff.SyncN, diff.SyncTime)
+	} else if diff.WriteBytes < 100*1000 || diff.WriteBytes != diff.TxStats.WriteBytes {
+		t.Fatalf("unexpected written bytes: %d, %d on commit", diff.WriteBytes, diff.TxStats.WriteBytes)
+	} else if diff.RemapN == 0 || diff.RemapTime <= 0 || diff.GrowN == 0 || diff.GrowBytes <= 0 {
+		t.Fatalf("unexpected remaps or growth: %+v", diff)
+	} else if stats.FileSize <= before.FileSize || stats.MmapSize < stats.FileSize {
+		t.Fatalf("unexpected sizes: file %d, mmap %d", stats.FileSize, stats.MmapSize)
+	}
+}
+
+// Ensure that strict mode rolls back a commit that fails its check and
+// returns a *CheckError instead of panicking.
+func TestDB_StrictMode(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := bolt.Open(path, 0666, &bolt.Options{StrictModeLevel: bolt.CheckIncremental})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(name string, n int) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := put("widgets", 1000); err != nil {
+		t.Fatal(err)
+	} else if err := put("trash", 1000); err != nil {
+		t.Fatal(err)
+	} else if err := db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("trash")) }); err != nil {
+		t.Fatal(err)
+	} else if err := put("config", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the root branch of the bucket and the free pages.
+	var root int
+	var free []int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		for id := 2; id < int(tx.Size())/pageSize; id++ {
+			if info, err := tx.Page(id); err != nil {
+				return err
+			} else if info != nil && info.Type == "free" {
+				free = append(free, id)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the last element of the root branch at the highest free page
+	// left over from a leaf of plain values, which the next commit does not
+	// allocate.
+	leaf := 0
+	for _, id := range free {
+		q := buf[id*pageSize:]
+		if binary.LittleEndian.Uint16(q[8:]) != 0x02 {
+			continue
+		}
+		plain := true
+		for i := 0; i < int(binary.LittleEndian.Uint16(q[10:])); i++ {
+			if binary.LittleEndian.Uint32(q[16+16*i:])&0x01 != 0 {
+				plain = false
+			}
+		}
+		if plain {
+			leaf = id
+		}
+	}
+	if leaf == 0 {
+		t.Fatal("expected a free leaf page")
+	}
+	p := buf[root*pageSize:]
+	if p[8]&0x01 == 0 {
+		t.Fatalf("page %d is not a branch page", root)
+	}
+	last := int(binary.LittleEndian.Uint16(p[10:])) - 1
+	binary.LittleEndian.PutUint64(p[16+16*last+8:], uint64(leaf))
+
+	for _, o := range []*bolt.Options{
+		{StrictModeLevel: bolt.CheckIncremental},
+		{StrictModeLevel: bolt.CheckFull},
+		{StrictMode: true},
+	} {
+		if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+		db, err := bolt.Open(path, 0666, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		level := o.StrictModeLevel
+		if level == bolt.CheckOff {
+			level = bolt.CheckFull
+		}
+
+		// Change the first leaf only, so that the root branch is written.
+		err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("0000"), []byte("changed"))
+		})
+		var cerr *bolt.CheckError
+		if !errors.As(err, &cerr) || cerr.Level != level || len(cerr.Errors) == 0 {
+			t.Fatalf("%s: unexpected error: %v", level, err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket([]byte("widgets")).Get([]byte("0000")); bytes.Equal(v, []byte("changed")) {
+				t.Fatalf("%s: expected rollback", level)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Commits that do not touch the damage still succeed.
+		if level == bolt.CheckIncremental {
+			if err := db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("config")).Put([]byte("foo"), []byte("bar"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that Repair salvages the keys of a damaged data file.
+func TestRepair(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		zipped, err := tx.CreateBucketWithOptions([]byte("zipped"), bolt.BucketOptions{Compression: bolt.Flate})
+		if err != nil {
+			return err
+		}
+		inner, err := zipped.CreateBucket([]byte("inner"))
+		if err != nil {
+			return err
+		}
+		if err := inner.SetSequence(42); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if err := widgets.Put(k, make([]byte, 100)); err != nil {
+				return err
+			} else if err := zipped.Put(k, bytes.Repeat(k, 50)); err != nil {
+				return err
+			} else if i < 10 {
+				if err := inner.Put(k, k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := dumpKeys(t, db)
+	var root int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repair := func(buf []byte) (*bolt.RepairReport, map[string]string) {
+		if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+		dst := MustOpenDB()
+		defer dst.MustClose()
+		report, err := bolt.Repair(dst.DB, path, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst.MustCheck()
+		return report, dumpKeys(t, dst.DB)
+	}
+
+	// An intact file is copied as it is.
+	report, got := repair(buf)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected keys: %d, want %d", len(got), len(want))
+	} else if report.Meta < 0 || len(report.Lost) != 0 || report.Orphans != 0 || report.Buckets != 3 || report.Keys != 2010 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// The leaves of a lost branch page are found back in their bucket.
+	damaged := append([]byte(nil), buf...)
+	binary.LittleEndian.PutUint16(damaged[root*pageSize+8:], 0xFF)
+	report, got = repair(damaged)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected keys: %d, want %d", len(got), len(want))
+	} else if len(report.Lost) != 1 || report.Lost[0].Page != root || string(bytes.Join(report.Lost[0].Bucket, nil)) != "widgets" ||
+		report.Orphans == 0 || report.LostFound != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// Without meta pages, every leaf ends up in lost+found.
+	damaged = append([]byte(nil), buf...)
+	for i := 0; i < 2*pageSize; i++ {
+		damaged[i] = 0
+	}
+	report, got = repair(damaged)
+	if report.Meta != -1 || report.LostFound == 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	found := make(map[string]bool)
+	for k, v := range got {
+		if !strings.HasPrefix(k, "lost+found/") {
+			t.Fatalf("unexpected key outside lost+found: %s", k)
+		}
+		found[k[strings.LastIndex(k, "/"):]+"="+v] = true
+	}
+	for k, v := range want {
+		if !found[k[strings.LastIndex(k, "/"):]+"="+v] {
+			t.Fatalf("key not found: %s", k)
+		}
+	}
+
+	// Without the page of the root bucket either, the compression of the
+	// buckets is unknown and compressed values are kept as they are stored:
+	// their length followed by the DEFLATE stream.
+	rootBucket := int(binary.LittleEndian.Uint64(buf[32:]))
+	binary.LittleEndian.PutUint16(damaged[rootBucket*pageSize+8:], 0xFF)
+	report, got = repair(damaged)
+	if report.LostFound == 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	inflate := func(v string) (string, bool) {
+		n, sz := binary.Uvarint([]byte(v))
+		if sz <= 0 {
+			return "", false
+		}
+		out, err := ioutil.ReadAll(flate.NewReader(strings.NewReader(v[sz:])))
+		return string(out), err == nil && uint64(len(out)) == n
+	}
+	found = make(map[string]bool)
+	for k, v := range got {
+		found[k[strings.LastIndex(k, "/"):]+"="+v] = true
+		if u, ok := inflate(v); ok {
+			found[k[strings.LastIndex(k, "/"):]+"=zipped:"+u] = true
+		}
+	}
+	for k, v := range want {
+		if strings.HasPrefix(k, "zipped/") && !strings.HasPrefix(k, "zipped/inner/") {
+			v = "zipped:" + v
+		}
+		if !found[k[strings.LastIndex(k, "/"):]+"="+v] {
+			t.Fatalf("key not found: %s", k)
+		}
+	}
+}
 
-	// Verify we can update again.
+// Ensure that Repair refuses a database whose write-ahead log holds commits,
+// and a segmented database.
+func TestRepair_Unsupported(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db")
+	db, err := bolt.Open(path, 0666, &bolt.Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
-			t.Fatal(err)
-		}
-		return nil
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify that our change persisted.
-	if err := db.Update(func(tx *bolt.Tx) error {
+	// The commit is only in the log while the database is open.
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if _, err := bolt.Repair(dst.DB, path, 0); err == nil || !strings.Contains(err.Error(), "write-ahead log") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Closing checkpoints the log, after which the data file is complete.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bolt.Repair(dst.DB, path, 0); err != nil {
+		t.Fatal(err)
+	} else if err := dst.View(func(tx *bolt.Tx) error {
 		if tx.Bucket([]byte("widgets")) == nil {
 			t.Fatal("expected bucket")
 		}
@@ -946,81 +2593,146 @@ func TestDB_Update_Panic(t *testing.T) {
 	}); err != nil {
 		t.Fatal(err)
 	}
-}
 
-// Ensure a database can return an error through a read-only transactional block.
-func TestDB_View_Error(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
+	db, err = bolt.Open(filepath.Join(dir, "segments"), 0666, &bolt.Options{SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bolt.Repair(dst.DB, filepath.Join(dir, "segments"), 0); err == nil || !strings.Contains(err.Error(), "segmented") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
 
+// dumpKeys returns every key of db and its value, keyed by its bucket path
+// and the key joined by slashes.
+func dumpKeys(t *testing.T, db *bolt.DB) map[string]string {
+	m := make(map[string]string)
+	var walk func(prefix string, b *bolt.Bucket) error
+	walk = func(prefix string, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(prefix+string(k)+"/", b.Bucket(k))
+			}
+			m[prefix+string(k)] = string(v)
+			return nil
+		})
+	}
 	if err := db.View(func(tx *bolt.Tx) error {
-		return errors.New("xxx")
-	}); err == nil || err.Error() != "xxx" {
-		t.Fatalf("unexpected error: %s", err)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walk(string(name)+"/", b)
+		})
+	}); err != nil {
+		t.Fatal(err)
 	}
+	return m
 }
 
-// Ensure a read transaction that panics does not hold open locks.
-func TestDB_View_Panic(t *testing.T) {
+// Ensure that an export can be imported back into another database.
+func TestExport_Import(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
-
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
-			t.Fatal(err)
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		} else if err := widgets.SetSequence(7); err != nil {
+			return err
+		}
+		for k, v := range map[string]string{"foo": "bar", "empty": "", "\xff\x00": "\xfe", "<html>": "héllo"} {
+			if err := widgets.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		sub, err := widgets.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		} else if err := sub.SetSequence(3); err != nil {
+			return err
+		} else if err := sub.Put([]byte("baz"), []byte("bat")); err != nil {
+			return err
+		}
+		gadgets, err := tx.CreateBucketWithOptions([]byte("gadgets"), bolt.BucketOptions{Compression: bolt.Flate})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := gadgets.Put([]byte(fmt.Sprintf("%03d", i)), []byte(strings.Repeat("x", i))); err != nil {
+				return err
+			}
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
+	want := dumpKeys(t, db.DB)
 
-	// Panic during view transaction but recover.
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Log("recover: view", r)
-			}
-		}()
-
-		if err := db.View(func(tx *bolt.Tx) error {
-			if tx.Bucket([]byte("widgets")) == nil {
-				t.Fatal("expected bucket")
-			}
-			panic("omg")
-		}); err != nil {
-			t.Fatal(err)
-		}
-	}()
-
-	// Verify that we can still use read transactions.
+	// Round trip the whole database as JSON Lines.
+	var buf bytes.Buffer
 	if err := db.View(func(tx *bolt.Tx) error {
-		if tx.Bucket([]byte("widgets")) == nil {
-			t.Fatal("expected bucket")
+		return bolt.Export(tx, &buf, bolt.FormatJSONLines)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `{"path":["d2lkZ2V0cw=="],"key":"/wA=","value":"/g==","encoding":"base64"}`) {
+		t.Fatalf("binary key not in base64:\n%s", buf.String())
+	} else if !strings.Contains(buf.String(), `{"key":"gadgets","bucket":true,"compression":"flate"}`) {
+		t.Fatalf("bucket compression not exported:\n%s", buf.String())
+	}
+	db2 := MustOpenDB()
+	defer db2.MustClose()
+	if err := bolt.ImportWithOptions(db2.DB, &buf, bolt.ImportOptions{TxMaxSize: 256}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dumpKeys(t, db2.DB); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected keys: %v, want %v", got, want)
+	}
+	if err := db2.View(func(tx *bolt.Tx) error {
+		widgets := tx.Bucket([]byte("widgets"))
+		if seq := widgets.Sequence(); seq != 7 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		} else if seq := widgets.Bucket([]byte("sub")).Sequence(); seq != 3 {
+			t.Fatalf("unexpected nested sequence: %d", seq)
+		} else if c := widgets.Compression(); c != bolt.NoCompression {
+			t.Fatalf("unexpected compression: %s", c)
+		} else if c := tx.Bucket([]byte("gadgets")).Compression(); c != bolt.Flate {
+			t.Fatalf("unexpected compression: %s", c)
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-}
+	db2.MustCheck()
 
-// Ensure that DB stats can be returned.
-func TestDB_Stats(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte("widgets"))
-		return err
+	// Nested buckets cannot be exported as CSV.
+	if err := db.View(func(tx *bolt.Tx) error {
+		return bolt.ExportWithOptions(tx, ioutil.Discard, bolt.ExportOptions{Format: bolt.FormatCSV, Bucket: [][]byte{[]byte("widgets")}})
+	}); err == nil {
+		t.Fatal("expected error exporting nested bucket as csv")
+	}
+
+	// Round trip a single bucket as CSV into a nested bucket, in base64.
+	buf.Reset()
+	if err := db.View(func(tx *bolt.Tx) error {
+		return bolt.ExportWithOptions(tx, &buf, bolt.ExportOptions{Format: bolt.FormatCSV, Bucket: [][]byte{[]byte("widgets"), []byte("sub")}, Base64: true})
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	stats := db.Stats()
-	if stats.TxStats.PageCount != 2 {
-		t.Fatalf("unexpected TxStats.PageCount: %d", stats.TxStats.PageCount)
-	} else if stats.FreePageN != 0 {
-		t.Fatalf("unexpected FreePageN != 0: %d", stats.FreePageN)
-	} else if stats.PendingPageN != 2 {
-		t.Fatalf("unexpected PendingPageN != 2: %d", stats.PendingPageN)
+	if s := buf.String(); s != "key,value,encoding\nYmF6,YmF0,base64\n" {
+		t.Fatalf("unexpected csv: %q", s)
+	}
+	if err := bolt.ImportWithOptions(db2.DB, &buf, bolt.ImportOptions{Format: bolt.FormatCSV, Bucket: [][]byte{[]byte("copy"), []byte("sub")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("copy")).Bucket([]byte("sub")).Get([]byte("baz")); string(v) != "bat" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -1293,6 +3005,269 @@ func TestDB_BatchTime(t *testing.T) {
 	}
 }
 
+// Ensure that the open transactions are listed oldest first, with the stacks
+// that began them.
+func TestDB_OpenTransactions(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{RecordTxStack: true})
+	defer db.MustClose()
+
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := db.OpenTransactions()
+	if len(infos) != 2 {
+		t.Fatalf("unexpected transactions: %+v", infos)
+	}
+	if infos[0].ID != rtx.ID() || infos[0].Writable || infos[1].ID != wtx.ID() || !infos[1].Writable {
+		t.Fatalf("unexpected transactions: %+v", infos)
+	}
+	if infos[0].Start.After(infos[1].Start) {
+		t.Fatalf("unexpected order: %v, %v", infos[0].Start, infos[1].Start)
+	}
+	if !bytes.Contains(infos[0].Stack, []byte("TestDB_OpenTransactions")) {
+		t.Fatalf("unexpected stack: %s", infos[0].Stack)
+	}
+
+	if err := wtx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if infos := db.OpenTransactions(); len(infos) != 0 {
+		t.Fatalf("unexpected transactions: %+v", infos)
+	}
+}
+
+// Ensure that the watchdog reports a read-only transaction past
+// MaxReadTxAge once, and invalidates it.
+func TestDB_MaxReadTxAge(t *testing.T) {
+	long := make(chan bolt.TxInfo, 2)
+	db := MustOpenWithOption(&bolt.Options{
+		MaxReadTxAge:         20 * time.Millisecond,
+		OnLongReadTx:         func(info bolt.TxInfo) { long <- info },
+		InvalidateLongReadTx: true,
+	})
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A short transaction is not reported.
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		select {
+		case info := <-long:
+			if info.ID != tx.ID() || info.Writable {
+				t.Fatalf("unexpected transaction: %+v", info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a long transaction")
+		}
+		// The transaction keeps its pages pinned until it is rolled back.
+		if infos := db.OpenTransactions(); len(infos) != 1 || infos[0].ID != tx.ID() {
+			t.Fatalf("unexpected transactions: %+v", infos)
+		}
+		tx.Bucket([]byte("widgets"))
+		t.Fatal("expected panic")
+		return nil
+	})
+	if err != bolt.ErrTxInvalidated {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case info := <-long:
+		t.Fatalf("reported twice: %+v", info)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Ensure that a cursor already positioned on a page stops reading once its
+// transaction is invalidated, and that Tx.Do returns the error for a
+// transaction begun with Begin.
+func TestDB_MaxReadTxAge_Cursor(t *testing.T) {
+	long := make(chan bolt.TxInfo, 1)
+	db := MustOpenWithOption(&bolt.Options{
+		MaxReadTxAge:         20 * time.Millisecond,
+		OnLongReadTx:         func(info bolt.TxInfo) { long <- info },
+		InvalidateLongReadTx: true,
+	})
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"bar", "baz", "foo"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	c := tx.Bucket([]byte("widgets")).Cursor()
+	if k, _ := c.First(); string(k) != "bar" {
+		t.Fatalf("unexpected key: %q", k)
+	}
+	select {
+	case <-long:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a long transaction")
+	}
+
+	err = tx.Do(func(tx *bolt.Tx) error {
+		c.Next()
+		t.Fatal("expected panic")
+		return nil
+	})
+	if err != bolt.ErrTxInvalidated {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// recordingTracer records the names of the callbacks it receives.
+type recordingTracer struct {
+	bolt.NopTracer
+	mu     sync.Mutex
+	events []string
+	spans  map[string]bolt.TraceSpan
+}
+
+func (t *recordingTracer) record(name string, s bolt.TraceSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, name)
+	if t.spans == nil {
+		t.spans = make(map[string]bolt.TraceSpan)
+	}
+	t.spans[name] = s
+}
+
+func (t *recordingTracer) TxBegin(info bolt.TxInfo) {
+	t.record(fmt.Sprintf("begin %v", info.Writable), bolt.TraceSpan{TxID: info.ID})
+}
+func (t *recordingTracer) TxEnd(info bolt.TxInfo, committed bool, s bolt.TraceSpan) {
+	t.record(fmt.Sprintf("end %v %v", info.Writable, committed), s)
+}
+func (t *recordingTracer) WriterLockWait(s bolt.TraceSpan) { t.record("lock", s) }
+func (t *recordingTracer) Spill(s bolt.TraceSpan)          { t.record("spill", s) }
+func (t *recordingTracer) WritePages(s bolt.TraceSpan)     { t.record("write", s) }
+func (t *recordingTracer) Sync(s bolt.TraceSpan)           { t.record("sync", s) }
+func (t *recordingTracer) WriteMeta(s bolt.TraceSpan)      { t.record("meta", s) }
+func (t *recordingTracer) Grow(s bolt.TraceSpan)           { t.record("grow", s) }
+
+// Ensure that the tracer receives the steps of a commit in order.
+func TestDB_Tracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	db := MustOpenWithOption(&bolt.Options{Tracer: tracer})
+	defer db.MustClose()
+
+	tracer.events = nil
+	var id int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		id = tx.ID()
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 3*pageSize))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	// Steps are reported once they end, after the steps within them.
+	exp := []string{"lock", "begin true", "spill", "sync", "grow", "write", "sync", "sync", "meta", "end true true", "begin false", "end false false"}
+	if !reflect.DeepEqual(exp, tracer.events) {
+		t.Fatalf("exp=%v; got=%v", exp, tracer.events)
+	}
+	if s := tracer.spans["write"]; s.TxID != id || s.Count < 2 || s.Bytes < 4*pageSize {
+		t.Fatalf("unexpected write span: %+v", s)
+	}
+	if s := tracer.spans["meta"]; s.TxID != id || s.Bytes != pageSize || s.Duration <= 0 {
+		t.Fatalf("unexpected meta span: %+v", s)
+	}
+	if s := tracer.spans["end true true"]; s.Duration <= 0 || s.Start.IsZero() {
+		t.Fatalf("unexpected tx span: %+v", s)
+	}
+}
+
+// Ensure that BatchContext leaves the batch once its context is done before
+// the batch calls its function.
+func TestDB_BatchContext(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the writer lock so that the batch cannot start.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan error, 2)
+	go func() {
+		ch <- db.BatchContext(ctx, func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("cancelled"), []byte{})
+		})
+	}()
+	go func() {
+		ch <- db.Batch(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("kept"), []byte{})
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-ch; err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b.Get([]byte("cancelled")) != nil {
+			t.Fatal("unexpected key")
+		} else if b.Get([]byte("kept")) == nil {
+			t.Fatal("expected key")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func ExampleDB_Update() {
 	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
@@ -1634,8 +3609,8 @@ func MustOpenWithOption(o *bolt.Options) *DB {
 	}
 
 	freelistType := bolt.FreelistArrayType
-	if env := os.Getenv("TEST_FREELIST_TYPE"); env == string(bolt.FreelistMapType) {
-		freelistType = bolt.FreelistMapType
+	if env := os.Getenv("TEST_FREELIST_TYPE"); env == string(bolt.FreelistMapType) || env == string(bolt.FreelistExtentType) {
+		freelistType = bolt.FreelistType(env)
 	}
 	o.FreelistType = freelistType
 
@@ -1660,8 +3635,9 @@ func (db *DB) Close() error {
 	// Check database consistency after every test.
 	db.MustCheck()
 
-	// Close database and remove file.
+	// Close database and remove file and its write-ahead log, if any.
 	defer os.Remove(db.Path())
+	defer os.Remove(db.Path() + "-wal")
 	return db.DB.Close()
 }
 
@@ -0,0 +1,49 @@
+package dbolt_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bolt "github.com/c0mm4nd/dbolt"
+	"github.com/c0mm4nd/dbolt/dboltmetrics"
+)
+
+// Ensure that the stats are published through expvar and served in the
+// Prometheus text format.
+func TestMetrics(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dboltmetrics.Publish("TestMetrics", db.DB)
+	var m map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("TestMetrics").String()), &m); err != nil {
+		t.Fatal(err)
+	} else if m["sync_total"] == 0 || m["file_bytes"] != float64(db.Stats().FileSize) {
+		t.Fatalf("unexpected expvar: %v", m)
+	}
+
+	rec := httptest.NewRecorder()
+	dboltmetrics.Handler(db.DB).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	for _, line := range []string{
+		"# TYPE dbolt_sync_total counter\n",
+		"# TYPE dbolt_mmap_bytes gauge\n",
+		`dbolt_open_read_tx{path="` + db.Path() + `"} 0` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -2,10 +2,16 @@ package dbolt_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	bolt "github.com/c0mm4nd/dbolt"
@@ -60,6 +66,109 @@ func TestTx_Check_ReadOnly(t *testing.T) {
 	tx.Rollback()
 }
 
+// Ensure that Check reports typed errors, and that its options limit the
+// check without changing what it finds.
+func TestTx_CheckWithOptions(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := make(map[string]int)
+	for _, name := range []string{"widgets", "gadgets"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			roots[string(name)] = int(b.Root())
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the first leaf below the root branch of each bucket.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := func(name string) int {
+		p := buf[roots[name]*pageSize:]
+		if p[8]&0x01 == 0 {
+			t.Fatalf("page %d is not a branch page", roots[name])
+		}
+		return int(binary.LittleEndian.Uint64(p[16+8:]))
+	}
+	widget, gadget := leaf("widgets"), leaf("gadgets")
+
+	// Move the last key of the widgets leaf before the others, and turn the
+	// gadgets leaf into a freelist page.
+	p := buf[widget*pageSize:]
+	last := 16 + 16*(int(binary.LittleEndian.Uint16(p[10:]))-1)
+	p[last+int(binary.LittleEndian.Uint32(p[last+4:]))] = ' '
+	binary.LittleEndian.PutUint16(buf[gadget*pageSize+8:], 0x10)
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check := func(opts bolt.CheckOptions) []string {
+		var errs []string
+		if err := db.View(func(tx *bolt.Tx) error {
+			for err := range tx.CheckWithOptions(opts) {
+				var cerr *bolt.CheckError
+				if !errors.As(err, &cerr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				errs = append(errs, fmt.Sprintf("%d %s %s", cerr.Page, bytes.Join(cerr.Bucket, []byte("/")), cerr.Kind))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(errs)
+		return errs
+	}
+	keyOrder := fmt.Sprintf("%d widgets key order", widget)
+	invalidType := fmt.Sprintf("%d gadgets invalid type", gadget)
+
+	for _, tt := range []struct {
+		opts bolt.CheckOptions
+		want []string
+	}{
+		{bolt.CheckOptions{}, []string{invalidType, keyOrder}},
+		{bolt.CheckOptions{Workers: 4}, []string{invalidType, keyOrder}},
+		{bolt.CheckOptions{Workers: 4, SkipFreelist: true}, []string{invalidType, keyOrder}},
+		{bolt.CheckOptions{Buckets: [][]byte{[]byte("widgets")}}, []string{keyOrder}},
+		{bolt.CheckOptions{Buckets: [][]byte{[]byte("gadgets")}, SkipFreelist: true}, []string{invalidType}},
+	} {
+		if got := check(tt.opts); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Fatalf("%+v: unexpected errors: %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
 // Ensure that committing a closed transaction returns an error.
 func TestTx_Commit_ErrTxClosed(t *testing.T) {
 	db := MustOpenDB()
@@ -528,6 +637,48 @@ func TestTx_OnCommit_Rollback(t *testing.T) {
 	}
 }
 
+// Ensure that contiguous dirty pages are written with a few vectored writes
+// and that MaxWriteBatchSize caps the size of each write.
+func TestTx_Commit_VectoredWrite(t *testing.T) {
+	commit := func(maxWriteBatchSize int) bolt.TxStats {
+		db := MustOpenWithOption(&bolt.Options{MaxWriteBatchSize: maxWriteBatchSize})
+		defer db.MustClose()
+
+		var stats bolt.TxStats
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 500)); err != nil {
+					return err
+				}
+			}
+			tx.OnCommit(func() { stats = tx.Stats() })
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	pageSize := os.Getpagesize()
+	stats := commit(0)
+	if pages := int(stats.WriteBytes) / pageSize; pages < 100 {
+		t.Fatalf("unexpected pages written: %d", pages)
+	} else if stats.Write > 10 {
+		t.Fatalf("unexpected write calls: %d for %d pages", stats.Write, pages)
+	}
+
+	limited := commit(pageSize)
+	if limited.WriteBytes != stats.WriteBytes {
+		t.Fatalf("unexpected bytes written: %d != %d", limited.WriteBytes, stats.WriteBytes)
+	} else if limited.Write < int(limited.WriteBytes)/pageSize {
+		t.Fatalf("unexpected write calls: %d", limited.Write)
+	}
+}
+
 // Ensure that the database can be copied to a file path.
 func TestTx_CopyFile(t *testing.T) {
 	db := MustOpenDB()
@@ -653,6 +804,595 @@ func TestTx_CopyFile_Error_Normal(t *testing.T) {
 	}
 }
 
+// Ensure that a database with page checksums passes consistency checks after
+// enough writes to split and free pages.
+func TestTx_PageChecksum(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{PageChecksum: true})
+	defer db.MustClose()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 200; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", j)), bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0199")); !bytes.Equal(v, bytes.Repeat([]byte{9}, 100)) {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a reference to a page beyond the end of the data file is
+// reported rather than read, even without page trailers.
+func TestTx_PageOutOfBounds(t *testing.T) {
+	db := MustOpenDB()
+	defer os.Remove(db.f)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var root int
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(db.f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the first element of the branch root far past the end, up to
+	// ids whose offset in the file overflows.
+	for _, id := range []uint64{1 << 30, 1 << 51, 1<<63 - 1} {
+		damaged := append([]byte(nil), buf...)
+		binary.LittleEndian.PutUint64(damaged[root*pageSize+16+8:], id)
+		if err := ioutil.WriteFile(db.f, damaged, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := bolt.Open(db.f, 0666, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket([]byte("widgets")).Get([]byte("0000")); v != nil {
+				t.Fatalf("unexpected value: %q", v)
+			}
+			return nil
+		})
+		var perr *bolt.PageError
+		if !errors.As(err, &perr) || perr.ID != int(id) {
+			t.Fatalf("%d: unexpected error: %v", id, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a corrupted page is reported as a *PageError by managed
+// transactions and by Tx.Check instead of crashing.
+func TestTx_PageChecksum_Corrupted(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{PageChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = int(tx.Bucket([]byte("widgets")).Root())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.Info().PageSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the middle of the bucket's root page.
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xFF}, int64(root*pageSize+pageSize/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = bolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("widgets")).Get([]byte("0001"))
+		return nil
+	})
+	var perr *bolt.PageError
+	if !errors.As(err, &perr) || perr.ID != root || !errors.Is(err, bolt.ErrChecksum) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Transactions begun directly get the error from Tx.Do.
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Do(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("widgets")).Get([]byte("0001"))
+		return nil
+	})
+	if !errors.As(err, &perr) || perr.ID != root {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside Tx.Do, ForEach, Export and DiffTx return the error, each time
+	// they reach the page.
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tx.Bucket([]byte("widgets"))
+	for i := 0; i < 2; i++ {
+		if err := b.ForEach(func(k, v []byte) error { return nil }); !errors.As(err, &perr) || perr.ID != root {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := bolt.Export(tx, ioutil.Discard, bolt.FormatJSONLines); !errors.As(err, &perr) || perr.ID != root {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bolt.DiffTx(tx, tx, func(d bolt.Diff) error { return nil }); !errors.As(err, &perr) || perr.ID != root {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 || !errors.As(errs[0], &perr) || perr.ID != root {
+			t.Fatalf("unexpected check errors: %v", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEncryption returns encryption options for key id with a key derived
+// from it.
+func testEncryption(id uint32) *bolt.Encryption {
+	return &bolt.Encryption{
+		KeyID: id,
+		Key: func(id uint32) ([]byte, error) {
+			return bytes.Repeat([]byte{byte(id + 1)}, 32), nil
+		},
+	}
+}
+
+// Ensure that an encrypted database can be written, reopened and read back,
+// and that no plaintext reaches the data file.
+func TestTx_Encryption(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{Encryption: testEncryption(0), PageChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("top-secret-value")
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), secret); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(buf, secret) || bytes.Contains(buf, []byte("widgets")) {
+		t.Fatal("plaintext found in data file")
+	}
+
+	// Opening without the key or with the wrong key fails.
+	if _, err := bolt.Open(path, 0666, nil); err != bolt.ErrEncrypted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = bolt.Open(path, 0666, &bolt.Options{Encryption: &bolt.Encryption{
+		Key: func(uint32) ([]byte, error) { return make([]byte, 32), nil },
+	}})
+	if !errors.Is(err, bolt.ErrChecksum) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Rotate to key 1 and keep writing; older pages stay readable.
+	db, err = bolt.Open(path, 0666, &bolt.Options{Encryption: testEncryption(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("new"), []byte("value"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0499")); !bytes.Equal(v, secret) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("new")); !bytes.Equal(v, []byte("value")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that commits fail once a key has encrypted MaxKeyPages pages, across
+// reopens, until a new key is selected.
+func TestTx_Encryption_MaxKeyPages(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	enc := testEncryption(0)
+	enc.MaxKeyPages = 20
+	db, err := bolt.Open(path, 0666, &bolt.Options{Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(db *bolt.DB, i int) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%04d", i)), []byte("value"))
+		})
+	}
+	var i int
+	for ; i < 20; i++ {
+		if err = put(db, i); err != nil {
+			break
+		}
+	}
+	if err != bolt.ErrKeyExhausted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The count survives a reopen.
+	db, err = bolt.Open(path, 0666, &bolt.Options{Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(db, i); err != bolt.ErrKeyExhausted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new key starts a new count.
+	enc = testEncryption(1)
+	enc.MaxKeyPages = 20
+	db, err = bolt.Open(path, 0666, &bolt.Options{Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := put(db, i); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != i+1 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Tx.Rekey writes a copy that only opens with the new key.
+func TestTx_Rekey(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{Encryption: testEncryption(0)})
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 500; i++ {
+			if err := b.Delete([]byte(fmt.Sprintf("%04d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		n, err := tx.Rekey(f, testEncryption(7))
+		if err == nil && n != tx.Size() {
+			t.Fatalf("unexpected size: %d != %d", n, tx.Size())
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key must no longer be needed.
+	enc := testEncryption(7)
+	key := enc.Key
+	enc.Key = func(id uint32) ([]byte, error) {
+		if id != 7 {
+			return nil, fmt.Errorf("unexpected key id %d", id)
+		}
+		return key(id)
+	}
+	rekeyed, err := bolt.Open(path, 0666, &bolt.Options{Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rekeyed.Close()
+	if err := rekeyed.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0999")); len(v) != 100 {
+			t.Fatalf("unexpected value: %x", v)
+		} else if v := b.Get([]byte("0001")); v != nil {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rekeying a plain database is an error.
+	plain := MustOpenDB()
+	defer plain.MustClose()
+	if err := plain.View(func(tx *bolt.Tx) error {
+		_, err := tx.Rekey(ioutil.Discard, testEncryption(1))
+		return err
+	}); err != bolt.ErrNotEncrypted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a full backup followed by a chain of incremental backups
+// restores the database, and that incrementals only apply in order.
+func TestTx_WriteIncrementalTo(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{PageTxid: true, PageChecksum: true})
+	defer db.MustClose()
+
+	update := func(from, to int, del bool) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := from; i < to; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if del {
+					err = b.Delete(k)
+				} else {
+					err = b.Put(k, bytes.Repeat([]byte{byte(i)}, 100))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := func(since int) (string, int) {
+		path := tempfile()
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var txid int
+		if err := db.View(func(tx *bolt.Tx) error {
+			txid = tx.ID()
+			if since < 0 {
+				_, err := tx.WriteTo(f)
+				return err
+			}
+			_, err := tx.WriteIncrementalTo(f, since)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return path, txid
+	}
+
+	update(0, 1000, false)
+	full, txid := backup(-1)
+	defer os.Remove(full)
+	update(1000, 1100, false)
+	inc1, txid1 := backup(txid)
+	defer os.Remove(inc1)
+	update(0, 500, true)
+	update(2000, 2010, false)
+	inc2, _ := backup(txid1)
+	defer os.Remove(inc2)
+
+	// Only the changed pages are copied.
+	if fi, err := os.Stat(full); err != nil {
+		t.Fatal(err)
+	} else if ii, err := os.Stat(inc1); err != nil {
+		t.Fatal(err)
+	} else if ii.Size() >= fi.Size()/2 {
+		t.Fatalf("unexpected incremental size: %d of %d", ii.Size(), fi.Size())
+	}
+
+	// Incremental backups only apply on top of the backup they follow.
+	if _, err := bolt.ApplyIncremental(full, mustOpenFile(t, inc2)); err != bolt.ErrBackupMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{inc1, inc2} {
+		if _, err := bolt.ApplyIncremental(full, mustOpenFile(t, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := bolt.Open(full, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return db.View(func(orig *bolt.Tx) error {
+			if tx.ID() != orig.ID() {
+				t.Fatalf("unexpected tx id: %d != %d", tx.ID(), orig.ID())
+			}
+			var n int
+			c := orig.Bucket([]byte("widgets")).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if got := tx.Bucket([]byte("widgets")).Get(k); !bytes.Equal(got, v) {
+					t.Fatalf("unexpected value for %s: %x", k, got)
+				}
+				n++
+			}
+			if stats := tx.Bucket([]byte("widgets")).Stats(); stats.KeyN != n {
+				t.Fatalf("unexpected key count: %d != %d", stats.KeyN, n)
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Databases created without page transaction ids cannot be backed up
+	// incrementally.
+	plain := MustOpenDB()
+	defer plain.MustClose()
+	if err := plain.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteIncrementalTo(ioutil.Discard, 0)
+		return err
+	}); err != bolt.ErrNoPageTxid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// mustOpenFile opens a file for reading that is closed when the test ends.
+func mustOpenFile(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
 // TestTx_Rollback ensures there is no error when tx rollback whether we sync freelist or not.
 func TestTx_Rollback(t *testing.T) {
 	for _, isSyncFreelist := range []bool{false, true} {
@@ -921,3 +1661,114 @@ func ExampleTx_CopyFile() {
 	// Output:
 	// The value for 'foo' in the clone is: bar
 }
+
+// Ensure that DiffTx reports every bucket, key and sequence that differs.
+func TestDiffTx(t *testing.T) {
+	a := MustOpenDB()
+	defer a.MustClose()
+	b := MustOpenDB()
+	defer b.MustClose()
+
+	// fill creates the buckets and keys of a layout in db. Keys ending in
+	// a slash are buckets, and "#" sets the sequence of the bucket.
+	fill := func(db *DB, layout map[string]string) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			for path, v := range layout {
+				names := strings.Split(path, "/")
+				bkt, err := tx.CreateBucketIfNotExists([]byte(names[0]))
+				if err != nil {
+					return err
+				}
+				for _, name := range names[1 : len(names)-1] {
+					if bkt, err = bkt.CreateBucketIfNotExists([]byte(name)); err != nil {
+						return err
+					}
+				}
+				switch k := names[len(names)-1]; k {
+				case "":
+				case "#":
+					seq, _ := strconv.ParseUint(v, 10, 64)
+					err = bkt.SetSequence(seq)
+				default:
+					err = bkt.Put([]byte(k), []byte(v))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fill(a, map[string]string{
+		"widgets/#":     "1",
+		"widgets/foo":   "bar",
+		"widgets/old":   "x",
+		"widgets/baz":   "bat",
+		"widgets/sub/a": "1",
+		"widgets/kind":  "value",
+		"gadgets/":      "",
+	})
+	fill(b, map[string]string{
+		"widgets/#":      "2",
+		"widgets/foo":    "baz",
+		"widgets/new":    "y",
+		"widgets/baz":    "bat",
+		"widgets/sub/a":  "1",
+		"widgets/kind/x": "1",
+		"things/k":       "v",
+	})
+
+	diff := func(opts bolt.DiffOptions) []string {
+		var diffs []string
+		if err := a.View(func(txA *bolt.Tx) error {
+			return b.View(func(txB *bolt.Tx) error {
+				return bolt.DiffTxWithOptions(txA, txB, opts, func(d bolt.Diff) error {
+					s := fmt.Sprintf("%s %q %s", d.Kind, d.Bucket, d.Key)
+					if d.IsBucket {
+						s += fmt.Sprintf("/ %d->%d", d.OldSequence, d.NewSequence)
+					} else {
+						s += fmt.Sprintf(" %q->%q", d.Old, d.New)
+					}
+					diffs = append(diffs, s)
+					return nil
+				})
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return diffs
+	}
+
+	if got, want := diff(bolt.DiffOptions{}), []string{
+		`removed [] gadgets/ 0->0`,
+		`added [] things/ 0->0`,
+		`added ["things"] k ""->"v"`,
+		`changed [] widgets/ 1->2`,
+		`changed ["widgets"] foo "bar"->"baz"`,
+		`removed ["widgets"] kind "value"->""`,
+		`added ["widgets"] kind/ 0->0`,
+		`added ["widgets" "kind"] x ""->"1"`,
+		`added ["widgets"] new ""->"y"`,
+		`removed ["widgets"] old "x"->""`,
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diffs:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Scope the comparison to a bucket, which may be missing on one side.
+	if got, want := diff(bolt.DiffOptions{Bucket: [][]byte{[]byte("widgets"), []byte("kind")}}), []string{
+		`added ["widgets"] kind/ 0->0`,
+		`added ["widgets" "kind"] x ""->"1"`,
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diffs:\n%s", strings.Join(got, "\n"))
+	}
+	if got := diff(bolt.DiffOptions{Bucket: [][]byte{[]byte("widgets"), []byte("sub")}}); len(got) != 0 {
+		t.Fatalf("unexpected diffs:\n%s", strings.Join(got, "\n"))
+	}
+	if err := a.View(func(tx *bolt.Tx) error {
+		return bolt.DiffTxWithOptions(tx, tx, bolt.DiffOptions{Bucket: [][]byte{[]byte("missing")}}, func(bolt.Diff) error { return nil })
+	}); err != bolt.ErrBucketNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -4,6 +4,8 @@ package dbolt_test
 
 import (
 	"fmt"
+	"os"
+	"runtime"
 	"testing"
 
 	bolt "github.com/c0mm4nd/dbolt"
@@ -98,6 +100,92 @@ func insertChunk(t *testing.T, db *DB, chunkId int) {
 	}
 }
 
+// Ensure that released runs of free pages are punched out of the data file
+// and read back as empty once reused.
+func TestDB_PunchFreePages(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("punching holes is only supported on linux")
+	}
+
+	db := MustOpenWithOption(&bolt.Options{PunchFreePages: true})
+	defer db.MustClose()
+
+	allocated := func() int64 {
+		var st unix.Stat_t
+		if err := unix.Stat(db.Path(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Blocks * 512
+	}
+	update := func(fn func(b *bolt.Bucket) error) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return fn(b)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(b *bolt.Bucket) error {
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	update(put)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	before := allocated()
+	info, err := os.Stat(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pages freed by a commit are released by the next one.
+	update(func(b *bolt.Bucket) error {
+		for i := 0; i < 1000; i++ {
+			if err := b.Delete([]byte(fmt.Sprintf("%04d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	update(func(b *bolt.Bucket) error { return nil })
+	punched := db.Stats().PunchedBytes
+	if punched == 0 {
+		if db.Stats().FreePageN == 0 {
+			t.Fatal("expected free pages")
+		}
+		t.Skip("filesystem does not support punching holes")
+	}
+	if after := allocated(); after > before-int64(punched)/2 {
+		t.Fatalf("expected less disk usage: %d -> %d after punching %d bytes", before, after, punched)
+	}
+	if after, err := os.Stat(db.Path()); err != nil {
+		t.Fatal(err)
+	} else if after.Size() != info.Size() {
+		t.Fatalf("unexpected file size: %d -> %d", info.Size(), after.Size())
+	}
+
+	// The punched pages are reused.
+	update(put)
+	db.MustCheck()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+			return fmt.Errorf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Main reason for this check is travis limiting mlockable memory to 64KB
 // https://github.com/travis-ci/travis-ci/issues/2462
 func skipOnMemlockLimitBelow(t *testing.T, memlockLimitRequest uint64) {
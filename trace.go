@@ -0,0 +1,104 @@
+package dbolt
+
+import (
+	"log"
+	"time"
+)
+
+// Tracer receives the steps of the transaction lifecycle as they happen, for
+// forwarding into a tracing system. Callbacks are made synchronously, some
+// of them with database locks held, so they must be quick and must not use
+// the database. Embed NopTracer to implement only some of them.
+type Tracer interface {
+	// TxBegin is called once a transaction has begun.
+	TxBegin(tx TxInfo)
+
+	// TxEnd is called once a transaction has committed or rolled back. s
+	// spans the whole transaction.
+	TxEnd(tx TxInfo, committed bool, s TraceSpan)
+
+	// WriterLockWait is called once a writable transaction got the writer
+	// lock, or gave up waiting for it with s.Err.
+	WriterLockWait(s TraceSpan)
+
+	// Rebalance is called after a commit rebalanced the nodes that had
+	// deletions. s.Count is the number of nodes rebalanced.
+	Rebalance(s TraceSpan)
+
+	// Spill is called after a commit spilled its nodes onto dirty pages.
+	// s.Count is the number of nodes spilled.
+	Spill(s TraceSpan)
+
+	// WritePages is called after a commit wrote its dirty pages, to the
+	// data file or to the write-ahead log. s.Count is the number of pages
+	// and s.Bytes the number of bytes written.
+	WritePages(s TraceSpan)
+
+	// Sync is called after the data file or the write-ahead log was synced
+	// to disk.
+	Sync(s TraceSpan)
+
+	// WriteMeta is called after a commit wrote and synced its meta page.
+	// s.Bytes is the size of the meta page.
+	WriteMeta(s TraceSpan)
+
+	// Remap is called after the data file was mapped anew. s.Bytes is the
+	// size of the new mapping.
+	Remap(s TraceSpan)
+
+	// Grow is called after the data file grew. s.Bytes is its new size.
+	Grow(s TraceSpan)
+}
+
+// TraceSpan describes a step reported to a Tracer.
+type TraceSpan struct {
+	TxID     int           // id of the writable transaction, or 0
+	Start    time.Time     // when the step started
+	Duration time.Duration // how long the step took
+	Count    int           // number of nodes or pages, see Tracer
+	Bytes    int64         // number of bytes, see Tracer
+	Err      error         // error the step failed with, if any
+}
+
+// NopTracer is a Tracer that ignores every callback.
+type NopTracer struct{}
+
+func (NopTracer) TxBegin(TxInfo)                {}
+func (NopTracer) TxEnd(TxInfo, bool, TraceSpan) {}
+func (NopTracer) WriterLockWait(TraceSpan)      {}
+func (NopTracer) Rebalance(TraceSpan)           {}
+func (NopTracer) Spill(TraceSpan)               {}
+func (NopTracer) WritePages(TraceSpan)          {}
+func (NopTracer) Sync(TraceSpan)                {}
+func (NopTracer) WriteMeta(TraceSpan)           {}
+func (NopTracer) Remap(TraceSpan)               {}
+func (NopTracer) Grow(TraceSpan)                {}
+
+// span returns a span of the writable transaction txid that started at start
+// and ends now.
+func span(txid txid, start time.Time) TraceSpan {
+	return TraceSpan{TxID: int(txid), Start: start, Duration: time.Since(start)}
+}
+
+// rwtxid returns the id of the writable transaction, or 0 if there is none.
+func (db *DB) rwtxid() txid {
+	if db.rwtx == nil {
+		return 0
+	}
+	return db.rwtx.meta.txid
+}
+
+// Logger receives the errors the database cannot return to a caller, such as
+// those of background checkpoints. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logger returns the logger of the database, which defaults to the standard
+// logger of the log package.
+func (db *DB) logger() Logger {
+	if db.Logger != nil {
+		return db.Logger
+	}
+	return log.Default()
+}
@@ -1,11 +1,13 @@
 package dbolt
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"runtime/debug"
 	"sort"
-	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -26,10 +28,21 @@ type txid uint64
 type Tx struct {
 	writable       bool
 	managed        bool
+	ctx            context.Context // set by DB.BeginContext
 	db             *DB
 	meta           *meta
 	root           Bucket
 	pages          map[pgid]*page
+	verified       pageCache           // recently verified pages, with decrypted copies
+	snapshots      map[string]snapshot // snapshot directory changed by the transaction, or nil
+	held           map[pgid]bool       // pages held by snapshots, built by Page
+	shrinking      bool                // allocates the lowest free pages, see DB.Shrink
+	start          time.Time           // when the transaction began
+	stack          []byte              // stack that began the transaction, with Options.RecordTxStack
+	longReported   bool                // reported by the MaxReadTxAge watchdog; protected by metalock
+	committed      bool                // set by Commit on success, for Tracer.TxEnd
+	invalidated    int32               // set atomically by the MaxReadTxAge watchdog
+	raised         error               // last error the transaction panicked with, see raise
 	stats          TxStats
 	commitHandlers []func()
 
@@ -46,6 +59,10 @@ type Tx struct {
 func (tx *Tx) init(db *DB) {
 	tx.db = db
 	tx.pages = nil
+	tx.start = time.Now()
+	if db.RecordTxStack {
+		tx.stack = debug.Stack()
+	}
 
 	// Copy the meta page since it can be changed by the writer.
 	tx.meta = &meta{}
@@ -68,6 +85,15 @@ func (tx *Tx) ID() int {
 	return int(tx.meta.txid)
 }
 
+// Context returns the context the transaction was started with, or
+// context.Background() if there is none.
+func (tx *Tx) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
 // DB returns a reference to the database that created the transaction.
 func (tx *Tx) DB() *DB {
 	return tx.db
@@ -83,6 +109,15 @@ func (tx *Tx) Writable() bool {
 	return tx.writable
 }
 
+// Do calls fn and returns the *PageError a read of a damaged page panics with
+// as an error, as View and Update do for their functions. It is meant for
+// transactions begun with DB.Begin; an ErrTxInvalidated panic is returned as
+// well. Any other panic is propagated.
+func (tx *Tx) Do(fn func(*Tx) error) (err error) {
+	defer recoverPageError(&err, tx)
+	return fn(tx)
+}
+
 // Cursor creates a cursor associated with the root bucket.
 // All items in the cursor will return a nil value because all root bucket keys point to buckets.
 // The cursor is only valid as long as the transaction is open.
@@ -110,6 +145,14 @@ func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
 	return tx.root.CreateBucket(name)
 }
 
+// CreateBucketWithOptions creates a new bucket with the given options.
+// Returns the same errors as CreateBucket, and ErrInvalidCompression for an
+// unknown compression.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) CreateBucketWithOptions(name []byte, opts BucketOptions) (*Bucket, error) {
+	return tx.root.CreateBucketWithOptions(name, opts)
+}
+
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
@@ -148,18 +191,29 @@ func (tx *Tx) Commit() error {
 		return ErrTxNotWritable
 	}
 
-	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
-
 	// Rebalance nodes which have had deletions.
 	startTime := time.Now()
+	rebalanced := tx.stats.Rebalance
 	tx.root.rebalance()
 	if tx.stats.Rebalance > 0 {
 		tx.stats.RebalanceTime += time.Since(startTime)
 	}
+	if tx.db.Tracer != nil {
+		s := span(tx.meta.txid, startTime)
+		s.Count = tx.stats.Rebalance - rebalanced
+		tx.db.Tracer.Rebalance(s)
+	}
 
 	// spill data onto dirty pages.
 	startTime = time.Now()
-	if err := tx.root.spill(); err != nil {
+	spilled := tx.stats.Spill
+	err := tx.root.spill()
+	if tx.db.Tracer != nil {
+		s := span(tx.meta.txid, startTime)
+		s.Count, s.Err = tx.stats.Spill-spilled, err
+		tx.db.Tracer.Spill(s)
+	}
+	if err != nil {
 		tx.rollback()
 		return err
 	}
@@ -168,6 +222,12 @@ func (tx *Tx) Commit() error {
 	// Free the old root bucket.
 	tx.meta.root.root = tx.root.root
 
+	// Write out the snapshot directory if it changed.
+	if err := tx.commitSnapshots(); err != nil {
+		tx.rollback()
+		return err
+	}
+
 	// Free the old freelist because commit writes out a fresh freelist.
 	if tx.meta.freelist != pgidNoFreelist {
 		tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
@@ -180,6 +240,16 @@ func (tx *Tx) Commit() error {
 		}
 	} else {
 		tx.meta.freelist = pgidNoFreelist
+		tx.meta.flags &^= metaFlagFreelistExtents
+	}
+
+	// In strict mode, check the pages about to be written.
+	level := tx.db.strictLevel()
+	if level == CheckIncremental {
+		if errs := tx.checkDirty(); len(errs) > 0 {
+			tx.rollback()
+			return checkFailed(level, errs)
+		}
 	}
 
 	// Write dirty pages to disk.
@@ -189,19 +259,15 @@ func (tx *Tx) Commit() error {
 		return err
 	}
 
-	// If strict mode is enabled then perform a consistency check.
-	if tx.db.StrictMode {
-		ch := tx.Check()
-		var errs []string
-		for {
-			err, ok := <-ch
-			if !ok {
-				break
-			}
-			errs = append(errs, err.Error())
-		}
+	// In strict mode, check the whole database before the meta page makes
+	// the pages written visible.
+	if level == CheckFull {
+		var errs []*CheckError
+		tx.check(CheckOptions{}, func(err *CheckError) { errs = append(errs, err) })
 		if len(errs) > 0 {
-			panic("check fail: " + strings.Join(errs, "\n"))
+			tx.db.wal.abort()
+			tx.rollback()
+			return checkFailed(level, errs)
 		}
 	}
 
@@ -212,7 +278,15 @@ func (tx *Tx) Commit() error {
 	}
 	tx.stats.WriteTime += time.Since(startTime)
 
+	// Publish the snapshot directory now that it is on disk.
+	if tx.snapshots != nil {
+		tx.db.metalock.Lock()
+		tx.db.snapshots = tx.snapshots
+		tx.db.metalock.Unlock()
+	}
+
 	// Finalize the transaction.
+	tx.committed = true
 	tx.close()
 
 	// Execute commit handlers now that the locks have been removed.
@@ -227,7 +301,8 @@ func (tx *Tx) commitFreelist() error {
 	// Allocate new pages for the new free list. This will overestimate
 	// the size of the freelist but not underestimate the size (which would be bad).
 	opgid := tx.meta.pgid
-	p, err := tx.allocate((tx.db.freelist.size() / tx.db.pageSize) + 1)
+	tx.db.freelist.snapshots = snapshotTxids(tx.snapshotSet())
+	p, err := tx.allocate(((tx.db.freelist.size() + tx.db.trailer) / tx.db.pageSize) + 1)
 	if err != nil {
 		tx.rollback()
 		return err
@@ -237,6 +312,11 @@ func (tx *Tx) commitFreelist() error {
 		return err
 	}
 	tx.meta.freelist = p.id
+	if p.flags&freelistExtentPageFlag != 0 {
+		tx.meta.flags |= metaFlagFreelistExtents
+	} else {
+		tx.meta.flags &^= metaFlagFreelistExtents
+	}
 	// If the high water mark has moved up then attempt to grow the database.
 	if tx.meta.pgid > opgid {
 		if err := tx.db.grow(int(tx.meta.pgid+1) * tx.db.pageSize); err != nil {
@@ -277,13 +357,19 @@ func (tx *Tx) rollback() {
 	}
 	if tx.writable {
 		tx.db.freelist.rollback(tx.meta.txid)
+		tx.db.freelist.snapshots = snapshotTxids(tx.db.snapshots)
 		if !tx.db.hasSyncedFreelist() {
 			// Reconstruct free page list by scanning the DB to get the whole free page list.
 			// Note: scaning the whole db is heavy if your db size is large in NoSyncFreeList mode.
 			tx.db.freelist.noSyncReload(tx.db.freepages())
 		} else {
 			// Read free page list from freelist page.
-			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+			if p, err := tx.db.readPage(tx.db.meta().freelist); err != nil {
+				tx.db.freelist.noSyncReload(tx.db.freepages())
+			} else {
+				tx.db.freelist.reload(p)
+				tx.db.releasePage(p)
+			}
 		}
 	}
 	tx.close()
@@ -293,6 +379,10 @@ func (tx *Tx) close() {
 	if tx.db == nil {
 		return
 	}
+	if tracer := tx.db.Tracer; tracer != nil {
+		info := tx.info()
+		defer tracer.TxEnd(info, tx.committed, span(0, tx.start))
+	}
 	if tx.writable {
 		// Grab freelist stats.
 		freelistFreeN := tx.db.freelist.free_count()
@@ -300,7 +390,9 @@ func (tx *Tx) close() {
 		freelistAlloc := tx.db.freelist.size()
 
 		// Remove transaction ref & writer lock.
+		tx.db.metalock.Lock()
 		tx.db.rwtx = nil
+		tx.db.metalock.Unlock()
 		tx.db.rwlock.Unlock()
 
 		// Merge statistics.
@@ -315,6 +407,8 @@ func (tx *Tx) close() {
 		tx.db.removeTx(tx)
 	}
 
+	tx.releaseVerified()
+
 	// Clear all references.
 	tx.db = nil
 	tx.meta = nil
@@ -322,6 +416,19 @@ func (tx *Tx) close() {
 	tx.pages = nil
 }
 
+// releaseVerified drops the verified page cache. Decrypted single pages still
+// in the cache are returned to the page pool.
+func (tx *Tx) releaseVerified() {
+	if db := tx.db; db != nil && db.encryptor != nil {
+		tx.verified.forEach(func(p *page) {
+			if p.overflow == 0 {
+				db.putPage(unsafeByteSlice(unsafe.Pointer(p), 0, 0, db.pageSize))
+			}
+		})
+	}
+	tx.verified = pageCache{}
+}
+
 // Copy writes the entire database to a writer.
 // This function exists for backwards compatibility.
 //
@@ -334,22 +441,53 @@ func (tx *Tx) Copy(w io.Writer) error {
 // WriteTo writes the entire database to a writer.
 // If err == nil then exactly tx.Size() bytes will be written into the writer.
 func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
-	// Attempt to open reader with WriteFlag
-	f, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+	// Attempt to open reader with WriteFlag. Other storage than a single
+	// data file is read directly.
+	var f io.ReaderAt = tx.db.storage
+	if _, ok := tx.db.storage.(*fileStorage); ok {
+		file, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		f = file
+	}
+
+	// Write both meta pages.
+	n, err = tx.writeMetaPagesTo(w, tx.meta)
 	if err != nil {
-		return 0, err
+		return n, err
 	}
-	defer func() {
-		if cerr := f.Close(); err == nil {
-			err = cerr
-		}
-	}()
 
+	// Copy data pages past the meta pages, taking pages not yet
+	// checkpointed from the log.
+	var wn int64
+	if tx.db.wal != nil {
+		wn, err = tx.db.wal.copyPages(w, f, tx.db, tx.Size()-int64(tx.db.pageSize*2))
+	} else {
+		r := io.NewSectionReader(f, int64(tx.db.pageSize*2), tx.Size()-int64(tx.db.pageSize*2))
+		wn, err = io.CopyN(w, r, r.Size())
+	}
+	n += wn
+	if err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// writeMetaPagesTo writes m as the two meta pages of a copy of the database
+// seen by tx. Meta 1 gets a lower transaction id so that meta 0 is used.
+func (tx *Tx) writeMetaPagesTo(w io.Writer, m *meta) (n int64, err error) {
 	// Generate a meta page. We use the same page data for both meta pages.
 	buf := make([]byte, tx.db.pageSize)
 	page := (*page)(unsafe.Pointer(&buf[0]))
 	page.flags = metaPageFlag
-	*page.meta() = *tx.meta
+	*page.meta() = *m
 
 	// Write meta 0.
 	page.id = 0
@@ -369,19 +507,6 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 	if err != nil {
 		return n, fmt.Errorf("meta 1 copy: %s", err)
 	}
-
-	// Move past the meta pages in the file.
-	if _, err := f.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
-		return n, fmt.Errorf("seek: %s", err)
-	}
-
-	// Copy data pages.
-	wn, err := io.CopyN(w, f, tx.Size()-int64(tx.db.pageSize*2))
-	n += wn
-	if err != nil {
-		return n, err
-	}
-
 	return n, nil
 }
 
@@ -402,96 +527,31 @@ func (tx *Tx) CopyFile(path string, mode os.FileMode) error {
 	return f.Close()
 }
 
-// Check performs several consistency checks on the database for this transaction.
-// An error is returned if any inconsistency is found.
-//
-// It can be safely run concurrently on a writable transaction. However, this
-// incurs a high cost for large databases and databases with a lot of subbuckets
-// because of caching. This overhead can be removed if running on a read-only
-// transaction, however, it is not safe to execute other writer transactions at
-// the same time.
-func (tx *Tx) Check() <-chan error {
-	ch := make(chan error)
-	go tx.check(ch)
-	return ch
-}
-
-func (tx *Tx) check(ch chan error) {
-	// Force loading free list if opened in ReadOnly mode.
-	tx.db.loadFreelist()
-
-	// Check if any pages are double freed.
-	freed := make(map[pgid]bool)
-	all := make([]pgid, tx.db.freelist.count())
-	tx.db.freelist.copyall(all)
-	for _, id := range all {
-		if freed[id] {
-			ch <- fmt.Errorf("page %d: already freed", id)
+// reachablePages returns every page reachable from the transaction: the id of
+// each page and of each of its overflow pages, mapped to the id of the page.
+// It returns the first inconsistency found while walking the buckets.
+func (tx *Tx) reachablePages() (map[pgid]pgid, error) {
+	var first error
+	c := tx.newChecker(CheckOptions{SkipFreelist: true}, func(err *CheckError) {
+		if first == nil {
+			first = err
 		}
-		freed[id] = true
-	}
-
-	// Track every reachable page.
-	reachable := make(map[pgid]*page)
-	reachable[0] = tx.page(0) // meta0
-	reachable[1] = tx.page(1) // meta1
+	})
 	if tx.meta.freelist != pgidNoFreelist {
-		for i := uint32(0); i <= tx.page(tx.meta.freelist).overflow; i++ {
-			reachable[tx.meta.freelist+pgid(i)] = tx.page(tx.meta.freelist)
+		p := tx.db.page(tx.meta.freelist)
+		for i := uint32(0); i <= p.overflow; i++ {
+			c.reachable[tx.meta.freelist+pgid(i)] = tx.meta.freelist
 		}
 	}
-
-	// Recursively check buckets.
-	tx.checkBucket(&tx.root, reachable, freed, ch)
-
-	// Ensure all pages below high water mark are either reachable or freed.
-	for i := pgid(0); i < tx.meta.pgid; i++ {
-		_, isReachable := reachable[i]
-		if !isReachable && !freed[i] {
-			ch <- fmt.Errorf("page %d: unreachable unfreed", int(i))
-		}
+	c.walkBuckets()
+	if first != nil {
+		return nil, first
 	}
 
-	// Close the channel to signal completion.
-	close(ch)
-}
-
-func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool, ch chan error) {
-	// Ignore inline buckets.
-	if b.root == 0 {
-		return
+	if err := tx.snapshotPages(c.reachable); err != nil {
+		return nil, err
 	}
-
-	// Check every page used by this bucket.
-	b.tx.forEachPage(b.root, 0, func(p *page, _ int) {
-		if p.id > tx.meta.pgid {
-			ch <- fmt.Errorf("page %d: out of bounds: %d", int(p.id), int(b.tx.meta.pgid))
-		}
-
-		// Ensure each page is only referenced once.
-		for i := pgid(0); i <= pgid(p.overflow); i++ {
-			id := p.id + i
-			if _, ok := reachable[id]; ok {
-				ch <- fmt.Errorf("page %d: multiple references", int(id))
-			}
-			reachable[id] = p
-		}
-
-		// We should only encounter un-freed leaf and branch pages.
-		if freed[p.id] {
-			ch <- fmt.Errorf("page %d: reachable freed", int(p.id))
-		} else if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
-			ch <- fmt.Errorf("page %d: invalid type: %s", int(p.id), p.typ())
-		}
-	})
-
-	// Check each bucket within this bucket.
-	_ = b.ForEach(func(k, v []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.checkBucket(child, reachable, freed, ch)
-		}
-		return nil
-	})
+	return c.reachable, nil
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
@@ -511,6 +571,10 @@ func (tx *Tx) allocate(count int) (*page, error) {
 	return p, nil
 }
 
+// maxWriteIovecs is the largest number of buffers passed to one vectored
+// write, matching IOV_MAX on Linux.
+const maxWriteIovecs = 1024
+
 // write writes any dirty pages to disk.
 func (tx *Tx) write() error {
 	// Sort pages by id.
@@ -522,42 +586,88 @@ func (tx *Tx) write() error {
 	tx.pages = make(map[pgid]*page)
 	sort.Sort(pages)
 
-	// Write pages to disk in order.
+	// Fill in the page trailers now that the content is final.
+	if tx.db.trailer > 0 {
+		for _, p := range pages {
+			if err := tx.db.sealPage(p, tx.meta.txid); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Report the pages written, and how long it took, to the tracer.
+	start, writeBytes := time.Now(), tx.stats.WriteBytes
+	traceWrite := func(err error) error {
+		if tx.db.Tracer != nil {
+			s := span(tx.meta.txid, start)
+			s.Count, s.Bytes, s.Err = len(pages), tx.stats.WriteBytes-writeBytes, err
+			tx.db.Tracer.WritePages(s)
+		}
+		return err
+	}
+
+	// In WAL mode the pages are appended to the log instead and kept in
+	// memory until they are checkpointed.
+	if tx.db.wal != nil {
+		return traceWrite(tx.db.wal.writePages(tx.db, pages, &tx.stats))
+	}
+
+	// Write pages to disk in order. Runs of contiguous pages are merged into
+	// a single vectored write of up to MaxWriteBatchSize bytes.
+	var (
+		iov    [][]byte
+		offset int64
+		size   int
+	)
+	flush := func() error {
+		if len(iov) == 0 {
+			return nil
+		}
+		n, calls, err := tx.db.ops.writev(iov, offset)
+
+		// Update statistics.
+		tx.stats.Write += calls
+		tx.stats.WriteBytes += int64(n)
+		tx.db.addWritten(n)
+
+		iov, size = iov[:0], 0
+		return err
+	}
 	for _, p := range pages {
-		rem := (uint64(p.overflow) + 1) * uint64(tx.db.pageSize)
-		offset := int64(p.id) * int64(tx.db.pageSize)
-		var written uintptr
+		pos := int64(p.id) * int64(tx.db.pageSize)
+		rem := (int(p.overflow) + 1) * tx.db.pageSize
+		if len(iov) > 0 && (pos != offset+int64(size) || size+rem > tx.db.maxWriteBatchSize()) {
+			if err := flush(); err != nil {
+				return traceWrite(err)
+			}
+		}
 
-		// Write out page in "max allocation" sized chunks.
-		for {
-			sz := rem
+		// Add the page in "max allocation" sized chunks.
+		for written := 0; written < rem; {
+			sz := rem - written
 			if sz > consts.MaxAllocSize-1 {
 				sz = consts.MaxAllocSize - 1
 			}
-			buf := unsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
-
-			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
-				return err
+			if len(iov) == maxWriteIovecs {
+				if err := flush(); err != nil {
+					return traceWrite(err)
+				}
 			}
-
-			// Update statistics.
-			tx.stats.Write++
-
-			// Exit inner for loop if we've written all the chunks.
-			rem -= sz
-			if rem == 0 {
-				break
+			if len(iov) == 0 {
+				offset = pos + int64(written)
 			}
-
-			// Otherwise move offset forward and move pointer to next chunk.
-			offset += int64(sz)
-			written += uintptr(sz)
+			iov = append(iov, unsafeByteSlice(unsafe.Pointer(p), uintptr(written), 0, sz))
+			size += sz
+			written += sz
 		}
 	}
+	if err := traceWrite(flush()); err != nil {
+		return err
+	}
 
 	// Ignore file sync if flag is set on DB.
 	if !tx.db.NoSync {
-		if err := fdatasync(tx.db); err != nil {
+		if err := tx.db.timedSync(tx.meta.txid, tx.db.storage.Sync); err != nil {
 			return err
 		}
 	}
@@ -583,31 +693,76 @@ func (tx *Tx) write() error {
 }
 
 // writeMeta writes the meta to the disk.
-func (tx *Tx) writeMeta() error {
+func (tx *Tx) writeMeta() (err error) {
+	// Record the pages sealed under the current encryption key.
+	if tx.db.encryptor != nil {
+		tx.db.encryptor.record(tx.meta)
+	}
+
 	// Create a temporary buffer for the meta page.
 	buf := make([]byte, tx.db.pageSize)
 	p := tx.db.pageInBuffer(buf, 0)
 	tx.meta.write(p)
 
+	if tracer := tx.db.Tracer; tracer != nil {
+		start := time.Now()
+		defer func() {
+			s := span(tx.meta.txid, start)
+			s.Bytes, s.Err = int64(len(buf)), err
+			tracer.WriteMeta(s)
+		}()
+	}
+
+	// In WAL mode the meta page completes the transaction's log record.
+	if tx.db.wal != nil {
+		return tx.db.wal.commit(tx.db, buf, tx.meta.txid, &tx.stats)
+	}
+
 	// Write the meta page to file.
-	if _, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
+	n, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize))
+	tx.db.addWritten(n)
+	if err != nil {
 		return err
 	}
 	if !tx.db.NoSync {
-		if err := fdatasync(tx.db); err != nil {
+		if err := tx.db.timedSync(tx.meta.txid, tx.db.storage.Sync); err != nil {
 			return err
 		}
 	}
 
 	// Update statistics.
 	tx.stats.Write++
+	tx.stats.WriteBytes += int64(len(buf))
 
 	return nil
 }
 
+// checkInvalidated panics with ErrTxInvalidated if the MaxReadTxAge watchdog
+// invalidated tx.
+func (tx *Tx) checkInvalidated() {
+	if atomic.LoadInt32(&tx.invalidated) != 0 {
+		tx.raise(ErrTxInvalidated)
+	}
+}
+
+// raise panics with err, a *PageError or ErrTxInvalidated, after recording it
+// so that recoverPageError recovers it and no other panic.
+func (tx *Tx) raise(err error) {
+	tx.raised = err
+	panic(err)
+}
+
 // page returns a reference to the page with a given id.
 // If page has been written to then a temporary buffered page is returned.
+//
+// Pages read from the mmap are checked to be within it and to carry their
+// id, and are verified and decrypted if the database has page trailers, the
+// first time the transaction reaches them. A page that fails these checks
+// causes a panic with a *PageError, which managed transactions and Tx.Do
+// turn into an error.
 func (tx *Tx) page(id pgid) *page {
+	tx.checkInvalidated()
+
 	// Check the dirty pages first.
 	if tx.pages != nil {
 		if p, ok := tx.pages[id]; ok {
@@ -615,8 +770,32 @@ func (tx *Tx) page(id pgid) *page {
 		}
 	}
 
-	// Otherwise return directly from the mmap.
-	return tx.db.page(id)
+	// Without trailers the checks are cheap enough to repeat on every read.
+	if tx.db.trailer == 0 || id <= 1 {
+		p, err := tx.db.readPage(id)
+		if err != nil {
+			tx.raise(err)
+		}
+		return p
+	}
+	if p, ok := tx.verified.get(id); ok {
+		if p == nil {
+			return tx.db.page(id)
+		}
+		return p
+	}
+	p, err := tx.db.readPage(id)
+	if err != nil {
+		tx.raise(err)
+	}
+	// Only decrypted copies are kept: pointers into the mmap would go stale
+	// when a writable transaction remaps the file.
+	if tx.db.encryptor != nil {
+		tx.verified.put(id, p)
+	} else {
+		tx.verified.put(id, nil)
+	}
+	return p
 }
 
 // forEachPage iterates over every page within a given page and executes a function.
@@ -652,8 +831,16 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 		OverflowCount: int(p.overflow),
 	}
 
-	// Determine the type (or if it's free).
-	if tx.db.freelist.freed(pgid(id)) {
+	// Determine the type (or if it's free). Pages held by snapshots are still
+	// in use.
+	if tx.held == nil {
+		_, held := tx.db.freelist.pendingIDs()
+		tx.held = make(map[pgid]bool, len(held))
+		for _, id := range held {
+			tx.held[id] = true
+		}
+	}
+	if tx.db.freelist.freed(pgid(id)) && !tx.held[pgid(id)] {
 		info.Type = "free"
 	} else {
 		info.Type = p.typ()
@@ -685,8 +872,9 @@ type TxStats struct {
 	SpillTime time.Duration // total time spent spilling
 
 	// Write statistics.
-	Write     int           // number of writes performed
-	WriteTime time.Duration // total time spent writing to disk
+	Write      int           // number of write system calls performed
+	WriteBytes int64         // total bytes written to disk
+	WriteTime  time.Duration // total time spent writing to disk
 }
 
 func (s *TxStats) add(other *TxStats) {
@@ -701,6 +889,7 @@ func (s *TxStats) add(other *TxStats) {
 	s.Spill += other.Spill
 	s.SpillTime += other.SpillTime
 	s.Write += other.Write
+	s.WriteBytes += other.WriteBytes
 	s.WriteTime += other.WriteTime
 }
 
@@ -720,6 +909,7 @@ func (s *TxStats) Sub(other *TxStats) TxStats {
 	diff.Spill = s.Spill - other.Spill
 	diff.SpillTime = s.SpillTime - other.SpillTime
 	diff.Write = s.Write - other.Write
+	diff.WriteBytes = s.WriteBytes - other.WriteBytes
 	diff.WriteTime = s.WriteTime - other.WriteTime
 	return diff
 }
@@ -0,0 +1,111 @@
+package dbolt
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TxInfo describes an open transaction.
+type TxInfo struct {
+	ID       int       // transaction id, as returned by Tx.ID
+	Writable bool      // whether the transaction is read/write
+	Start    time.Time // when the transaction began
+	Stack    []byte    // stack that began the transaction, with Options.RecordTxStack
+}
+
+// info returns the description of tx.
+func (tx *Tx) info() TxInfo {
+	return TxInfo{
+		ID:       tx.ID(),
+		Writable: tx.writable,
+		Start:    tx.start,
+		Stack:    tx.stack,
+	}
+}
+
+// OpenTransactions returns the transactions open on the database, oldest
+// first, including read-only transactions invalidated by the MaxReadTxAge
+// watchdog but not rolled back yet.
+func (db *DB) OpenTransactions() []TxInfo {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	infos := make([]TxInfo, 0, len(db.txs)+1)
+	if db.rwtx != nil {
+		infos = append(infos, db.rwtx.info())
+	}
+	for _, t := range db.txs {
+		infos = append(infos, t.info())
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// watchdog reports or invalidates the read-only transactions open for longer
+// than Options.MaxReadTxAge.
+type watchdog struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// startWatchdog starts checking the age of the read-only transactions in the
+// background, twice per MaxReadTxAge.
+func (db *DB) startWatchdog() {
+	w := &watchdog{stop: make(chan struct{}), done: make(chan struct{})}
+	db.watchdog = w
+	go func() {
+		defer close(w.done)
+		interval := db.MaxReadTxAge / 2
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				db.checkReadTxAge(now)
+			}
+		}
+	}()
+}
+
+// stopWatchdog stops the watchdog, if any, and waits for it to exit.
+func (w *watchdog) stopWatchdog() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// checkReadTxAge reports every read-only transaction older than MaxReadTxAge
+// once, and invalidates it with InvalidateLongReadTx. An invalidated
+// transaction stays in db.txs, so that writers keep its pages pinned until it
+// is rolled back.
+func (db *DB) checkReadTxAge(now time.Time) {
+	var long []TxInfo
+	db.metalock.Lock()
+	for _, t := range db.txs {
+		if t.longReported || now.Sub(t.start) < db.MaxReadTxAge {
+			continue
+		}
+		t.longReported = true
+		long = append(long, t.info())
+		if db.InvalidateLongReadTx {
+			atomic.StoreInt32(&t.invalidated, 1)
+		}
+	}
+	db.metalock.Unlock()
+
+	if db.OnLongReadTx != nil {
+		for _, info := range long {
+			db.OnLongReadTx(info)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package dbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultWALCheckpointSize is the size the write-ahead log may grow to before
+// it is checkpointed if Options.WALCheckpointSize is not set.
+const DefaultWALCheckpointSize = 16 * 1024 * 1024
+
+// walSuffix is appended to the database path to name the write-ahead log.
+const walSuffix = "-wal"
+
+// walMagic marks the start of every record in the write-ahead log.
+const walMagic uint32 = 0x57414C21
+
+// walHeaderSize is the size of a record header: the magic, the number of
+// pages, the transaction id, the size of the pages and a checksum.
+const walHeaderSize = 32
+
+// wal is the write-ahead log of a database.
+//
+// Every commit appends one record holding the dirty pages of the transaction
+// followed by its meta page, and syncs the log once. Logged pages are kept in
+// memory and take precedence over the data file until a checkpoint writes
+// them to the data file and truncates the log. Every logged page is in the
+// log, so the memory they take is bounded by the size of the log, which a
+// commit never leaves at twice the checkpoint size or more.
+type wal struct {
+	file Storage
+	path string // path of the log file, empty for the log of a LogStorage
+	size int64  // bytes of committed records
+
+	// State of the record being written by the current transaction. The
+	// pages it replaced in memory are restored if it is aborted.
+	off      int64
+	count    uint32
+	hash     hash.Hash64
+	replaced map[pgid]walPage
+
+	// sync syncs the log file. Tests replace it to inject failures.
+	sync func() error
+
+	mu     sync.RWMutex
+	pages  map[pgid]walPage // pages not yet checkpointed, by id
+	seq    uint64           // sequence of the last logged page
+	logged int32            // 1 while pages is not empty, read without mu
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// walPage is a page held by the log. Pages written later have a higher
+// sequence; a checkpoint applies them in that order so that a page always
+// ends up with its latest content even where it overlapped an older span.
+type walPage struct {
+	p   *page
+	seq uint64
+}
+
+// openWAL opens the write-ahead log and reads the records it holds into
+// memory. The log is created when Options.WAL is set; otherwise a log left
+// behind by an earlier process is still replayed.
+func (db *DB) openWAL() error {
+	f, path, err := db.openLog()
+	if f == nil || err != nil {
+		return err
+	}
+
+	w := &wal{file: f, path: path, hash: fnv.New64a(), pages: make(map[pgid]walPage), sync: f.Sync}
+	if err := w.replay(db.pageSize, !db.readOnly); err != nil {
+		_ = f.Close()
+		return err
+	}
+	db.wal = w
+	return nil
+}
+
+// openLog returns the storage of the write-ahead log: the log of
+// Options.Storage if it is a LogStorage, or else the file next to the data
+// file along with its path. It returns nil if there is no log and Options.WAL
+// is not set.
+func (db *DB) openLog() (Storage, string, error) {
+	if ls, ok := db.Options.Storage.(LogStorage); ok {
+		f, err := ls.Log()
+		if err != nil {
+			return nil, "", err
+		}
+		if !db.WAL {
+			if sz, err := f.Size(); err != nil || sz == 0 {
+				_ = f.Close()
+				return nil, "", err
+			}
+		}
+		return f, "", nil
+	}
+
+	flag := os.O_RDWR
+	if db.readOnly {
+		flag = os.O_RDONLY
+	} else if db.WAL {
+		flag |= os.O_CREATE
+	}
+	f, err := db.openFile(db.path+walSuffix, flag, 0666)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	return &fileStorage{file: f, readOnly: db.readOnly}, f.Name(), nil
+}
+
+// replay reads every complete record of the log into memory. Reading stops
+// at the first record that is torn or fails its checksum, and the log is cut
+// there if truncate is set.
+func (w *wal) replay(pageSize int, truncate bool) error {
+	end, err := w.file.Size()
+	if err != nil {
+		return err
+	}
+
+	var hdr [walHeaderSize]byte
+	for w.size+walHeaderSize <= end {
+		if _, err := w.file.ReadAt(hdr[:], w.size); err != nil {
+			return fmt.Errorf("wal read: %s", err)
+		}
+		count := binary.LittleEndian.Uint32(hdr[4:])
+		size := int64(binary.LittleEndian.Uint64(hdr[16:]))
+		if binary.LittleEndian.Uint32(hdr[0:]) != walMagic || size <= 0 || size%int64(pageSize) != 0 ||
+			w.size+walHeaderSize+size > end {
+			break
+		}
+
+		buf := make([]byte, size)
+		if _, err := w.file.ReadAt(buf, w.size+walHeaderSize); err != nil {
+			return fmt.Errorf("wal read: %s", err)
+		}
+		pages := walRecordPages(buf, pageSize, count)
+		if pages == nil || walChecksum(buf, hdr[:]) != binary.LittleEndian.Uint64(hdr[24:]) {
+			break
+		}
+		for _, p := range pages {
+			w.install(p)
+		}
+		w.size += walHeaderSize + size
+	}
+
+	// Drop whatever follows the last complete record.
+	if truncate && w.size < end {
+		if err := w.file.Truncate(w.size); err != nil {
+			return fmt.Errorf("wal truncate: %s", err)
+		}
+	}
+	return nil
+}
+
+// walRecordPages splits the pages of a record. It returns nil unless the
+// record holds exactly count page spans ending with a meta page.
+func walRecordPages(buf []byte, pageSize int, count uint32) []*page {
+	var pages []*page
+	for off := 0; off < len(buf); {
+		p := (*page)(unsafe.Pointer(&buf[off]))
+		off += (int(p.overflow) + 1) * pageSize
+		if off > len(buf) {
+			return nil
+		}
+		pages = append(pages, p)
+	}
+	if len(pages) == 0 || uint32(len(pages)) != count || pages[len(pages)-1].flags&metaPageFlag == 0 {
+		return nil
+	}
+	return pages
+}
+
+// walChecksum returns the checksum of a record: an FNV-64a hash of its pages
+// followed by the first fields of its header.
+func walChecksum(pages, hdr []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(pages)
+	_, _ = h.Write(hdr[:24])
+	return h.Sum64()
+}
+
+// page returns the logged copy of a page, or nil if the page is only in the
+// data file. It is safe to call on a nil log. An empty log is checked without
+// taking the lock, which is safe since a transaction only reads pages that
+// were logged before it began.
+func (w *wal) page(id pgid) *page {
+	if w == nil || atomic.LoadInt32(&w.logged) == 0 {
+		return nil
+	}
+	w.mu.RLock()
+	e := w.pages[id]
+	w.mu.RUnlock()
+	return e.p
+}
+
+// install makes a logged page visible. The caller must hold the lock unless
+// the log is not shared yet.
+func (w *wal) install(p *page) {
+	w.seq++
+	w.pages[p.id] = walPage{p: p, seq: w.seq}
+	atomic.StoreInt32(&w.logged, 1)
+}
+
+// sorted returns the logged pages in the order they were written.
+func (w *wal) sorted() []*page {
+	w.mu.RLock()
+	entries := make([]walPage, 0, len(w.pages))
+	for _, e := range w.pages {
+		entries = append(entries, e)
+	}
+	w.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	pages := make([]*page, len(entries))
+	for i, e := range entries {
+		pages[i] = e.p
+	}
+	return pages
+}
+
+// highWater returns the size in bytes needed to hold every logged page.
+func (w *wal) highWater(pageSize int) int {
+	var sz int
+	for id, e := range w.pages {
+		if end := (int(id) + int(e.p.overflow) + 1) * pageSize; end > sz {
+			sz = end
+		}
+	}
+	return sz
+}
+
+// writePages starts a new record at the end of the log and appends the dirty
+// pages of a transaction to it. The pages are owned by the log from now on.
+func (w *wal) writePages(db *DB, pages pages, stats *TxStats) error {
+	w.off = w.size + walHeaderSize
+	w.count = 0
+	w.hash.Reset()
+	w.replaced = make(map[pgid]walPage)
+	for _, p := range pages {
+		if err := w.append(db, p, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes a page span to the record being written and makes it visible
+// to transactions reading through the log. The page it replaces is kept until
+// the record is committed or aborted.
+func (w *wal) append(db *DB, p *page, stats *TxStats) error {
+	buf := p.span(db.pageSize)
+	n, err := w.file.WriteAt(buf, w.off)
+	db.addWritten(n)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	stats.Write++
+	stats.WriteBytes += int64(len(buf))
+	_, _ = w.hash.Write(buf)
+	w.off += int64(len(buf))
+	w.count++
+
+	w.mu.Lock()
+	if _, ok := w.replaced[p.id]; !ok {
+		w.replaced[p.id] = w.pages[p.id]
+	}
+	w.install(p)
+	w.mu.Unlock()
+	return nil
+}
+
+// commit completes the record being written with the meta page in buf and
+// syncs the log. A checkpoint is requested once the log grows past the
+// checkpoint size. If the log reaches twice that size before the background
+// checkpointer gets to it, the commit checkpoints the log itself to bound the
+// memory held by logged pages.
+func (w *wal) commit(db *DB, buf []byte, txid txid, stats *TxStats) error {
+	p := db.pageInBuffer(buf, 0)
+	if err := w.append(db, p, stats); err != nil {
+		return err
+	}
+
+	var hdr [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], walMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], w.count)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(txid))
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(w.off-w.size-walHeaderSize))
+	_, _ = w.hash.Write(hdr[:24])
+	binary.LittleEndian.PutUint64(hdr[24:], w.hash.Sum64())
+	n, err := w.file.WriteAt(hdr[:], w.size)
+	db.addWritten(n)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	stats.Write++
+	stats.WriteBytes += walHeaderSize
+	if !db.NoSync {
+		if err := db.timedSync(txid, w.sync); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	w.size = w.off
+	w.replaced = nil
+
+	// Point the database at the new meta page.
+	db.metalock.Lock()
+	db.meta0 = db.page(0).meta()
+	db.meta1 = db.page(1).meta()
+	db.metalock.Unlock()
+
+	if w.size >= 2*int64(db.walCheckpointSize()) {
+		// The commit is durable in the log whether or not this succeeds.
+		if err := db.checkpoint(); err != nil {
+			db.logger().Printf("bolt.Checkpoint(): %s", err)
+		}
+	} else if w.size >= int64(db.walCheckpointSize()) && w.trigger != nil {
+		select {
+		case w.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// abort drops a record that could not be written completely, or that must not
+// be committed, and restores the pages it replaced in memory. It is safe to
+// call on a nil log.
+func (w *wal) abort() {
+	if w == nil {
+		return
+	}
+	_ = w.file.Truncate(w.size)
+
+	w.mu.Lock()
+	for id, e := range w.replaced {
+		if e.p == nil {
+			delete(w.pages, id)
+		} else {
+			w.pages[id] = e
+		}
+	}
+	if len(w.pages) == 0 {
+		atomic.StoreInt32(&w.logged, 0)
+	}
+	w.mu.Unlock()
+	w.replaced = nil
+}
+
+// walCheckpointSize returns the size the log may grow to before it is
+// checkpointed.
+func (db *DB) walCheckpointSize() int {
+	if db.WALCheckpointSize > 0 {
+		return db.WALCheckpointSize
+	}
+	return DefaultWALCheckpointSize
+}
+
+// Checkpoint writes the pages held in the write-ahead log to the data file
+// and truncates the log. It waits for the current write transaction to
+// finish. Checkpoints also happen in the background as the log grows and when
+// the database is closed, so calling Checkpoint is only needed to bound the
+// work left for Open after a crash. It does nothing without a log.
+func (db *DB) Checkpoint() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	} else if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	return db.checkpoint()
+}
+
+// checkpoint folds the log into the data file. The caller must hold the
+// writer lock but not the meta lock.
+func (db *DB) checkpoint() error {
+	w := db.wal
+	if w == nil {
+		return nil
+	}
+
+	pages := w.sorted()
+	if len(pages) == 0 {
+		return nil
+	}
+
+	// Write data pages in log order before the meta pages that reference
+	// them, syncing in between just like a commit does.
+	write := func(meta bool) error {
+		for _, p := range pages {
+			if (p.id <= 1) != meta {
+				continue
+			}
+			n, err := db.ops.writeAt(p.span(db.pageSize), int64(p.id)*int64(db.pageSize))
+			db.addWritten(n)
+			if err != nil {
+				return err
+			}
+		}
+		return db.timedSync(0, db.storage.Sync)
+	}
+	if err := write(false); err != nil {
+		return err
+	}
+	if err := write(true); err != nil {
+		return err
+	}
+
+	// The data file is complete so the log can be emptied.
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	} else if err := db.timedSync(0, w.sync); err != nil {
+		return err
+	}
+	w.size = 0
+
+	db.metalock.Lock()
+	w.mu.Lock()
+	w.pages = make(map[pgid]walPage)
+	atomic.StoreInt32(&w.logged, 0)
+	w.mu.Unlock()
+	db.meta0 = db.page(0).meta()
+	db.meta1 = db.page(1).meta()
+	db.metalock.Unlock()
+	return nil
+}
+
+// startCheckpointer starts checkpointing the log in the background whenever
+// a commit grows it past the checkpoint size.
+func (db *DB) startCheckpointer() {
+	w := db.wal
+	w.trigger = make(chan struct{}, 1)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-w.trigger:
+				if err := db.Checkpoint(); err != nil && err != ErrDatabaseNotOpen {
+					db.logger().Printf("bolt.Checkpoint(): %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopCheckpointer stops the background checkpointer, if any, and waits for
+// it to exit.
+func (w *wal) stopCheckpointer() {
+	if w == nil || w.stop == nil {
+		return
+	}
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// close closes the log. An empty log file is removed unless WAL mode is on.
+func (w *wal) close(db *DB) error {
+	if w.size == 0 && !db.WAL && !db.readOnly && w.path != "" {
+		_ = os.Remove(w.path)
+	}
+	return w.file.Close()
+}
+
+// copyPages writes the data pages of the database to w like io.CopyN does
+// for the data file, taking pages that are still in the log from memory.
+func (w *wal) copyPages(dst io.Writer, f io.ReaderAt, db *DB, n int64) (int64, error) {
+	// Find the latest logged content of every page, splitting spans.
+	logged := make(map[pgid][]byte)
+	for _, p := range w.sorted() {
+		span := p.span(db.pageSize)
+		for i := 0; i <= int(p.overflow); i++ {
+			logged[p.id+pgid(i)] = span[i*db.pageSize : (i+1)*db.pageSize]
+		}
+	}
+
+	var written int64
+	buf := make([]byte, db.pageSize)
+	for id := pgid(2); written < n; id++ {
+		b, ok := logged[id]
+		if !ok {
+			nr, err := f.ReadAt(buf, int64(id)*int64(db.pageSize))
+			if err != nil && err != io.EOF {
+				return written, err
+			}
+			for i := nr; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			b = buf
+		}
+		nn, err := dst.Write(b)
+		written += int64(nn)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
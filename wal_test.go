@@ -0,0 +1,66 @@
+package dbolt
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Ensure that a commit whose log sync fails leaves no trace: neither in
+// memory nor in the data file once the log is checkpointed on close.
+func TestWAL_SyncFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, &Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(k string) error {
+		return db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k), []byte(k))
+		})
+	}
+	if err := put("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	errSync := errors.New("sync failed")
+	db.wal.sync = func() error { return errSync }
+	if err := put("bar"); err != errSync {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.wal.sync = db.wal.file.Sync
+
+	// check fails unless exactly the keys committed are visible.
+	check := func(db *DB) {
+		if err := db.View(func(tx *Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			if v := b.Get([]byte("foo")); string(v) != "foo" {
+				t.Fatalf("unexpected value: %q", v)
+			} else if v := b.Get([]byte("bar")); v != nil {
+				t.Fatalf("failed commit is visible: %q", v)
+			}
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db)
+
+	// Closing checkpoints the log into the data file.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}